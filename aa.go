@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// selfLabel distinguishes the new suite of an A/A comparison, which runs the
+// same commit with the same configuration as the old suite.
+const selfLabel = "self"
+
+// isSelfComparison returns whether the run compares a commit against itself
+// to measure noise, which it does when old and new resolve to the same commit
+// and configuration.
+func isSelfComparison(newSuite *benchSuite) bool {
+	return newSuite.label == selfLabel
+}
+
+// writeSelfComparison writes the distribution of the deltas of an A/A
+// comparison per metric. As both sides run the same code, every delta is
+// spurious: the fraction of rows that benchstat flags as significant is the
+// false positive rate of the comparison on this machine, which should be
+// close to its alpha of 5%, and the magnitudes of the deltas show how large a
+// change has to be to stand out from noise, e.g. to pick a --threshold.
+func writeSelfComparison(w io.Writer, tables []*benchstat.Table) {
+	fmt.Fprintln(w, "\nA/A comparison: both sides ran the same commit, so every delta is noise")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "metric\tbenchmarks\tsignificant\t|delta| p50\tp90\tmax")
+	for _, t := range tables {
+		var deltas []float64
+		var significant int
+		for _, row := range t.Rows {
+			if len(row.Metrics) != 2 || row.Metrics[0].Mean == 0 {
+				continue
+			}
+			deltas = append(deltas, math.Abs(row.Metrics[1].Mean/row.Metrics[0].Mean-1)*100)
+			if row.Change != 0 {
+				significant++
+			}
+		}
+		if len(deltas) == 0 {
+			continue
+		}
+		sort.Float64s(deltas)
+		fmt.Fprintf(tw, "%s\t%d\t%d (%.0f%%)\t%.2f%%\t%.2f%%\t%.2f%%\n", t.Metric, len(deltas),
+			significant, float64(significant)/float64(len(deltas))*100,
+			quantile(deltas, 0.5), quantile(deltas, 0.9), deltas[len(deltas)-1])
+	}
+	_ = tw.Flush()
+}
+
+// quantile returns the q-quantile of the sorted values, interpolating
+// linearly between the closest ranks.
+func quantile(sorted []float64, q float64) float64 {
+	pos := q * float64(len(sorted)-1)
+	i := int(pos)
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (pos-float64(i))*(sorted[i+1]-sorted[i])
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+	"golang.org/x/perf/benchstat"
+)
+
+// allocSitesTop is the number of allocation sites listed per regressed
+// benchmark.
+const allocSitesTop = 5
+
+// allocSite is an allocation call site, attributed with its estimated share
+// of a benchmark's allocs/op in the old and new suites.
+type allocSite struct {
+	site     string // function (file:line)
+	old, new float64
+}
+
+// allocShares returns the fraction of the allocations of the benchmark in the
+// memory profile that each allocation site is responsible for. Samples are
+// attributed to the benchmark if its function (or a closure within it)
+// appears in their stack, and to the innermost non-runtime frame.
+func allocShares(p *profile.Profile, benchmark string) map[string]float64 {
+	idx := -1
+	for i, st := range p.SampleType {
+		if st.Type == "alloc_objects" {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return nil
+	}
+	fn := ".Benchmark" + topLevelBench(benchmark)
+	inBench := func(s *profile.Sample) bool {
+		for _, loc := range s.Location {
+			for _, l := range loc.Line {
+				if name := l.Function.Name; strings.HasSuffix(name, fn) || strings.Contains(name, fn+".") {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	site := func(s *profile.Sample) string {
+		for _, loc := range s.Location {
+			for _, l := range loc.Line {
+				if !strings.HasPrefix(l.Function.Name, "runtime.") {
+					return fmt.Sprintf("%s (%s:%d)", l.Function.Name, l.Function.Filename, l.Line)
+				}
+			}
+		}
+		return "runtime"
+	}
+
+	res := make(map[string]float64)
+	var total float64
+	for _, s := range p.Sample {
+		if !inBench(s) {
+			continue
+		}
+		v := float64(s.Value[idx])
+		res[site(s)] += v
+		total += v
+	}
+	if total == 0 {
+		return nil
+	}
+	for k := range res {
+		res[k] /= total
+	}
+	return res
+}
+
+// readProfile parses the pprof profile at the provided path.
+func readProfile(path string) (*profile.Profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return profile.Parse(f)
+}
+
+// attributeAllocs estimates, for each benchmark with an allocs/op regression,
+// which allocation sites account for the increase. Each site's share of the
+// benchmark's sampled allocations in the merged memory profiles is scaled by
+// the benchmark's mean allocs/op, and sites are ranked by their increase.
+func attributeAllocs(w io.Writer, oldSuite, newSuite *benchSuite, tables []*benchstat.Table) error {
+	var regressed []*benchstat.Row
+	for _, t := range tables {
+		if t.Metric != "allocs/op" {
+			continue
+		}
+		for _, row := range t.Rows {
+			if row.Change == -1 && len(row.Metrics) == 2 {
+				regressed = append(regressed, row)
+			}
+		}
+	}
+	if len(regressed) == 0 {
+		return nil
+	}
+	oldProf, err := readProfile(oldSuite.getProfileFile("mem"))
+	if err != nil {
+		return err
+	}
+	newProf, err := readProfile(newSuite.getProfileFile("mem"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nallocation sites contributing to allocs/op regressions:\n")
+	for _, row := range regressed {
+		oldShares := allocShares(oldProf, row.Benchmark)
+		newShares := allocShares(newProf, row.Benchmark)
+		sites := make(map[string]*allocSite)
+		get := func(k string) *allocSite {
+			s, ok := sites[k]
+			if !ok {
+				s = &allocSite{site: k}
+				sites[k] = s
+			}
+			return s
+		}
+		for k, v := range oldShares {
+			get(k).old = v * row.Metrics[0].Mean
+		}
+		for k, v := range newShares {
+			get(k).new = v * row.Metrics[1].Mean
+		}
+		var ranked []*allocSite
+		for _, s := range sites {
+			if s.new > s.old {
+				ranked = append(ranked, s)
+			}
+		}
+		sort.Slice(ranked, func(i, j int) bool {
+			return ranked[i].new-ranked[i].old > ranked[j].new-ranked[j].old
+		})
+		if len(ranked) > allocSitesTop {
+			ranked = ranked[:allocSitesTop]
+		}
+
+		fmt.Fprintf(w, "  %s (%s):\n", row.Benchmark, row.Delta)
+		if len(ranked) == 0 {
+			fmt.Fprintf(w, "    no sampled allocation sites found\n")
+			continue
+		}
+		for _, s := range ranked {
+			fmt.Fprintf(w, "    %+8.2f allocs/op  (%.2f -> %.2f)  %s\n", s.new-s.old, s.old, s.new, s.site)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// annotation is a note on the benchmarks matching a pattern, e.g. a link to
+// the issue tracking a known source of noise.
+type annotation struct {
+	re   *regexp.Regexp
+	note string
+}
+
+// loadAnnotations parses the annotations file. Each line of the file holds a
+// benchmark pattern followed by the note rendered next to the benchmarks it
+// matches:
+//
+//	# lines starting with # are comments
+//	^KV/Scan              known noisy, see issue #123
+//	Insert/rows=1000$     regressed on purpose in #456
+//
+// Patterns are unanchored regexps, as with --run, matched against benchmark
+// names without the Benchmark prefix and GOMAXPROCS suffix.
+func loadAnnotations(path string) ([]annotation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var res []annotation
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, errors.Errorf("%s:%d: expected a pattern and a note", path, n)
+		}
+		re, err := regexp.Compile(fields[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, n)
+		}
+		note := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+		res = append(res, annotation{re: re, note: note})
+	}
+	return res, s.Err()
+}
+
+// markAnnotatedRows adds the notes of the annotations matching each row to
+// its note, so that known issues are visible next to the rows they affect.
+func markAnnotatedRows(tables []*benchstat.Table, annotations []annotation) {
+	for _, table := range tables {
+		for _, row := range table.Rows {
+			name := procsSuffix.ReplaceAllString(row.Benchmark, "")
+			for _, a := range annotations {
+				if a.re.MatchString(name) {
+					row.Note = strings.TrimSpace(row.Note + " [" + a.note + "]")
+				}
+			}
+		}
+	}
+}
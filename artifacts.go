@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// dirUsage returns the number of files under the path and their total size.
+func dirUsage(path string) (files int, size int64, err error) {
+	err = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return files, size, err
+}
+
+// describeUsage describes the number and size of files.
+func describeUsage(files int, size int64) string {
+	if files == 1 {
+		return "1 file, " + formatBytes(size)
+	}
+	return fmt.Sprintf("%d files, %s", files, formatBytes(size))
+}
+
+// outputTime returns the time of the run that the suite's output file is
+// named after, if it is in the suite's artifacts directory.
+func outputTime(bs *benchSuite) (string, bool) {
+	if bs.outFile == nil || filepath.Dir(bs.outFile.Name()) != bs.artDir {
+		return "", false
+	}
+	return strings.TrimPrefix(filepath.Base(bs.outFile.Name()), "out."), true
+}
+
+// writeArtifactSummary writes what the run left where, with their sizes, and
+// the commands that reproduce its analysis, so that users can find and manage
+// the data that benchdiff leaves behind.
+func writeArtifactSummary(w io.Writer, runID string, oldSuite, newSuite, controlSuite *benchSuite) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nartifacts:")
+	suites := []struct {
+		name string
+		bs   *benchSuite
+	}{{"old", oldSuite}, {"new", newSuite}, {"control", controlSuite}}
+	for _, s := range suites {
+		if s.bs == nil {
+			continue
+		}
+		fmt.Fprintf(tw, "  %s (%s)\n", s.name, s.bs.ref)
+		for _, dir := range s.bs.binDirs {
+			files, size, err := dirUsage(dir)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tw, "    binaries\t%s\t%s\n", dir, describeUsage(files, size))
+		}
+		if s.bs.outFile != nil {
+			path := artifactPath(s.bs.outFile.Name())
+			_, size, err := dirUsage(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tw, "    output\t%s\t%s\n", path, formatBytes(size))
+		}
+		if s.bs.artDir != "" {
+			files, size, err := dirUsage(s.bs.artDir)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tw, "    artifacts\t%s\t%s\n", s.bs.artDir, describeUsage(files, size))
+		}
+	}
+	files, size, err := dirUsage("benchdiff")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(tw, "  total\tbenchdiff\t%s\n", describeUsage(files, size))
+	fmt.Fprintf(tw, "  journal\t%s\n", filepath.Join(journalDir, runID+".json"))
+	if progress := filepath.Join(progressDir, runID+".json"); pathExists(progress) {
+		fmt.Fprintf(tw, "  progress\t%s\n", progress)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "  (the artifacts directories hold the outputs of all runs, logs, profiles, and reports;")
+	fmt.Fprintln(w, "  remove a ref's binaries and artifacts with rm -r benchdiff/<ref>)")
+
+	fmt.Fprintln(w, "reproduce:")
+	if oldSuite.outFile != nil && newSuite.outFile != nil {
+		fmt.Fprintf(w, "  benchstat %s %s\n", benchstatInput(oldSuite.outFile.Name()), benchstatInput(newSuite.outFile.Name()))
+	}
+	e, err := loadJournal(runID)
+	if err != nil {
+		return err
+	}
+	oldTime, okOld := outputTime(oldSuite)
+	newTime, okNew := outputTime(newSuite)
+	if okOld && okNew && oldTime == newTime {
+		fmt.Fprintf(w, "  benchdiff %s  # reprocess the output\n", quoteArgs(e.replayArgs("--previous-run="+newTime)))
+	}
+	fmt.Fprintf(w, "  benchdiff rerun %s  # rerun the benchmarks\n", runID)
+	return nil
+}
+
+// benchstatInput returns the shell argument that passes the output file to
+// benchstat, decompressing it on the fly if it has been compressed.
+func benchstatInput(path string) string {
+	if p := artifactPath(path); p != path {
+		return "<(zstd -dcq " + shellQuote(p) + ")"
+	}
+	return shellQuote(path)
+}
+
+// quoteArgs joins the arguments, quoted for a POSIX shell.
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// pathExists returns whether the path exists.
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// asymRow describes a benchmark whose old and new sides ended up with a
+// different number of valid samples, for instance because some iterations
+// crashed or timed out.
+type asymRow struct {
+	benchmark  string
+	nOld, nNew int
+}
+
+// findAsymmetricRows returns all benchmarks in the provided tables with
+// mismatched sample counts between the old and new configurations. Benchmarks
+// that are missing entirely from one side are not considered asymmetric, as
+// they can not be equalized.
+func findAsymmetricRows(tables []*benchstat.Table) []asymRow {
+	var res []asymRow
+	seen := make(map[string]int)
+	for _, table := range tables {
+		for _, row := range table.Rows {
+			if len(row.Metrics) != 2 {
+				continue
+			}
+			nOld, nNew := len(row.Metrics[0].Values), len(row.Metrics[1].Values)
+			if nOld == nNew || nOld == 0 || nNew == 0 {
+				continue
+			}
+			if i, ok := seen[row.Benchmark]; ok {
+				// Different metrics of the same benchmark may disagree if some
+				// samples did not report every unit. Keep the largest deficit.
+				if abs(nOld-nNew) > abs(res[i].nOld-res[i].nNew) {
+					res[i].nOld, res[i].nNew = nOld, nNew
+				}
+				continue
+			}
+			seen[row.Benchmark] = len(res)
+			res = append(res, asymRow{benchmark: row.Benchmark, nOld: nOld, nNew: nNew})
+		}
+	}
+	return res
+}
+
+// markAsymmetricRows annotates the note of each row with mismatched sample
+// counts between the old and new configurations so that the asymmetry is
+// visible in the report.
+func markAsymmetricRows(tables []*benchstat.Table) {
+	for _, table := range tables {
+		for _, row := range table.Rows {
+			if len(row.Metrics) != 2 {
+				continue
+			}
+			nOld, nNew := len(row.Metrics[0].Values), len(row.Metrics[1].Values)
+			if nOld == nNew || nOld == 0 || nNew == 0 {
+				continue
+			}
+			row.Note = strings.TrimSpace(fmt.Sprintf("%s [asymmetric samples %d+%d]", row.Note, nOld, nNew))
+		}
+	}
+}
+
+// equalizeSamples reruns each benchmark with fewer samples on one side than
+// the other until both sides have the same number of samples.
+func equalizeSamples(ctx context.Context, oldSuite, newSuite *benchSuite, tables []*benchstat.Table, benchTime string) error {
+	rows := findAsymmetricRows(tables)
+	if len(rows) == 0 {
+		return nil
+	}
+	pkgs, err := benchPkgs(newSuite.outFile)
+	if err != nil {
+		return err
+	}
+	results, err := newSuite.results(false)
+	if err != nil {
+		return err
+	}
+	procs, err := recordedProcs(results)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "equalizing sample counts for %d benchmark(s)\n", len(rows))
+	for _, r := range rows {
+		pkg, ok := pkgs[r.benchmark]
+		if !ok {
+			continue
+		}
+		bs, deficit := newSuite, r.nOld-r.nNew
+		if deficit < 0 {
+			bs, deficit = oldSuite, -deficit
+		}
+		pattern := benchRegexp(r.benchmark, procs)
+		n := r.nOld
+		if r.nNew > n {
+			n = r.nNew
+		}
+		for i := 0; i < deficit; i++ {
+			if err := bs.writeConfig(n-deficit+i+1, benchTime); err != nil {
+				return err
+			}
+			err := runSingleBench(ctx, bs, pkgToTestBin(pkg), benchOpts{runPattern: pattern, benchTime: benchTime})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// benchPkgs scans benchmark output and returns a mapping from each benchmark
+// name (as reported by benchstat) to the package it was run in.
+func benchPkgs(f *os.File) (map[string]string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	defer f.Seek(0, io.SeekEnd)
+
+	res := make(map[string]string)
+	var pkg string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "pkg: ") {
+			pkg = strings.TrimPrefix(line, "pkg: ")
+			continue
+		}
+		if !strings.HasPrefix(line, "Benchmark") {
+			continue
+		}
+		fields := strings.Fields(line)
+		res[strings.TrimPrefix(fields[0], "Benchmark")] = pkg
+	}
+	return res, s.Err()
+}
+
+// resultPkgs is like benchPkgs for the suite's output, but keys the packages
+// by the names that the benchmarks are compared under, i.e. after
+// --normalize-procs, --filter, and --group-by. Synthetic benchmarks are left
+// out, as are groups whose members were run in different packages.
+func resultPkgs(bs *benchSuite) (map[string]string, error) {
+	if _, err := bs.outFile.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	defer bs.outFile.Seek(0, io.SeekEnd)
+
+	res := make(map[string]string)
+	mixed := make(map[string]bool)
+	var pkg string
+	s := bufio.NewScanner(bs.outFile)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "pkg: ") {
+			pkg = strings.TrimPrefix(line, "pkg: ")
+			continue
+		}
+		if !isBenchResult(line) {
+			continue
+		}
+		name := strings.Fields(line)[0]
+		if bs.procs != nil {
+			name = bs.procs.rename(name, false)
+		}
+		name = strings.TrimPrefix(name, "Benchmark")
+		if isSyntheticBench(name) {
+			continue
+		}
+		if bs.projection != nil {
+			var keep bool
+			if name, keep = bs.projection.rename(name); !keep {
+				continue
+			}
+		}
+		if p, ok := res[name]; ok && p != pkg {
+			mixed[name] = true
+		}
+		res[name] = pkg
+	}
+	for name := range mixed {
+		delete(res, name)
+	}
+	return res, s.Err()
+}
+
+var procsSuffix = regexp.MustCompile(`-\d+$`)
+
+// benchRegexp returns a -test.bench pattern that matches exactly the provided
+// benchmark, as reported by benchstat (i.e. without the "Benchmark" prefix and
+// with a GOMAXPROCS suffix if its GOMAXPROCS wasn't 1). The suffix is only
+// stripped if it is one of the procs the results were recorded with, see
+// recordedProcs, as it is otherwise part of the benchmark's name.
+func benchRegexp(name string, procs map[string]bool) string {
+	if base, p := splitProcs(name); procs[p] {
+		name = base
+	}
+	parts := strings.Split(name, "/")
+	for i, p := range parts {
+		if i == 0 {
+			p = "Benchmark" + p
+		}
+		parts[i] = "^" + regexp.QuoteMeta(p) + "$"
+	}
+	return strings.Join(parts, "/")
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestBenchRegexp(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		procs map[string]bool
+		want  string
+	}{
+		{"Foo-8", map[string]bool{"8": true}, `^BenchmarkFoo$`},
+		{"Foo/size-64-8", map[string]bool{"8": true}, `^BenchmarkFoo$/^size-64$`},
+		{"Foo/size-64", nil, `^BenchmarkFoo$/^size-64$`},
+		{"Foo/size-64", map[string]bool{"8": true}, `^BenchmarkFoo$/^size-64$`},
+		{"Foo/a.b-4", map[string]bool{"4": true, "16": true}, `^BenchmarkFoo$/^a\.b$`},
+	} {
+		if got := benchRegexp(tc.name, tc.procs); got != tc.want {
+			t.Errorf("benchRegexp(%q, %v) = %q, want %q", tc.name, tc.procs, got, tc.want)
+		}
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"hash/fnv"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -12,10 +17,10 @@ import (
 
 // expandPackages expands the package filter into all of the packages that it
 // references using `go list`.
-func expandPackages(pkgFilter []string) ([]string, error) {
+func expandPackages(ctx context.Context, pkgFilter []string) ([]string, error) {
 	args := []string{"go", "list"}
 	args = append(args, pkgFilter...)
-	pkgs, err := capture(args...)
+	pkgs, err := capture(ctx, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "expanding packages")
 	}
@@ -43,12 +48,30 @@ func hash(s []string) string {
 	return strconv.Itoa(int(u))
 }
 
-// testArtifactsDir returns the directory to store benchdiff binaries for
-// specified git ref.
-func testBinDir(ref string, pkgFilter []string) string {
+// testBinDir returns the directory to store benchdiff binaries for specified
+// git ref. If binRoot is set (see --bin-dir), binaries are stored under it
+// instead of in the repository.
+func testBinDir(binRoot, ref string, pkgFilter []string) string {
+	if binRoot != "" {
+		return filepath.Join(binRoot, ref, hash(pkgFilter))
+	}
 	return filepath.Join(testDir(ref), "bin", hash(pkgFilter))
 }
 
+// ignoreBenchdiffDir creates the ./benchdiff directory, if needed, with a
+// .gitignore that ignores everything in it, so that benchdiff's artifacts and
+// binaries never show up as untracked files in the repository.
+func ignoreBenchdiffDir() error {
+	if err := os.MkdirAll("benchdiff", 0755); err != nil {
+		return err
+	}
+	path := filepath.Join("benchdiff", ".gitignore")
+	if _, err := os.Stat(path); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte("# Generated by benchdiff.\n*\n"), 0644)
+}
+
 // pkgToTestBin translates a Go package name into a test binary name.
 func pkgToTestBin(pkg string) string {
 	// Strip github.com prefix.
@@ -65,24 +88,54 @@ func testBinToPkg(bin string) string {
 	return strings.ReplaceAll(bin, "_", "/")
 }
 
+// buildError is the failure of the build of a test binary, with the output of
+// the build tool, such as the compiler errors.
+type buildError struct {
+	err    error
+	output string
+}
+
+func (e *buildError) Error() string {
+	return fmt.Sprintf("building test binary: %s\n%s", e.err, strings.TrimRight(e.output, "\n"))
+}
+
+// runBuild runs the build tool, capturing its output and, if log is not nil,
+// also streaming it to log. If the build fails, it returns a *buildError.
+func runBuild(ctx context.Context, log io.Writer, args ...string) error {
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	if log != nil {
+		out = io.MultiWriter(&buf, log)
+	}
+	if err := spawnWith(ctx, nil, out, out, args...); err != nil {
+		return &buildError{err: err, output: buf.String()}
+	}
+	return nil
+}
+
 // buildTestBin builds a test binary for the specified package and moves it to
-// the destination directory if successful.
-func buildTestBin(pkg, dst string, useBazel bool) (string, bool, error) {
+// the destination directory if successful. Any build flags are passed through
+// to the build tool. The build tool's output is only written to log, if not
+// nil, and included in the error of a failed build.
+func buildTestBin(
+	ctx context.Context, pkg, dst string, useBazel bool, buildFlags []string, log io.Writer,
+) (string, bool, error) {
 	dstFile := pkgToTestBin(pkg) // cockroachdb_cockroach_pkg_util_log
 	var srcFile string
 	if !useBazel {
 		srcFile = dstFile
-		// Capture to silence warnings from pkgs with no test files.
-		if _, err := capture("go", "test", "-c", "-o", dstFile, pkg); err != nil {
-			return "", false, errors.Wrap(err, "building test binary")
+		args := append([]string{"go", "test", "-c", "-o", dstFile}, buildFlags...)
+		if err := runBuild(ctx, log, append(args, pkg)...); err != nil {
+			return "", false, err
 		}
 	} else {
 		relPkg := strings.TrimPrefix(pkg, "github.com/cockroachdb/cockroach/")
 		pathList := strings.Split(relPkg, string(filepath.Separator)) // ['pkg','util','log']
 		last := pathList[len(pathList)-1]                             // 'log'
 		// `bazel build //pkg/util/log:log_test`.
-		if _, err := capture("bazel", "build", "//"+relPkg+":"+last+"_test"); err != nil {
-			return "", false, errors.Wrap(err, "building test binary")
+		args := append([]string{"bazel", "build"}, buildFlags...)
+		if err := runBuild(ctx, log, append(args, "//"+relPkg+":"+last+"_test")...); err != nil {
+			return "", false, err
 		}
 		// `_bazel/bin/pkg/util/log/log_test_/log_test`.
 		out := append([]string{"_bazel", "bin"}, pathList...)
@@ -97,8 +150,22 @@ func buildTestBin(pkg, dst string, useBazel bool) (string, bool, error) {
 		}
 		return "", false, errors.Wrap(err, "looking for test binary")
 	}
-	if err := spawn("mv", srcFile, filepath.Join(dst, dstFile)); err != nil {
+	if err := spawn(ctx, "mv", srcFile, filepath.Join(dst, dstFile)); err != nil {
 		return "", false, errors.Wrap(err, "moving test binary")
 	}
 	return dstFile, true, nil
 }
+
+// saveBuildLog saves the output of the failed build of the package to the
+// artifacts directory, as build.<test binary>.log, and returns its path.
+func saveBuildLog(artDir, pkg string, err error) (string, error) {
+	output := err.Error()
+	if be, ok := err.(*buildError); ok {
+		output = be.output
+	}
+	path := filepath.Join(artDir, "build."+pkgToTestBin(pkg)+".log")
+	if err := ioutil.WriteFile(path, []byte(output), 0644); err != nil {
+		return "", errors.Wrap(err, "saving build output")
+	}
+	return path, nil
+}
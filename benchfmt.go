@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// writeConfig writes benchfmt configuration lines describing the next
+// benchmark invocation to the suite's output file. Together with the goos,
+// goarch, pkg, and cpu configuration lines that test binaries print
+// themselves, this makes the output files self-describing, so that they can be
+// consumed directly by tools that understand the Go benchmark format, like
+// benchstat and benchseries.
+func (bs *benchSuite) writeConfig(iter int, benchTime string) error {
+	if benchTime == "" {
+		benchTime = "1s"
+	}
+	_, err := fmt.Fprintf(bs.outFile, "commit: %s\nref: %s\nhost: %s\niteration: %d\nbenchtime: %s\n",
+		bs.commit, bs.ref, bs.configHost(), iter, benchTime)
+	if err != nil {
+		return err
+	}
+	if len(bs.buildFlags) > 0 {
+		if _, err := fmt.Fprintf(bs.outFile, "buildflags: %s\n", strings.Join(bs.buildFlags, " ")); err != nil {
+			return err
+		}
+	}
+	if len(bs.binDirs) > 1 {
+		if _, err := fmt.Fprintf(bs.outFile, "layout: %d\n", bs.layout); err != nil {
+			return err
+		}
+	}
+	if len(bs.env) > 0 {
+		if _, err := fmt.Fprintf(bs.outFile, "env: %s\n", strings.Join(bs.env, " ")); err != nil {
+			return err
+		}
+	}
+	if bs.image != "" {
+		if _, err := fmt.Fprintf(bs.outFile, "image: %s\n", bs.image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configHost returns the name of the host that the suite's benchmarks are run
+// on, resolving the local host's name.
+func (bs *benchSuite) configHost() string {
+	if bs.isRemote() {
+		return bs.host
+	}
+	if h, err := os.Hostname(); err == nil {
+		return h
+	}
+	return "localhost"
+}
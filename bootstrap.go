@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// Methods of computing confidence intervals, as passed to --ci.
+const (
+	ciNone      = "none"
+	ciBootstrap = "bootstrap"
+)
+
+// bootstrapResamples is the number of resamples that bootstrap confidence
+// intervals are computed from.
+const bootstrapResamples = 2000
+
+// ciLevel is the confidence level of the intervals.
+const ciLevel = 0.95
+
+func validateCI(method string) error {
+	switch method {
+	case ciNone, ciBootstrap:
+		return nil
+	default:
+		return errors.Errorf("unknown --ci method %q; expected 'none' or 'bootstrap'", method)
+	}
+}
+
+// markConfidenceIntervals annotates the note of each row with the confidence
+// interval of its percent delta, computed with the configured method. The note
+// is carried into every output format.
+func markConfidenceIntervals(tables []*benchstat.Table, cc *compareConfig) {
+	if cc.ci != ciBootstrap {
+		return
+	}
+	for _, table := range tables {
+		for _, row := range table.Rows {
+			if len(row.Metrics) != 2 {
+				continue
+			}
+			lo, hi, ok := bootstrapCI(row.Benchmark, row.Metrics[0], row.Metrics[1], cc.paired)
+			if !ok {
+				continue
+			}
+			row.Note = strings.TrimSpace(fmt.Sprintf("%s [%.0f%% CI %+.2f%%..%+.2f%%]", row.Note, ciLevel*100, lo, hi))
+		}
+	}
+}
+
+// bootstrapCI returns the percentile bootstrap confidence interval of the
+// percent delta between the means of the old and new samples. Unlike the
+// normal approximation, the percentile interval needn't be symmetric, which
+// suits the skewed distributions of latencies.
+//
+// If paired, the samples of each round are resampled together, as in
+// pairedTest, which requires all samples (Values): removing outliers from
+// either side would misalign the rounds. Otherwise, each side's samples
+// without outliers (RValues) are resampled on their own, like the means in
+// the report are computed. Samples that can't be paired because a side is
+// missing some rounds are resampled unpaired.
+//
+// The resampling is seeded by the benchmark's name, so that reports of the
+// same results are identical.
+func bootstrapCI(name string, old, new *benchstat.Metrics, paired bool) (lo, hi float64, ok bool) {
+	oldXs, newXs := old.RValues, new.RValues
+	paired = paired && len(old.Values) == len(new.Values)
+	if paired {
+		oldXs, newXs = old.Values, new.Values
+	}
+	if len(oldXs) < 2 || len(newXs) < 2 {
+		return 0, 0, false
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	rng := rand.New(rand.NewSource(int64(h.Sum64())))
+
+	deltas := make([]float64, 0, bootstrapResamples)
+	for i := 0; i < bootstrapResamples; i++ {
+		var oldSum, newSum float64
+		if paired {
+			for range oldXs {
+				j := rng.Intn(len(oldXs))
+				oldSum += oldXs[j]
+				newSum += newXs[j]
+			}
+		} else {
+			for range oldXs {
+				oldSum += oldXs[rng.Intn(len(oldXs))]
+			}
+			for range newXs {
+				newSum += newXs[rng.Intn(len(newXs))]
+			}
+		}
+		oldMean, newMean := oldSum/float64(len(oldXs)), newSum/float64(len(newXs))
+		if oldMean == 0 {
+			return 0, 0, false
+		}
+		deltas = append(deltas, (newMean/oldMean-1)*100)
+	}
+	sort.Float64s(deltas)
+	if deltas[0] == deltas[len(deltas)-1] {
+		return 0, 0, false // e.g. all samples are equal
+	}
+	tail := (1 - ciLevel) / 2
+	return quantile(deltas, tail), quantile(deltas, 1-tail), true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/perf/benchstat"
+)
+
+func TestBootstrapCI(t *testing.T) {
+	// Rounds drift from 100 to 190, and the new samples are 8-12% slower.
+	old := metrics(100, 110, 120, 130, 140, 150, 160, 170, 180, 190)
+	new := metrics(110, 120, 132, 143, 155, 165, 174, 188, 198, 208)
+	for _, tc := range []struct {
+		name   string
+		paired bool
+		// The bounds that the interval must lie within.
+		minLo, maxHi float64
+	}{
+		// Unpaired, the drift widens the interval to well beyond the delta.
+		{"unpaired", false, -20, 40},
+		{"paired", true, 8, 12},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lo, hi, ok := bootstrapCI("Foo", old, new, tc.paired)
+			if !ok {
+				t.Fatal("no interval")
+			}
+			if lo > 9.9 || hi < 9.9 || lo < tc.minLo || hi > tc.maxHi {
+				t.Errorf("got [%.2f, %.2f], want an interval around 9.9%% within [%g, %g]", lo, hi, tc.minLo, tc.maxHi)
+			}
+			if lo2, hi2, _ := bootstrapCI("Foo", old, new, tc.paired); lo2 != lo || hi2 != hi {
+				t.Errorf("got [%.2f, %.2f], then [%.2f, %.2f] for the same samples", lo, hi, lo2, hi2)
+			}
+		})
+	}
+	t.Run("paired width is narrower", func(t *testing.T) {
+		lo, hi, _ := bootstrapCI("Foo", old, new, false)
+		plo, phi, _ := bootstrapCI("Foo", old, new, true)
+		if phi-plo >= hi-lo {
+			t.Errorf("paired interval [%.2f, %.2f] isn't narrower than unpaired [%.2f, %.2f]", plo, phi, lo, hi)
+		}
+	})
+
+	// The unpaired path resamples the samples without outliers, and so does
+	// the paired path if the rounds don't line up.
+	outlier := &benchstat.Metrics{
+		Values:  []float64{100, 101, 99, 100, 1000},
+		RValues: []float64{100, 101, 99, 100},
+	}
+	steady := metrics(100, 100, 101, 99)
+	for _, paired := range []bool{false, true} {
+		lo, hi, ok := bootstrapCI("Foo", steady, outlier, paired)
+		if !ok || lo < -2 || hi > 2 {
+			t.Errorf("paired=%t: got [%.2f, %.2f] (ok=%t), want the outlier excluded", paired, lo, hi, ok)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		old, new *benchstat.Metrics
+	}{
+		{"too few samples", metrics(100), metrics(110)},
+		{"all equal", metrics(100, 100, 100), metrics(100, 100, 100)},
+		{"zero mean", metrics(0, 0, 0), metrics(1, 2, 3)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if lo, hi, ok := bootstrapCI("Foo", tc.old, tc.new, false); ok {
+				t.Errorf("got [%.2f, %.2f], want no interval", lo, hi)
+			}
+		})
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	sorted := []float64{0, 10, 20, 30, 40}
+	for _, tc := range []struct {
+		q, want float64
+	}{
+		{0, 0}, {0.25, 10}, {0.5, 20}, {0.1, 4}, {0.9, 36}, {1, 40},
+	} {
+		if got := quantile(sorted, tc.q); got != tc.want {
+			t.Errorf("quantile(%v, %g) = %g, want %g", sorted, tc.q, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// deltaBudget gates a run on the geometric mean delta of the benchmarks of
+// each package, or of each team's packages, per metric, rather than on the
+// delta of individual benchmarks, tolerating small scattered regressions but
+// failing on aggregate drift. The geomean includes the insignificant deltas,
+// as drift often consists of changes too small to be significant on their
+// own. See --budget.
+type deltaBudget struct {
+	budget float64 // as a fraction, like --threshold
+	// teams groups packages by team, if set.
+	teams owners
+}
+
+// budgetGroup is the aggregate delta of a group of benchmarks in a table.
+type budgetGroup struct {
+	group      string
+	metric     string
+	benchmarks int
+	pctDelta   float64 // geomean delta, in percent
+	regression float64 // the worsening in percent, or 0 if it improved
+}
+
+// evaluate computes the geomean delta of each group of benchmarks per table,
+// ordered by group and metric. dirs determines which deltas are regressions.
+// Synthetic benchmarks, and groups of --group-by that span packages, belong
+// to no package and are left out.
+func (b *deltaBudget) evaluate(
+	newSuite *benchSuite, tables []*benchstat.Table, dirs directions,
+) ([]budgetGroup, error) {
+	pkgs, err := resultPkgs(newSuite)
+	if err != nil {
+		return nil, err
+	}
+	var res []budgetGroup
+	for _, t := range tables {
+		logRatios := make(map[string]float64)
+		counts := make(map[string]int)
+		for _, row := range t.Rows {
+			if len(row.Metrics) != 2 || row.Metrics[0].Mean <= 0 || row.Metrics[1].Mean <= 0 {
+				continue
+			}
+			group, ok := pkgs[row.Benchmark]
+			if !ok {
+				continue
+			}
+			if b.teams != nil {
+				group = b.teams.teamOf(group)
+			}
+			logRatios[group] += math.Log(row.Metrics[1].Mean / row.Metrics[0].Mean)
+			counts[group]++
+		}
+		higherBetter := dirs.higherIsBetter(t)
+		for group, sum := range logRatios {
+			g := budgetGroup{
+				group:      group,
+				metric:     t.Metric,
+				benchmarks: counts[group],
+				pctDelta:   (math.Exp(sum/float64(counts[group])) - 1) * 100,
+			}
+			if (g.pctDelta > 0) != higherBetter {
+				g.regression = math.Abs(g.pctDelta)
+			}
+			res = append(res, g)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].group != res[j].group {
+			return res[i].group < res[j].group
+		}
+		return res[i].metric < res[j].metric
+	})
+	return res, nil
+}
+
+// exceeds returns whether the group's regression exceeds the budget.
+func (b *deltaBudget) exceeds(g budgetGroup) bool {
+	return g.regression > b.budget*100
+}
+
+// write writes the aggregate delta of each group against the budget.
+func (b *deltaBudget) write(w io.Writer, groups []budgetGroup) {
+	by := "package"
+	if b.teams != nil {
+		by = "team"
+	}
+	fmt.Fprintf(w, "\ndelta budget of %.2f%% geomean regression per %s:\n", b.budget*100, by)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, g := range groups {
+		status := "ok"
+		if b.exceeds(g) {
+			status = "over budget"
+		}
+		n := "1 benchmark"
+		if g.benchmarks != 1 {
+			n = fmt.Sprintf("%d benchmarks", g.benchmarks)
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%+.2f%%\t(%s)\t%s\n", g.group, g.metric, g.pctDelta, n, status)
+	}
+	_ = tw.Flush()
+}
+
+// check returns an error for the first group whose regression exceeds the
+// budget.
+func (b *deltaBudget) check(groups []budgetGroup) error {
+	for _, g := range groups {
+		if b.exceeds(g) {
+			return errors.Errorf("geomean %s regression of %.2f%% in %s exceeded budget of %.2f%%",
+				g.metric, g.regression, g.group, b.budget*100)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nvanbenschoten/benchdiff/ui"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"golang.org/x/perf/benchstat"
+)
+
+const buildtimeUsage = `usage: benchdiff buildtime [options] <old> <new> [<pkgs>...]
+
+benchdiff buildtime compares the time it takes to build the packages (default
+./...) at two commits, along with the peak memory usage (max-rss-B) of the
+build. The commits are built in alternating order for the configured number of
+iterations, and the results are compared with the standard statistics. Each
+build starts from an empty build cache, so the times include building the
+packages' dependencies.
+
+Options:
+  -c, --count         <n>     number of iterations (default 5)
+      --mode          <mode>  'test' to time go test -c (default) or 'build' to time go build
+      --post-checkout <cmd>   an optional command to run after checking out each commit
+      --secrets-file  <path>  environment file of secrets for the post-checkout command
+      --secrets-cmd   <cmd>   command printing secrets for the post-checkout command`
+
+// buildtimeBench is the name of the benchmark that build times are recorded
+// under, with the package as its sub-benchmark.
+const buildtimeBench = "Build"
+
+func runBuildtime(ctx context.Context, args []string) error {
+	var count int
+	var mode, postChck, secretsCmd string
+	var secretsFiles []string
+	var help bool
+
+	flags := pflag.NewFlagSet("buildtime", pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, buildtimeUsage) }
+	flags.BoolVarP(&help, "help", "h", false, "")
+	flags.IntVarP(&count, "count", "c", 5, "")
+	flags.StringVarP(&mode, "mode", "", "test", "")
+	flags.StringVarP(&postChck, "post-checkout", "", "", "")
+	flags.StringSliceVarP(&secretsFiles, "secrets-file", "", nil, "")
+	flags.StringVarP(&secretsCmd, "secrets-cmd", "", "", "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if help {
+		fmt.Fprintln(os.Stderr, buildtimeUsage)
+		return nil
+	}
+	if flags.NArg() < 2 {
+		fmt.Fprintln(os.Stderr, buildtimeUsage)
+		return errors.New("expected old and new commits")
+	}
+	if mode != "test" && mode != "build" {
+		return errors.Errorf("invalid --mode %q: must be 'test' or 'build'", mode)
+	}
+	pkgFilter := flags.Args()[2:]
+	if len(pkgFilter) == 0 {
+		pkgFilter = []string{"./..."}
+	}
+	var refs [2]string
+	for i, ref := range flags.Args()[:2] {
+		sha, err := getRefAsSHA(ctx, ref)
+		if err != nil {
+			return err
+		}
+		refs[i] = shortenRef(ctx, sha)
+	}
+	secrets, err := loadHookSecrets(ctx, secretsFiles, secretsCmd)
+	if err != nil {
+		return err
+	}
+
+	if err := ignoreBenchdiffDir(); err != nil {
+		return err
+	}
+	dir := filepath.Join("benchdiff", "buildtime", refs[0]+"-"+refs[1])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	now := time.Now().Format(time.RFC3339)
+	var outFiles [2]*os.File
+	for i, name := range []string{"old", "new"} {
+		f, err := os.Create(filepath.Join(dir, name+"."+now))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		outFiles[i] = f
+	}
+
+	for iter := 0; iter < count; iter++ {
+		// Alternate which commit is built first.
+		order := []int{0, 1}
+		if iter%2 == 1 {
+			order = []int{1, 0}
+		}
+		for _, i := range order {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := timeBuilds(ctx, outFiles[i], mode, refs[i], pkgFilter, postChck, secrets,
+				fmt.Sprintf("building %s (iteration %d/%d): ", refs[i], iter+1, count)); err != nil {
+				return err
+			}
+		}
+	}
+
+	var c benchstat.Collection
+	c.Alpha = 0.05
+	c.Order = benchstat.ByName
+	for i, name := range []string{"old", "new"} {
+		if _, err := outFiles[i].Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := c.AddFile(name, outFiles[i]); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("old=%s new=%s\n\n", refs[0], refs[1])
+	benchstat.FormatText(os.Stdout, c.Tables())
+	fmt.Printf("\nwrote results to %s\n", dir)
+	return nil
+}
+
+// timeBuilds checks out the ref in the build worktree and times the build of
+// each of its packages, like timeBuild.
+func timeBuilds(
+	ctx context.Context,
+	w io.Writer,
+	mode, ref string,
+	pkgFilter []string,
+	postChck string,
+	secrets *hookSecrets,
+	status string,
+) error {
+	leave, err := enterWorktree(ctx, ref, postChck, secrets)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	pkgs, err := expandPackages(ctx, pkgFilter)
+	if err != nil {
+		return err
+	}
+	var spinner ui.Spinner
+	spinner.Start(os.Stderr, status)
+	defer spinner.Stop()
+	for j, pkg := range pkgs {
+		spinner.Update(ui.Fraction(j, len(pkgs)))
+		if err := timeBuild(ctx, w, mode, pkg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeBuild builds the package with an empty build cache and writes the wall
+// time and peak memory usage of the build to w in the Go benchmark format.
+// Packages that fail to build are skipped.
+func timeBuild(ctx context.Context, w io.Writer, mode, pkg string) error {
+	tmp, err := ioutil.TempDir("", "benchdiff-buildtime")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	args := []string{"go", "build", "-o", os.DevNull, pkg}
+	if mode == "test" {
+		args = []string{"go", "test", "-c", "-o", filepath.Join(tmp, "pkg.test"), pkg}
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "GOCACHE="+filepath.Join(tmp, "cache"))
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	wall := time.Since(start)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nskipping %s, which failed to build: %s\n", pkg, strings.TrimSpace(string(out)))
+		return nil
+	}
+	// The rusage of a waited-for process covers its own waited-for children,
+	// i.e. the compiler and linker. Maxrss is in kilobytes on Linux.
+	var maxRSS int64
+	if ru, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		maxRSS = int64(ru.Maxrss) * 1024
+	}
+	_, err = fmt.Fprintf(w, "Benchmark%s/%s 1 %d ns/op %d max-rss-B\n", buildtimeBench, pkg, wall.Nanoseconds(), maxRSS)
+	return err
+}
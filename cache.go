@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// resultCacheDir returns the directory in which the results of a comparison
+// with the provided cache key are stored.
+func resultCacheDir(key string) string {
+	return filepath.Join("benchdiff", "cache", key)
+}
+
+// resultOptions holds the run options that affect the results of the
+// benchmarks, as opposed to their order or how they're processed and
+// displayed. Results are only reused, and only compared across runs, under
+// the same options, which are hashed whole (see optionsHash), so that an
+// option added here can't reuse the results of runs without it.
+type resultOptions struct {
+	pkgs         []string // as passed, before expansion
+	runPattern   string
+	benchTime    string
+	cpuProfile   bool
+	memProfile   bool
+	mutexProfile bool
+	itersPerTest int
+	skipBench    string // -test.skip pattern of the user, if set
+	// shardBenchmarks runs each benchmark function in its own process.
+	shardBenchmarks bool
+	fuzzSeeds       bool     // run the seed corpora of fuzz targets instead of benchmarks
+	examples        bool     // also time testable examples
+	parallel        int      // number of tests to run concurrently
+	exclusive       []string // packages that must not be run concurrently
+	strategy        string
+	autoBenchTime   string // benchtime for fast, noisy benchmarks, if set
+	short           bool
+	sizeClass       string
+	skipIdentical   bool // skip tests with identical old and new binaries
+	equalizeN       bool // rerun benchmarks to equalize the sample counts
+	sample          string
+	collectorList   []string // names of the collectors
+}
+
+// suiteOptions holds the build and run configuration of a suite that affects
+// its results, apart from its commit.
+type suiteOptions struct {
+	host          string
+	useBazel      bool
+	buildFlags    []string
+	env           []string
+	launch        []string
+	layouts       int
+	harness       bool
+	leakMetrics   bool
+	validateLines bool
+}
+
+// options returns the suite's result-affecting configuration.
+func (bs *benchSuite) options() suiteOptions {
+	return suiteOptions{
+		host:          bs.host,
+		useBazel:      bs.useBazel,
+		buildFlags:    bs.buildFlags,
+		env:           bs.env,
+		launch:        bs.launch,
+		layouts:       bs.layouts,
+		harness:       bs.harness,
+		leakMetrics:   bs.leakMetrics,
+		validateLines: bs.validateLines,
+	}
+}
+
+// optionsHash returns a hash of the options, which are structs of plain
+// values, formatted with all their fields.
+func optionsHash(opts ...interface{}) string {
+	parts := make([]string, len(opts))
+	for i, o := range opts {
+		parts[i] = fmt.Sprintf("%#v", o)
+	}
+	return hash(parts)
+}
+
+// resultCacheKey returns the key under which the results of a comparison
+// between the two suites are cached: the resolved commits of both suites
+// along with their options and the result options of the run.
+func resultCacheKey(oldSuite, newSuite *benchSuite, cfg *runConfig) string {
+	key := []interface{}{oldSuite.commit, newSuite.commit, oldSuite.options(), newSuite.options(), cfg.resultOptions}
+	if cfg.sample != "" {
+		// The selected benchmarks depend on the seed, which otherwise only
+		// affects the order of iterations.
+		key = append(key, cfg.seed)
+	}
+	return optionsHash(key...)
+}
+
+// hasCachedResults returns whether complete results are cached under the key.
+func hasCachedResults(key string) bool {
+	for _, name := range []string{"old", "new"} {
+		if _, err := os.Stat(filepath.Join(resultCacheDir(key), name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// loadCachedResults installs the results cached under the key into the suites.
+func loadCachedResults(key string, oldSuite, newSuite *benchSuite) error {
+	for _, c := range []struct {
+		name string
+		bs   *benchSuite
+	}{{"old", oldSuite}, {"new", newSuite}} {
+		f, err := os.OpenFile(filepath.Join(resultCacheDir(key), c.name), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		c.bs.artDir = testArtifactsDir(c.bs.id())
+		c.bs.outFile = f
+	}
+	fmt.Fprintf(os.Stderr, "serving results from cache %s; pass --force-rerun to rerun\n", resultCacheDir(key))
+	return nil
+}
+
+// storeCachedResults stores the results of the suites under the key. Results
+// are written to temporary files and renamed into place, so that only complete
+// results are ever found in the cache.
+func storeCachedResults(key string, oldSuite, newSuite *benchSuite) error {
+	dir := resultCacheDir(key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, c := range []struct {
+		name string
+		bs   *benchSuite
+	}{{"old", oldSuite}, {"new", newSuite}} {
+		if err := copyOutFile(c.bs, filepath.Join(dir, c.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyOutFile atomically copies the output file of the suite to dst.
+func copyOutFile(bs *benchSuite, dst string) error {
+	if _, err := bs.outFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	defer bs.outFile.Seek(0, io.SeekEnd)
+	tmp := dst + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, bs.outFile); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
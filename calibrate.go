@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// calibrationBench is the name of the calibration benchmark, as reported by
+// benchstat.
+const calibrationBench = "BenchdiffCalibration"
+
+// runCalibrate implements the hidden `benchdiff calibrate` command, which runs
+// a fixed CPU and memory bound workload and prints its result in the Go
+// benchmark format. It is run alongside the benchmarks of each suite when the
+// suites are run on different machines so that the results can be normalized
+// by the relative speed of the machines.
+func runCalibrate(ctx context.Context, args []string) error {
+	buf := make([]byte, 64<<10)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	ints := make([]int, 4096)
+	r := testing.Benchmark(func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sum := sha256.Sum256(buf)
+			for j := range ints {
+				ints[j] = int(sum[j%len(sum)]) * (len(ints) - j)
+			}
+			sort.Ints(ints)
+		}
+	})
+	fmt.Printf("Benchmark%s\t%s\n", calibrationBench, r.String())
+	return nil
+}
+
+// runCalibration runs the calibration benchmark for the suite, on the suite's
+// host, and appends its result to the suite's output file.
+func runCalibration(ctx context.Context, bs *benchSuite) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := bs.remoteCommand([]string{self, "calibrate"})
+	if err := spawnWith(ctx, os.Stdin, bs.outFile, os.Stderr, args...); err != nil {
+		return errors.Wrapf(err, "running calibration on %s", bs.hostName())
+	}
+	return nil
+}
+
+// normalizeByCalibration scales the time and throughput metrics of the new
+// configuration in the collection by the ratio between the old and new
+// calibration results, which compensates for the speed difference between
+// the machines that the suites were run on. The ratio is returned, or zero if
+// either side is missing calibration results.
+func normalizeByCalibration(c *benchstat.Collection) float64 {
+	mean := func(config string) float64 {
+		m := c.Metrics[benchstat.Key{Config: config, Benchmark: calibrationBench, Unit: "ns/op"}]
+		if m == nil || len(m.Values) == 0 {
+			return 0
+		}
+		var sum float64
+		for _, v := range m.Values {
+			sum += v
+		}
+		return sum / float64(len(m.Values))
+	}
+	oldCal, newCal := mean("old"), mean("new")
+	if oldCal == 0 || newCal == 0 {
+		return 0
+	}
+	ratio := newCal / oldCal
+	for k, m := range c.Metrics {
+		if k.Config != "new" || k.Benchmark == calibrationBench {
+			continue
+		}
+		switch k.Unit {
+		case "ns/op":
+			for i := range m.Values {
+				m.Values[i] /= ratio
+			}
+		case "MB/s":
+			for i := range m.Values {
+				m.Values[i] *= ratio
+			}
+		}
+	}
+	return ratio
+}
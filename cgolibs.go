@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// linkedLibs returns the shared libraries that the binary links against,
+// keyed by soname. Each is described by the file that the soname resolves to,
+// which usually carries the library's full version, and a digest of its
+// contents, which catches libraries that don't version their file names.
+// Statically linked binaries link no libraries.
+func linkedLibs(ctx context.Context, bin string) (map[string]string, error) {
+	// ldd exits with a failing exit code for static binaries.
+	out, err := exec.CommandContext(ctx, "ldd", bin).Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	libs := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		// libfoo.so.1 => /usr/lib/libfoo.so.1 (0x00007f...)
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "=>" || !filepath.IsAbs(fields[2]) {
+			continue
+		}
+		path, err := filepath.EvalSymlinks(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		digest, err := fileDigest(path)
+		if err != nil {
+			return nil, err
+		}
+		libs[fields[0]] = fmt.Sprintf("%s@%s", filepath.Base(path), hex.EncodeToString(digest)[:12])
+	}
+	return libs, nil
+}
+
+// recordLinkedLibs records the shared libraries that each of the suites' test
+// binaries link against, and warns about tests whose binaries link different
+// libraries in different suites, as that alone can explain a delta. The
+// libraries are resolved on the local host, so suites that run on remote
+// hosts are skipped.
+func recordLinkedLibs(ctx context.Context, bss []*benchSuite) error {
+	for _, bs := range bss {
+		if bs.isRemote() {
+			continue
+		}
+		bs.libs = make(map[string]map[string]string)
+		for t := range bs.testFiles {
+			libs, err := linkedLibs(ctx, bs.getTestBinary(t))
+			if err != nil {
+				return err
+			}
+			bs.libs[t] = libs
+		}
+	}
+	for _, bs := range bss[1:] {
+		if bss[0].libs == nil || bs.libs == nil {
+			continue
+		}
+		for _, t := range bs.testFiles.sorted() {
+			a, ok := bss[0].libs[t]
+			if !ok {
+				continue
+			}
+			if diff := diffLibs(a, bs.libs[t]); diff != "" {
+				fmt.Fprintf(os.Stderr, "WARNING: %s links different shared libraries in %s and %s: %s\n",
+					t, bss[0].id(), bs.id(), diff)
+			}
+		}
+	}
+	return nil
+}
+
+// diffLibs describes the differences between two sets of linked libraries,
+// or returns the empty string if they are the same.
+func diffLibs(a, b map[string]string) string {
+	var diffs []string
+	for name, v := range a {
+		if w, ok := b[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s only linked by the first", name))
+		} else if v != w {
+			diffs = append(diffs, fmt.Sprintf("%s %s vs %s", name, v, w))
+		}
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s only linked by the second", name))
+		}
+	}
+	sort.Strings(diffs)
+	return strings.Join(diffs, ", ")
+}
+
+// writeLinkedLibs writes a benchfmt configuration line listing the shared
+// libraries that the test's binary links against, if any, to the suite's
+// output file.
+func (bs *benchSuite) writeLinkedLibs(test string) error {
+	libs := bs.libs[test]
+	if len(libs) == 0 {
+		return nil
+	}
+	var parts []string
+	for name, v := range libs {
+		parts = append(parts, name+"="+v)
+	}
+	sort.Strings(parts)
+	_, err := fmt.Fprintf(bs.outFile, "libs: %s\n", strings.Join(parts, " "))
+	return err
+}
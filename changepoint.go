@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"regexp"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"golang.org/x/perf/benchstat"
+)
+
+const changepointsUsage = `usage: benchdiff changepoints [--history-dir <dir>] [--run <regexp>]
+
+benchdiff changepoints runs E-divisive change-point detection over the history
+of each benchmark metric in the history store and lists the runs at which the
+level of a benchmark shifted. Runs are recorded in the history store by passing
+--record to benchdiff.
+
+Options:
+      --history-dir  <dir>     directory or gs:// bucket holding the history (default benchdiff/history)
+  -r, --run          <regexp>  only consider benchmarks matching regexp
+      --alpha        <n>       significance level of the permutation test (default 0.05)
+      --permutations <n>       number of permutations in the significance test (default 199)
+      --min-size     <n>       minimum number of runs between change points (default 3)`
+
+func runChangepoints(ctx context.Context, args []string) error {
+	var historyDir, runPattern string
+	var alpha float64
+	var permutations, minSize int
+	var help bool
+
+	flags := pflag.NewFlagSet("changepoints", pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, changepointsUsage) }
+	flags.BoolVarP(&help, "help", "h", false, "")
+	flags.StringVarP(&historyDir, "history-dir", "", defaultHistoryDir, "")
+	flags.StringVarP(&runPattern, "run", "r", ".", "")
+	flags.Float64VarP(&alpha, "alpha", "", 0.05, "")
+	flags.IntVarP(&permutations, "permutations", "", 199, "")
+	flags.IntVarP(&minSize, "min-size", "", 3, "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if help {
+		fmt.Fprintln(os.Stderr, changepointsUsage)
+		return nil
+	}
+	if minSize < 2 {
+		return errors.New("--min-size must be at least 2")
+	}
+	runRe, err := regexp.Compile(runPattern)
+	if err != nil {
+		return err
+	}
+
+	entries, err := loadHistory(ctx, historyDir)
+	if err != nil {
+		return err
+	}
+	entries = latestConfigEntries(entries)
+	if len(entries) < 2*minSize {
+		return errors.Errorf("need at least %d runs in history store %q, found %d",
+			2*minSize, historyDir, len(entries))
+	}
+
+	// Load every entry into a single collection, using the entry's index as
+	// its configuration.
+	var c benchstat.Collection
+	for i, e := range entries {
+		f, err := os.Open(e.path)
+		if err != nil {
+			return err
+		}
+		err = c.AddFile(fmt.Sprint(i), f)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Seed deterministically so that repeated invocations agree.
+	rng := rand.New(rand.NewSource(1))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "name\tunit\tref\tdate\tbefore\tafter\tdelta")
+	var found int
+	for _, bench := range c.Benchmarks[""] {
+		if !runRe.MatchString(bench) {
+			continue
+		}
+		for _, unit := range c.Units {
+			// Build the series of per-run means, skipping runs that did not
+			// report this benchmark.
+			var series []float64
+			var idxs []int
+			for i := range entries {
+				m := c.Metrics[benchstat.Key{Config: fmt.Sprint(i), Benchmark: bench, Unit: unit}]
+				if m == nil || len(m.Values) == 0 {
+					continue
+				}
+				series = append(series, mean(m.Values))
+				idxs = append(idxs, i)
+			}
+			cps := eDivisive(series, minSize, alpha, permutations, rng)
+			for k, cp := range cps {
+				lo, hi := 0, len(series)
+				if k > 0 {
+					lo = cps[k-1]
+				}
+				if k < len(cps)-1 {
+					hi = cps[k+1]
+				}
+				before, after := mean(series[lo:cp]), mean(series[cp:hi])
+				e := entries[idxs[cp]]
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.4g\t%.4g\t%+.2f%%\n",
+					bench, unit, e.ref, e.time.Format(historyTimeFormat),
+					before, after, (after/before-1)*100)
+				found++
+			}
+		}
+	}
+	if found == 0 {
+		fmt.Println("no change points detected")
+		return nil
+	}
+	return tw.Flush()
+}
+
+// eDivisive finds change points in the series using the E-divisive method of
+// Matteson and James, applied through recursive bisection. Each candidate
+// change point is accepted if a permutation test deems it significant at the
+// provided level. The indexes of the first value after each change point are
+// returned in increasing order.
+func eDivisive(series []float64, minSize int, alpha float64, permutations int, rng *rand.Rand) []int {
+	var res []int
+	var rec func(lo, hi int)
+	rec = func(lo, hi int) {
+		seg := series[lo:hi]
+		tau, q := bestSplit(seg, minSize)
+		if tau < 0 {
+			return
+		}
+		perm := append([]float64(nil), seg...)
+		exceeded := 0
+		for i := 0; i < permutations; i++ {
+			rng.Shuffle(len(perm), func(a, b int) { perm[a], perm[b] = perm[b], perm[a] })
+			if _, pq := bestSplit(perm, minSize); pq >= q {
+				exceeded++
+			}
+		}
+		if p := float64(exceeded+1) / float64(permutations+1); p >= alpha {
+			return
+		}
+		rec(lo, lo+tau)
+		res = append(res, lo+tau)
+		rec(lo+tau, hi)
+	}
+	rec(0, len(series))
+	return res
+}
+
+// bestSplit returns the split point of xs that maximizes the E-divisive
+// divergence statistic between the two sides, along with the statistic. If
+// the series is too short to split, -1 is returned.
+func bestSplit(xs []float64, minSize int) (int, float64) {
+	n := len(xs)
+	if n < 2*minSize {
+		return -1, 0
+	}
+	d := func(i, j int) float64 { return math.Abs(xs[i] - xs[j]) }
+
+	// Maintain the within-left, within-right, and cross distance sums as the
+	// split point moves right one element at a time.
+	var within, right, cross float64
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			right += d(i, j)
+		}
+	}
+	best, bestQ := -1, math.Inf(-1)
+	for tau := 1; tau <= n-minSize; tau++ {
+		e := tau - 1 // element moving from right to left
+		var toLeft, toRight float64
+		for i := 0; i < e; i++ {
+			toLeft += d(i, e)
+		}
+		for j := e + 1; j < n; j++ {
+			toRight += d(e, j)
+		}
+		within += toLeft
+		right -= toRight
+		cross += toRight - toLeft
+		if tau < minSize {
+			continue
+		}
+		m, k := float64(tau), float64(n-tau)
+		stat := 2*cross/(m*k) - within/(m*(m-1)/2) - right/(k*(k-1)/2)
+		if q := m * k / (m + k) * stat; q > bestQ {
+			best, bestQ = tau, q
+		}
+	}
+	return best, bestQ
+}
+
+func mean(xs []float64) float64 {
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
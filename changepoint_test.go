@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestEDivisive(t *testing.T) {
+	noise := rand.New(rand.NewSource(42))
+	// level returns n values around the level, with 1% noise.
+	level := func(n int, v float64) []float64 {
+		res := make([]float64, n)
+		for i := range res {
+			res[i] = v * (1 + 0.01*noise.NormFloat64())
+		}
+		return res
+	}
+	cat := func(parts ...[]float64) []float64 {
+		var res []float64
+		for _, p := range parts {
+			res = append(res, p...)
+		}
+		return res
+	}
+	for _, tc := range []struct {
+		name   string
+		series []float64
+		want   []int
+	}{
+		{"no change", level(40, 100), nil},
+		{"single change", cat(level(20, 100), level(20, 120)), []int{20}},
+		{"two changes", cat(level(15, 100), level(15, 80), level(15, 100)), []int{15, 30}},
+		{"late change", cat(level(30, 100), level(5, 150)), []int{30}},
+		// Shorter than two segments of the minimum size.
+		{"short series", []float64{100, 100, 200, 200, 200}, nil},
+		{"empty", nil, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := eDivisive(tc.series, 3, 0.05, 199, rand.New(rand.NewSource(1)))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("eDivisive() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBestSplit(t *testing.T) {
+	xs := []float64{1, 1, 1, 1, 5, 5, 5}
+	if tau, q := bestSplit(xs, 2); tau != 4 || q <= 0 {
+		t.Errorf("bestSplit(%v) = (%d, %g), want (4, > 0)", xs, tau, q)
+	}
+	if tau, _ := bestSplit(xs[:3], 2); tau != -1 {
+		t.Errorf("bestSplit(%v) = %d, want -1", xs[:3], tau)
+	}
+}
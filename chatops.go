@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nvanbenschoten/benchdiff/github"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+const chatopsUsage = `usage: benchdiff chatops [options] [-- <args>...]
+
+benchdiff chatops lets reviewers request benchmark comparisons from pull
+request comments. A comment whose first line is a command such as
+
+  !benchdiff ./pkg/kv --count=5
+
+runs benchdiff with the command's arguments, comparing the pull request's head
+against its merge base with the base branch, and replies to the comment with
+the comparison. Comments are picked up by polling the repository's comments,
+or from GitHub's issue_comment webhook with --listen. Commands run one at a
+time, in the repository that benchdiff chatops is started in, with the
+arguments following "--" (if any) preceding those of each command.
+
+As commands run the code of pull requests, only commands of the repository's
+owners, members, and collaborators are run by default. Commands may only pass
+packages and the flags that select and compare benchmarks (--count, --run,
+--benchtime, --paired, etc.); flags that run commands, pick hosts, or publish
+results are rejected.
+
+The GitHub repository and token are read from the GITHUB_REPOSITORY and
+GITHUB_TOKEN environment variables, as set by GitHub Actions.
+
+Options:
+      --prefix <cmd>     the command that triggers a comparison (default !benchdiff)
+      --poll   <d>       how often to poll for new comments, or 0 to not poll
+                         (default 1m)
+      --listen <addr>    serve the issue_comment webhook (e.g. on :8080)
+      --webhook-secret <s>
+                         the secret of the webhook (default $BENCHDIFF_WEBHOOK_SECRET)
+      --allow  <assocs>  comma-separated author associations allowed to run commands
+                         (default OWNER,MEMBER,COLLABORATOR)
+      --remote <name>    the git remote to fetch pull requests from (default origin)`
+
+// chatopsStateFile records the progress of the comment poller, so that
+// comments are handled once across restarts.
+var chatopsStateFile = filepath.Join("benchdiff", "chatops.json")
+
+// webhookSecretEnv is the environment variable holding the default webhook
+// secret.
+const webhookSecretEnv = "BENCHDIFF_WEBHOOK_SECRET"
+
+// maxCommentLen is the maximum length of a GitHub comment.
+const maxCommentLen = 65536
+
+// chatopsState is the progress of the comment poller.
+type chatopsState struct {
+	// Since is the creation time of the last handled comment.
+	Since time.Time `json:"since"`
+	// Handled are the ids of recently handled comments, as comments created
+	// at Since are listed again.
+	Handled []int64 `json:"handled"`
+}
+
+// chatops runs the comparisons requested in comments.
+type chatops struct {
+	client   *github.Client
+	self     string
+	prefix   string
+	allow    map[string]bool
+	remote   string
+	baseArgs []string // preceding the arguments of each command
+}
+
+func runChatops(ctx context.Context, args []string) error {
+	var prefix, poll, listen, secret, remote string
+	var allow []string
+	var help bool
+
+	flags := pflag.NewFlagSet("chatops", pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, chatopsUsage) }
+	flags.BoolVarP(&help, "help", "h", false, "")
+	flags.StringVarP(&prefix, "prefix", "", "!benchdiff", "")
+	flags.StringVarP(&poll, "poll", "", "1m", "")
+	flags.StringVarP(&listen, "listen", "", "", "")
+	flags.StringVarP(&secret, "webhook-secret", "", os.Getenv(webhookSecretEnv), "")
+	flags.StringSliceVarP(&allow, "allow", "", []string{"OWNER", "MEMBER", "COLLABORATOR"}, "")
+	flags.StringVarP(&remote, "remote", "", "origin", "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if help {
+		fmt.Fprintln(os.Stderr, chatopsUsage)
+		return nil
+	}
+	interval, err := time.ParseDuration(poll)
+	if err != nil {
+		return errors.Wrap(err, "--poll")
+	}
+	if interval == 0 && listen == "" {
+		return errors.New("expected --poll or --listen")
+	}
+	if listen != "" && secret == "" {
+		return errors.New("--listen requires a --webhook-secret")
+	}
+	client, err := github.New()
+	if err != nil {
+		return err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	c := &chatops{
+		client:   client,
+		self:     self,
+		prefix:   prefix,
+		allow:    make(map[string]bool),
+		remote:   remote,
+		baseArgs: flags.Args(),
+	}
+	for _, a := range allow {
+		c.allow[strings.ToUpper(a)] = true
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Comments are handled one at a time, in the order they arrive.
+	comments := make(chan github.Comment, 100)
+	if listen != "" {
+		srv := &http.Server{Addr: listen, Handler: webhookHandler(secret, comments)}
+		go func() {
+			fmt.Fprintf(os.Stderr, "serving the webhook on %s\n", listen)
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				fmt.Fprintf(os.Stderr, "serving the webhook: %s\n", err)
+				stop()
+			}
+		}()
+		defer srv.Close()
+	}
+	if interval > 0 {
+		go func() {
+			if err := pollComments(ctx, client, interval, comments); err != nil {
+				fmt.Fprintf(os.Stderr, "polling comments: %s\n", err)
+				stop()
+			}
+		}()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case comment := <-comments:
+			if err := c.handle(ctx, comment); err != nil {
+				fmt.Fprintf(os.Stderr, "handling %s: %s\n", comment.HTMLURL, err)
+			}
+		}
+	}
+}
+
+// pollComments lists new comments every interval and passes them on. Only
+// comments created after the poller first started are passed on.
+func pollComments(ctx context.Context, client *github.Client, interval time.Duration, out chan<- github.Comment) error {
+	var state chatopsState
+	if data, err := ioutil.ReadFile(chatopsStateFile); err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return errors.Wrapf(err, "decoding %s", chatopsStateFile)
+		}
+	} else if os.IsNotExist(err) {
+		state.Since = time.Now().UTC()
+	} else {
+		return err
+	}
+	handled := make(map[int64]bool)
+	for _, id := range state.Handled {
+		handled[id] = true
+	}
+	for {
+		comments, err := client.ListComments(ctx, state.Since)
+		if err != nil {
+			// Transient API errors shouldn't stop the poller.
+			fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+		}
+		var changed bool
+		for _, comment := range comments {
+			if handled[comment.ID] || comment.CreatedAt.Before(state.Since) {
+				continue
+			}
+			handled[comment.ID] = true
+			state.Handled = append(state.Handled, comment.ID)
+			state.Since, changed = comment.CreatedAt, true
+			select {
+			case out <- comment:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		if changed {
+			if n := len(state.Handled); n > 1000 {
+				state.Handled = state.Handled[n-1000:]
+			}
+			if err := writeChatopsState(state); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func writeChatopsState(state chatopsState) error {
+	if err := ignoreBenchdiffDir(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(chatopsStateFile, append(data, '\n'), 0644)
+}
+
+// webhookHandler handles GitHub's issue_comment webhook, passing on created
+// comments.
+func webhookHandler(secret string, out chan<- github.Comment) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 25<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(r.Header.Get("X-Hub-Signature-256")), []byte(want)) {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-GitHub-Event") != "issue_comment" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		var event struct {
+			Action  string         `json:"action"`
+			Comment github.Comment `json:"comment"`
+		}
+		if err := json.Unmarshal(body, &event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if event.Action != "created" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		select {
+		case out <- event.Comment:
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			http.Error(w, "too many pending commands", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// parseCommand returns the arguments of the command in the first line of the
+// comment, and whether the comment holds a command.
+func (c *chatops) parseCommand(body string) ([]string, bool) {
+	line := strings.TrimSpace(strings.SplitN(body, "\n", 2)[0])
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != c.prefix {
+		return nil, false
+	}
+	return fields[1:], true
+}
+
+// handle runs the comparison requested by the comment, if any, and replies to
+// it with the result.
+func (c *chatops) handle(ctx context.Context, comment github.Comment) error {
+	args, ok := c.parseCommand(comment.Body)
+	if !ok {
+		return nil
+	}
+	if !c.allow[comment.AuthorAssociation] {
+		fmt.Fprintf(os.Stderr, "ignoring command of %s (%s) in %s\n",
+			comment.User.Login, comment.AuthorAssociation, comment.HTMLURL)
+		return nil
+	}
+	pr, err := c.client.GetPullRequest(ctx, comment.IssueNumber())
+	if err != nil || pr == nil {
+		// Commands on issues are ignored.
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "running %s from %s\n", strings.Join(append([]string{c.prefix}, args...), " "), comment.HTMLURL)
+
+	cmdLine := "`" + strings.Join(append([]string{c.prefix}, args...), " ") + "`"
+	out, runErr := c.run(ctx, pr, args)
+	var body string
+	if runErr != nil {
+		body = fmt.Sprintf("%s requested by @%s failed: %s\n", cmdLine, comment.User.Login, runErr)
+	} else {
+		body = fmt.Sprintf("%s requested by @%s (%s -> %s):\n", cmdLine, comment.User.Login,
+			shortenRef(ctx, pr.Base.Ref), shortenRef(ctx, pr.Head.SHA))
+	}
+	const fence = "\n```\n"
+	if room := maxCommentLen - len(body) - 2*len(fence) - len("...\n"); len(out) > room {
+		out = "...\n" + out[len(out)-room:]
+	}
+	body += fence + out + fence
+	return c.client.CommentOnIssue(ctx, pr.Number, body)
+}
+
+// run fetches the pull request and runs benchdiff with the arguments on it,
+// comparing its head against its merge base. It returns the output of the
+// comparison, or the tail of benchdiff's output on failure.
+func (c *chatops) run(ctx context.Context, pr *github.PullRequest, args []string) (string, error) {
+	if err := checkCommandArgs(args); err != nil {
+		return "", err
+	}
+	err := spawnWith(ctx, nil, os.Stderr, os.Stderr, "git", "fetch", "--quiet", c.remote,
+		pr.Base.SHA, fmt.Sprintf("pull/%d/head", pr.Number))
+	if err != nil {
+		return "", errors.Wrap(err, "fetching the pull request")
+	}
+	base, err := capture(ctx, "git", "merge-base", pr.Base.SHA, pr.Head.SHA)
+	if err != nil {
+		return "", errors.Wrap(err, "finding the merge base")
+	}
+	args = withFlags(append(append([]string(nil), c.baseArgs...), args...),
+		"--old="+base, "--new="+pr.Head.SHA)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(c.self, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, io.MultiWriter(&stderr, os.Stderr)
+	if err := runInterruptible(ctx, cmd); err != nil {
+		return tailLines(stderr.String(), 20), err
+	}
+	return stdout.String(), nil
+}
+
+// chatopsFlags are the benchdiff flags that commands may pass, mapped to
+// whether they take a value. Commands run with the runner's secrets, so flags
+// that run commands, pick hosts, or publish results aren't among them.
+var chatopsFlags = map[string]bool{
+	"--count": true, "-c": true,
+	"--run": true, "-r": true,
+	"--benchtime": true, "-d": true,
+	"--sort": true, "-s": true,
+	"--threshold": true, "-t": true,
+	"--short":           false,
+	"--size":            true,
+	"--examples":        false,
+	"--filter":          true,
+	"--group-by":        true,
+	"--sub-filter":      true,
+	"--normalize-procs": true,
+	"--paired":          false,
+	"--ci":              true,
+	"--fdr":             true,
+	"--effect-size":     false,
+	"--min-effect":      true,
+	"--equalize-n":      false,
+	"--skip-identical":  false,
+	"--shuffle":         true,
+	"--seed":            true,
+	"--strategy":        true,
+	"--sample":          true,
+}
+
+// checkCommandArgs returns an error if the arguments of a command hold a flag
+// that isn't in chatopsFlags. All other arguments are packages.
+func checkCommandArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			continue
+		}
+		name := args[i]
+		inline := false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, inline = name[:j], true
+		}
+		takesValue, ok := chatopsFlags[name]
+		if !ok {
+			return errors.Errorf("%s is not allowed in commands", name)
+		}
+		if takesValue && !inline {
+			i++ // the value
+		}
+	}
+	return nil
+}
+
+// tailLines returns the last n lines of the string.
+func tailLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestCheckCommandArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		ok   bool
+	}{
+		{nil, true},
+		{[]string{"./pkg/kv", "./pkg/sql"}, true},
+		{[]string{"./pkg/kv", "--count=5", "--run", "BenchmarkScan", "-d", "1s", "--paired"}, true},
+		// The value of a flag may look like a flag.
+		{[]string{"--run", "--post-checkout=x"}, true},
+		{[]string{"./pkg/kv", "--post-checkout=touch /tmp/x"}, false},
+		{[]string{"--secrets-cmd", "env"}, false},
+		{[]string{"--sudo", "-y"}, false},
+		{[]string{"--slack-webhook=https://example.com"}, false},
+		{[]string{"--old-host=evil"}, false},
+		{[]string{"-c5"}, false},
+		{[]string{"--", "--publish=gs://bucket"}, false},
+	} {
+		if err := checkCommandArgs(tc.args); (err == nil) != tc.ok {
+			t.Errorf("checkCommandArgs(%q) = %v, want ok=%t", tc.args, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nvanbenschoten/benchdiff/github"
+	"golang.org/x/perf/benchstat"
+)
+
+// checkRunName is the name of the GitHub check run created by --github-check.
+const checkRunName = "benchdiff"
+
+// benchmarkDef is the location of a benchmark function's definition.
+type benchmarkDef struct {
+	path string
+	line int
+}
+
+// findBenchmarkDefs locates the definitions of the top-level benchmark
+// functions of the provided benchmarks at the specified commit. pkgs maps each
+// benchmark to the import path of its package, which is used to pick the
+// right definition if multiple packages define a benchmark with the same name.
+func findBenchmarkDefs(ctx context.Context, commit string, benchmarks []string, pkgs map[string]string) map[string]benchmarkDef {
+	res := make(map[string]benchmarkDef)
+	for _, b := range benchmarks {
+		fn := "Benchmark" + topLevelBench(b)
+		out, err := capture(ctx, "git", "grep", "-n", "-E", "^func "+regexp.QuoteMeta(fn)+`\(`, commit, "--", "*_test.go")
+		if err != nil {
+			// Not found.
+			continue
+		}
+		for _, l := range strings.Split(out, "\n") {
+			// <commit>:<path>:<line>:<text>
+			parts := strings.SplitN(strings.TrimPrefix(l, commit+":"), ":", 3)
+			if len(parts) != 3 {
+				continue
+			}
+			line, err := strconv.Atoi(parts[1])
+			if err != nil {
+				continue
+			}
+			def := benchmarkDef{path: parts[0], line: line}
+			if pkg, ok := pkgs[b]; ok && strings.HasSuffix(pkg, path.Dir(def.path)) {
+				res[b] = def
+				break
+			}
+			if _, ok := res[b]; !ok {
+				res[b] = def
+			}
+		}
+	}
+	return res
+}
+
+// makeCheckRun builds a GitHub check run for the comparison. Each regression
+// is annotated on the definition of its benchmark function. Regressions that
+// exceed the threshold, if one is set, fail the check.
+func makeCheckRun(
+	ctx context.Context,
+	oldSuite, newSuite *benchSuite,
+	tables []*benchstat.Table,
+	thresh thresholds,
+	cc *compareConfig,
+) (github.CheckRun, error) {
+	pkgs, err := benchPkgs(newSuite.outFile)
+	if err != nil {
+		return github.CheckRun{}, err
+	}
+	var benchmarks []string
+	var regressions, improvements, failures int
+	for _, t := range tables {
+		for _, row := range t.Rows {
+			switch row.Change {
+			case -1:
+				regressions++
+				benchmarks = append(benchmarks, row.Benchmark)
+			case 1:
+				improvements++
+			}
+		}
+	}
+	defs := findBenchmarkDefs(ctx, newSuite.commit, benchmarks, pkgs)
+
+	run := github.CheckRun{
+		Name:    checkRunName,
+		HeadSHA: newSuite.commit,
+	}
+	for _, t := range tables {
+		for _, row := range t.Rows {
+			if row.Change != -1 {
+				continue
+			}
+			level := "warning"
+			if cc.failsGate(t, row, thresh.of(t)) {
+				level = "failure"
+				failures++
+			}
+			def, ok := defs[row.Benchmark]
+			if !ok {
+				continue
+			}
+			run.Annotations = append(run.Annotations, github.Annotation{
+				Path:      def.path,
+				StartLine: def.line,
+				EndLine:   def.line,
+				Level:     level,
+				Title:     fmt.Sprintf("%s regression in %s", t.Metric, row.Benchmark),
+				Message:   fmt.Sprintf("%s %s (%s)", t.Metric, row.Delta, row.Note),
+			})
+		}
+	}
+
+	switch {
+	case failures > 0:
+		run.Conclusion = "failure"
+	case regressions > 0:
+		run.Conclusion = "neutral"
+	default:
+		run.Conclusion = "success"
+	}
+	run.Title = fmt.Sprintf("%d regression(s), %d improvement(s)", regressions, improvements)
+	run.Summary = fmt.Sprintf("Compared `%s` (%s) against `%s` (%s).",
+		newSuite.ref, newSuite.subject, oldSuite.ref, oldSuite.subject)
+	var buf bytes.Buffer
+	benchstat.FormatText(&buf, tables)
+	run.Text = "```\n" + buf.String() + "```"
+	return run, nil
+}
+
+// reportCheckRun creates a GitHub check run for the comparison on the new
+// suite's commit.
+func reportCheckRun(
+	ctx context.Context,
+	client *github.Client,
+	oldSuite, newSuite *benchSuite,
+	tables []*benchstat.Table,
+	thresh thresholds,
+	cc *compareConfig,
+) error {
+	run, err := makeCheckRun(ctx, oldSuite, newSuite, tables, thresh, cc)
+	if err != nil {
+		return err
+	}
+	url, err := client.CreateCheckRun(ctx, run)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\ncreated check run: %s\n", url)
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Cloud providers that --cloud can provision a VM on.
+const (
+	cloudGCE = "gce"
+	cloudEC2 = "ec2"
+)
+
+// sshReadyTimeout bounds how long to wait for a provisioned VM to accept ssh
+// connections.
+const sshReadyTimeout = 5 * time.Minute
+
+// cloudConfig configures the VM provisioned with --cloud.
+type cloudConfig struct {
+	provider    string
+	machineType string
+	zone        string // zone for GCE, region for EC2
+	image       string // <project>/<family> for GCE, AMI ID for EC2
+	key         string // EC2 key pair name
+	user        string // EC2 ssh user
+}
+
+// cloudVM is an ephemeral VM that both suites' benchmarks are run on. It is
+// created with nothing but its base image, as the test binaries are copied to
+// it like to any other remote host.
+type cloudVM struct {
+	cfg  cloudConfig
+	name string // GCE instance name or EC2 instance ID
+	host string // ssh destination
+}
+
+// provisionVM creates a VM and waits for it to accept ssh connections. The VM
+// is torn down if it can not be reached.
+func provisionVM(ctx context.Context, cfg cloudConfig) (vm *cloudVM, err error) {
+	vm = &cloudVM{cfg: cfg}
+	switch cfg.provider {
+	case cloudGCE:
+		err = vm.createGCE(ctx)
+	case cloudEC2:
+		err = vm.createEC2(ctx)
+	default:
+		return nil, errors.Errorf("unknown cloud %q; must be %s or %s", cfg.provider, cloudGCE, cloudEC2)
+	}
+	if vm.name != "" {
+		fmt.Fprintf(os.Stderr, "provisioned %s %s VM %s\n", cfg.machineType, cfg.provider, vm.name)
+	}
+	if err == nil {
+		err = waitForSSH(ctx, vm.host)
+	}
+	if err != nil {
+		if vm.name != "" {
+			_ = vm.teardown()
+		}
+		return nil, errors.Wrapf(err, "provisioning %s VM", cfg.provider)
+	}
+	return vm, nil
+}
+
+func (vm *cloudVM) createGCE(ctx context.Context) error {
+	image := vm.cfg.image
+	if image == "" {
+		image = "debian-cloud/debian-12"
+	}
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) != 2 {
+		return errors.Errorf("invalid GCE image %q: must be <project>/<family>", image)
+	}
+	project, err := capture(ctx, "gcloud", "config", "get-value", "project")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("benchdiff-%d", time.Now().Unix())
+	if _, err := capture(ctx, "gcloud", "compute", "instances", "create", name,
+		"--zone", vm.cfg.zone, "--machine-type", vm.cfg.machineType,
+		"--image-project", parts[0], "--image-family", parts[1],
+		"--labels", "benchdiff=ephemeral", "--quiet"); err != nil {
+		return err
+	}
+	vm.name = name
+	// Add the instance to the ssh config, so that plain ssh and scp reach it.
+	if _, err := capture(ctx, "gcloud", "compute", "config-ssh", "--quiet"); err != nil {
+		return err
+	}
+	vm.host = strings.Join([]string{name, vm.cfg.zone, project}, ".")
+	return nil
+}
+
+func (vm *cloudVM) createEC2(ctx context.Context) error {
+	if vm.cfg.image == "" || vm.cfg.key == "" {
+		return errors.New("--cloud-image (an AMI ID) and --cloud-key are required for ec2")
+	}
+	aws := func(args ...string) (string, error) {
+		return capture(ctx, append([]string{"aws", "--region", vm.cfg.zone, "--output", "text"}, args...)...)
+	}
+	id, err := aws("ec2", "run-instances", "--image-id", vm.cfg.image,
+		"--instance-type", vm.cfg.machineType, "--key-name", vm.cfg.key,
+		"--tag-specifications", "ResourceType=instance,Tags=[{Key=benchdiff,Value=ephemeral}]",
+		"--query", "Instances[0].InstanceId")
+	if err != nil {
+		return err
+	}
+	vm.name = id
+	if _, err := aws("ec2", "wait", "instance-running", "--instance-ids", id); err != nil {
+		return err
+	}
+	dns, err := aws("ec2", "describe-instances", "--instance-ids", id,
+		"--query", "Reservations[0].Instances[0].PublicDnsName")
+	if err != nil {
+		return err
+	}
+	vm.host = vm.cfg.user + "@" + dns
+	return nil
+}
+
+// waitForSSH waits for the host to accept ssh connections.
+func waitForSSH(ctx context.Context, host string) error {
+	deadline := time.Now().Add(sshReadyTimeout)
+	for {
+		_, err := capture(ctx, "ssh", "-o", "StrictHostKeyChecking=accept-new", "-o", "ConnectTimeout=10", host, "true")
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Wrapf(err, "waiting for ssh on %s", host)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// teardown deletes the VM. It isn't canceled along with the run, which it
+// cleans up after.
+func (vm *cloudVM) teardown() error {
+	ctx := context.Background()
+	var err error
+	switch vm.cfg.provider {
+	case cloudGCE:
+		_, err = capture(ctx, "gcloud", "compute", "instances", "delete", vm.name, "--zone", vm.cfg.zone, "--quiet")
+	case cloudEC2:
+		_, err = capture(ctx, "aws", "--region", vm.cfg.zone, "ec2", "terminate-instances", "--instance-ids", vm.name)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "tearing down VM %s; delete it manually", vm.name)
+	}
+	fmt.Fprintf(os.Stderr, "tore down %s VM %s\n", vm.cfg.provider, vm.name)
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Collector measures a dimension of an invocation of a test binary that the
+// benchmarks in it do not report themselves. Start is called once the test
+// binary's process has started and Stop once it has exited and been waited
+// on. Stop returns the measured values keyed by unit, which are recorded under
+// the Invocation/<test> benchmark and compared like any other result.
+//
+// A Collector is reused across invocations, but never used concurrently.
+type Collector interface {
+	Start(pid int) error
+	Stop() (map[string]float64, error)
+}
+
+// collectorFactories holds the built-in collectors, keyed by the name that
+// enables them in --collectors.
+var collectorFactories = map[string]func() (Collector, error){
+	"rusage":  func() (Collector, error) { return &rusageCollector{}, nil },
+	"perf":    newPerfCollector,
+	"energy":  newEnergyCollector,
+	"io":      func() (Collector, error) { return &procIOCollector{}, nil },
+	"runtime": newRuntimeCollector,
+	"startup": func() (Collector, error) { return &startupCollector{}, nil },
+}
+
+// envCollector is implemented by collectors that need environment variables
+// to be set for the test binary.
+type envCollector interface {
+	Env() []string
+}
+
+// collectorNames returns the names of the built-in collectors.
+func collectorNames() []string {
+	var names []string
+	for name := range collectorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newCollectors instantiates the collectors with the provided names.
+// Collectors are started and stopped in order. The perf collector is ordered
+// last, as the perf process that it spawns is reaped when it stops and would
+// otherwise be accounted to the rusage and io collectors.
+func newCollectors(names []string) ([]Collector, error) {
+	names = append([]string(nil), names...)
+	sort.SliceStable(names, func(i, j int) bool { return names[i] != "perf" && names[j] == "perf" })
+	var res []Collector
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		factory, ok := collectorFactories[name]
+		if !ok {
+			return nil, errors.Errorf("unknown collector %q; available: %s",
+				name, strings.Join(collectorNames(), ", "))
+		}
+		c, err := factory()
+		if err != nil {
+			return nil, errors.Wrapf(err, "collector %q", name)
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// writeInvocationMetrics records the metrics collected around an invocation
+// of the test binary in the suite's output file.
+func writeInvocationMetrics(bs *benchSuite, test string, metrics map[string]float64) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	units := make([]string, 0, len(metrics))
+	for u := range metrics {
+		units = append(units, u)
+	}
+	sort.Strings(units)
+	var b strings.Builder
+	b.WriteString("Benchmark" + invocationBench + "/" + test + " 1")
+	for _, u := range units {
+		b.WriteString(" " + strconv.FormatFloat(metrics[u], 'g', -1, 64) + " " + u)
+	}
+	_, err := bs.outFile.WriteString(b.String() + "\n")
+	return err
+}
+
+// rusageCollector measures the CPU time, page faults, and context switches
+// of an invocation. The kernel adds the resource usage of each child process
+// to its parent's RUSAGE_CHILDREN usage when the child is reaped, so the
+// difference between readings taken around the invocation measures the test
+// binary.
+type rusageCollector struct {
+	start syscall.Rusage
+}
+
+func (c *rusageCollector) Start(pid int) error {
+	return syscall.Getrusage(syscall.RUSAGE_CHILDREN, &c.start)
+}
+
+func (c *rusageCollector) Stop() (map[string]float64, error) {
+	var end syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_CHILDREN, &end); err != nil {
+		return nil, err
+	}
+	dur := func(tv syscall.Timeval) float64 {
+		return float64(time.Duration(tv.Nano()))
+	}
+	return map[string]float64{
+		"user-ns":         dur(end.Utime) - dur(c.start.Utime),
+		"sys-ns":          dur(end.Stime) - dur(c.start.Stime),
+		"minor-faults":    float64(end.Minflt - c.start.Minflt),
+		"major-faults":    float64(end.Majflt - c.start.Majflt),
+		"vol-ctxswitches": float64(end.Nvcsw - c.start.Nvcsw),
+		"inv-ctxswitches": float64(end.Nivcsw - c.start.Nivcsw),
+	}, nil
+}
+
+// perfEvents are the hardware counters measured by the perf collector.
+var perfEvents = []string{"cycles", "instructions", "cache-misses", "branch-misses"}
+
+// perfCollector measures hardware performance counters of an invocation by
+// attaching `perf stat` to the test binary's process.
+type perfCollector struct {
+	out *os.File
+	cmd *exec.Cmd
+}
+
+func newPerfCollector() (Collector, error) {
+	if _, err := exec.LookPath("perf"); err != nil {
+		return nil, err
+	}
+	return &perfCollector{}, nil
+}
+
+func (c *perfCollector) Start(pid int) error {
+	var err error
+	if c.out, err = ioutil.TempFile("", "benchdiff-perf"); err != nil {
+		return err
+	}
+	c.cmd = exec.Command("perf", "stat", "-x", ",", "-o", c.out.Name(),
+		"-e", strings.Join(perfEvents, ","), "-p", strconv.Itoa(pid))
+	return c.cmd.Start()
+}
+
+func (c *perfCollector) Stop() (map[string]float64, error) {
+	defer os.Remove(c.out.Name())
+	defer c.out.Close()
+	// perf exits once the process that it is attached to exits.
+	if err := c.cmd.Wait(); err != nil {
+		return nil, errors.Wrap(err, "running perf stat")
+	}
+	res := make(map[string]float64)
+	s := bufio.NewScanner(c.out)
+	for s.Scan() {
+		// <value>,<unit>,<event>,...
+		fields := strings.Split(s.Text(), ",")
+		if len(fields) < 3 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			// "<not counted>" or "<not supported>".
+			continue
+		}
+		res[fields[2]] = v
+	}
+	return res, s.Err()
+}
+
+// energyCollector measures the energy consumption of an invocation using the
+// host's RAPL counters.
+type energyCollector struct {
+	zones []raplZone
+	start energySample
+}
+
+func newEnergyCollector() (Collector, error) {
+	zones, err := raplZones()
+	if err != nil {
+		return nil, err
+	}
+	return &energyCollector{zones: zones}, nil
+}
+
+func (c *energyCollector) Start(pid int) error {
+	var err error
+	c.start, err = sampleEnergy(c.zones)
+	return err
+}
+
+func (c *energyCollector) Stop() (map[string]float64, error) {
+	end, err := sampleEnergy(c.zones)
+	if err != nil {
+		return nil, err
+	}
+	return energyMetrics(c.zones, c.start, end), nil
+}
+
+// procIOCollector measures the I/O of an invocation using the I/O accounting
+// of the benchdiff process.
+type procIOCollector struct {
+	start map[string]uint64
+}
+
+func (c *procIOCollector) Start(pid int) error {
+	var err error
+	c.start, err = readProcIO()
+	return err
+}
+
+func (c *procIOCollector) Stop() (map[string]float64, error) {
+	end, err := readProcIO()
+	if err != nil {
+		return nil, err
+	}
+	return procIODelta(c.start, end), nil
+}
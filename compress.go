@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// zstExt is the extension of artifacts compressed with zstd.
+const zstExt = ".zst"
+
+// isCompressible returns whether the artifact at the path is compressed by
+// --compress-artifacts: the output files of runs, build logs, and profiles,
+// which make up the bulk of the artifacts of tree-wide runs. Reports are left
+// as they are, to be opened directly, as are artifacts compressed already.
+func isCompressible(path string) bool {
+	base := filepath.Base(path)
+	if strings.HasSuffix(base, zstExt) {
+		return false
+	}
+	return strings.HasPrefix(base, "out.") || filepath.Ext(base) == ".log" || filepath.Ext(base) == ".prof"
+}
+
+// compressArtifacts compresses the compressible artifacts in the artifacts
+// directories of the suites with zstd, replacing each with its .zst. The
+// suites' output files are closed first. If zstd isn't installed, the
+// artifacts are left uncompressed.
+func compressArtifacts(ctx context.Context, suites ...*benchSuite) error {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: zstd not found; leaving artifacts uncompressed")
+		return nil
+	}
+	for _, bs := range suites {
+		if bs == nil || bs.artDir == "" {
+			continue
+		}
+		if bs.outFile != nil {
+			_ = bs.outFile.Close()
+		}
+		entries, err := os.ReadDir(bs.artDir)
+		if err != nil {
+			return err
+		}
+		args := []string{"zstd", "-q", "-f", "--rm"}
+		var n int
+		for _, e := range entries {
+			if path := filepath.Join(bs.artDir, e.Name()); e.Type().IsRegular() && isCompressible(path) {
+				args = append(args, path)
+				n++
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		if _, err := capture(ctx, args...); err != nil {
+			return errors.Wrapf(err, "compressing artifacts in %s", bs.artDir)
+		}
+	}
+	return nil
+}
+
+// decompressArtifact restores the artifact at the path from its .zst, if
+// only the compressed artifact exists, so that the artifacts of compressed
+// runs can be re-analyzed transparently.
+func decompressArtifact(ctx context.Context, path string) error {
+	if pathExists(path) || !pathExists(path+zstExt) {
+		return nil
+	}
+	if _, err := capture(ctx, "zstd", "-d", "-q", "--rm", path+zstExt, "-o", path); err != nil {
+		return errors.Wrapf(err, "decompressing %s", path+zstExt)
+	}
+	return nil
+}
+
+// decompressRun restores the output file of a run of the suite and the
+// suite's profiles, for re-analysis with --previous-run.
+func decompressRun(ctx context.Context, bs *benchSuite, outFile string) error {
+	if err := decompressArtifact(ctx, outFile); err != nil {
+		return err
+	}
+	profiles, err := filepath.Glob(filepath.Join(bs.artDir, "*.prof"+zstExt))
+	if err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		if err := decompressArtifact(ctx, strings.TrimSuffix(p, zstExt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// artifactPath returns the path of the artifact, or of its .zst if it has
+// been compressed.
+func artifactPath(path string) string {
+	if !pathExists(path) && pathExists(path+zstExt) {
+		return path + zstExt
+	}
+	return path
+}
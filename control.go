@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// controlLabel distinguishes the control suite from the old suite, which is
+// usually built from the same ref.
+const controlLabel = "control"
+
+// withControl expands the indexes of the suites that a run is scheduled
+// against (0 for old, 1 for new) to include the control suite (2) directly
+// after every run against the old suite.
+func withControl(suites []int) []int {
+	res := make([]int, 0, len(suites)+1)
+	for _, idx := range suites {
+		res = append(res, idx)
+		if idx == 0 {
+			res = append(res, 2)
+		}
+	}
+	return res
+}
+
+// addSuites adds the output of each suite to the collection under the
+// corresponding config name.
+func addSuites(c *benchstat.Collection, names []string, suites ...*benchSuite) error {
+	for i, bs := range suites {
+		// The control suite runs on the old suite's host.
+		r, err := bs.results(names[i] != "new")
+		if err != nil {
+			return err
+		}
+		if err := c.AddFile(names[i], r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markControlNoise annotates the note of each row with the difference between
+// the means of the control and old suites. Both usually run the same code, so
+// the difference quantifies run-to-run noise and gives context for judging
+// the delta between old and new.
+func markControlNoise(tables []*benchstat.Table, controlSuite, oldSuite *benchSuite) error {
+	var c benchstat.Collection
+	if err := addSuites(&c, []string{"control", "old"}, controlSuite, oldSuite); err != nil {
+		return err
+	}
+	noise := make(map[string]map[string]float64)
+	for _, t := range c.Tables() {
+		m := make(map[string]float64, len(t.Rows))
+		for _, row := range t.Rows {
+			if len(row.Metrics) != 2 || row.Metrics[0].Mean == 0 {
+				continue
+			}
+			m[row.Benchmark] = math.Abs(row.Metrics[1].Mean/row.Metrics[0].Mean-1) * 100
+		}
+		noise[t.Metric] = m
+	}
+	for _, t := range tables {
+		for _, row := range t.Rows {
+			if pct, ok := noise[t.Metric][row.Benchmark]; ok {
+				row.Note = strings.TrimSpace(fmt.Sprintf("%s [control ±%.1f%%]", row.Note, pct))
+			}
+		}
+	}
+	return nil
+}
+
+// formatControlTables writes a three-column comparison of the control, old,
+// and new suites in text form.
+func formatControlTables(w io.Writer, controlSuite, oldSuite, newSuite *benchSuite, byName bool) error {
+	var c benchstat.Collection
+	c.Alpha = 0.05
+	if byName {
+		c.Order = benchstat.ByName
+	}
+	err := addSuites(&c, []string{"control", "old", "new"}, controlSuite, oldSuite, newSuite)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nthree-way comparison (control=%s, old=%s, new=%s):\n", controlSuite.ref, oldSuite.ref, newSuite.ref)
+	benchstat.FormatText(w, c.Tables())
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// allowedCPUs returns the CPUs that the process may run on, from its
+// affinity mask, in ascending order.
+func allowedCPUs() ([]int, error) {
+	var mask [1024 / 64]uint64
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0,
+		uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return nil, errno
+	}
+	var cpus []int
+	for i, w := range mask {
+		for b := 0; b < 64; b++ {
+			if w&(1<<uint(b)) != 0 {
+				cpus = append(cpus, i*64+b)
+			}
+		}
+	}
+	return cpus, nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "runtime"
+
+// allowedCPUs returns the CPUs that the process may run on. Without an
+// affinity mask to consult, that is all of them.
+func allowedCPUs() ([]int, error) {
+	cpus := make([]int, runtime.NumCPU())
+	for i := range cpus {
+		cpus[i] = i
+	}
+	return cpus, nil
+}
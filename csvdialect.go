@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	// Aliased, as csv is an output format.
+	gocsv "encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// csvDialect controls the CSV output for spreadsheets in locales that use a
+// decimal comma, which would otherwise misread the numbers. See
+// --csv-delimiter and --decimal-comma.
+type csvDialect struct {
+	delim        rune
+	decimalComma bool
+}
+
+// makeCSVDialect parses the CSV options. The delimiter defaults to a
+// semicolon with decimal commas, as is conventional, and a comma otherwise.
+func makeCSVDialect(delim string, decimalComma bool) (csvDialect, error) {
+	d := csvDialect{delim: ',', decimalComma: decimalComma}
+	if decimalComma {
+		d.delim = ';'
+	}
+	switch delim {
+	case "":
+	case `\t`, "tab":
+		d.delim = '\t'
+	default:
+		r, n := utf8.DecodeRuneInString(delim)
+		if n != len(delim) || r == '"' || r == '\n' || r == '\r' {
+			return d, errors.Errorf("invalid --csv-delimiter %q: must be a single character", delim)
+		}
+		d.delim = r
+	}
+	if d.decimalComma && d.delim == ',' {
+		return d, errors.New("--decimal-comma can not be used with a comma --csv-delimiter")
+	}
+	return d, nil
+}
+
+// formatCSV writes the tables in CSV format, like benchstat.FormatCSV, in
+// the provided dialect.
+func formatCSV(w io.Writer, tables []*benchstat.Table, d csvDialect) error {
+	// If norange is true, suppress the range information for each data item.
+	// If norange is false, insert a "±" in the appropriate columns of the header row.
+	norange := false
+	if d == (csvDialect{}) || d == (csvDialect{delim: ','}) {
+		benchstat.FormatCSV(w, tables, norange)
+		return nil
+	}
+	for i, t := range tables {
+		if i > 0 {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		var buf bytes.Buffer
+		benchstat.FormatCSV(&buf, []*benchstat.Table{t}, norange)
+		r := gocsv.NewReader(&buf)
+		r.FieldsPerRecord = -1
+		records, err := r.ReadAll()
+		if err != nil {
+			return err
+		}
+		cw := gocsv.NewWriter(w)
+		cw.Comma = d.delim
+		for _, rec := range records {
+			if d.decimalComma {
+				for j, cell := range rec {
+					if isNumericCell(cell) {
+						rec[j] = strings.Replace(cell, ".", ",", 1)
+					}
+				}
+			}
+			if err := cw.Write(rec); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isNumericCell returns whether the cell holds a number, which may be signed
+// or a percentage, as in the mean, range, and delta columns.
+func isNumericCell(cell string) bool {
+	s := strings.TrimSuffix(strings.TrimPrefix(cell, "+"), "%")
+	_, err := strconv.ParseFloat(s, 64)
+	return s != "" && err == nil
+}
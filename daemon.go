@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+const daemonUsage = `usage: benchdiff daemon [options] [-- <args>...]
+       benchdiff daemon submit [--queue <dir>] <args>...
+       benchdiff daemon status [--queue <dir>] [<job-id>]
+
+benchdiff daemon turns a dedicated, otherwise quiet machine into a benchmark
+server. It watches a queue directory for comparison jobs and runs them one at a
+time, in the repository that it is started in. Each job is an invocation of
+benchdiff with the job's arguments, preceded by the daemon's own arguments
+(those following "--", e.g. sinks such as --slack-webhook that every job should
+publish to). The output of each job is logged in the queue directory, and its
+comparison is also written there as JSON.
+
+benchdiff daemon submit queues a job with the provided arguments and prints
+its id. benchdiff daemon status lists the queued, running, and finished jobs,
+or prints the record of one job.
+
+Jobs are files in the pending, running, done, and failed subdirectories of the
+queue, so they can also be queued by writing a file to pending, and several
+daemons can share a queue on a shared filesystem.
+
+Options:
+      --queue  <dir>   the queue directory (default benchdiff/queue)
+      --poll   <d>     how often to check for new jobs (default 10s)
+      --fetch          run git fetch before each job, so that submitted refs resolve
+      --listen <addr>  serve an HTTP API (e.g. on :8080) to submit and query jobs:
+                       POST /runs with {"args": [...]}, GET /runs, GET /runs/<id>,
+                       GET /runs/<id>/results (the comparison, as JSON), GET /runs/<id>/log
+      --token  <tok>   the bearer token that API requests must carry, required with --listen
+                       (default $BENCHDIFF_DAEMON_TOKEN)`
+
+// daemonTokenEnv is the environment variable holding the default API token,
+// which keeps it out of the process list.
+const daemonTokenEnv = "BENCHDIFF_DAEMON_TOKEN"
+
+// defaultQueueDir is the default queue directory of the daemon.
+var defaultQueueDir = filepath.Join("benchdiff", "queue")
+
+// States of a daemon job, each of which is a subdirectory of the queue.
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+var jobStates = []string{jobPending, jobRunning, jobDone, jobFailed}
+
+// daemonJob is a comparison job run by the daemon.
+type daemonJob struct {
+	ID        string    `json:"id"`
+	Args      []string  `json:"args"`
+	Submitted time.Time `json:"submitted"`
+	// The following are set once the job is picked up.
+	State    string     `json:"state,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Log      string     `json:"log,omitempty"`
+	Results  string     `json:"results,omitempty"` // the comparison, as JSON
+}
+
+// jobQueue is a queue directory of daemon jobs.
+type jobQueue struct {
+	dir string
+}
+
+func (q jobQueue) path(state, id string) string {
+	return filepath.Join(q.dir, state, id+".json")
+}
+
+func (q jobQueue) init() error {
+	for _, state := range append(jobStates, "logs", "results") {
+		if err := os.MkdirAll(filepath.Join(q.dir, state), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// submit queues a job with the arguments and returns it.
+func (q jobQueue) submit(args []string) (daemonJob, error) {
+	if err := q.init(); err != nil {
+		return daemonJob{}, err
+	}
+	now := time.Now().UTC()
+	job := daemonJob{
+		// Ids sort in submission order, with a suffix to keep jobs submitted
+		// in the same second apart.
+		ID:        fmt.Sprintf("%s-%04d", now.UTC().Format(historyTimeFormat), now.Nanosecond()/1e5),
+		Args:      args,
+		Submitted: now,
+		State:     jobPending,
+	}
+	return job, q.write(job)
+}
+
+// write writes the record of the job in the directory of its state. The file
+// is replaced atomically, so that the daemon never picks up a partial job.
+func (q jobQueue) write(job daemonJob) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(q.dir, "."+job.ID+".tmp")
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(job.State, job.ID))
+}
+
+// list returns the jobs in the state, oldest first.
+func (q jobQueue) list(state string) ([]daemonJob, error) {
+	files, err := filepath.Glob(filepath.Join(q.dir, state, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var res []daemonJob
+	for _, f := range files {
+		job, err := readJob(f)
+		if err != nil {
+			// The job may have moved on since it was listed.
+			continue
+		}
+		job.State = state
+		res = append(res, job)
+	}
+	return res, nil
+}
+
+// find returns the job with the id, in whichever state it is.
+func (q jobQueue) find(id string) (daemonJob, error) {
+	for _, state := range jobStates {
+		job, err := readJob(q.path(state, id))
+		if err == nil {
+			job.State = state
+			return job, nil
+		} else if !os.IsNotExist(errors.Cause(err)) {
+			return job, err
+		}
+	}
+	return daemonJob{}, errors.Errorf("no job %q in %s", id, q.dir)
+}
+
+func readJob(path string) (daemonJob, error) {
+	var job daemonJob
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return job, err
+	}
+	if err := json.Unmarshal(data, &job); err != nil {
+		return job, errors.Wrapf(err, "decoding %s", path)
+	}
+	return job, nil
+}
+
+// claim moves the oldest pending job to running and returns it, or returns
+// false if there is none. Jobs are claimed by renaming their file, so that
+// only one of several daemons sharing the queue claims each job.
+func (q jobQueue) claim() (daemonJob, bool, error) {
+	pending, err := q.list(jobPending)
+	if err != nil {
+		return daemonJob{}, false, err
+	}
+	for _, job := range pending {
+		if err := os.Rename(q.path(jobPending, job.ID), q.path(jobRunning, job.ID)); err != nil {
+			if os.IsNotExist(err) {
+				continue // claimed by another daemon
+			}
+			return daemonJob{}, false, err
+		}
+		job.State = jobRunning
+		return job, true, nil
+	}
+	return daemonJob{}, false, nil
+}
+
+// finish records the outcome of the running job and moves it to done or
+// failed.
+func (q jobQueue) finish(job daemonJob, runErr error) error {
+	now := time.Now().UTC()
+	job.Finished = &now
+	job.State = jobDone
+	if runErr != nil {
+		job.State = jobFailed
+		job.Error = runErr.Error()
+	}
+	if err := q.write(job); err != nil {
+		return err
+	}
+	return os.Remove(q.path(jobRunning, job.ID))
+}
+
+// requeue moves the running job back to pending, e.g. when the daemon is
+// stopped while running it.
+func (q jobQueue) requeue(job daemonJob) error {
+	job.State, job.Started = jobPending, nil
+	if err := q.write(job); err != nil {
+		return err
+	}
+	return os.Remove(q.path(jobRunning, job.ID))
+}
+
+func runDaemon(ctx context.Context, args []string) error {
+	var queueDir, poll, listen, token string
+	var fetch, help bool
+
+	flags := pflag.NewFlagSet("daemon", pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, daemonUsage) }
+	flags.BoolVarP(&help, "help", "h", false, "")
+	flags.StringVarP(&queueDir, "queue", "", defaultQueueDir, "")
+	flags.StringVarP(&poll, "poll", "", "10s", "")
+	flags.BoolVarP(&fetch, "fetch", "", false, "")
+	flags.StringVarP(&listen, "listen", "", "", "")
+	flags.StringVarP(&token, "token", "", os.Getenv(daemonTokenEnv), "")
+	if len(args) > 0 && (args[0] == "submit" || args[0] == "status") {
+		// The arguments of submitted jobs are benchdiff's, so only a leading
+		// --queue is the subcommand's.
+		sub, rest := args[0], args[1:]
+		if len(rest) > 0 && strings.HasPrefix(rest[0], "--queue=") {
+			queueDir, rest = strings.TrimPrefix(rest[0], "--queue="), rest[1:]
+		} else if len(rest) > 1 && rest[0] == "--queue" {
+			queueDir, rest = rest[1], rest[2:]
+		}
+		if len(rest) > 0 && rest[0] == "--" {
+			rest = rest[1:]
+		}
+		return runDaemonClient(jobQueue{dir: queueDir}, sub, rest)
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if help {
+		fmt.Fprintln(os.Stderr, daemonUsage)
+		return nil
+	}
+	if listen != "" && token == "" {
+		// Jobs run benchdiff with arbitrary arguments, which can run commands.
+		return errors.New("--listen requires a --token")
+	}
+	q := jobQueue{dir: queueDir}
+
+	interval, err := time.ParseDuration(poll)
+	if err != nil {
+		return errors.Wrap(err, "--poll")
+	}
+	if err := q.init(); err != nil {
+		return err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Jobs left running by a daemon that died are run again.
+	running, err := q.list(jobRunning)
+	if err != nil {
+		return err
+	}
+	for _, job := range running {
+		fmt.Fprintf(os.Stderr, "requeuing interrupted job %s\n", job.ID)
+		if err := q.requeue(job); err != nil {
+			return err
+		}
+	}
+
+	wake := make(chan struct{}, 1)
+	if listen != "" {
+		api := &jobAPI{q: q, token: token, wake: wake}
+		go func() {
+			if err := serveJobAPI(ctx, listen, api); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				stop()
+			}
+		}()
+	}
+
+	fmt.Fprintf(os.Stderr, "watching %s for jobs\n", q.dir)
+	for {
+		job, ok, err := q.claim()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-wake:
+				continue
+			case <-time.After(interval):
+				continue
+			}
+		}
+		if fetch {
+			if err := spawn(ctx, "git", "fetch", "--quiet"); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: git fetch: %s\n", err)
+			}
+		}
+		runErr := runJob(ctx, q, self, flags.Args(), &job)
+		if ctx.Err() != nil {
+			fmt.Fprintf(os.Stderr, "stopped; requeuing job %s\n", job.ID)
+			return q.requeue(job)
+		}
+		if err := q.finish(job, runErr); err != nil {
+			return err
+		}
+		if runErr != nil {
+			fmt.Fprintf(os.Stderr, "job %s failed: %s\n", job.ID, runErr)
+		} else {
+			fmt.Fprintf(os.Stderr, "job %s done\n", job.ID)
+		}
+	}
+}
+
+// runDaemonClient implements the submit and status subcommands of the daemon.
+func runDaemonClient(q jobQueue, sub string, args []string) error {
+	switch sub {
+	case "submit":
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, daemonUsage)
+			return errors.New("expected the arguments of the job")
+		}
+		job, err := q.submit(args)
+		if err != nil {
+			return err
+		}
+		fmt.Println(job.ID)
+		return nil
+	case "status":
+		if len(args) == 0 {
+			return printJobs(q)
+		}
+		job, err := q.find(args[0])
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(job, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	default:
+		panic("unexpected")
+	}
+}
+
+// runJob runs the job by invoking benchdiff with the daemon's arguments and the
+// job's, logging its output in the queue and writing its comparison there as
+// JSON.
+func runJob(ctx context.Context, q jobQueue, self string, daemonArgs []string, job *daemonJob) error {
+	now := time.Now().UTC()
+	job.Started = &now
+	job.Log = filepath.Join(q.dir, "logs", job.ID+".log")
+	job.Results = filepath.Join(q.dir, "results", job.ID+".json")
+	if err := q.write(*job); err != nil {
+		return err
+	}
+	log, err := os.Create(job.Log)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	fmt.Fprintf(os.Stderr, "running job %s: benchdiff %s\n", job.ID, strings.Join(job.Args, " "))
+
+	args := withFlags(append(append([]string(nil), daemonArgs...), job.Args...),
+		"--format=json:"+job.Results)
+	cmd := exec.Command(self, args...)
+	// Jobs can't prompt for confirmation.
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = nil, log, log
+	if err := runInterruptible(ctx, cmd); err != nil {
+		return errors.Errorf("%s (see %s)", err, job.Log)
+	}
+	return nil
+}
+
+// runInterruptible runs the command, an invocation of benchdiff, and interrupts
+// rather than kills it when the context is canceled, so that it cleans up,
+// e.g. releases the build worktree and records its progress, before exiting.
+func runInterruptible(ctx context.Context, cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = cmd.Process.Signal(os.Interrupt)
+		case <-done:
+		}
+	}()
+	return cmd.Wait()
+}
+
+// withFlags returns the arguments with the flags added, before any terminating
+// "--". Flags that are passed later override earlier ones.
+func withFlags(args []string, flags ...string) []string {
+	for i, a := range args {
+		if a == "--" {
+			return append(append(args[:i:i], flags...), args[i:]...)
+		}
+	}
+	return append(args, flags...)
+}
+
+// printJobs lists the jobs of the queue in each state.
+func printJobs(q jobQueue) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "id\tstate\tsubmitted\targs")
+	for _, state := range jobStates {
+		jobs, err := q.list(state)
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", job.ID, state,
+				job.Submitted.Local().Format(localTimeFormat), strings.Join(job.Args, " "))
+		}
+	}
+	return tw.Flush()
+}
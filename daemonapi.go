@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// jobAPI serves the daemon's HTTP API, which lets CI and chatops bots submit
+// jobs to a central benchmark machine and query them:
+//
+//	POST /runs               submit a job, with a body of {"args": [...]}
+//	GET  /runs               list the jobs
+//	GET  /runs/<id>          get the record of a job, including its state
+//	GET  /runs/<id>/results  get the comparison of a finished job, as JSON
+//	GET  /runs/<id>/log      get the output of a job
+//
+// Requests must carry the token as a bearer token.
+type jobAPI struct {
+	q     jobQueue
+	token string
+	// wake is signaled when a job is submitted, so that the daemon picks it
+	// up without waiting for its next poll.
+	wake chan<- struct{}
+}
+
+// jobID matches valid job ids, which are used in paths.
+var jobID = regexp.MustCompile(`^[\w-]+$`)
+
+// maxSubmitBody is the maximum size of the body of a submit request.
+const maxSubmitBody = 1 << 20
+
+// serveJobAPI serves the API on the address until the context is canceled.
+func serveJobAPI(ctx context.Context, addr string, api *jobAPI) error {
+	srv := &http.Server{Addr: addr, Handler: api}
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.ListenAndServe() }()
+	fmt.Fprintf(os.Stderr, "serving the API on %s\n", addr)
+	select {
+	case err := <-errCh:
+		return errors.Wrap(err, "serving the API")
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+}
+
+func (api *jobAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if api.token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(api.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "runs" || len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		api.submit(w, r)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		api.list(w)
+	case len(parts) > 1 && r.Method == http.MethodGet:
+		if !jobID.MatchString(parts[1]) {
+			http.NotFound(w, r)
+			return
+		}
+		job, err := api.q.find(parts[1])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if len(parts) == 2 {
+			writeJSON(w, http.StatusOK, job)
+			return
+		}
+		switch parts[2] {
+		case "results":
+			if job.State != jobDone {
+				http.Error(w, fmt.Sprintf("job %s is %s", job.ID, job.State), http.StatusConflict)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			serveJobFile(w, job.Results)
+		case "log":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			serveJobFile(w, job.Log)
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (api *jobAPI) submit(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Args []string `json:"args"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxSubmitBody)).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Args) == 0 {
+		http.Error(w, "expected the arguments of the job", http.StatusBadRequest)
+		return
+	}
+	job, err := api.q.submit(req.Args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	select {
+	case api.wake <- struct{}{}:
+	default:
+	}
+	w.Header().Set("Location", "/runs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func (api *jobAPI) list(w http.ResponseWriter) {
+	jobs := []daemonJob{}
+	for _, state := range jobStates {
+		js, err := api.q.list(state)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jobs = append(jobs, js...)
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(data, '\n'))
+}
+
+// serveJobFile writes the contents of the file, which was written by a job.
+func serveJobFile(w http.ResponseWriter, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) || path == "" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	_, _ = io.Copy(w, f)
+}
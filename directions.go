@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// directions maps units, or the metrics that benchstat names after them (e.g.
+// time/op for ns/op), to whether larger values are better, overriding the
+// default: larger is better for throughputs, i.e. MB/s (benchstat's speed)
+// and custom units ending in /s like ops/s, and smaller is better otherwise.
+// The direction decides which changes are improvements and regressions, and
+// thereby the order of rows, the coloring of the html and sheets outputs, and
+// which rows fail --threshold. See --direction. A nil directions applies the
+// defaults.
+type directions map[string]bool
+
+// parseDirections parses the --direction values, each of the form
+// <unit>=higher or <unit>=lower.
+func parseDirections(specs []string) (directions, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	d := make(directions)
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, "=")
+		if i <= 0 {
+			return nil, errors.Errorf("invalid --direction %q: must be <unit>=higher or <unit>=lower", spec)
+		}
+		switch spec[i+1:] {
+		case "higher":
+			d[spec[:i]] = true
+		case "lower":
+			d[spec[:i]] = false
+		default:
+			return nil, errors.Errorf("invalid --direction %q: must be <unit>=higher or <unit>=lower", spec)
+		}
+	}
+	return d, nil
+}
+
+// higherIsBetter returns whether larger values are better for the metric of
+// the table.
+func (d directions) higherIsBetter(t *benchstat.Table) bool {
+	if better, ok := d[t.Metric]; ok {
+		return better
+	}
+	if len(t.Rows) > 0 && len(t.Rows[0].Metrics) > 0 {
+		if better, ok := d[t.Rows[0].Metrics[0].Unit]; ok {
+			return better
+		}
+	}
+	return t.Metric == "speed" || strings.HasSuffix(t.Metric, "/s")
+}
+
+// orient fixes the direction of the changes in the tables whose direction
+// differs from benchstat's, which only considers speed (MB/s) better when
+// larger, and re-sorts those tables by the order.
+func (d directions) orient(tables []*benchstat.Table, order benchstat.Order) {
+	for _, t := range tables {
+		if d.higherIsBetter(t) == (t.Metric == "speed") {
+			continue
+		}
+		for _, row := range t.Rows {
+			row.Change = -row.Change
+		}
+		if order != nil {
+			benchstat.Sort(t, order)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// cliffsDelta returns Cliff's delta of the new samples over the old: the
+// probability that a new sample is greater than an old one, minus the
+// probability that it is smaller. It ranges from -1 (every new sample is
+// smaller) to +1 (every new sample is greater), regardless of the size of the
+// delta in percent, and so measures how consistently the benchmark changed.
+func cliffsDelta(old, new *benchstat.Metrics) (float64, bool) {
+	if len(old.RValues) == 0 || len(new.RValues) == 0 {
+		return 0, false
+	}
+	var dominance int
+	for _, n := range new.RValues {
+		for _, o := range old.RValues {
+			switch {
+			case n > o:
+				dominance++
+			case n < o:
+				dominance--
+			}
+		}
+	}
+	return float64(dominance) / float64(len(old.RValues)*len(new.RValues)), true
+}
+
+// effectMagnitude returns the conventional label of the magnitude of a
+// Cliff's delta.
+func effectMagnitude(d float64) string {
+	switch d = math.Abs(d); {
+	case d < 0.147:
+		return "negligible"
+	case d < 0.33:
+		return "small"
+	case d < 0.474:
+		return "medium"
+	default:
+		return "large"
+	}
+}
+
+// rowEffect returns Cliff's delta of the row.
+func rowEffect(row *benchstat.Row) (float64, bool) {
+	if len(row.Metrics) != 2 {
+		return 0, false
+	}
+	return cliffsDelta(row.Metrics[0], row.Metrics[1])
+}
+
+// markEffectSizes annotates the note of each row with its effect size.
+func markEffectSizes(tables []*benchstat.Table) {
+	for _, table := range tables {
+		for _, row := range table.Rows {
+			if d, ok := rowEffect(row); ok && !strings.HasPrefix(row.Note, "(all equal)") {
+				row.Note = strings.TrimSpace(fmt.Sprintf("%s [δ=%+.2f %s]", row.Note, d, effectMagnitude(d)))
+			}
+		}
+	}
+}
+
+// meetsMinEffect returns whether the row's effect size is at least the
+// minimum, which is met by any row if 0.
+func meetsMinEffect(row *benchstat.Row, minEffect float64) bool {
+	if minEffect == 0 {
+		return true
+	}
+	d, ok := rowEffect(row)
+	return ok && math.Abs(d) >= minEffect
+}
+
+// byEffect orders the rows of a table by the magnitude of their effect size,
+// largest first.
+func byEffect(t *benchstat.Table, i, j int) bool {
+	di, _ := rowEffect(t.Rows[i])
+	dj, _ := rowEffect(t.Rows[j])
+	if math.Abs(di) != math.Abs(dj) {
+		return math.Abs(di) > math.Abs(dj)
+	}
+	return t.Rows[i].Benchmark < t.Rows[j].Benchmark
+}
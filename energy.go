@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// raplDir is the directory in which the Linux powercap framework exposes the
+// RAPL (Running Average Power Limit) energy counters.
+const raplDir = "/sys/class/powercap"
+
+// raplZone is a top-level RAPL zone, typically a CPU package.
+type raplZone struct {
+	dir      string
+	maxRange uint64 // the counter wraps around at this value
+}
+
+// raplZones returns the top-level RAPL zones of the host. Sub-zones (e.g. the
+// cores or DRAM of a package) are excluded, as their energy is included in
+// their parent zone.
+func raplZones() ([]raplZone, error) {
+	dirs, err := filepath.Glob(filepath.Join(raplDir, "intel-rapl:*"))
+	if err != nil {
+		return nil, err
+	}
+	var zones []raplZone
+	for _, d := range dirs {
+		if strings.Count(filepath.Base(d), ":") != 1 {
+			continue
+		}
+		max, err := readCounter(filepath.Join(d, "max_energy_range_uj"))
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, raplZone{dir: d, maxRange: max})
+	}
+	if len(zones) == 0 {
+		return nil, errors.Errorf("no RAPL energy counters found in %s", raplDir)
+	}
+	return zones, nil
+}
+
+// readCounter reads an integer counter from a sysfs file.
+func readCounter(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// energySample is a reading of the energy counters of all RAPL zones.
+type energySample struct {
+	t        time.Time
+	counters []uint64 // in microjoules
+}
+
+// sampleEnergy reads the energy counters of the zones.
+func sampleEnergy(zones []raplZone) (energySample, error) {
+	s := energySample{t: time.Now(), counters: make([]uint64, len(zones))}
+	for i, z := range zones {
+		v, err := readCounter(filepath.Join(z.dir, "energy_uj"))
+		if err != nil {
+			return s, errors.Wrap(err, "reading RAPL energy counter")
+		}
+		s.counters[i] = v
+	}
+	return s, nil
+}
+
+// energyMetrics returns the energy consumed by all zones between the two
+// samples, in joules, and the average power draw, in watts. The counters
+// measure the whole host, not just the benchmark process, so measurements are
+// only meaningful on an otherwise idle machine.
+func energyMetrics(zones []raplZone, start, end energySample) map[string]float64 {
+	var uj uint64
+	for i, z := range zones {
+		if end.counters[i] >= start.counters[i] {
+			uj += end.counters[i] - start.counters[i]
+		} else {
+			uj += z.maxRange - start.counters[i] + end.counters[i]
+		}
+	}
+	joules := float64(uj) / 1e6
+	metrics := map[string]float64{"J": joules}
+	if secs := end.t.Sub(start.t).Seconds(); secs > 0 {
+		metrics["W"] = joules / secs
+	}
+	return metrics
+}
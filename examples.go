@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// exampleUnit is the unit under which the wall time of testable examples is
+// reported with --examples. It differs from ns/op so that examples are
+// compared in their own table, apart from the benchmarks.
+const exampleUnit = "ns/example"
+
+// exampleNote labels the rows of examples in the comparison.
+const exampleNote = "[example, low precision]"
+
+// runExamples implements --examples. It runs each testable example of the test
+// binary matching the run pattern, with -test.run, for as many runs as fit in
+// the benchtime, and writes the wall time per run, less the startup cost of
+// the binary, to the suite's output as a benchmark result named after the
+// example. This gives coarse end-to-end timings for packages whose
+// performance-sensitive paths have examples but no benchmarks. The timings
+// include the capture and comparison of the example's output and the test
+// framework's overhead, so they are far less precise than benchmarks.
+func runExamples(ctx context.Context, bs *benchSuite, test string, opts benchOpts) error {
+	bin := bs.getTestBinary(test)
+	out, err := bs.captureTest(ctx, bin, "-test.list", "^Example")
+	if err != nil {
+		return errors.Wrapf(err, "listing examples of %s", test)
+	}
+	match, err := regexp.Compile(opts.runPattern)
+	if err != nil {
+		return errors.Wrap(err, "invalid run pattern")
+	}
+	var examples []string
+	for _, e := range strings.Fields(out) {
+		if strings.HasPrefix(e, "Example") && match.MatchString(e) {
+			examples = append(examples, e)
+		}
+	}
+	if len(examples) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(bs.outFile, "pkg: %s\n", testBinToPkg(test)); err != nil {
+		return err
+	}
+
+	startup, err := bs.timeTest(ctx, bin, "-test.run", "^$")
+	if err != nil {
+		return err
+	}
+	count := opts.count
+	if count < 1 {
+		count = 1
+	}
+	for _, example := range examples {
+		run := "^" + example + "$"
+		runs, err := timedPasses(ctx, bs, bin, run, opts.benchTime, startup)
+		if err != nil {
+			bs.triage.record(stageRun, bs, test, opts.iter, fmt.Sprintf("%s: %s", example, err))
+			if opts.tolerateCrash {
+				continue
+			}
+			return errors.Wrapf(err, "running %s", example)
+		}
+		for i := 0; i < count; i++ {
+			wall, err := bs.timeTest(ctx, bin, "-test.run", run, "-test.count", strconv.Itoa(runs))
+			if err != nil {
+				return errors.Wrapf(err, "running %s", example)
+			}
+			perRun := float64(wall-startup) / float64(runs)
+			if perRun <= 0 {
+				perRun = float64(wall) / float64(runs)
+			}
+			_, err = fmt.Fprintf(bs.outFile, "Benchmark%s \t%d\t%.0f %s\n", example, runs, perRun, exampleUnit)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// markExampleRows annotates the note of each row of examples, so that their
+// low precision is visible in the report.
+func markExampleRows(tables []*benchstat.Table) {
+	for _, table := range tables {
+		if table.Metric != exampleUnit {
+			continue
+		}
+		for _, row := range table.Rows {
+			row.Note = strings.TrimSpace(row.Note + " " + exampleNote)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"os"
 	"os/exec"
@@ -11,15 +12,26 @@ import (
 
 // capture executes the command specified by args and returns its stdout. If
 // the process exits with a failing exit code, capture instead returns an error
-// which includes the process's stderr.
-func capture(args ...string) (string, error) {
+// which includes the process's stderr. The process is killed if the context is
+// canceled.
+func capture(ctx context.Context, args ...string) (string, error) {
+	return captureWithEnv(ctx, nil, args...)
+}
+
+// captureWithEnv is like capture, but sets the environment variables, in
+// KEY=VALUE form, in the process's environment in addition to the current
+// process's.
+func captureWithEnv(ctx context.Context, env []string, args ...string) (string, error) {
 	var cmd *exec.Cmd
 	if len(args) == 0 {
 		panic("capture called with no arguments")
 	} else if len(args) == 1 {
-		cmd = exec.Command(args[0])
+		cmd = exec.CommandContext(ctx, args[0])
 	} else {
-		cmd = exec.Command(args[0], args[1:]...)
+		cmd = exec.CommandContext(ctx, args[0], args[1:]...)
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
 	out, err := cmd.Output()
 	if err != nil {
@@ -35,24 +47,25 @@ func capture(args ...string) (string, error) {
 // current processes's stdin, stdout, and stderr streams. If the process exits
 // with a failing exit code, run returns a generic "process exited with
 // status..." error, as the process has likely written an error message to
-// stderr.
-func spawn(args ...string) error {
-	return spawnWith(os.Stdin, os.Stdout, os.Stderr, args...)
+// stderr. The process is killed if the context is canceled.
+func spawn(ctx context.Context, args ...string) error {
+	return spawnWith(ctx, os.Stdin, os.Stdout, os.Stderr, args...)
 }
 
 // spawnWith executes the command specified by args using the provided reader
 // and writers for process I/O. The subprocess inherits the current processes's
 // stdin, stdout, and stderr streams. If the process exits with a failing exit
 // code, run returns a generic "process exited with status..." error, as the
-// process has likely written an error message to stderr.
-func spawnWith(in io.Reader, out, err io.Writer, args ...string) error {
+// process has likely written an error message to stderr. The process is killed
+// if the context is canceled.
+func spawnWith(ctx context.Context, in io.Reader, out, err io.Writer, args ...string) error {
 	var cmd *exec.Cmd
 	if len(args) == 0 {
 		panic("spawn called with no arguments")
 	} else if len(args) == 1 {
-		cmd = exec.Command(args[0])
+		cmd = exec.CommandContext(ctx, args[0])
 	} else {
-		cmd = exec.Command(args[0], args[1:]...)
+		cmd = exec.CommandContext(ctx, args[0], args[1:]...)
 	}
 	cmd.Stdin = in
 	cmd.Stdout = out
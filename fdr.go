@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// fdrNote labels the rows whose deltas are significant on their own, but not
+// after controlling the false discovery rate.
+const fdrNote = "[not significant at FDR]"
+
+// controlFDR demotes the significant deltas of the tables that don't survive
+// the Benjamini-Hochberg procedure at false discovery rate q, applied across
+// the rows of all tables. Testing thousands of benchmarks at p < 0.05 flags
+// dozens by chance alone; the procedure bounds the expected fraction of
+// flagged deltas that are such false discoveries to q.
+func controlFDR(tables []*benchstat.Table, test benchstat.DeltaTest, q float64) {
+	type rowTest struct {
+		row *benchstat.Row
+		p   float64
+	}
+	var tests []rowTest
+	for _, table := range tables {
+		if !table.OldNewDelta {
+			continue
+		}
+		for _, row := range table.Rows {
+			if len(row.Metrics) != 2 {
+				continue
+			}
+			p, err := test(row.Metrics[0], row.Metrics[1])
+			if err != nil || p < 0 {
+				continue
+			}
+			tests = append(tests, rowTest{row: row, p: p})
+		}
+	}
+	sort.Slice(tests, func(i, j int) bool { return tests[i].p < tests[j].p })
+	ps := make([]float64, len(tests))
+	for i, t := range tests {
+		ps[i] = t.p
+	}
+	for _, t := range tests[bhCutoff(ps, q):] {
+		if t.row.Delta == "~" {
+			continue
+		}
+		t.row.Delta = "~"
+		t.row.PctDelta = 0
+		t.row.Change = 0
+		t.row.Note = strings.TrimSpace(t.row.Note + " " + fdrNote)
+	}
+}
+
+// bhCutoff returns the number k of the sorted p-values whose hypotheses the
+// Benjamini-Hochberg procedure rejects at false discovery rate q: the largest
+// rank k whose p-value is at most k/m*q.
+func bhCutoff(ps []float64, q float64) int {
+	m := float64(len(ps))
+	k := 0
+	for i, p := range ps {
+		if p <= float64(i+1)/m*q {
+			k = i + 1
+		}
+	}
+	return k
+}
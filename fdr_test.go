@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/perf/benchstat"
+)
+
+func TestBHCutoff(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ps   []float64
+		q    float64
+		want int
+	}{
+		{"m=0", nil, 0.05, 0},
+		{"none", []float64{0.2, 0.5, 0.9}, 0.05, 0},
+		{"all significant", []float64{0.001, 0.01, 0.02, 0.03}, 0.05, 4},
+		// The thresholds k/m*q are 0.005, 0.01, ..., 0.05. Ranks 4 and 5 fail
+		// (0.039 > 0.02, 0.041 > 0.025), as do all later ones.
+		{"cut-off", []float64{0.001, 0.008, 0.012, 0.039, 0.041, 0.2, 0.3, 0.5, 0.7, 0.9}, 0.05, 3},
+		// A passing rank rejects all smaller ranks, even failing ones.
+		{"step-up", []float64{0.02, 0.025, 0.03}, 0.05, 3},
+		{"single", []float64{0.04}, 0.05, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := bhCutoff(tc.ps, tc.q); got != tc.want {
+				t.Errorf("bhCutoff(%v, %g) = %d, want %d", tc.ps, tc.q, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestControlFDR(t *testing.T) {
+	row := func(name string, p float64) *benchstat.Row {
+		return &benchstat.Row{
+			Benchmark: name,
+			Metrics:   []*benchstat.Metrics{{Mean: p}, {}},
+			Delta:     "+10.00%",
+			PctDelta:  10,
+			Change:    -1,
+		}
+	}
+	// The test returns the p-value stashed in the old mean.
+	test := func(old, new *benchstat.Metrics) (float64, error) { return old.Mean, nil }
+	rows := []*benchstat.Row{row("A", 0.001), row("B", 0.04), row("C", 0.5)}
+	tables := []*benchstat.Table{{OldNewDelta: true, Rows: rows}}
+	controlFDR(tables, test, 0.05)
+	if rows[0].Change != -1 {
+		t.Errorf("A was demoted")
+	}
+	if rows[1].Change != 0 || rows[1].Delta != "~" || rows[1].Note != fdrNote {
+		t.Errorf("B wasn't demoted: %+v", rows[1])
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fuzzSeedsUnit is the unit under which the throughput of fuzz targets is
+// reported with --fuzz-seeds. Time per execution is reported, rather than
+// executions per second, so that benchstat treats smaller values as better.
+const fuzzSeedsUnit = "ns/exec"
+
+// maxTimedPasses caps the number of passes over the seed corpus of a fuzz
+// target, or of runs of an example, per sample.
+const maxTimedPasses = 1 << 20
+
+// runFuzzSeeds implements --fuzz-seeds. Instead of running the test binary's
+// benchmarks, it runs the seed corpus (the inputs added with F.Add and those
+// in testdata/fuzz) of each fuzz target matching the run pattern, without
+// fuzzing, for as many passes as fit in the benchtime. The time per execution
+// of the fuzz function is written to the suite's output as a benchmark result
+// named after the fuzz target, along with the executions per second.
+func runFuzzSeeds(ctx context.Context, bs *benchSuite, test string, opts benchOpts) error {
+	bin := bs.getTestBinary(test)
+	out, err := bs.captureTest(ctx, bin, "-test.list", "^Fuzz")
+	if err != nil {
+		return errors.Wrapf(err, "listing fuzz targets of %s", test)
+	}
+	match, err := regexp.Compile(opts.runPattern)
+	if err != nil {
+		return errors.Wrap(err, "invalid run pattern")
+	}
+	var targets []string
+	for _, t := range strings.Fields(out) {
+		if strings.HasPrefix(t, "Fuzz") && match.MatchString(strings.TrimPrefix(t, "Fuzz")) {
+			targets = append(targets, t)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(bs.outFile, "pkg: %s\n", testBinToPkg(test)); err != nil {
+		return err
+	}
+
+	// Measure the startup cost of the binary, which is subtracted from each
+	// measurement.
+	startup, err := bs.timeTest(ctx, bin, "-test.run", "^$")
+	if err != nil {
+		return err
+	}
+	count := opts.count
+	if count < 1 {
+		count = 1
+	}
+	for _, target := range targets {
+		run := "^" + target + "$"
+		// A first pass determines the number of seed inputs and the number
+		// of passes that fit in the benchtime.
+		out, err := bs.captureTest(ctx, bin, "-test.run", run, "-test.v")
+		if err != nil {
+			bs.triage.record(stageRun, bs, test, opts.iter, fmt.Sprintf("%s: %s", target, err))
+			if opts.tolerateCrash {
+				continue
+			}
+			return errors.Wrapf(err, "running seed corpus of %s", target)
+		}
+		inputs := strings.Count(out, "=== RUN   "+target+"/")
+		if inputs == 0 {
+			continue
+		}
+		passes, err := timedPasses(ctx, bs, bin, run, opts.benchTime, startup)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			wall, err := bs.timeTest(ctx, bin, "-test.run", run, "-test.count", strconv.Itoa(passes))
+			if err != nil {
+				return errors.Wrapf(err, "running seed corpus of %s", target)
+			}
+			execs := inputs * passes
+			perExec := float64(wall-startup) / float64(execs)
+			if perExec <= 0 {
+				perExec = float64(wall) / float64(execs)
+			}
+			_, err = fmt.Fprintf(bs.outFile, "Benchmark%s \t%d\t%.2f %s\t%.0f execs/sec\n",
+				target, execs, perExec, fuzzSeedsUnit, 1e9/perExec)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// timedPasses returns the number of runs of the tests matching the run pattern
+// (e.g. passes over the seed corpus of a fuzz target) that fit in the
+// benchtime, which is either a duration or a number of runs (e.g. 100x).
+func timedPasses(ctx context.Context, bs *benchSuite, bin, run, benchTime string, startup time.Duration) (int, error) {
+	if benchTime == "" {
+		benchTime = "1s"
+	}
+	if strings.HasSuffix(benchTime, "x") {
+		n, err := strconv.Atoi(strings.TrimSuffix(benchTime, "x"))
+		if err != nil || n < 1 {
+			return 0, errors.Errorf("invalid benchtime %q", benchTime)
+		}
+		return n, nil
+	}
+	target, err := time.ParseDuration(benchTime)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid benchtime %q", benchTime)
+	}
+	wall, err := bs.timeTest(ctx, bin, "-test.run", run)
+	if err != nil {
+		return 0, err
+	}
+	pass := wall - startup
+	if pass <= 0 {
+		pass = time.Microsecond
+	}
+	n := int(target / pass)
+	switch {
+	case n < 1:
+		n = 1
+	case n > maxTimedPasses:
+		n = maxTimedPasses
+	}
+	return n, nil
+}
+
+// captureTest runs the test binary with the arguments, through the suite's
+// launch prefix and on its host, and returns its output.
+func (bs *benchSuite) captureTest(ctx context.Context, bin string, args ...string) (string, error) {
+	return capture(ctx, bs.remoteCommand(append([]string{bin}, args...), bs.env...)...)
+}
+
+// timeTest runs the test binary like captureTest and returns its wall time.
+func (bs *benchSuite) timeTest(ctx context.Context, bin string, args ...string) (time.Duration, error) {
+	cmdArgs := bs.remoteCommand(append([]string{bin}, args...), bs.env...)
+	start := time.Now()
+	if out, err := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...).CombinedOutput(); err != nil {
+		return 0, errors.Wrapf(err, "running %s: %s", bin, out)
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// generateStep regenerates the generated code of a ref after it is checked
+// out, such as protobuf or stringer output that isn't committed, but only if
+// it is stale, as generation is often much slower than the build itself. See
+// --generate.
+type generateStep struct {
+	// check is the command that verifies that the generated code is up to
+	// date, by exiting with a failing code if it isn't. If empty, the code is
+	// considered stale if the packages don't build.
+	check    string
+	generate string
+}
+
+// checkArgs returns the arguments of the staleness check of the packages.
+func (g *generateStep) checkArgs(pkgFilter []string) []string {
+	if g.check != "" {
+		return strings.Split(g.check, " ")
+	}
+	return append([]string{"go", "build"}, pkgFilter...)
+}
+
+// run runs the generation step for the ref with generate if the staleness
+// check, run with check, fails.
+func (g *generateStep) run(ref string, pkgFilter []string, check, generate func(args ...string) error) error {
+	if g == nil {
+		return nil
+	}
+	if err := check(g.checkArgs(pkgFilter)...); err == nil {
+		fmt.Fprintf(os.Stderr, "generated code of %s is up to date\n", ref)
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "generated code of %s is stale; running %s\n", ref, g.generate)
+	if err := generate(strings.Split(g.generate, " ")...); err != nil {
+		return errors.Wrap(err, "generate")
+	}
+	return nil
+}
+
+// runLocal runs the generation step for the ref, checked out in the working
+// directory, if needed. The commands get the secrets, like the post-checkout
+// command. The output of the check is discarded, while that of the generation
+// step goes to stderr.
+func (g *generateStep) runLocal(ctx context.Context, ref string, pkgFilter []string, secrets *hookSecrets) error {
+	check := func(args ...string) error {
+		var out bytes.Buffer
+		return secrets.run(ctx, nil, &out, &out, args...)
+	}
+	generate := func(args ...string) error {
+		return secrets.run(ctx, os.Stdin, os.Stderr, os.Stderr, args...)
+	}
+	return g.run(ref, pkgFilter, check, generate)
+}
+
+// runRemote runs the generation step for the ref, checked out in the
+// directory on the build host, if needed.
+func (g *generateStep) runRemote(
+	ctx context.Context, host, dir, ref string, pkgFilter []string, secrets *hookSecrets,
+) error {
+	remote := func(args ...string) error {
+		return secrets.remoteRun(ctx, host, dir, args...)
+	}
+	return g.run(ref, pkgFilter, remote, remote)
+}
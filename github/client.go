@@ -0,0 +1,283 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxAnnotations is the maximum number of annotations that the GitHub Checks
+// API accepts in a single request.
+const maxAnnotations = 50
+
+// Client is capable of communicating with the GitHub Checks API to report
+// benchmark comparisons on commits, and with the GitHub Issues API to file
+// regressions.
+//
+// The client is configured using the same environment variables that GitHub
+// Actions sets: GITHUB_TOKEN, GITHUB_REPOSITORY (owner/repo), and optionally
+// GITHUB_API_URL.
+type Client struct {
+	token string
+	repo  string
+	base  string
+	http  *http.Client
+}
+
+// New creates a new Client from the environment. It returns an error if the
+// environment is not properly configured.
+func New() (*Client, error) {
+	c := Client{
+		token: os.Getenv("GITHUB_TOKEN"),
+		repo:  os.Getenv("GITHUB_REPOSITORY"),
+		base:  os.Getenv("GITHUB_API_URL"),
+		http:  http.DefaultClient,
+	}
+	if c.token == "" {
+		return nil, errors.New("GITHUB_TOKEN not set")
+	}
+	if strings.Count(c.repo, "/") != 1 {
+		return nil, errors.Errorf("GITHUB_REPOSITORY must be set to owner/repo, found %q", c.repo)
+	}
+	if c.base == "" {
+		c.base = "https://api.github.com"
+	}
+	return &c, nil
+}
+
+// Annotation points at a line range of a file in the check run's commit.
+type Annotation struct {
+	Path      string `json:"path"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	Level     string `json:"annotation_level"` // notice, warning, or failure
+	Title     string `json:"title,omitempty"`
+	Message   string `json:"message"`
+}
+
+// CheckRun is a completed check run on a commit.
+type CheckRun struct {
+	Name        string
+	HeadSHA     string
+	Conclusion  string // success, neutral, or failure
+	Title       string
+	Summary     string
+	Text        string
+	Annotations []Annotation
+}
+
+type checkRunOutput struct {
+	Title       string       `json:"title"`
+	Summary     string       `json:"summary"`
+	Text        string       `json:"text,omitempty"`
+	Annotations []Annotation `json:"annotations,omitempty"`
+}
+
+type checkRunRequest struct {
+	Name       string         `json:"name,omitempty"`
+	HeadSHA    string         `json:"head_sha,omitempty"`
+	Status     string         `json:"status,omitempty"`
+	Conclusion string         `json:"conclusion,omitempty"`
+	Output     checkRunOutput `json:"output"`
+}
+
+type checkRunResponse struct {
+	ID      int64  `json:"id"`
+	HTMLURL string `json:"html_url"`
+}
+
+// CreateCheckRun creates the check run and returns its URL. Annotations beyond
+// the per-request limit are added by updating the check run.
+func (c *Client) CreateCheckRun(ctx context.Context, run CheckRun) (string, error) {
+	anns := run.Annotations
+	batch := func() []Annotation {
+		n := len(anns)
+		if n > maxAnnotations {
+			n = maxAnnotations
+		}
+		b := anns[:n]
+		anns = anns[n:]
+		return b
+	}
+	output := checkRunOutput{Title: run.Title, Summary: run.Summary, Text: run.Text}
+
+	output.Annotations = batch()
+	var resp checkRunResponse
+	err := c.do(ctx, "POST", fmt.Sprintf("/repos/%s/check-runs", c.repo), checkRunRequest{
+		Name:       run.Name,
+		HeadSHA:    run.HeadSHA,
+		Status:     "completed",
+		Conclusion: run.Conclusion,
+		Output:     output,
+	}, &resp)
+	if err != nil {
+		return "", errors.Wrap(err, "creating check run")
+	}
+	for len(anns) > 0 {
+		output.Annotations = batch()
+		err := c.do(ctx, "PATCH", fmt.Sprintf("/repos/%s/check-runs/%d", c.repo, resp.ID),
+			checkRunRequest{Output: output}, nil)
+		if err != nil {
+			return "", errors.Wrap(err, "adding check run annotations")
+		}
+	}
+	return resp.HTMLURL, nil
+}
+
+// Issue is a GitHub issue.
+type Issue struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	HTMLURL string `json:"html_url"`
+}
+
+// FindOpenIssue returns the open issue with exactly the provided title, if
+// one exists.
+func (c *Client) FindOpenIssue(ctx context.Context, title string) (*Issue, error) {
+	q := fmt.Sprintf("repo:%s is:issue is:open in:title %q", c.repo, title)
+	var res struct {
+		Items []Issue `json:"items"`
+	}
+	if err := c.do(ctx, "GET", "/search/issues?q="+url.QueryEscape(q), nil, &res); err != nil {
+		return nil, errors.Wrap(err, "searching issues")
+	}
+	for i := range res.Items {
+		if res.Items[i].Title == title {
+			return &res.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// CreateIssue files a new issue with the provided labels.
+func (c *Client) CreateIssue(ctx context.Context, title, body string, labels []string) (*Issue, error) {
+	req := struct {
+		Title  string   `json:"title"`
+		Body   string   `json:"body"`
+		Labels []string `json:"labels,omitempty"`
+	}{title, body, labels}
+	var res Issue
+	if err := c.do(ctx, "POST", fmt.Sprintf("/repos/%s/issues", c.repo), req, &res); err != nil {
+		return nil, errors.Wrap(err, "creating issue")
+	}
+	return &res, nil
+}
+
+// CommentOnIssue adds a comment to an existing issue.
+func (c *Client) CommentOnIssue(ctx context.Context, number int, body string) error {
+	req := struct {
+		Body string `json:"body"`
+	}{body}
+	err := c.do(ctx, "POST", fmt.Sprintf("/repos/%s/issues/%d/comments", c.repo, number), req, nil)
+	return errors.Wrap(err, "commenting on issue")
+}
+
+// Comment is a comment on an issue or pull request.
+type Comment struct {
+	ID                int64     `json:"id"`
+	Body              string    `json:"body"`
+	HTMLURL           string    `json:"html_url"`
+	IssueURL          string    `json:"issue_url"`
+	AuthorAssociation string    `json:"author_association"`
+	CreatedAt         time.Time `json:"created_at"`
+	User              struct {
+		Login string `json:"login"`
+	} `json:"user"`
+}
+
+// IssueNumber returns the number of the issue or pull request that the comment
+// is on.
+func (c *Comment) IssueNumber() int {
+	n, _ := strconv.Atoi(c.IssueURL[strings.LastIndex(c.IssueURL, "/")+1:])
+	return n
+}
+
+// ListComments returns the comments on the repository's issues and pull
+// requests created or updated since the provided time, oldest first.
+func (c *Client) ListComments(ctx context.Context, since time.Time) ([]Comment, error) {
+	var res []Comment
+	for page := 1; ; page++ {
+		path := fmt.Sprintf("/repos/%s/issues/comments?sort=created&direction=asc&per_page=100&page=%d&since=%s",
+			c.repo, page, url.QueryEscape(since.UTC().Format(time.RFC3339)))
+		var batch []Comment
+		if err := c.do(ctx, "GET", path, nil, &batch); err != nil {
+			return nil, errors.Wrap(err, "listing comments")
+		}
+		res = append(res, batch...)
+		if len(batch) < 100 {
+			return res, nil
+		}
+	}
+}
+
+// PullRequest is a GitHub pull request.
+type PullRequest struct {
+	Number int `json:"number"`
+	Head   struct {
+		SHA string `json:"sha"`
+	} `json:"head"`
+	Base struct {
+		SHA string `json:"sha"`
+		Ref string `json:"ref"`
+	} `json:"base"`
+}
+
+// GetPullRequest returns the pull request with the number, or nil if there is
+// none, e.g. because the number is that of an issue.
+func (c *Client) GetPullRequest(ctx context.Context, number int) (*PullRequest, error) {
+	var res PullRequest
+	err := c.do(ctx, "GET", fmt.Sprintf("/repos/%s/pulls/%d", c.repo, number), nil, &res)
+	if err != nil {
+		if strings.Contains(err.Error(), "404") {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "getting pull request")
+	}
+	return &res, nil
+}
+
+// do sends a request with the JSON-encoded body, if not nil, to the API and
+// decodes the response into res, if not nil.
+func (c *Client) do(ctx context.Context, method, path string, body, res interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.base+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "token "+c.token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(data))
+	}
+	if res == nil {
+		return nil
+	}
+	return json.Unmarshal(data, res)
+}
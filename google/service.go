@@ -24,6 +24,11 @@ import (
 type Service struct {
 	drive  *drive.Service
 	sheets *sheets.Service
+
+	// SmallerBetter returns whether smaller values are better for the metric
+	// of a table, which decides the colors of deltas. If nil, smaller is
+	// better except for speeds.
+	SmallerBetter func(*benchstat.Table) bool
 }
 
 // New creates a new Service. It verifies that credentials are properly set and
@@ -183,7 +188,7 @@ func (srv *Service) createRawSheet(t *benchstat.Table, tIdx int) (*sheets.Sheet,
 	}
 
 	// Conditional formatting.
-	cf := condFormatting(sheetID, info.deltaCol, isSmallerBetter(t))
+	cf := condFormatting(sheetID, info.deltaCol, srv.isSmallerBetter(t))
 
 	// Grid properties.
 	grid := &sheets.GridProperties{
@@ -243,7 +248,7 @@ func (srv *Service) createOverviewSheet(rawInfos []rawSheetInfo) *sheets.Sheet {
 			continue
 		}
 
-		smallerBetter := isSmallerBetter(info.table)
+		smallerBetter := srv.isSmallerBetter(info.table)
 		sortOrder := "DESCENDING"
 		if smallerBetter {
 			sortOrder = "ASCENDING"
@@ -382,7 +387,10 @@ func deltaToPercentString(delta string) string {
 	return delta
 }
 
-func isSmallerBetter(table *benchstat.Table) bool {
+func (srv *Service) isSmallerBetter(table *benchstat.Table) bool {
+	if srv.SmallerBetter != nil {
+		return srv.SmallerBetter(table)
+	}
 	// "smaller is better, except speeds"
 	//  https://github.com/golang/perf/blob/master/benchstat/table.go#L110
 	return (table.Metric != "speed")
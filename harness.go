@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// harnessFile is the name under which the harness is overlaid into the
+// directory of each package that is built with it.
+const harnessFile = "zz_benchdiff_harness_test.go"
+
+// Environment variables that enable the features of the harness in a test
+// binary built with it.
+const (
+	leakMetricsEnv    = "BENCHDIFF_LEAK_METRICS"
+	runtimeMetricsEnv = "BENCHDIFF_RUNTIME_METRICS"
+)
+
+// harnessTemplate is a test file that is overlaid into each package when
+// building with --leak-metrics or --runtime-metrics.
+//
+// If BENCHDIFF_LEAK_METRICS is set, it interposes on the test binary's stdout
+// and, as each benchmark reports its result, appends the number of goroutines
+// and of live heap objects (after a GC) to the result line. The measurements
+// are taken concurrently with the start of the next benchmark, and the forced
+// GC may slightly perturb it.
+//
+// If BENCHDIFF_RUNTIME_METRICS is set, it writes a snapshot of the
+// runtime/metrics in runtimeMetrics to the file it names when the binary
+// exits, one "<unit> <value>" pair per line. See runtimeCollector.
+var harnessTemplate = template.Must(template.New("harness").Delims("[[", "]]").Parse(`// Code generated by benchdiff. DO NOT EDIT.
+
+package [[.Package]]_test
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"testing"
+)
+
+var benchdiffDone = make(chan struct{})
+
+func init() {
+	if os.Getenv("[[.LeakEnv]]") == "" {
+		close(benchdiffDone)
+		return
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		panic(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	go func() {
+		defer close(benchdiffDone)
+		sample := []metrics.Sample{{Name: "/gc/heap/objects:objects"}}
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			line := s.Text()
+			if strings.HasPrefix(line, "Benchmark") && strings.Contains(line, "ns/op") {
+				runtime.GC()
+				metrics.Read(sample)
+				// Exclude this goroutine.
+				line = fmt.Sprintf("%s\t%d goroutines\t%d heap-objects",
+					line, runtime.NumGoroutine()-1, sample[0].Value.Uint64())
+			}
+			fmt.Fprintln(stdout, line)
+		}
+	}()
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if os.Getenv("[[.LeakEnv]]") != "" {
+		os.Stdout.Close()
+	}
+	<-benchdiffDone
+	if path := os.Getenv("[[.RuntimeEnv]]"); path != "" {
+		if err := benchdiffDumpMetrics(path); err != nil {
+			fmt.Fprintln(os.Stderr, "benchdiff: writing runtime metrics:", err)
+		}
+	}
+	os.Exit(code)
+}
+
+func benchdiffDumpMetrics(path string) error {
+	var samples []metrics.Sample
+	for _, d := range metrics.All() {
+		samples = append(samples, metrics.Sample{Name: d.Name})
+	}
+	metrics.Read(samples)
+	values := make(map[string]metrics.Value, len(samples))
+	for _, s := range samples {
+		values[s.Name] = s.Value
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	[[- range $m := .Metrics]]
+	if v, ok := values["[[.Name]]"]; ok {
+		switch v.Kind() {
+		case metrics.KindUint64:
+			fmt.Fprintf(w, "[[.Unit]] %d\n", v.Uint64())
+		case metrics.KindFloat64:
+			fmt.Fprintf(w, "[[.Unit]] %g\n", v.Float64())
+		case metrics.KindFloat64Histogram:
+			[[- range .Quantiles]]
+			fmt.Fprintf(w, "[[$m.Unit]]-p[[.]] %g\n", benchdiffQuantile(v.Float64Histogram(), [[.]]))
+			[[- end]]
+		}
+	}
+	[[- end]]
+	// The fraction of CPU time spent on GC, including assists.
+	gc, total := values["/cpu/classes/gc/total:cpu-seconds"], values["/cpu/classes/total:cpu-seconds"]
+	if gc.Kind() == metrics.KindFloat64 && total.Kind() == metrics.KindFloat64 && total.Float64() > 0 {
+		fmt.Fprintf(w, "gc-cpu-frac %g\n", gc.Float64()/total.Float64())
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// benchdiffQuantile returns an upper bound of the q'th percentile of the
+// histogram.
+func benchdiffQuantile(h *metrics.Float64Histogram, q int) float64 {
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	var sum uint64
+	for i, c := range h.Counts {
+		sum += c
+		if sum*100 >= total*uint64(q) {
+			if math.IsInf(h.Buckets[i+1], 1) {
+				return h.Buckets[i]
+			}
+			return h.Buckets[i+1]
+		}
+	}
+	return h.Buckets[len(h.Buckets)-1]
+}
+`))
+
+// harnessData is the data that harnessTemplate is executed against.
+type harnessData struct {
+	Package    string
+	LeakEnv    string
+	RuntimeEnv string
+	Metrics    []runtimeMetric
+}
+
+var testMainRE = regexp.MustCompile(`(?m)^func TestMain\(`)
+
+// writeHarnessOverlay writes the harness for the package, along with a
+// -overlay file that adds it to the package's directory, into dir. It returns
+// the build flag that applies the overlay. If the package defines its own
+// TestMain, the harness can not be added and false is returned.
+func writeHarnessOverlay(ctx context.Context, pkg, dir string) (string, bool, error) {
+	out, err := capture(ctx, "go", "list", "-f",
+		`{{.Dir}}|{{.Name}}|{{join .TestGoFiles ","}}|{{join .XTestGoFiles ","}}`, pkg)
+	if err != nil {
+		return "", false, errors.Wrap(err, "listing package")
+	}
+	parts := strings.Split(out, "|")
+	if len(parts) != 4 {
+		return "", false, errors.Errorf("unexpected go list output %q", out)
+	}
+	pkgDir, name := parts[0], parts[1]
+	for _, f := range strings.Split(parts[2]+","+parts[3], ",") {
+		if f == "" {
+			continue
+		}
+		src, err := ioutil.ReadFile(filepath.Join(pkgDir, f))
+		if err != nil {
+			return "", false, err
+		}
+		if testMainRE.Match(src) {
+			return "", false, nil
+		}
+	}
+
+	harness, err := os.Create(filepath.Join(dir, pkgToTestBin(pkg)+"_harness.go"))
+	if err != nil {
+		return "", false, err
+	}
+	err = harnessTemplate.Execute(harness, harnessData{
+		Package:    name,
+		LeakEnv:    leakMetricsEnv,
+		RuntimeEnv: runtimeMetricsEnv,
+		Metrics:    runtimeMetrics,
+	})
+	if err != nil {
+		_ = harness.Close()
+		return "", false, err
+	}
+	if err := harness.Close(); err != nil {
+		return "", false, err
+	}
+	overlay, err := json.Marshal(map[string]map[string]string{
+		"Replace": {filepath.Join(pkgDir, harnessFile): harness.Name()},
+	})
+	if err != nil {
+		return "", false, err
+	}
+	overlayPath := filepath.Join(dir, pkgToTestBin(pkg)+"_overlay.json")
+	if err := ioutil.WriteFile(overlayPath, overlay, 0644); err != nil {
+		return "", false, err
+	}
+	return fmt.Sprintf("-overlay=%s", overlayPath), true, nil
+}
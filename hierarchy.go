@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// subBenchmark is a benchmark name split into its top-level benchmark and the
+// names of its sub-benchmarks, e.g. Foo/size=1024/workers=8-8 into Foo and
+// [size=1024 workers=8].
+type subBenchmark struct {
+	parent string
+	subs   []string
+	procs  string
+}
+
+func parseSubBenchmark(name string) subBenchmark {
+	base, procs := splitProcs(name)
+	parts := strings.Split(base, "/")
+	return subBenchmark{parent: parts[0], subs: parts[1:], procs: procs}
+}
+
+// params returns the key=value parameters in the sub-benchmark names.
+// Sub-benchmark names that aren't of that form are keyed by their level,
+// counting from 1, e.g. Foo/small/workers=8 has the parameters #1=small and
+// workers=8.
+func (s subBenchmark) params() map[string]string {
+	if len(s.subs) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(s.subs))
+	for i, sub := range s.subs {
+		if j := strings.Index(sub, "="); j > 0 {
+			res[sub[:j]] = sub[j+1:]
+		} else {
+			res[fmt.Sprintf("#%d", i+1)] = sub
+		}
+	}
+	return res
+}
+
+// subFilter filters benchmarks by the parameters of their sub-benchmarks. A
+// benchmark is kept if, for each key, one of the values matches. See
+// --sub-filter.
+type subFilter map[string][]string
+
+// parseSubFilter parses the --sub-filter values, each of the form key=value.
+func parseSubFilter(specs []string) (subFilter, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	f := make(subFilter)
+	for _, spec := range specs {
+		i := strings.Index(spec, "=")
+		if i <= 0 {
+			return nil, errors.Errorf("invalid --sub-filter %q: must be key=value", spec)
+		}
+		f[spec[:i]] = append(f[spec[:i]], spec[i+1:])
+	}
+	return f, nil
+}
+
+func (f subFilter) matches(name string) bool {
+	params := parseSubBenchmark(name).params()
+	for key, values := range f {
+		v, ok := params[key]
+		if !ok {
+			return false
+		}
+		var match bool
+		for _, want := range values {
+			match = match || v == want
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// apply removes the rows of benchmarks that don't match the filter from the
+// tables, and the tables left without rows.
+func (f subFilter) apply(tables []*benchstat.Table) []*benchstat.Table {
+	if len(f) == 0 {
+		return tables
+	}
+	res := tables[:0]
+	for _, t := range tables {
+		rows := t.Rows[:0]
+		for _, row := range t.Rows {
+			if f.matches(row.Benchmark) {
+				rows = append(rows, row)
+			}
+		}
+		if t.Rows = rows; len(rows) > 0 {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// subGroup is a top-level benchmark along with the rows of its
+// sub-benchmarks in a table.
+type subGroup struct {
+	parent string
+	rows   []*benchstat.Row
+}
+
+// groupSubBenchmarks groups the rows of the table by their top-level
+// benchmark, in the order in which each first appears. Benchmarks without
+// sub-benchmarks are groups of their own.
+func groupSubBenchmarks(t *benchstat.Table) []*subGroup {
+	var groups []*subGroup
+	byParent := make(map[string]*subGroup)
+	for _, row := range t.Rows {
+		sb := parseSubBenchmark(row.Benchmark)
+		g, ok := byParent[sb.parent]
+		if !ok || len(sb.subs) == 0 {
+			g = &subGroup{parent: sb.parent}
+			groups = append(groups, g)
+			if len(sb.subs) > 0 {
+				byParent[sb.parent] = g
+			}
+		}
+		g.rows = append(g.rows, row)
+	}
+	return groups
+}
+
+// rollup summarizes the sub-benchmarks of a top-level benchmark in a table.
+type rollup struct {
+	Parent string `json:"parent"`
+	// Count is the number of sub-benchmarks, of which Improved and Regressed
+	// changed significantly.
+	Count     int `json:"count"`
+	Improved  int `json:"improved"`
+	Regressed int `json:"regressed"`
+	// Old and New are the geometric means of the sub-benchmarks' means,
+	// excluding the ones that are zero, and PctDelta the change between
+	// them.
+	Old      float64 `json:"old_geomean"`
+	New      float64 `json:"new_geomean"`
+	PctDelta float64 `json:"pct_delta"`
+}
+
+func makeRollup(g *subGroup) rollup {
+	r := rollup{Parent: g.parent, Count: len(g.rows)}
+	var logOld, logNew float64
+	var n int
+	for _, row := range g.rows {
+		switch {
+		case row.Change > 0:
+			r.Improved++
+		case row.Change < 0:
+			r.Regressed++
+		}
+		if len(row.Metrics) != 2 || row.Metrics[0].Mean <= 0 || row.Metrics[1].Mean <= 0 {
+			continue
+		}
+		logOld += math.Log(row.Metrics[0].Mean)
+		logNew += math.Log(row.Metrics[1].Mean)
+		n++
+	}
+	if n > 0 {
+		r.Old, r.New = math.Exp(logOld/float64(n)), math.Exp(logNew/float64(n))
+		r.PctDelta = (r.New/r.Old - 1) * 100
+	}
+	return r
+}
+
+// summary describes the rollup in a line.
+func (r rollup) summary() string {
+	s := "1 sub-benchmark"
+	if r.Count != 1 {
+		s = fmt.Sprintf("%d sub-benchmarks", r.Count)
+	}
+	if r.Old > 0 {
+		s += fmt.Sprintf(", geomean %+.2f%%", r.PctDelta)
+	}
+	return s + fmt.Sprintf(", %d improved, %d regressed", r.Improved, r.Regressed)
+}
+
+// rollups returns the rollups of the top-level benchmarks of the table that
+// have sub-benchmarks.
+func rollups(t *benchstat.Table) []rollup {
+	var res []rollup
+	for _, g := range groupSubBenchmarks(t) {
+		if len(parseSubBenchmark(g.rows[0].Benchmark).subs) > 0 {
+			res = append(res, makeRollup(g))
+		}
+	}
+	return res
+}
+
+// addJSONHierarchy adds the rollups of the top-level benchmarks to the JSON
+// representation of the tables.
+func addJSONHierarchy(jts []jsonTable, tables []*benchstat.Table) {
+	for i := range jts {
+		for _, t := range tables {
+			if t.Metric == jts[i].Metric {
+				jts[i].Rollups = rollups(t)
+			}
+		}
+	}
+}
+
+// rollupTables returns a table per table of the comparison with a row per
+// top-level benchmark with sub-benchmarks, comparing the geometric means of
+// their sub-benchmarks, for sinks that only render benchstat tables.
+func rollupTables(tables []*benchstat.Table) []*benchstat.Table {
+	var res []*benchstat.Table
+	for _, t := range tables {
+		rs := rollups(t)
+		if len(rs) == 0 {
+			continue
+		}
+		rt := &benchstat.Table{Metric: t.Metric + " (rollup)", Configs: t.Configs, OldNewDelta: t.OldNewDelta}
+		for _, r := range rs {
+			if r.Old == 0 {
+				continue
+			}
+			unit := t.Rows[0].Metrics[0].Unit
+			rt.Rows = append(rt.Rows, &benchstat.Row{
+				Benchmark: r.Parent,
+				Metrics:   []*benchstat.Metrics{{Unit: unit, Mean: r.Old}, {Unit: unit, Mean: r.New}},
+				PctDelta:  r.PctDelta,
+				Delta:     fmt.Sprintf("%+.2f%%", r.PctDelta),
+				Note:      fmt.Sprintf("(%d improved, %d regressed of %d)", r.Improved, r.Regressed, r.Count),
+			})
+		}
+		if len(rt.Rows) > 0 {
+			res = append(res, rt)
+		}
+	}
+	return res
+}
+
+// formatHierarchyHTML writes the tables in HTML with the sub-benchmarks of
+// each top-level benchmark grouped under it, in a collapsible section whose
+// summary is their rollup. The sub-benchmarks are listed by their names
+// relative to the top-level benchmark.
+func formatHierarchyHTML(w io.Writer, tables []*benchstat.Table) error {
+	type htmlRow struct {
+		Name, Class string
+		Values      []string
+		Delta, Note string
+	}
+	type htmlGroup struct {
+		Parent  string
+		Summary string // empty for benchmarks without sub-benchmarks
+		Rows    []htmlRow
+	}
+	type htmlTable struct {
+		Metric  string
+		Configs []string
+		Groups  []*htmlGroup
+	}
+	var data []htmlTable
+	for _, t := range tables {
+		ht := htmlTable{Metric: t.Metric, Configs: t.Configs}
+		for _, g := range groupSubBenchmarks(t) {
+			hasSubs := len(parseSubBenchmark(g.rows[0].Benchmark).subs) > 0
+			var hg *htmlGroup
+			if n := len(ht.Groups); !hasSubs && n > 0 && ht.Groups[n-1].Summary == "" {
+				// Consecutive benchmarks without sub-benchmarks share a table.
+				hg = ht.Groups[n-1]
+			} else {
+				hg = &htmlGroup{Parent: g.parent}
+				if hasSubs {
+					hg.Summary = makeRollup(g).summary()
+				}
+				ht.Groups = append(ht.Groups, hg)
+			}
+			for _, row := range g.rows {
+				hr := htmlRow{Name: row.Benchmark, Class: "unchanged", Delta: row.Delta, Note: row.Note}
+				if sb := parseSubBenchmark(row.Benchmark); len(sb.subs) > 0 {
+					hr.Name = strings.Join(sb.subs, "/")
+					if sb.procs != "" {
+						hr.Name += "-" + sb.procs
+					}
+				}
+				switch {
+				case row.Change > 0:
+					hr.Class = "better"
+				case row.Change < 0:
+					hr.Class = "worse"
+				}
+				for _, m := range row.Metrics {
+					hr.Values = append(hr.Values, m.Format(row.Scaler))
+				}
+				hg.Rows = append(hg.Rows, hr)
+			}
+		}
+		data = append(data, ht)
+	}
+	return hierarchyTemplate.Execute(w, data)
+}
+
+var hierarchyTemplate = template.Must(template.New("hierarchy").Parse(`{{range $t := .}}<h3>{{.Metric}}</h3>
+{{range .Groups}}{{if .Summary}}<details open><summary>{{.Parent}}: {{.Summary}}</summary>
+{{end}}<table class='benchstat oldnew'>
+<tr class='configs'><th>{{range $t.Configs}}<th>{{.}}{{end}}<th>delta<th>
+{{range .Rows}}<tr class='{{.Class}}'><td>{{.Name}}{{range .Values}}<td>{{.}}{{end}}<td>{{.Delta}}<td class='note'>{{.Note}}
+{{end}}</table>
+{{if .Summary}}</details>
+{{end}}{{end}}{{end}}`))
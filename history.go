@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultHistoryDir is the default location of the history store.
+var defaultHistoryDir = filepath.Join("benchdiff", "history")
+
+// historyTimeFormat is the format of the timestamp in the name of each history
+// entry. History timestamps are always recorded in UTC so that they have a
+// fixed width.
+const historyTimeFormat = "2006-01-02T15_04_05Z"
+
+// historyEntry is a single recorded run in the history store. Each entry holds
+// the benchmark output of a single git ref at a point in time, run with the
+// configuration identified by config (see historyConfig). Entries recorded
+// before configurations were recorded have none.
+type historyEntry struct {
+	time   time.Time
+	ref    string
+	config string
+	path   string
+}
+
+// historyEntryName returns the file name of a history entry.
+func historyEntryName(t time.Time, ref, config string) string {
+	return t.UTC().Format(historyTimeFormat) + "_" + ref + "+" + config
+}
+
+// historyConfig identifies the configuration of the suite's results in the
+// history store: its build and run configuration and the result options of
+// the run. Results under different configurations, e.g. with different
+// environments or benchtimes, differ systematically, so they're not compared.
+func historyConfig(bs *benchSuite, cfg *runConfig) string {
+	return optionsHash(bs.options(), cfg.resultOptions)
+}
+
+// entriesWithConfig returns the entries recorded under the configuration.
+func entriesWithConfig(entries []historyEntry, config string) []historyEntry {
+	var res []historyEntry
+	for _, e := range entries {
+		if e.config == config {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// latestConfigEntries returns the entries recorded under the configuration of
+// the latest entry, for commands that analyze the history as one series.
+func latestConfigEntries(entries []historyEntry) []historyEntry {
+	if len(entries) == 0 {
+		return nil
+	}
+	res := entriesWithConfig(entries, entries[len(entries)-1].config)
+	if skipped := len(entries) - len(res); skipped > 0 {
+		fmt.Fprintf(os.Stderr, "skipping %d run(s) with another configuration than the latest run\n", skipped)
+	}
+	return res
+}
+
+// isRemoteHistory returns whether the history store lives in an artifact
+// bucket instead of on the local filesystem.
+func isRemoteHistory(dir string) bool {
+	return strings.HasPrefix(dir, "gs://")
+}
+
+// localHistoryDir returns the local directory that mirrors the history store.
+// If the history store lives in an artifact bucket, it is first synced to a
+// local cache directory.
+func localHistoryDir(ctx context.Context, dir string) (string, error) {
+	if !isRemoteHistory(dir) {
+		return dir, nil
+	}
+	cache := filepath.Join("benchdiff", "history-cache", hash([]string{dir}))
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		return "", err
+	}
+	if _, err := capture(ctx, "gsutil", "-m", "-q", "rsync", "-r", dir, cache); err != nil {
+		return "", errors.Wrap(err, "syncing history store")
+	}
+	return cache, nil
+}
+
+// recordHistory stores the output of the benchmark suite in the history store,
+// under its configuration.
+func recordHistory(ctx context.Context, dir string, bs *benchSuite, cfg *runConfig, t time.Time) error {
+	name := historyEntryName(t, bs.ref, historyConfig(bs, cfg))
+	local := dir
+	if isRemoteHistory(dir) {
+		var err error
+		if local, err = ioutil.TempDir("", "benchdiff-history"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(local)
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if _, err := bs.outFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	defer bs.outFile.Seek(0, io.SeekEnd)
+	f, err := os.Create(filepath.Join(local, name))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, bs.outFile); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if isRemoteHistory(dir) {
+		dst := strings.TrimSuffix(dir, "/") + "/" + name
+		if _, err := capture(ctx, "gsutil", "-q", "cp", f.Name(), dst); err != nil {
+			return errors.Wrap(err, "uploading history entry")
+		}
+	}
+	return nil
+}
+
+// loadHistory returns all entries in the history store, ordered from oldest to
+// newest.
+func loadHistory(ctx context.Context, dir string) ([]historyEntry, error) {
+	local, err := localHistoryDir(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(local)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "reading history store")
+	}
+	var entries []historyEntry
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || len(name) <= len(historyTimeFormat)+1 {
+			continue
+		}
+		t, err := time.Parse(historyTimeFormat, name[:len(historyTimeFormat)])
+		if err != nil {
+			continue
+		}
+		e := historyEntry{
+			time: t,
+			ref:  name[len(historyTimeFormat)+1:],
+			path: filepath.Join(local, name),
+		}
+		if i := strings.LastIndex(e.ref, "+"); i >= 0 {
+			e.ref, e.config = e.ref[:i], e.ref[i+1:]
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].time.Before(entries[j].time)
+	})
+	return entries, nil
+}
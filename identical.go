@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// identicalTests returns the tests whose binaries are byte-identical between
+// the two suites. The benchmarks in such binaries can not have changed, so
+// measuring them is a waste of time, unless the suites run them differently:
+// on different hosts, with different environments, or through different launch
+// prefixes.
+func identicalTests(bs1, bs2 *benchSuite, tests fileSet) ([]string, error) {
+	if bs1.host != bs2.host ||
+		strings.Join(bs1.env, " ") != strings.Join(bs2.env, " ") ||
+		strings.Join(bs1.launch, " ") != strings.Join(bs2.launch, " ") {
+		return nil, nil
+	}
+	var res []string
+	for _, t := range tests.sorted() {
+		sum1, err := fileDigest(bs1.getTestBinary(t))
+		if err != nil {
+			return nil, err
+		}
+		sum2, err := fileDigest(bs2.getTestBinary(t))
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(sum1, sum2) {
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
+
+// fileDigest returns the SHA-256 digest of the file at the provided path.
+func fileDigest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// logIdenticalTests lists the packages that were skipped because their
+// binaries were identical.
+func logIdenticalTests(w io.Writer, tests []string) {
+	if len(tests) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\nunchanged (identical binary):\n")
+	for _, t := range tests {
+		fmt.Fprintf(w, "  %s\n", testBinToPkg(t))
+	}
+}
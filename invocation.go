@@ -0,0 +1,14 @@
+package main
+
+import "strings"
+
+// invocationBench is the name of the synthetic benchmark under which metrics
+// that are measured around an entire invocation of a test binary, rather than
+// reported by individual benchmarks, are recorded. See Collector.
+const invocationBench = "Invocation"
+
+// isSyntheticBench returns whether the benchmark, as reported by benchstat, is
+// recorded by benchdiff itself rather than run from a package.
+func isSyntheticBench(name string) bool {
+	return name == calibrationBench || strings.HasPrefix(name, invocationBench+"/")
+}
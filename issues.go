@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/nvanbenschoten/benchdiff/github"
+	"golang.org/x/perf/benchstat"
+)
+
+// issueTitle returns the title of the tracking issue for a regression. The
+// title is stable across runs, so that repeated regressions are commented on
+// the existing issue instead of filing duplicates.
+func issueTitle(r regression) string {
+	name := r.row.Benchmark
+	if r.pkg != "" {
+		name = r.pkg + "." + name
+	}
+	return fmt.Sprintf("benchdiff: %s regression in %s", r.table.Metric, procsSuffix.ReplaceAllString(name, ""))
+}
+
+// issueBody returns the body of the tracking issue, or of the comment on an
+// existing issue, for a regression.
+func issueBody(oldSuite, newSuite *benchSuite, r regression, verifyPaths []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "benchdiff found a %s regression of %s in `%s`, which reproduced over %d additional iterations.\n\n",
+		r.table.Metric, r.row.Delta, r.row.Benchmark, verifyIters)
+	fmt.Fprintf(&b, "old: `%s` %s\nnew: `%s` %s\n\n", oldSuite.ref, oldSuite.subject, newSuite.ref, newSuite.subject)
+
+	// Excerpt the regressed row from the report.
+	excerpt := *r.table
+	excerpt.Rows = []*benchstat.Row{r.row}
+	var buf bytes.Buffer
+	benchstat.FormatText(&buf, []*benchstat.Table{&excerpt})
+	fmt.Fprintf(&b, "```\n%s```\n\n", buf.String())
+
+	fmt.Fprintf(&b, "Artifacts:\n")
+	fmt.Fprintf(&b, "- old results: `%s`\n", oldSuite.outFile.Name())
+	fmt.Fprintf(&b, "- new results: `%s`\n", newSuite.outFile.Name())
+	for _, p := range verifyPaths {
+		fmt.Fprintf(&b, "- verification results: `%s`\n", p)
+	}
+	return b.String()
+}
+
+// fileIssues files a tracking issue for each confirmed regression, or comments
+// on the existing open issue for it.
+func fileIssues(
+	ctx context.Context,
+	client *github.Client,
+	oldSuite, newSuite *benchSuite,
+	regs []regression,
+	verifyPaths []string,
+	labels []string,
+) error {
+	for _, r := range regs {
+		title := issueTitle(r)
+		body := issueBody(oldSuite, newSuite, r, verifyPaths)
+		existing, err := client.FindOpenIssue(ctx, title)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			if err := client.CommentOnIssue(ctx, existing.Number, body); err != nil {
+				return err
+			}
+			fmt.Printf("commented on issue: %s\n", existing.HTMLURL)
+			continue
+		}
+		issue, err := client.CreateIssue(ctx, title, body, labels)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("filed issue: %s\n", issue.HTMLURL)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+const rerunUsage = `usage: benchdiff rerun [<run-id>]
+
+benchdiff rerun replays an earlier invocation of benchdiff with its exact
+configuration: the same flags and packages, the same resolved old and new
+commits (even if the refs have since moved), and the same Go and benchdiff
+environment variables. Every invocation is recorded in the run journal under
+benchdiff/journal. Without a run id, the recorded runs are listed.
+
+While a run's benchmarks are running, its progress is written to
+benchdiff/progress/<run-id>.json every few seconds: the tests and iterations
+being run, the iterations completed and time spent per test, and the failures
+so far. After a crash or a reboot, it shows where the run stopped, and its
+status is left as "running".`
+
+// journalDir is the directory holding the run journal.
+var journalDir = filepath.Join("benchdiff", "journal")
+
+// journalEnvVars are the Go toolchain and runtime environment variables that
+// are recorded in the journal, as they can affect the results of a run. They
+// are listed explicitly rather than by their GO prefix, which would also match
+// unrelated variables holding credentials, like GOOGLE_APPLICATION_CREDENTIALS,
+// and GOAUTH and GOPROXY, which may hold credentials, are left out.
+var journalEnvVars = []string{
+	"GO111MODULE", "GO386", "GOAMD64", "GOARCH", "GOARM", "GOARM64", "GOBIN", "GOCACHE",
+	"GODEBUG", "GOENV", "GOEXPERIMENT", "GOFIPS140", "GOFLAGS", "GOGC", "GOINSECURE",
+	"GOMAXPROCS", "GOMEMLIMIT", "GOMIPS", "GOMIPS64", "GOMODCACHE", "GONOPROXY", "GONOSUMDB",
+	"GOOS", "GOPATH", "GOPPC64", "GOPRIVATE", "GORISCV64", "GOROOT", "GOSUMDB", "GOTMPDIR",
+	"GOTOOLCHAIN", "GOTRACEBACK", "GOWASM", "GOWORK",
+}
+
+// journalEnvPrefixes are the prefixes of the other environment variables
+// that are recorded in the journal.
+var journalEnvPrefixes = []string{"CGO_", "BENCHDIFF_"}
+
+func isJournalEnv(kv string) bool {
+	name := strings.SplitN(kv, "=", 2)[0]
+	for _, v := range journalEnvVars {
+		if name == v {
+			return true
+		}
+	}
+	for _, p := range journalEnvPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// journalSecretFlags are the flags whose values are secrets, which are
+// redacted in the journal and not replayed.
+var journalSecretFlags = []string{"--slack-webhook"}
+
+// redactedValue replaces the values of secret flags in the journal.
+const redactedValue = "<redacted>"
+
+// redactSecretFlags returns the arguments with the values of secret flags
+// redacted.
+func redactSecretFlags(args []string) []string {
+	res := append([]string(nil), args...)
+	for i := 0; i < len(res); i++ {
+		if res[i] == "--" {
+			break
+		}
+		for _, f := range journalSecretFlags {
+			switch {
+			case res[i] == f && i+1 < len(res):
+				i++
+				res[i] = redactedValue
+			case strings.HasPrefix(res[i], f+"="):
+				res[i] = f + "=" + redactedValue
+			}
+		}
+	}
+	return res
+}
+
+// journalEntry records a single invocation of benchdiff.
+type journalEntry struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Args      []string  `json:"args"`
+	Dir       string    `json:"dir"`
+	OldRef    string    `json:"old_ref"`
+	OldCommit string    `json:"old_commit"`
+	NewRef    string    `json:"new_ref"`
+	NewCommit string    `json:"new_commit"`
+	Env       []string  `json:"env,omitempty"`
+	// Packages are the package filters of the run, which are replayed in
+	// place of a --pkgs-from flag, as the list may have come from stdin.
+	Packages []string `json:"packages,omitempty"`
+}
+
+// recordJournal records the invocation that resolved the provided suites in
+// the run journal and returns its run id.
+func recordJournal(oldSuite, newSuite *benchSuite, pkgFilter []string, t time.Time) (string, error) {
+	e := journalEntry{
+		Time:      t.UTC(),
+		Args:      redactSecretFlags(os.Args[1:]),
+		OldRef:    oldSuite.ref,
+		OldCommit: oldSuite.commit,
+		NewRef:    newSuite.ref,
+		NewCommit: newSuite.commit,
+		Packages:  pkgFilter,
+	}
+	var err error
+	if e.Dir, err = os.Getwd(); err != nil {
+		return "", err
+	}
+	for _, kv := range os.Environ() {
+		if isJournalEnv(kv) {
+			e.Env = append(e.Env, kv)
+		}
+	}
+	if err := os.MkdirAll(journalDir, 0755); err != nil {
+		return "", err
+	}
+	// Ids sort in invocation order, with a suffix to keep runs started in the
+	// same second apart, like the ids of daemon jobs. The entry is created
+	// exclusively, so that runs that pick the same id pick the next one.
+	for suffix := t.Nanosecond() / 1e5; ; suffix++ {
+		e.ID = fmt.Sprintf("%s-%04d", t.UTC().Format(historyTimeFormat), suffix)
+		data, err := json.MarshalIndent(e, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		f, err := os.OpenFile(filepath.Join(journalDir, e.ID+".json"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if _, err := f.Write(data); err != nil {
+			_ = f.Close()
+			return "", err
+		}
+		return e.ID, f.Close()
+	}
+}
+
+// loadJournal reads the journal entry with the provided run id.
+func loadJournal(id string) (journalEntry, error) {
+	var e journalEntry
+	data, err := ioutil.ReadFile(filepath.Join(journalDir, id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return e, errors.Errorf("no run %q in journal %s", id, journalDir)
+		}
+		return e, err
+	}
+	return e, json.Unmarshal(data, &e)
+}
+
+// replayArgs returns the arguments that replay the journal entry, pinning the
+// old and new suites to the commits that the entry's refs resolved to, with the
+// extra flags.
+func (e journalEntry) replayArgs(extra ...string) []string {
+	pin := append([]string{"--old=" + e.OldCommit, "--new=" + e.NewCommit}, extra...)
+	var args []string
+	var pkgsFrom bool
+	for i := 0; i < len(e.Args); i++ {
+		a := e.Args[i]
+		if a == "--" {
+			args = append(args, e.Args[i:]...)
+			break
+		}
+		switch {
+		case a == "--pkgs-from":
+			i++ // skip its value
+			pkgsFrom = true
+		case strings.HasPrefix(a, "--pkgs-from="):
+			pkgsFrom = true
+		case i+1 < len(e.Args) && e.Args[i+1] == redactedValue:
+			i++ // a redacted secret flag, which can't be replayed
+		case strings.HasSuffix(a, "="+redactedValue):
+		default:
+			args = append(args, a)
+		}
+	}
+	if pkgsFrom {
+		// The packages are replayed as positional arguments. Duplicates of
+		// the original positional arguments are removed by run.
+		args = append(args, e.Packages...)
+	}
+	// Flags that are passed later override earlier ones, but not after a
+	// terminating "--".
+	for i, a := range args {
+		if a == "--" {
+			return append(append(args[:i:i], pin...), args[i:]...)
+		}
+	}
+	return append(args, pin...)
+}
+
+func init() {
+	// Registered here rather than in the subcommands literal, as runRerun
+	// calls back into run, which references subcommands.
+	subcommands["rerun"] = runRerun
+}
+
+func runRerun(ctx context.Context, args []string) error {
+	var help bool
+	flags := pflag.NewFlagSet("rerun", pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, rerunUsage) }
+	flags.BoolVarP(&help, "help", "h", false, "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if help || flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, rerunUsage)
+		return nil
+	}
+
+	if flags.NArg() == 0 {
+		files, err := ioutil.ReadDir(journalDir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		var ids []string
+		for _, f := range files {
+			if id := strings.TrimSuffix(f.Name(), ".json"); id != f.Name() {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			e, err := loadJournal(id)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s  %s  %s..%s  benchdiff %s\n", id, e.Time.Local().Format(localTimeFormat),
+				shortenRef(ctx, e.OldCommit), shortenRef(ctx, e.NewCommit), strings.Join(e.Args, " "))
+		}
+		return nil
+	}
+
+	e, err := loadJournal(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if wd, err := os.Getwd(); err == nil && wd != e.Dir {
+		fmt.Fprintf(os.Stderr, "warning: run %s was invoked in %s\n", e.ID, e.Dir)
+	}
+	for _, a := range e.Args {
+		if strings.HasSuffix(a, redactedValue) {
+			fmt.Fprintf(os.Stderr, "warning: run %s passed secret flags (%s), which are not replayed\n",
+				e.ID, strings.Join(journalSecretFlags, ", "))
+			break
+		}
+	}
+	for _, kv := range e.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		if err := os.Setenv(parts[0], parts[1]); err != nil {
+			return err
+		}
+	}
+	os.Args = append([]string{os.Args[0]}, e.replayArgs()...)
+	fmt.Fprintf(os.Stderr, "replaying run %s: benchdiff %s\n", e.ID, strings.Join(os.Args[1:], " "))
+	return run(ctx)
+}
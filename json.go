@@ -0,0 +1,85 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// jsonTable is the JSON representation of a benchstat table.
+type jsonTable struct {
+	Metric string    `json:"metric"`
+	Rows   []jsonRow `json:"rows"`
+	// Rollups summarize the sub-benchmarks of each top-level benchmark, with
+	// --hierarchy.
+	Rollups []rollup `json:"rollups,omitempty"`
+}
+
+// jsonRow is the JSON representation of a single row of a benchstat table.
+type jsonRow struct {
+	Benchmark string      `json:"benchmark"`
+	Unit      string      `json:"unit"`
+	Old       jsonMetrics `json:"old"`
+	New       jsonMetrics `json:"new"`
+	Delta     string      `json:"delta"`
+	PctDelta  float64     `json:"pct_delta"`
+	Change    int         `json:"change"`
+	// PValue is the p-value of the delta test, unset if there wasn't one, as
+	// when all samples are equal.
+	PValue *float64 `json:"p_value,omitempty"`
+	Note   string   `json:"note,omitempty"`
+	// Parent is the top-level benchmark of a sub-benchmark, and Params the
+	// parameters in its name (see subBenchmark.params).
+	Parent string            `json:"parent,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// jsonMetrics is the JSON representation of the measurements of a single
+// configuration in a row of a benchstat table.
+type jsonMetrics struct {
+	Mean    float64   `json:"mean"`
+	Min     float64   `json:"min"`
+	Max     float64   `json:"max"`
+	Samples []float64 `json:"samples"`
+}
+
+// pValueNote matches the p-value in the note of a row, as formatted by
+// benchstat, e.g. (p=0.008 n=5+5).
+var pValueNote = regexp.MustCompile(`\(p=([0-9.]+) n=\d+\+\d+\)`)
+
+func makeJSONTables(tables []*benchstat.Table) []jsonTable {
+	res := make([]jsonTable, 0, len(tables))
+	for _, t := range tables {
+		jt := jsonTable{Metric: t.Metric}
+		for _, row := range t.Rows {
+			if len(row.Metrics) != 2 {
+				continue
+			}
+			conv := func(m *benchstat.Metrics) jsonMetrics {
+				return jsonMetrics{Mean: m.Mean, Min: m.Min, Max: m.Max, Samples: m.Values}
+			}
+			jr := jsonRow{
+				Benchmark: row.Benchmark,
+				Unit:      row.Metrics[0].Unit,
+				Old:       conv(row.Metrics[0]),
+				New:       conv(row.Metrics[1]),
+				Delta:     row.Delta,
+				PctDelta:  row.PctDelta,
+				Change:    row.Change,
+				Note:      row.Note,
+			}
+			if m := pValueNote.FindStringSubmatch(row.Note); m != nil {
+				if p, err := strconv.ParseFloat(m[1], 64); err == nil {
+					jr.PValue = &p
+				}
+			}
+			if sb := parseSubBenchmark(row.Benchmark); len(sb.subs) > 0 {
+				jr.Parent, jr.Params = sb.parent, sb.params()
+			}
+			jt.Rows = append(jt.Rows, jr)
+		}
+		res = append(res, jt)
+	}
+	return res
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// k8sHostPrefix is the prefix of --old-host and --new-host values that run the
+// suite's benchmarks as Kubernetes Jobs in the namespace following it, e.g.
+// k8s:bench.
+const k8sHostPrefix = "k8s:"
+
+// k8sMountDir is where the volume holding the test binaries is mounted in the
+// pods that benchdiff launches.
+const k8sMountDir = "/benchdiff"
+
+// k8sPollInterval is the interval at which the status of Jobs is polled.
+const k8sPollInterval = 2 * time.Second
+
+// k8sConfig configures how a suite's benchmarks are run on Kubernetes. Each
+// invocation of a test binary runs as its own Job, in a pod with guaranteed
+// QoS: its CPU and memory requests equal its limits, so with the kubelet's
+// static CPU manager policy, it is pinned to exclusive cores. The test
+// binaries are copied to a ReadWriteMany PersistentVolumeClaim, which is
+// mounted into each Job.
+type k8sConfig struct {
+	Namespace string `json:"namespace"`
+	Image     string `json:"image"`
+	Volume    string `json:"volume"`
+	CPUs      int    `json:"cpus"`
+	Memory    string `json:"memory"`
+}
+
+// isK8sHost returns whether the host runs benchmarks on Kubernetes.
+func isK8sHost(host string) bool {
+	return strings.HasPrefix(host, k8sHostPrefix)
+}
+
+// k8sObject is a Kubernetes object, as passed to kubectl apply.
+type k8sObject = map[string]interface{}
+
+// kubectl returns the arguments of a kubectl command in the namespace.
+func (c *k8sConfig) kubectl(args ...string) []string {
+	return append([]string{"kubectl", "--namespace", c.Namespace}, args...)
+}
+
+// k8sCleanupTimeout bounds the deletion of the objects of a run.
+const k8sCleanupTimeout = time.Minute
+
+// delete deletes the object without waiting for it to be gone. It isn't
+// canceled along with the run, which it cleans up after, so that interrupted
+// runs don't leave pods running in the cluster.
+func (c *k8sConfig) delete(kind, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), k8sCleanupTimeout)
+	defer cancel()
+	_, err := capture(ctx, c.kubectl("delete", kind, name, "--wait=false")...)
+	return err
+}
+
+// podSpec returns the spec of a pod that runs the command with the volume
+// holding the test binaries mounted.
+func (c *k8sConfig) podSpec(command []string) k8sObject {
+	resources := k8sObject{"cpu": strconv.Itoa(c.CPUs), "memory": c.Memory}
+	return k8sObject{
+		"restartPolicy": "Never",
+		"containers": []k8sObject{{
+			"name":       "benchdiff",
+			"image":      c.Image,
+			"command":    command,
+			"workingDir": k8sMountDir,
+			"resources":  k8sObject{"requests": resources, "limits": resources},
+			"volumeMounts": []k8sObject{{
+				"name": "binaries", "mountPath": k8sMountDir,
+			}},
+		}},
+		"volumes": []k8sObject{{
+			"name":                  "binaries",
+			"persistentVolumeClaim": k8sObject{"claimName": c.Volume},
+		}},
+	}
+}
+
+// apply creates the object.
+func (c *k8sConfig) apply(ctx context.Context, obj k8sObject) error {
+	manifest, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return spawnWith(ctx, bytes.NewReader(manifest), ioutil.Discard, os.Stderr, c.kubectl("apply", "-f", "-")...)
+}
+
+// k8sName returns a unique name for an object launched by benchdiff.
+func k8sName(kind string) string {
+	return fmt.Sprintf("benchdiff-%s-%d", kind, time.Now().UnixNano())
+}
+
+// pushBinaries copies the files to the directory on the volume, using a
+// short-lived pod that mounts it.
+func (c *k8sConfig) pushBinaries(ctx context.Context, dir string, files []string) (err error) {
+	name := k8sName("loader")
+	err = c.apply(ctx, k8sObject{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   k8sObject{"name": name},
+		"spec":       c.podSpec([]string{"sleep", "3600"}),
+	})
+	if err != nil {
+		return errors.Wrap(err, "creating loader pod")
+	}
+	defer func() {
+		if delErr := c.delete("pod", name); err == nil {
+			err = delErr
+		}
+	}()
+	if _, err := capture(ctx, c.kubectl("wait", "--for=condition=Ready", "--timeout=10m", "pod/"+name)...); err != nil {
+		return errors.Wrap(err, "waiting for loader pod")
+	}
+	if _, err := capture(ctx, c.kubectl("exec", name, "--", "mkdir", "-p", dir)...); err != nil {
+		return errors.Wrap(err, "creating directory on volume")
+	}
+	for _, f := range files {
+		dst := c.Namespace + "/" + name + ":" + path.Join(dir, filepath.Base(f))
+		if _, err := capture(ctx, c.kubectl("cp", f, dst)...); err != nil {
+			return errors.Wrapf(err, "copying %s to volume", f)
+		}
+	}
+	return nil
+}
+
+// command wraps the command, which must reference binaries on the volume, so
+// that it is run as a Job by `benchdiff k8s-job`.
+func (c *k8sConfig) command(args []string) []string {
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+	cfg, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return append([]string{self, "k8s-job", string(cfg), "--"}, args...)
+}
+
+// runK8sJob implements the internal `benchdiff k8s-job <config> -- <command>`
+// subcommand, which runs the command as a Kubernetes Job, waits for it to
+// complete, and writes its logs to stdout. benchdiff exits with the exit code
+// of the command.
+func runK8sJob(ctx context.Context, args []string) error {
+	if len(args) < 3 || args[1] != "--" {
+		return errors.New("usage: benchdiff k8s-job <config> -- <command>")
+	}
+	var c k8sConfig
+	if err := json.Unmarshal([]byte(args[0]), &c); err != nil {
+		return errors.Wrap(err, "decoding config")
+	}
+	code, err := c.runJob(ctx, args[2:])
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		os.Exit(code)
+	}
+	return nil
+}
+
+// runJob runs the command as a Job and returns its exit code.
+func (c *k8sConfig) runJob(ctx context.Context, command []string) (code int, err error) {
+	name := k8sName("job")
+	err = c.apply(ctx, k8sObject{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata":   k8sObject{"name": name},
+		"spec": k8sObject{
+			"backoffLimit": 0,
+			"template":     k8sObject{"spec": c.podSpec(command)},
+		},
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "creating job")
+	}
+	defer func() {
+		if delErr := c.delete("job", name); err == nil {
+			err = delErr
+		}
+	}()
+
+	for {
+		status, err := capture(ctx, c.kubectl("get", "job", name,
+			"-o", "jsonpath={.status.succeeded},{.status.failed}")...)
+		if err != nil {
+			return 0, errors.Wrap(err, "getting job status")
+		}
+		if status != "," {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(k8sPollInterval):
+		}
+	}
+	if err := spawnWith(ctx, nil, os.Stdout, os.Stderr, c.kubectl("logs", "job/"+name)...); err != nil {
+		return 0, errors.Wrap(err, "getting job logs")
+	}
+	out, err := capture(ctx, c.kubectl("get", "pods", "-l", "job-name="+name, "-o",
+		"jsonpath={.items[0].status.containerStatuses[0].state.terminated.exitCode}")...)
+	if err != nil {
+		return 0, errors.Wrap(err, "getting job exit code")
+	}
+	if code, err = strconv.Atoi(out); err != nil {
+		return 0, errors.Errorf("job %s did not terminate normally", name)
+	}
+	return code, nil
+}
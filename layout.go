@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// layoutFlag returns the build flag that links a test binary with the
+// function layout randomized by the provided seed.
+func layoutFlag(seed int) string {
+	return "-ldflags=-randlayout=" + strconv.Itoa(seed)
+}
+
+// noASLRPrefix returns the command prefix that runs a test binary with
+// address space layout randomization disabled.
+func noASLRPrefix(ctx context.Context) ([]string, error) {
+	arch, err := capture(ctx, "uname", "-m")
+	if err != nil {
+		return nil, err
+	}
+	return []string{"setarch", arch, "-R"}, nil
+}
+
+// selectLayout switches the suite to the binaries of the layout that the
+// provided iteration runs with. Iterations cycle through the layouts.
+func (bs *benchSuite) selectLayout(iter int) {
+	if len(bs.binDirs) <= 1 {
+		return
+	}
+	bs.layout = iter % len(bs.binDirs)
+	bs.binDir = bs.binDirs[bs.layout]
+}
+
+// layoutMeans scans benchmark output and returns the mean ns/op of each
+// benchmark in each layout, as recorded by the "layout" configuration lines.
+func layoutMeans(f *os.File) (map[string]map[int]float64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	defer f.Seek(0, io.SeekEnd)
+
+	sums := make(map[string]map[int][]float64)
+	layout := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "layout: ") {
+			layout, _ = strconv.Atoi(strings.TrimPrefix(line, "layout: "))
+			continue
+		}
+		if !strings.HasPrefix(line, "Benchmark") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 3; i < len(fields); i++ {
+			if fields[i] != "ns/op" {
+				continue
+			}
+			v, err := strconv.ParseFloat(fields[i-1], 64)
+			if err != nil {
+				break
+			}
+			name := strings.TrimPrefix(fields[0], "Benchmark")
+			if sums[name] == nil {
+				sums[name] = make(map[int][]float64)
+			}
+			sums[name][layout] = append(sums[name][layout], v)
+		}
+	}
+	res := make(map[string]map[int]float64, len(sums))
+	for name, layouts := range sums {
+		res[name] = make(map[int]float64, len(layouts))
+		for l, vs := range layouts {
+			res[name][l] = mean(vs)
+		}
+	}
+	return res, s.Err()
+}
+
+// layoutSpread returns the spread between the slowest and fastest layout's
+// mean as a percentage of the average of the layout means.
+func layoutSpread(means map[int]float64) float64 {
+	if len(means) < 2 {
+		return 0
+	}
+	lo, hi, sum := math.Inf(1), math.Inf(-1), 0.0
+	for _, m := range means {
+		lo, hi, sum = math.Min(lo, m), math.Max(hi, m), sum+m
+	}
+	avg := sum / float64(len(means))
+	if avg == 0 {
+		return 0
+	}
+	return (hi - lo) / avg * 100
+}
+
+// logLayoutVariance reports how much each benchmark's time/op varies across
+// binary layouts within each suite, next to its old-to-new delta. A delta that
+// is smaller than the layout-induced spread may be an artifact of code layout
+// rather than of the code change.
+func logLayoutVariance(w io.Writer, oldSuite, newSuite *benchSuite, tables []*benchstat.Table) error {
+	oldMeans, err := layoutMeans(oldSuite.outFile)
+	if err != nil {
+		return err
+	}
+	newMeans, err := layoutMeans(newSuite.outFile)
+	if err != nil {
+		return err
+	}
+	deltas := make(map[string]*benchstat.Row)
+	for _, t := range tables {
+		if t.Metric == "time/op" {
+			for _, row := range t.Rows {
+				deltas[row.Benchmark] = row
+			}
+		}
+	}
+	var names []string
+	for name := range newMeans {
+		if _, ok := oldMeans[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "\nlayout-induced variance (spread of time/op across %d layouts):\n", len(oldSuite.binDirs))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "name\told spread\tnew spread\tdelta\t")
+	for _, name := range names {
+		oldSpread, newSpread := layoutSpread(oldMeans[name]), layoutSpread(newMeans[name])
+		delta, note := "~", ""
+		if row, ok := deltas[name]; ok {
+			delta = row.Delta
+			if row.Delta != "~" && math.Abs(row.PctDelta) < math.Max(oldSpread, newSpread) {
+				note = "within layout noise"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%.2f%%\t%.2f%%\t%s\t%s\n", name, oldSpread, newSpread, delta, note)
+	}
+	return tw.Flush()
+}
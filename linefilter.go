@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+)
+
+// benchLineFilter passes on the output of a test binary, discarding benchmark
+// result lines whose benchmark isn't one of the binary's benchmarks. Some test
+// binaries print benchmark-like lines from nested harnesses (e.g. tests that
+// run sub-processes), which would otherwise be parsed as results and corrupt
+// the statistics. See --validate-lines. Output is passed on a line at a time,
+// and the filter must be closed to pass on any incomplete final line.
+type benchLineFilter struct {
+	w     io.Writer
+	known map[string]bool // top-level benchmark names, from -test.list
+	mu    sync.Mutex      // stdout and stderr share the filter
+	buf   []byte
+	// discarded counts the impostor lines.
+	discarded int
+}
+
+func newBenchLineFilter(w io.Writer, benchmarks []string) *benchLineFilter {
+	f := &benchLineFilter{w: w, known: make(map[string]bool, len(benchmarks))}
+	for _, b := range benchmarks {
+		f.known[b] = true
+	}
+	return f
+}
+
+func (f *benchLineFilter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buf = append(f.buf, p...)
+	for {
+		i := bytes.IndexByte(f.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := f.writeLine(f.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		f.buf = f.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (f *benchLineFilter) writeLine(line []byte) error {
+	if s := string(line); isBenchResult(s) && !f.known[topLevelResult(s)] {
+		f.discarded++
+		return nil
+	}
+	_, err := f.w.Write(line)
+	return err
+}
+
+func (f *benchLineFilter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.buf) == 0 {
+		return nil
+	}
+	err := f.writeLine(f.buf)
+	f.buf = nil
+	return err
+}
+
+// topLevelResult returns the name of the benchmark function of a benchmark
+// result line, without the name of any sub-benchmark or GOMAXPROCS suffix.
+func topLevelResult(line string) string {
+	name, _ := splitProcs(strings.Fields(line)[0])
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
@@ -7,24 +7,29 @@ import (
 	"io"
 	"io/fs"
 	"io/ioutil"
-	"math"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/pprof/profile"
+	"github.com/nvanbenschoten/benchdiff/github"
 	"github.com/nvanbenschoten/benchdiff/google"
+	"github.com/nvanbenschoten/benchdiff/runner"
 	"github.com/nvanbenschoten/benchdiff/ui"
 	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
 	"golang.org/x/perf/benchstat"
 )
 
-const usage = `usage: benchdiff [--old <commit>] [--new <commit>] <pkgs>...`
+const usage = `usage: benchdiff [--old <commit>] [--new <commit>] [--pkgs <pkgs>] <pkgs>...`
 
 const helpString = `benchdiff automates the process of running and comparing Go microbenchmarks
 across code changes.
@@ -47,32 +52,408 @@ containing the service account key using the GOOGLE_APPLICATION_CREDENTIALS
 environment variable. See https://cloud.google.com/docs/authentication/production.
 
 Options:
-  -n, --new       <commit>  measure the difference between this commit and old (default HEAD)
-  -o, --old       <commit>  measure the difference between this commit and new (default new~)
-                            'lastmerge' selects the most recent merge commit.
+  -n, --new       <commit>  measure the difference between this commit and old (default HEAD).
+                            'worktree' selects the working tree, with its uncommitted changes
+                            and untracked files, which is compared against HEAD by default
+  -o, --old       <commit>  measure the difference between this commit and new (default new~).
+                            'lastmerge' selects the most recent merge commit. release:<tag>
+                            compares against the recorded numbers of the release, fetched from
+                            the release store, instead of building and running it. If old and
+                            new are the same commit with the same configuration, the run is an
+                            A/A comparison that measures noise: the report gains the
+                            distribution of the spurious deltas and the false positive rate
+      --release-store <dir> directory or gs:// bucket of release bundles, published with
+                            benchdiff publish-release (default $BENCHDIFF_RELEASE_STORE)
+      --control   <commit>  also run a control suite built from this commit (typically the old
+                            commit) alongside old. The report gains a three-way (control, old,
+                            new) comparison, and each row is annotated with the difference
+                            between control and old, which quantifies run-to-run noise
+      --pkgs      <pkgs>    comma-separated packages to benchmark, equivalent to the positional
+                            arguments but self-describing in scripts and Makefiles. Quote
+                            patterns to keep the shell from expanding them
+      --pkgs-from <file>    read additional packages, separated by whitespace, from the file, or
+                            from stdin if '-', e.g. to pass a long list of affected packages
   -r, --run       <regexp>  run only benchmarks matching regexp
+      --skip-bench <regexp> skip benchmarks matching regexp, using -test.skip. Test binaries
+                            that predate -test.skip (Go 1.20) are run with a -test.bench
+                            pattern listing the remaining top-level benchmarks instead
+      --parallel  <n>       run the comparisons of n packages concurrently, each pinned to a
+                            disjoint set of physical cores (with their hyperthread siblings) of
+                            the CPUs that benchdiff may run on, with taskset. The benchmarks of
+                            a package are still run one at a time. Requires an otherwise idle machine with
+                            enough cores that the partitions don't share caches heavily.
+                            Packages whose benchmarks keep at least 90% of their CPU set busy
+                            (e.g. with b.RunParallel) are detected and run exclusively, on all
+                            CPUs.
+                            Turns off the preview, and can't be combined with --preview
+      --exclusive <pkgs>    comma-separated packages (like --priority) to always run
+                            exclusively under --parallel
+      --shard-benchmarks    run each benchmark function in its own process, listed with
+                            -test.list, so that a crash or timeout in one benchmark only loses
+                            that benchmark's results for the iteration
+      --fuzz-seeds          instead of benchmarks, run the seed corpus (F.Add inputs and
+                            testdata/fuzz) of the fuzz targets matching --run, without fuzzing,
+                            for as many passes as fit in the benchtime, and compare the time per
+                            execution (ns/exec) to catch fuzz target throughput regressions
+      --examples            also time the testable examples matching --run, for packages
+                            without benchmarks for their performance-sensitive paths. Each
+                            example is run under -test.run for as many runs as fit in the
+                            benchtime, and the wall time per run (ns/example) is compared.
+                            These are coarse end-to-end timings, labeled as low precision
+      --validate-lines      discard benchmark result lines whose benchmark isn't one of the
+                            test binary's (as listed by -test.list), such as those printed by
+                            nested harnesses or sub-processes, which would corrupt the results
   -c, --count     <n>       run tests and benchmarks n times (default 10)
   -d  --benchtime <d>       run each benchmark for duration d (default 1s)
+      --auto-benchtime <d>  after the first iterations, run benchmarks that are fast (<1µs/op)
+                            and noisy (>5% variation) separately with benchtime d
+      --short               pass -test.short to the benchmarks
+      --size      <class>   run benchmarks of the given size class: 'small', 'medium', or
+                            'large'. The class is exported to the benchmarks as BENCHDIFF_SIZE,
+                            which benchmarks can consult to skip heavyweight cases. 'small'
+                            implies --short
+      --collectors <names>  comma-separated collectors that measure each test binary invocation,
+                            compared under the Invocation/<pkg> benchmark:
+                              rusage: CPU time, page faults, and context switches
+                              perf:   hardware counters, using perf stat. Can't be combined
+                                      with --sudo or --cap-add
+                              energy: joules (J) and watts (W), using the RAPL counters of
+                                      Linux hosts. The counters cover the whole machine, so it
+                                      should otherwise be idle
+                              io:     disk I/O (read-B, write-B) and read and write syscalls,
+                                      using Linux I/O accounting
+                              runtime: scheduling latencies, GC pauses and CPU fraction, and
+                                      other runtime/metrics, dumped by the test binary on exit.
+                                      Requires the harness (see --leak-metrics)
+                              startup: time from the start of the test binary to its first
+                                      line of benchmark output (startup-ns), which isolates
+                                      init-time regressions
+      --leak-metrics        build the test binaries with an injected TestMain harness that
+                            records the number of goroutines and live heap objects after each
+                            benchmark, and compare them. Packages that define their own
+                            TestMain are built without the harness
+      --energy              alias for --collectors=energy
+      --io                  alias for --collectors=io
+      --runtime-metrics     alias for --collectors=runtime
       --cpuprofile          record and write cpu profiles
-      --memprofile          record and write allocation profiles
+      --memprofile          record and write allocation profiles. For each benchmark with an
+                            allocs/op regression, the allocation sites that account for the
+                            increase are listed
       --mutexprofile        record and write mutex contention profiles
-  -t, --threshold <n>       exit with code 0 if all regressions are below threshold, else 1
+  -t, --threshold <n>       exit with code 0 if all significant regressions are below threshold,
+                            else 1. The threshold is a fraction (e.g. 0.2) or a percentage
+                            (e.g. 20%), and applies to all metrics unless given per metric
+                            or unit as <metric>:<threshold>, e.g. time/op:5%,alloc/op:10%.
+                            A negative threshold, e.g. -1, disables the gate (for the metric)
+      --budget <n>          exit with code 1 if the geomean delta of the benchmarks of any
+                            package regresses a metric by more than n (e.g. 0.05 for 5%),
+                            tolerating scattered regressions of individual benchmarks
+      --budget-by <g>       group the benchmarks for --budget by package (default) or team,
+                            which requires --owners
   -p, --previous-run <time> time of previous run; skip running benches and just (re)process previous run
       --post-checkout       an optional command to run after checking out each branch to
-                            configure the git repo so that 'go build' succeeds
+                            configure the git repo so that 'go build' succeeds. Branches are
+                            checked out in a worktree in the git directory, leaving the
+                            working tree untouched
+      --generate  <cmd>     a command that regenerates generated code after checking out each
+                            branch, e.g. 'make generate', which is only run if the code is
+                            stale, unlike an unconditional --post-checkout
+      --generate-check <c>  a command that exits with a failing code if the generated code is
+                            stale, e.g. 'make check-generated'. By default, the code is stale
+                            if the packages don't build with 'go build'
+      --secrets-file <path> an environment file (KEY=VALUE lines) of secrets to pass to the
+                            post-checkout command and plugins, e.g. for generating license-gated
+                            assets. Secrets are not passed to the test binaries or recorded, and
+                            their values are scrubbed from the commands' output
+      --secrets-cmd  <cmd>  a command that prints secrets in the same format, e.g. from a vault
+      --schedule  <mode>    order in which iterations are run: 'by-test' runs all iterations of
+                            a package before the next, 'round-robin' runs one iteration of
+                            every package per round (default by-test)
+      --shuffle   <mode>    randomize the order of iterations: 'off', 'tests' shuffles the order
+                            of packages, 'all' shuffles every iteration and which suite runs
+                            first (default off)
+      --priority  <pkgs>    comma-separated packages (e.g. ./pkg/kv or ./pkg/sql/...) to run
+                            before all others. Their comparison is printed as soon as their
+                            iterations complete, while the remaining packages run
+      --sample    <pct>     run only a random pct% of the benchmarks in each package, for a
+                            quick, broad health check. The report is labeled as sampled
+      --seed      <n>       seed used to shuffle and sample, for reproducing a previous run
+                            (default random, logged at the start of the run)
+      --strategy  <s>       how iterations are run: 'interleave-process' runs each iteration in
+                            its own process, alternating between old and new; 'interleave-count'
+                            runs all iterations of a package in one process with -test.count,
+                            alternating between old and new per package; 'block' runs each
+                            iteration in its own process, but all old iterations of a package
+                            before all new ones (default interleave-process)
+      --reuse-process       alias for --strategy=interleave-count, which amortizes expensive
+                            fixture setup across iterations
+      --drop-warmup <p>     discard the first sample of each benchmark in each process that ran
+                            it several times (see --strategy=interleave-count) as a warm-up
+                            sample taken with cold caches: 'never' (default), 'always', 'auto'
+                            if it deviates from the process's other samples by more than 50%,
+                            or if by more than a given deviation like '30%'. Comma-separated
+                            '<regexp>=<policy>' rules set the policy of the matching benchmarks,
+                            e.g. 'auto,Storage=always'. The out files keep all samples
+      --skip-identical      skip packages whose old and new test binaries are byte-identical
+                            and are run on the same host with the same environment and launch
+                            prefix, and list them as unchanged in the report. Can't be combined
+                            with --control
+      --force-rerun         rerun the benchmarks even if results for the same commits, packages,
+                            and configuration are cached from a previous run
       --preview             show benchdiff text output while benchmarks are being run (default true)
+                            Regardless, the latest comparison is written to report.txt and
+                            report.json in the new commit's artifacts directory after every
+                            iteration
+      --summary             list the binaries, outputs, and other artifacts that the run left
+                            behind with their sizes, and the commands that reproduce its
+                            analysis, at the end of the run (default true)
+      --compress-artifacts  compress the outputs, build logs, and profiles in the artifacts
+                            directories with zstd at the end of the run. Compressed outputs
+                            are decompressed transparently by --previous-run
+      --old-env   <k=v>     run the old suite's benchmarks with this environment variable set;
+                            may be repeated
+      --new-env   <k=v>     run the new suite's benchmarks with this environment variable set;
+                            may be repeated
+      --pin-runtime <k=v,...>
+                            pin Go runtime knobs (GOGC, GOMAXPROCS, GOMEMLIMIT, GODEBUG) to the
+                            same values for both suites, e.g. 'GOGC=off,GOMAXPROCS=8' to remove
+                            GC nondeterminism. The knobs that aren't pinned are unset, so that
+                            neither suite picks them up from the environment. The pinned values
+                            are recorded in the output files; --old-env and --new-env can't
+                            override them
+      --old-build-flags <f> space-separated flags passed to 'go test -c' (or 'bazel build')
+                            when building the old suite, e.g. '-tags=foo'
+      --new-build-flags <f> space-separated flags passed to 'go test -c' (or 'bazel build')
+                            when building the new suite. Together with --old-env and
+                            --new-env, this allows comparing a commit against itself with
+                            different build or run configurations
+      --sudo                run the test binaries as root via sudo, for benchmarks that need
+                            raw sockets, io_uring limits, cgroup manipulation, etc.
+      --cap-add   <caps>    comma-separated capabilities (e.g. net_raw,sys_admin) to run the
+                            test binaries with, as the current user, via sudo and setpriv
+  -y, --yes                 confirm --sudo or --cap-add without prompting
+      --numa-node <n>       bind the test binaries' CPU and memory to NUMA node n using numactl
+      --no-aslr             run the test binaries with address space layout randomization
+                            disabled, using setarch
+      --mem-limit <size>    cap the memory of each test binary (e.g. 8GiB), so that a leaky
+                            benchmark can't take down the host. A binary that runs out of
+                            memory is reported in the 'oom' column of the failure triage and
+                            fails the run
+      --mem-limit-mode <m>  how to cap memory: 'rlimit' (default) sets RLIMIT_AS with prlimit,
+                            which limits virtual memory (the Go runtime needs about 1GiB of
+                            address space to start); 'cgroup' runs each binary in a systemd
+                            scope with MemoryMax, which limits resident memory
+      --scratch-dir <dir>   run each test binary with a fresh TMPDIR under dir, removed after
+                            it exits, for benchmarks that need a lot of scratch space (with
+                            b.TempDir or os.TempDir). Each binary is only run if dir has at
+                            least --scratch-min-free space (default 1GiB). Local runs only
+      --scratch-min-free <size>
+                            the free space required under --scratch-dir (e.g. 20GiB)
+      --layouts   <n>       build each suite n times, once with the default and n-1 times with
+                            a randomized function layout (-ldflags=-randlayout), and cycle
+                            through the layouts across iterations. The spread of each
+                            benchmark across layouts is reported next to its delta, exposing
+                            layout-induced variance that masquerades as a code change
+      --old-host  <host>    run the old suite's benchmarks on this host over ssh
+      --new-host  <host>    run the new suite's benchmarks on this host over ssh. If the old
+                            and new suites run on different hosts, a calibration benchmark is
+                            run on both and results are normalized by the hosts' relative speed.
+                            A host of the form k8s:<namespace> runs each invocation of a test
+                            binary as a Kubernetes Job in the namespace
+      --normalize-procs <mode>
+                            line up the results of hosts with different core counts, whose
+                            benchmark names have different GOMAXPROCS suffixes (e.g. -8 and
+                            -16): 'strip' removes the suffixes, and comma-separated old=new
+                            mappings (e.g. 8=16) rename the old suite's suffixes. Without it, a
+                            mismatch is warned about. Note that 'strip' also strips numeric
+                            suffixes of sub-benchmark names on single-core hosts
+      --run-on    <host>    run both suites' benchmarks on this host over ssh. Shorthand for
+                            --old-host and --new-host
+      --build-on  <host>    build the test binaries on this host over ssh instead of locally, and
+                            copy them back. The commits are pushed to a clone of the repository
+                            in ~/benchdiff-build on the host, where the post-checkout command is
+                            also run. Can be combined with --run-on
+      --allow-toolchain-skew
+                            compare suites whose test binaries were built with different Go
+                            versions or cgo settings, e.g. because the commits' go.mod files
+                            select different toolchains, with a warning. By default, this is
+                            an error
+      --k8s-volume <pvc>    ReadWriteMany PersistentVolumeClaim that test binaries are copied to
+                            for Kubernetes hosts (required with k8s: hosts)
+      --k8s-image <image>   image of the Jobs' containers (default debian:stable-slim)
+      --k8s-cpus  <n>       CPUs of each Job. Requests equal limits for guaranteed QoS, so the
+                            kubelet's static CPU manager pins Jobs to exclusive cores (default 2)
+      --k8s-memory <q>      memory of each Job (default 4Gi)
+      --cloud     <cloud>   provision a fresh VM on 'gce' or 'ec2', run both suites' benchmarks
+                            on it, and tear it down afterwards. Requires the gcloud or aws CLI
+      --machine-type <type> machine type of the VM (default c2-standard-16 for gce, c5.4xlarge
+                            for ec2)
+      --cloud-zone <zone>   zone (gce) or region (ec2) of the VM (default us-central1-a or
+                            us-east-1)
+      --cloud-image <image> image of the VM: <project>/<family> for gce (default
+                            debian-cloud/debian-12), or an AMI ID for ec2 (required)
+      --cloud-key <name>    EC2 key pair to ssh into the VM with (required for ec2)
+      --cloud-user <user>   user to ssh into an EC2 VM as (default admin)
+      --record              store the new suite's results in the history store, unless they
+                            were served from the cache. Results are recorded with their build
+                            and run configuration, and only compared with results of the same
+                            configuration
+      --history-dir <dir>   directory or gs:// bucket holding the history store
+                            (default benchdiff/history)
+      --noise               score the noise of each benchmark from the runs in the history
+                            store that repeat a commit (e.g. A/A runs and reruns) as the
+                            typical run-to-run deviation of its mean, shown in the notes as
+                            'noise ±x%'. Regressions must also exceed twice the noise score to
+                            fail --threshold and --github-check
+      --plugin    <name>    invoke the benchdiff-<name> executable on the PATH at each lifecycle
+                            point (post-build, post-iteration, post-run) with a JSON payload
+                            on stdin; may be repeated. Plugins may reply with extra results at
+                            post-build and post-iteration, but not at post-run, which is passed
+                            the finished comparison
+      --equalize-n          rerun benchmarks that have fewer samples on one side than the other
+                            until both sides have an equal number of samples. Can't be combined
+                            with --paired
+      --paired              test the significance of deltas by pairing the old and new samples
+                            of each round of interleaved iterations (a signed-rank test of the
+                            per-round ratios), which cancels out load that drifts across rounds
+                            and so detects smaller deltas than the default pooled U-test
+      --ci        <method>  annotate each delta with its 95% confidence interval computed with
+                            the method: 'bootstrap' resamples the samples (pairwise with
+                            --paired), which suits skewed latency distributions, or 'none'
+                            (default none)
+      --fdr       <q>       control the false discovery rate of significant deltas at q (e.g.
+                            0.05) with the Benjamini-Hochberg procedure across all rows, so
+                            that tree-wide runs don't flag dozens of benchmarks by chance.
+                            Deltas that don't survive are reported as insignificant
   -b  --bazel               build the test binaries with bazel
-  -s  --sort      <order>   sort output by 'delta' (largest first) or 'name'
+      --skip-broken-builds  skip packages that fail to build on either commit instead of
+                            aborting. Failures are listed in the failure triage report
+      --show-build-output   stream the output of the build tool while building, e.g. to debug
+                            --post-checkout setups. The output of failed builds is always
+                            shown and saved to ./benchdiff/<ref>/artifacts/build.<bin>.log
+      --bin-dir   <dir>     store test binaries under dir instead of ./benchdiff/<ref>/bin, to
+                            keep them out of the repository. ./benchdiff is always ignored by
+                            git through a generated .gitignore
+  -s  --sort      <order>   sort output by 'delta' (largest first), 'effect' (largest effect size
+                            first, see --effect-size), or 'name'
+      --effect-size         annotate each delta with its effect size, Cliff's delta δ: how
+                            consistently the new samples are greater (+1) or smaller (-1) than
+                            the old ones, labeled negligible, small, medium, or large
+      --min-effect <d>      only fail --threshold and --github-check on regressions whose effect
+                            size |δ| is at least d (e.g. 0.474 for large), so that tiny but
+                            significant changes don't fail the gate. Implies --effect-size
+      --format    <fmt>[:<file>]
+                            output the results in the specified format: 'text', 'csv', 'html',
+                            'sheets', 'template', or 'json', to the file if provided or else to
+                            stdout. May be repeated to write several formats in one run, of
+                            which at most one to stdout. If none writes to stdout, the results
+                            are also written there as text
+      --hierarchy           group sub-benchmarks (e.g. Foo/size=1024/workers=8) under their
+                            top-level benchmark in the html, sheets, and json outputs, with a
+                            rollup per top-level benchmark: the geomean delta of its
+                            sub-benchmarks and how many improved and regressed. The html output
+                            has no sparklines in this mode
+      --sub-filter <k=v>    only report sub-benchmarks whose name has the key=value parameter,
+                            e.g. 'workers=8'. Sub-benchmark names that aren't key=value pairs
+                            are keyed by their level, e.g. '#1=small'. May be repeated: values
+                            of the same key are alternatives, different keys must all match
+      --filter    <expr>    only compare the results matching the benchproc-style filter, whose
+                            space-separated terms must all match: <key>:<value> where the key is
+                            'name', the top-level benchmark, or '/<param>', a sub-benchmark
+                            parameter as for --sub-filter, e.g. '/workers:8'. Values may be
+                            '(a OR b)' alternatives or a /regexp/, and '-' negates a term
+      --group-by  <keys>    aggregate the results of benchmarks with the same values of the
+                            comma-separated keys, as for --filter, into a single benchmark,
+                            e.g. 'name,/size' compares Foo/size=1024 across all other
+                            parameters. The aggregate of each iteration is the geomean of its
+                            members' results, so the comparison keeps its statistics
+      --payload-size <regexp>=<size>
+                            derive MB/s from ns/op for the benchmarks matching the regexp (as
+                            with --run, but matching sub-benchmark names too) that don't call
+                            b.SetBytes, as if they processed size bytes (e.g. 4KiB) per op. May
+                            be repeated; the first match applies
+      --direction <unit>=<dir>
+                            whether 'higher' or 'lower' values of the unit (or of the metric
+                            benchstat names after it, e.g. time/op) are better, which decides
+                            which changes are improvements and regressions for sorting,
+                            coloring (html and sheets), and --threshold. By default, MB/s and
+                            custom units ending in /s like ops/s are better when higher, and
+                            all other units when lower. May be repeated
+      --slack-webhook <url> also post the results, as text, to the slack incoming webhook
+      --publish   <target>  render the results as an HTML report and upload it to
+                            <target>/<run-id>/index.html, next to an index page of all runs
+                            published there, and print its URL. The target is a GCS prefix,
+                            gs://<bucket>/<path>, uploaded to with gsutil, or an scp target,
+                            <host>:<path>
+      --publish-url <url>   the URL that the --publish target is served at, to print the URL
+                            of the report (default https://storage.googleapis.com/<bucket>/<path>
+                            for GCS targets)
+      --owners    <file>    a CODEOWNERS-like file mapping package patterns to teams, one
+                            '<pattern> <team> [<slack-webhook>]' rule per line, the last
+                            matching rule winning. Patterns are import paths in which '...'
+                            matches any string, webhooks of the form $VAR are read from the
+                            environment. The report gains a summary section per team listing
+                            its regressions, which are also posted to the team's webhook
+      --annotations <file>  a file of '<pattern> <note>' lines, rendering the note next to the
+                            benchmarks matching the pattern (an unanchored regexp, as with
+                            --run), e.g. 'KV/Scan known noisy, see issue #123'
+      --template  <file>    Go text/template file used to render the results with --format=template
+      --units     <mode>    scaling of values in text output: 'auto' scales each row to its own
+                            unit (e.g. µs or ms), 'base' never scales (ns, B), and 'table'
+                            scales all rows of a table to the unit of its smallest value, so
+                            that the values line up (default auto)
+      --bytes     <mode>    scale bytes by powers of 1000 ('si', kB/MB) or 1024 ('iec', KiB/MiB)
+                            in text output (default si)
+      --thousands           insert thousands separators into values in text output
       --csv                 output the results in a csv format
-      --html                output the results in an HTML table
+      --csv-delimiter <c>   the field delimiter of csv output, e.g. ';' or 'tab' (default ',',
+                            or ';' with --decimal-comma)
+      --decimal-comma       write numbers in csv output with a decimal comma, for spreadsheets in
+                            locales that would otherwise misread them. Google Sheets output
+                            always holds typed numbers, which are shown in the sheet's locale
+      --html                output the results in an HTML table. If the history store holds
+                            previous runs of the same configuration, each benchmark is shown
+                            with a sparkline of its last 20 recorded values
       --sheets              output the results to a new Google Sheets document
+      --redact              strip hostnames, usernames, and absolute paths from the metadata of
+                            shareable outputs (the header, sheets, HTML, JSON, and templates),
+                            so that results can be posted publicly
+      --github-check        create a GitHub check run on the new commit that lists regressions,
+                            annotated on their Benchmark function definitions. Regressions
+                            above --threshold fail the check. Requires GITHUB_TOKEN and
+                            GITHUB_REPOSITORY (owner/repo) to be set
+      --file-issues <n>     re-verify regressions above threshold n (e.g. 0.1 for 10%) by
+                            rerunning them, and file a GitHub issue for each confirmed one,
+                            or comment on its open issue. Requires GITHUB_TOKEN and
+                            GITHUB_REPOSITORY (owner/repo) to be set
+      --issue-labels <l>    comma-separated labels applied to filed issues
+      --notify-desktop      fire a desktop notification when the run finishes or fails
+                            (uses notify-send on Linux and osascript on macOS)
+      --bell                ring the terminal bell when the run finishes or fails
       --help                display this help
 
 Example invocations:
   $ benchdiff --sheets ./pkg/...
   $ benchdiff --old=master~ --new=master --threshold=0.2 ./pkg/kv ./pkg/storage/...
+  $ benchdiff --old=master~ --new=master --threshold=time/op:5% --threshold=allocs/op:0% ./pkg/kv
   $ benchdiff --new=d1fbdb2 --run=Datum --count=2 --csv ./pkg/sql/...
-  $ benchdiff --new=6299bd4 --sheets --post-checkout='dev generate go' ./pkg/workload/...`
+  $ benchdiff --new=6299bd4 --sheets --post-checkout='dev generate go' ./pkg/workload/...
+  $ benchdiff --format=template --template=report.tmpl ./pkg/kv
+
+Subcommands:
+  trend                     report sustained drift across the runs in the history store
+  changepoints              list the runs in the history store at which benchmarks shifted
+  plugins                   list the plugins found on the PATH
+  series                    compute benchmark ratio series across the runs in the history store
+  rerun                     replay an earlier run's exact configuration from the run journal
+  status                    print the progress and partial comparison of a run, which a running
+                            benchdiff also prints on SIGUSR1
+  buildtime                 compare the build time and memory of packages between two commits
+  snapshot-env              record a container image of the toolchain and OS libraries to embed in results
+  suggest                   list changed exported functions that no benchmark covers, ranked by CPU profiles
+  daemon                    run comparison jobs from a queue directory, one at a time, on a benchmark server
+  chatops                   run comparisons requested in pull request comments (!benchdiff <pkgs>) and reply
+  publish-release           publish a release's benchmark output for comparisons with --old=release:<tag>`
 
 // TODO: it's unclear whether G Suite Domain-wide Delegation is required for the
 // Google service account. If it is, add the following requirement to the help
@@ -122,150 +503,1079 @@ const (
 	//
 	//   generated sheet: https://docs.google.com/spreadsheets/...
 	sheets
+	// Output the benchmark comparison by executing a user-supplied Go
+	// text/template against the comparison data model (see templateData).
+	tmpl
+	// Output the benchmark comparison in the JSON format of the report in the
+	// artifacts directory (see jsonReport).
+	jsonFmt
+	// Post the benchmark comparison, as text, to a slack incoming webhook.
+	slack
 )
 
+// timeFormat is the format of the times that output files are named after.
+// Runs name them in UTC, so that the names of runs on machines in different
+// zones are comparable, while names with an offset, of older runs, still
+// parse.
 const timeFormat = "2006-01-02T15_04_05Z07:00"
 
+// localTimeFormat is the format in which times are shown to users, in their
+// local zone.
+const localTimeFormat = "2006-01-02 15:04:05 MST"
+
+// subcommands maps the names of benchdiff's subcommands to their
+// implementations. Each is passed the arguments following its name.
+var subcommands = map[string]func(ctx context.Context, args []string) error{
+	"calibrate":       runCalibrate,
+	"trend":           runTrend,
+	"changepoints":    runChangepoints,
+	"plugins":         runListPlugins,
+	"series":          runSeries,
+	"buildtime":       runBuildtime,
+	"snapshot-env":    runSnapshotEnv,
+	"suggest":         runSuggest,
+	"daemon":          runDaemon,
+	"chatops":         runChatops,
+	"publish-release": runPublishRelease,
+	"status":          runStatus,
+	// Internal, used to run test binaries on Kubernetes.
+	"k8s-job": runK8sJob,
+}
+
 func main() {
-	if err := run(context.Background()); err != nil {
+	// Cancel the run on interrupt, which kills its subprocesses. A second interrupt exits immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	if err := run(ctx); err != nil {
+		if ctx.Err() != nil {
+			err = errors.Wrap(err, "interrupted")
+		}
 		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
 		os.Exit(1)
 	}
 }
 
-func run(ctx context.Context) error {
+func run(ctx context.Context) (retErr error) {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			return cmd(ctx, os.Args[2:])
+		}
+	}
+
 	var help, outCSV, outHTML, outSheets bool
+	var formats []string
+	var templatePath, slackWebhook, ownersPath, annotationsPath string
+	var publishDest, publishURL string
+	var hierarchy bool
+	var subFilters, groupBy, payloadSizes, directionSpecs []string
+	var benchFilter string
 	var oldRef, newRef, order, postChck, runPattern, benchTime, previousRun string
+	var secretsFiles []string
+	var secretsCmd, pkgsFrom, generateCmd, generateCheck string
+	var pkgs []string
+	var normalizeProcs string
+	var unitMode, bytesMode string
+	var thousands bool
+	var csvDelim string
+	var decimalComma, redactOutput bool
 	var itersPerTest int
 	var cpuProfile, memProfile, mutexProfile bool
-	var threshold float64
+	var thresholdSpecs []string
+	var budget float64
+	var budgetBy string
 	var useBazel bool
-	var preview bool
+	var preview, summary, compress bool
+	var equalizeN, paired bool
+	var ciMethod string
+	var fdr, minEffect float64
+	var effectSize, noise bool
+	var dropWarmup string
+	var oldHost, newHost string
+	var runOn, buildOn, binDir string
+	var allowToolchainSkew, skipBrokenBuilds, showBuildOutput bool
+	var k8s k8sConfig
+	var cloud cloudConfig
+	var record bool
+	var historyDir string
+	var pluginNames []string
+	var schedule, shuffle string
+	var seed int64
+	var strategy string
+	var reuseProcess bool
+	var autoBenchTime string
+	var skipBench string
+	var shardBenchmarks bool
+	var fuzzSeeds bool
+	var validateLines bool
+	var releaseStore string
+	var memLimit, memLimitMode, scratchDir, scratchMinFree string
+	var examples bool
+	var parallel int
+	var exclusive []string
+	var short bool
+	var sizeClass string
+	var forceRerun bool
+	var skipIdentical bool
+	var sample string
+	var priority []string
+	var oldEnv, newEnv, pinRuntime []string
+	var oldBuildFlags, newBuildFlags string
+	var controlRef string
+	var githubCheck bool
+	var fileIssuesAbove float64
+	var issueLabels []string
+	var notifyDesktop, bell bool
+	var sudo, yes bool
+	var capAdd []string
+	var numaNode int
+	var noASLR bool
+	var layouts int
+	var energy bool
+	var procIO bool
+	var collectorList []string
+	var leakMetrics, rtMetrics bool
 
 	pflag.Usage = func() { fmt.Fprintln(os.Stderr, usage) }
 	pflag.BoolVarP(&help, "help", "h", false, "")
 	pflag.BoolVarP(&outCSV, "csv", "", false, "")
 	pflag.BoolVarP(&outHTML, "html", "", false, "")
 	pflag.BoolVarP(&outSheets, "sheets", "", false, "")
+	pflag.StringArrayVarP(&formats, "format", "", nil, "")
+	pflag.StringVarP(&slackWebhook, "slack-webhook", "", "", "")
+	pflag.StringVarP(&publishDest, "publish", "", "", "")
+	pflag.BoolVarP(&hierarchy, "hierarchy", "", false, "")
+	pflag.StringArrayVarP(&subFilters, "sub-filter", "", nil, "")
+	pflag.StringVarP(&benchFilter, "filter", "", "", "")
+	pflag.StringSliceVarP(&groupBy, "group-by", "", nil, "")
+	pflag.StringArrayVarP(&payloadSizes, "payload-size", "", nil, "")
+	pflag.StringArrayVarP(&directionSpecs, "direction", "", nil, "")
+	pflag.StringVarP(&publishURL, "publish-url", "", "", "")
+	pflag.StringVarP(&ownersPath, "owners", "", "", "")
+	pflag.StringVarP(&annotationsPath, "annotations", "", "", "")
+	pflag.StringVarP(&templatePath, "template", "", "", "")
 	pflag.BoolVarP(&useBazel, "bazel", "b", false, "")
 	pflag.StringVarP(&oldRef, "old", "o", "", "")
 	pflag.StringVarP(&newRef, "new", "n", "", "")
 	pflag.StringVarP(&order, "sort", "s", "delta", "")
 	pflag.StringVarP(&postChck, "post-checkout", "", "", "")
+	pflag.StringVarP(&generateCmd, "generate", "", "", "")
+	pflag.StringVarP(&generateCheck, "generate-check", "", "", "")
+	pflag.StringSliceVarP(&secretsFiles, "secrets-file", "", nil, "")
+	pflag.StringVarP(&pkgsFrom, "pkgs-from", "", "", "")
+	pflag.StringSliceVarP(&pkgs, "pkgs", "", nil, "")
+	pflag.StringVarP(&normalizeProcs, "normalize-procs", "", "", "")
+	pflag.StringVarP(&unitMode, "units", "", "auto", "")
+	pflag.StringVarP(&bytesMode, "bytes", "", "si", "")
+	pflag.BoolVarP(&thousands, "thousands", "", false, "")
+	pflag.StringVarP(&csvDelim, "csv-delimiter", "", "", "")
+	pflag.BoolVarP(&decimalComma, "decimal-comma", "", false, "")
+	pflag.BoolVarP(&redactOutput, "redact", "", false, "")
+	pflag.StringVarP(&secretsCmd, "secrets-cmd", "", "", "")
 	pflag.StringVarP(&runPattern, "run", "r", ".", "")
 	pflag.IntVarP(&itersPerTest, "count", "c", 10, "")
 	pflag.StringVarP(&benchTime, "benchtime", "d", "", "")
 	pflag.BoolVarP(&cpuProfile, "cpuprofile", "", false, "")
 	pflag.BoolVarP(&memProfile, "memprofile", "", false, "")
 	pflag.BoolVarP(&mutexProfile, "mutexprofile", "", false, "")
-	pflag.Float64VarP(&threshold, "threshold", "t", -1, "")
+	pflag.StringSliceVarP(&thresholdSpecs, "threshold", "t", nil, "")
+	pflag.Float64VarP(&budget, "budget", "", -1, "")
+	pflag.StringVarP(&budgetBy, "budget-by", "", "package", "")
 	pflag.StringVarP(&previousRun, "previous-run", "p", "", "")
 	pflag.BoolVarP(&preview, "preview", "", true, "")
+	pflag.BoolVarP(&summary, "summary", "", true, "")
+	pflag.BoolVarP(&compress, "compress-artifacts", "", false, "")
+	pflag.BoolVarP(&equalizeN, "equalize-n", "", false, "")
+	pflag.BoolVarP(&paired, "paired", "", false, "")
+	pflag.StringVarP(&ciMethod, "ci", "", ciNone, "")
+	pflag.Float64VarP(&fdr, "fdr", "", 0, "")
+	pflag.BoolVarP(&effectSize, "effect-size", "", false, "")
+	pflag.Float64VarP(&minEffect, "min-effect", "", 0, "")
+	pflag.BoolVarP(&noise, "noise", "", false, "")
+	pflag.StringVarP(&dropWarmup, "drop-warmup", "", "never", "")
+	pflag.StringVarP(&oldHost, "old-host", "", "", "")
+	pflag.StringVarP(&newHost, "new-host", "", "", "")
+	pflag.StringVarP(&runOn, "run-on", "", "", "")
+	pflag.StringVarP(&buildOn, "build-on", "", "", "")
+	pflag.StringVarP(&binDir, "bin-dir", "", "", "")
+	pflag.BoolVarP(&allowToolchainSkew, "allow-toolchain-skew", "", false, "")
+	pflag.BoolVarP(&skipBrokenBuilds, "skip-broken-builds", "", false, "")
+	pflag.BoolVarP(&showBuildOutput, "show-build-output", "", false, "")
+	pflag.StringVarP(&k8s.Volume, "k8s-volume", "", "", "")
+	pflag.StringVarP(&k8s.Image, "k8s-image", "", "debian:stable-slim", "")
+	pflag.IntVarP(&k8s.CPUs, "k8s-cpus", "", 2, "")
+	pflag.StringVarP(&k8s.Memory, "k8s-memory", "", "4Gi", "")
+	pflag.StringVarP(&cloud.provider, "cloud", "", "", "")
+	pflag.StringVarP(&cloud.machineType, "machine-type", "", "", "")
+	pflag.StringVarP(&cloud.zone, "cloud-zone", "", "", "")
+	pflag.StringVarP(&cloud.image, "cloud-image", "", "", "")
+	pflag.StringVarP(&cloud.key, "cloud-key", "", "", "")
+	pflag.StringVarP(&cloud.user, "cloud-user", "", "admin", "")
+	pflag.BoolVarP(&record, "record", "", false, "")
+	pflag.StringVarP(&historyDir, "history-dir", "", defaultHistoryDir, "")
+	pflag.StringSliceVarP(&pluginNames, "plugin", "", nil, "")
+	pflag.StringVarP(&schedule, "schedule", "", scheduleByTest, "")
+	pflag.StringVarP(&shuffle, "shuffle", "", shuffleOff, "")
+	pflag.Int64VarP(&seed, "seed", "", 0, "")
+	pflag.StringVarP(&strategy, "strategy", "", strategyInterleaveProcess, "")
+	pflag.BoolVarP(&reuseProcess, "reuse-process", "", false, "")
+	pflag.StringVarP(&autoBenchTime, "auto-benchtime", "", "", "")
+	pflag.StringVarP(&skipBench, "skip-bench", "", "", "")
+	pflag.BoolVarP(&shardBenchmarks, "shard-benchmarks", "", false, "")
+	pflag.BoolVarP(&fuzzSeeds, "fuzz-seeds", "", false, "")
+	pflag.BoolVarP(&validateLines, "validate-lines", "", false, "")
+	pflag.StringVarP(&releaseStore, "release-store", "", os.Getenv(releaseStoreEnv), "")
+	pflag.StringVarP(&memLimit, "mem-limit", "", "", "")
+	pflag.StringVarP(&memLimitMode, "mem-limit-mode", "", memLimitRlimit, "")
+	pflag.StringVarP(&scratchDir, "scratch-dir", "", "", "")
+	pflag.StringVarP(&scratchMinFree, "scratch-min-free", "", "", "")
+	pflag.BoolVarP(&examples, "examples", "", false, "")
+	pflag.IntVarP(&parallel, "parallel", "", 1, "")
+	pflag.StringSliceVarP(&exclusive, "exclusive", "", nil, "")
+	pflag.BoolVarP(&short, "short", "", false, "")
+	pflag.StringVarP(&sizeClass, "size", "", "", "")
+	pflag.BoolVarP(&forceRerun, "force-rerun", "", false, "")
+	pflag.BoolVarP(&skipIdentical, "skip-identical", "", false, "")
+	pflag.StringVarP(&sample, "sample", "", "", "")
+	pflag.StringSliceVarP(&priority, "priority", "", nil, "")
+	pflag.StringArrayVarP(&oldEnv, "old-env", "", nil, "")
+	pflag.StringArrayVarP(&newEnv, "new-env", "", nil, "")
+	pflag.StringArrayVarP(&pinRuntime, "pin-runtime", "", nil, "")
+	pflag.StringVarP(&oldBuildFlags, "old-build-flags", "", "", "")
+	pflag.StringVarP(&newBuildFlags, "new-build-flags", "", "", "")
+	pflag.StringVarP(&controlRef, "control", "", "", "")
+	pflag.BoolVarP(&githubCheck, "github-check", "", false, "")
+	pflag.Float64VarP(&fileIssuesAbove, "file-issues", "", -1, "")
+	pflag.StringSliceVarP(&issueLabels, "issue-labels", "", nil, "")
+	pflag.BoolVarP(&notifyDesktop, "notify-desktop", "", false, "")
+	pflag.BoolVarP(&bell, "bell", "", false, "")
+	pflag.BoolVarP(&sudo, "sudo", "", false, "")
+	pflag.StringSliceVarP(&capAdd, "cap-add", "", nil, "")
+	pflag.BoolVarP(&yes, "yes", "y", false, "")
+	pflag.IntVarP(&numaNode, "numa-node", "", -1, "")
+	pflag.BoolVarP(&noASLR, "no-aslr", "", false, "")
+	pflag.IntVarP(&layouts, "layouts", "", 0, "")
+	pflag.BoolVarP(&energy, "energy", "", false, "")
+	pflag.BoolVarP(&procIO, "io", "", false, "")
+	pflag.StringSliceVarP(&collectorList, "collectors", "", nil, "")
+	pflag.BoolVarP(&leakMetrics, "leak-metrics", "", false, "")
+	pflag.BoolVarP(&rtMetrics, "runtime-metrics", "", false, "")
 	pflag.Parse()
 	prArgs := pflag.Args()
 
 	if help {
 		return runHelp(ctx)
 	}
+	prArgs = append(prArgs, pkgs...)
+	if pkgsFrom != "" {
+		list, err := readPkgList(pkgsFrom)
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			return errors.Errorf("no packages in --pkgs-from %s", pkgsFrom)
+		}
+		prArgs = append(prArgs, list...)
+	}
 	if len(prArgs) == 0 && previousRun == "" {
 		return runHelp(ctx)
 	}
-	pkgFilter := prArgs
-	sort.Strings(pkgFilter)
+	pkgFilter := dedupPkgs(prArgs)
+	if notifyDesktop || bell {
+		start := time.Now()
+		defer func() { notifyCompletion(notifyDesktop, bell, start, retErr) }()
+	}
 
-	// Parse the output format.
-	var out outputFmt
-	var srv *google.Service
-	var err error
-	switch {
-	case outCSV:
-		if outHTML {
-			return errors.New("--csv and --html incompatible")
-		} else if outSheets {
-			return errors.New("--csv and --sheets incompatible")
-		}
-		out = csv
-	case outHTML:
-		if outSheets {
-			return errors.New("--html and --sheets incompatible")
-		}
-		out = html
-	case outSheets:
-		out = sheets
+	units, err := makeUnitOpts(unitMode, bytesMode, thousands)
+	if err != nil {
+		return err
+	}
+	dialect, err := makeCSVDialect(csvDelim, decimalComma)
+	if err != nil {
+		return err
+	}
+	if err := validateCI(ciMethod); err != nil {
+		return err
+	}
+	if fdr < 0 || fdr >= 1 {
+		return errors.New("--fdr must be in [0, 1)")
+	}
+	if order != "delta" && order != "name" && order != "effect" {
+		return errors.Errorf("unknown --sort order %q; expected 'delta', 'effect', or 'name'", order)
+	}
+	if minEffect < 0 || minEffect > 1 {
+		return errors.New("--min-effect must be in [0, 1]")
+	}
+	// Parse the output sinks.
+	sinks, err := parseSinks(formats, outCSV, outHTML, outSheets, slackWebhook)
+	if err != nil {
+		return err
+	}
+	output := &outputConfig{sinks: sinks, units: units, dialect: dialect, hierarchy: hierarchy}
+	if output.subFilter, err = parseSubFilter(subFilters); err != nil {
+		return err
+	}
+	if output.has(sheets) {
 		// Init the Google service ASAP to detect credential issues.
-		if srv, err = google.New(ctx); err != nil {
+		if output.srv, err = google.New(ctx); err != nil {
+			return err
+		}
+	}
+	if output.has(tmpl) {
+		if templatePath == "" {
+			return errors.New("--format=template requires --template")
+		}
+		if output.tmpl, err = loadTemplate(templatePath); err != nil {
 			return err
 		}
-	default:
-		out = text
+	}
+
+	var publish *publishTarget
+	if publishDest != "" {
+		if publish, err = newPublishTarget(publishDest, publishURL); err != nil {
+			return err
+		}
+	} else if publishURL != "" {
+		return errors.New("--publish-url requires --publish")
+	}
+
+	if annotationsPath != "" {
+		if output.annotations, err = loadAnnotations(annotationsPath); err != nil {
+			return errors.Wrap(err, "loading annotations")
+		}
+	}
+
+	var teams owners
+	if ownersPath != "" {
+		if teams, err = loadOwners(ownersPath); err != nil {
+			return errors.Wrap(err, "loading owners")
+		}
+	}
+	threshold, err := parseThresholds(thresholdSpecs)
+	if err != nil {
+		return err
+	}
+	var db *deltaBudget
+	if budget >= 0 {
+		db = &deltaBudget{budget: budget}
+		switch budgetBy {
+		case "package":
+		case "team":
+			if teams == nil {
+				return errors.New("--budget-by=team requires --owners")
+			}
+			db.teams = teams
+		default:
+			return errors.Errorf("invalid --budget-by %q: must be package or team", budgetBy)
+		}
+	}
+
+	if paired && equalizeN {
+		// The samples that --equalize-n adds run after the other side's, so
+		// they can't be paired with them by round.
+		return errors.New("--paired can not be used with --equalize-n, whose added samples aren't interleaved")
+	}
+
+	var gh *github.Client
+	if githubCheck || fileIssuesAbove >= 0 {
+		// Init the GitHub client ASAP to detect credential issues.
+		if gh, err = github.New(); err != nil {
+			return err
+		}
+	}
+
+	// Fetch the recorded numbers of the release to compare against, if any,
+	// which replace building and running the old suite.
+	var release *releaseBundle
+	if strings.HasPrefix(oldRef, releasePrefix) {
+		switch {
+		case controlRef != "" || skipIdentical || equalizeN:
+			return errors.New("--old=release:<tag> can not be used with --control, --skip-identical, or --equalize-n")
+		case previousRun != "":
+			return errors.New("--old=release:<tag> can not be used with --previous-run")
+		case paired:
+			return errors.New("--old=release:<tag> can not be used with --paired, as the release's samples weren't interleaved")
+		}
+		if release, err = fetchReleaseBundle(ctx, releaseStore, strings.TrimPrefix(oldRef, releasePrefix)); err != nil {
+			return err
+		}
+		if ok, err := checkValidRef(ctx, release.Commit); err != nil {
+			return err
+		} else if !ok {
+			return errors.Errorf("commit %s of release %s is not in the local repository; fetch it with git fetch --tags",
+				release.Commit, release.Tag)
+		}
+		oldRef = release.Commit
 	}
 
 	// Parse the specified git refs.
-	oldRef, newRef, err = parseGitRefs(oldRef, newRef)
+	oldRef, newRef, err = parseGitRefs(ctx, oldRef, newRef)
 	if err != nil {
 		return err
 	}
-	oldSubject, err := subjectForRef(oldRef)
+	oldSubject, err := subjectForRef(ctx, oldRef)
 	if err != nil {
 		return err
 	}
-	newSubject, err := subjectForRef(newRef)
+	newSubject, err := subjectForRef(ctx, newRef)
 	if err != nil {
 		return err
 	}
 
+	plugins, err := findPlugins(pluginNames)
+	if err != nil {
+		return err
+	}
+
+	if runOn != "" {
+		if oldHost != "" || newHost != "" {
+			return errors.New("--run-on can not be used with --old-host or --new-host")
+		}
+		oldHost, newHost = runOn, runOn
+	}
+	if buildOn != "" && (useBazel || leakMetrics || rtMetrics) {
+		return errors.New("--build-on can not be used with --bazel or the harness")
+	}
+	if cloud.provider != "" && previousRun == "" {
+		if oldHost != "" || newHost != "" {
+			return errors.New("--cloud can not be used with --old-host or --new-host")
+		}
+		if cloud.machineType == "" {
+			cloud.machineType = map[string]string{cloudGCE: "c2-standard-16", cloudEC2: "c5.4xlarge"}[cloud.provider]
+		}
+		if cloud.zone == "" {
+			cloud.zone = map[string]string{cloudGCE: "us-central1-a", cloudEC2: "us-east-1"}[cloud.provider]
+		}
+		vm, err := provisionVM(ctx, cloud)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := vm.teardown(); err != nil && retErr == nil {
+				retErr = err
+			}
+		}()
+		oldHost, newHost = vm.host, vm.host
+	}
+	if (oldHost != "" || newHost != "") && (cpuProfile || memProfile || mutexProfile) {
+		return errors.New("profiles can not be collected from remote hosts")
+	}
+	if (oldHost != "" || newHost != "") && len(capAdd) > 0 {
+		return errors.New("--cap-add can not be used with remote hosts")
+	}
+	privileged := privilegePrefix(sudo, capAdd)
+	if privileged != nil && previousRun == "" {
+		if err := confirmPrivileges(sudo, capAdd, yes); err != nil {
+			return err
+		}
+	}
+
 	// Build the benchmark suites.
-	oldSuite := makeBenchSuite(oldRef, oldSubject, useBazel)
-	newSuite := makeBenchSuite(newRef, newSubject, useBazel)
+	oldSuite := makeBenchSuite(oldRef, oldSubject, oldHost, useBazel)
+	newSuite := makeBenchSuite(newRef, newSubject, newHost, useBazel)
+	pinned, err := parsePinnedRuntime(pinRuntime)
+	if err != nil {
+		return err
+	}
+	for _, env := range [][]string{oldEnv, newEnv} {
+		if err := checkPinnedRuntime(pinned, env); err != nil {
+			return err
+		}
+	}
+	// The pinned knobs are part of each suite's environment, so that they are
+	// recorded in its output and results aren't shared with unpinned runs.
+	oldSuite.env = append(append([]string(nil), pinned...), oldEnv...)
+	newSuite.env = append(append([]string(nil), pinned...), newEnv...)
+	oldSuite.buildHost, newSuite.buildHost = buildOn, buildOn
+	oldSuite.binRoot, newSuite.binRoot = binDir, binDir
+	oldSuite.skipBrokenBuilds, newSuite.skipBrokenBuilds = skipBrokenBuilds, skipBrokenBuilds
+	oldSuite.showBuildOutput, newSuite.showBuildOutput = showBuildOutput, showBuildOutput
+	failures := &triage{}
+	oldSuite.triage, newSuite.triage = failures, failures
+	defer func() {
+		// Summarize the failures that led up to a fatal error.
+		if retErr != nil {
+			writeTriage(os.Stderr, failures.list())
+		}
+	}()
+	for _, bs := range []*benchSuite{&oldSuite, &newSuite} {
+		if !isK8sHost(bs.host) {
+			continue
+		}
+		if k8s.Volume == "" {
+			return errors.Errorf("--k8s-volume is required to run on %s", bs.host)
+		}
+		c := k8s
+		c.Namespace = strings.TrimPrefix(bs.host, k8sHostPrefix)
+		bs.k8s = &c
+	}
+	var launch []string
+	if memLimit != "" {
+		limit, err := parseMemSize(memLimit)
+		if err != nil {
+			return errors.Wrap(err, "--mem-limit")
+		}
+		// The limit must be applied before sudo, as the cgroup scope belongs
+		// to the user.
+		if launch, err = memLimitPrefix(limit, memLimitMode); err != nil {
+			return err
+		}
+		oldSuite.memLimit, newSuite.memLimit = memLimit, memLimit
+	}
+	launch = append(launch, numaPrefix(numaNode)...)
+	launch = append(launch, privileged...)
+	if noASLR {
+		// The personality must be set after sudo, which clears it.
+		aslr, err := noASLRPrefix(ctx)
+		if err != nil {
+			return err
+		}
+		launch = append(launch, aslr...)
+	}
+	if len(pinned) > 0 {
+		launch = append(launch, unpinnedRuntimePrefix(pinned)...)
+	}
+	oldSuite.launch, newSuite.launch = launch, launch
+	if rtMetrics {
+		collectorList = append(collectorList, "runtime")
+	}
+	harness := leakMetrics
+	for _, name := range collectorList {
+		harness = harness || name == "runtime"
+	}
+	if harness {
+		if useBazel {
+			return errors.New("--leak-metrics and the runtime collector can not be used with --bazel")
+		}
+		oldSuite.harness, newSuite.harness = true, true
+		oldSuite.leakMetrics, newSuite.leakMetrics = leakMetrics, leakMetrics
+	}
+	if layouts > 1 {
+		if oldHost != "" || newHost != "" || useBazel {
+			return errors.New("--layouts can not be used with remote hosts or --bazel")
+		}
+		oldSuite.layouts, newSuite.layouts = layouts, layouts
+	}
+	oldSuite.buildFlags, newSuite.buildFlags = strings.Fields(oldBuildFlags), strings.Fields(newBuildFlags)
+	for _, bs := range []*benchSuite{&oldSuite, &newSuite} {
+		if bs.commit, err = getRefAsSHA(ctx, bs.ref); err != nil {
+			return err
+		}
+		for _, kv := range bs.env {
+			if !strings.Contains(kv, "=") {
+				return errors.Errorf("invalid environment variable %q: must be KEY=VALUE", kv)
+			}
+		}
+	}
+	var controlSuite *benchSuite
+	if controlRef != "" {
+		if skipIdentical {
+			return errors.New("--skip-identical can not be used with --control, which compares every package's noise")
+		}
+		if controlRef, err = getRefAsSHA(ctx, controlRef); err != nil {
+			return err
+		}
+		controlRef = shortenRef(ctx, controlRef)
+		controlSubject, err := subjectForRef(ctx, controlRef)
+		if err != nil {
+			return err
+		}
+		cs := makeBenchSuite(controlRef, controlSubject, oldHost, useBazel)
+		cs.label = controlLabel
+		cs.k8s = oldSuite.k8s
+		cs.buildHost = buildOn
+		cs.binRoot = binDir
+		cs.triage = failures
+		cs.skipBrokenBuilds = skipBrokenBuilds
+		cs.showBuildOutput = showBuildOutput
+		cs.launch = launch
+		cs.env = pinned
+		cs.memLimit = memLimit
+		cs.harness, cs.leakMetrics = harness, leakMetrics
+		if cs.commit, err = getRefAsSHA(ctx, cs.ref); err != nil {
+			return err
+		}
+		controlSuite = &cs
+		defer controlSuite.close()
+	}
+	secrets, err := loadHookSecrets(ctx, secretsFiles, secretsCmd)
+	if err != nil {
+		return err
+	}
+	var scratch *scratchSpace
+	if scratchDir != "" {
+		if oldSuite.isRemote() || newSuite.isRemote() {
+			return errors.New("--scratch-dir is not supported with remote hosts")
+		}
+		if scratch, err = newScratchSpace(scratchDir, scratchMinFree); err != nil {
+			return err
+		}
+	} else if scratchMinFree != "" {
+		return errors.New("--scratch-min-free requires --scratch-dir")
+	}
+	var generate *generateStep
+	if generateCmd != "" {
+		generate = &generateStep{check: generateCheck, generate: generateCmd}
+	} else if generateCheck != "" {
+		return errors.New("--generate-check requires --generate")
+	}
+	procs, err := parseProcsNormalization(normalizeProcs)
+	if err != nil {
+		return err
+	}
+	warmup, err := parseWarmupPolicy(dropWarmup)
+	if err != nil {
+		return err
+	}
+	projection, err := parseProjection(benchFilter, groupBy)
+	if err != nil {
+		return err
+	}
+	payloads, err := parsePayloadSizes(payloadSizes)
+	if err != nil {
+		return err
+	}
+	dirs, err := parseDirections(directionSpecs)
+	if err != nil {
+		return err
+	}
+	if output.srv != nil {
+		output.srv.SmallerBetter = func(t *benchstat.Table) bool { return !dirs.higherIsBetter(t) }
+	}
+	var redact *redactor
+	if redactOutput {
+		redact = newRedactor(ctx, oldHost, newHost, buildOn)
+	}
+	for _, bs := range []*benchSuite{&oldSuite, &newSuite, controlSuite} {
+		if bs != nil {
+			bs.secrets = secrets
+			bs.generate = generate
+			bs.scratch = scratch
+			bs.procs = procs
+			bs.warmup = warmup
+			bs.projection = projection
+			bs.payloads = payloads
+			bs.redact = redact
+			bs.validateLines = validateLines
+		}
+	}
+	cmp := &compareConfig{
+		paired:       paired,
+		ci:           ciMethod,
+		fdr:          fdr,
+		effectSizes:  effectSize || minEffect > 0 || order == "effect",
+		sortByEffect: order == "effect",
+		minEffect:    minEffect,
+		directions:   dirs,
+	}
+	snap, err := loadEnvSnapshot()
+	if err != nil {
+		return err
+	}
+	if snap != nil {
+		if goVersion, err := capture(ctx, "go", "env", "GOVERSION"); err == nil && goVersion != snap.GoVersion {
+			fmt.Fprintf(os.Stderr, "warning: the recorded environment image %s has %s, but the local toolchain is %s; "+
+				"rerun benchdiff snapshot-env\n", snap.Image, snap.GoVersion, goVersion)
+		}
+		for _, bs := range []*benchSuite{&oldSuite, &newSuite, controlSuite} {
+			if bs != nil {
+				bs.image = snap.Image
+			}
+		}
+	}
+	if oldSuite.id() == newSuite.id() {
+		// An A/A comparison, which measures the noise of the machine.
+		if skipIdentical {
+			return errors.Errorf("old and new suites are identical (%s), which --skip-identical would skip entirely",
+				oldSuite.id())
+		}
+		newSuite.label = selfLabel
+	}
 	defer oldSuite.close()
 	defer newSuite.close()
 
 	printHeader(os.Stdout, oldSuite, newSuite)
+	if err := ignoreBenchdiffDir(); err != nil {
+		return err
+	}
+	runID, err := recordJournal(&oldSuite, &newSuite, pkgFilter, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "recorded run %s; replay with 'benchdiff rerun %s'\n", runID, runID)
 
-	if previousRun == "" {
-		if err := buildBenches(ctx, pkgFilter, postChck, &oldSuite, &newSuite); err != nil {
+	// Parse the run configuration.
+	if reuseProcess {
+		if pflag.CommandLine.Changed("strategy") && strategy != strategyInterleaveCount {
+			return errors.New("--reuse-process and --strategy incompatible")
+		}
+		strategy = strategyInterleaveCount
+	}
+	if err := validateSizeClass(sizeClass); err != nil {
+		return err
+	}
+	if sizeClass == sizeSmall {
+		short = true
+	}
+	if energy {
+		collectorList = append(collectorList, "energy")
+	}
+	if procIO {
+		collectorList = append(collectorList, "io")
+	}
+	if len(collectorList) > 0 && (oldHost != "" || newHost != "") {
+		return errors.New("collectors can not be used with remote hosts")
+	}
+	// perf stat attaches to the process that benchdiff starts, which under
+	// sudo is sudo itself rather than the test binary.
+	for _, name := range collectorList {
+		if name == "perf" && privileged != nil {
+			return errors.New("the perf collector can not be used with --sudo or --cap-add")
+		}
+	}
+	collectors, err := newCollectors(collectorList)
+	if err != nil {
+		return err
+	}
+	if layouts > 1 && strategy == strategyInterleaveCount {
+		return errors.New("--layouts requires a strategy that runs each iteration in its own process")
+	}
+	if autoBenchTime != "" && strategy != strategyInterleaveProcess {
+		return errors.New("--auto-benchtime requires --strategy=interleave-process")
+	}
+	if parallel > 1 {
+		switch {
+		case cpuProfile || memProfile || mutexProfile:
+			return errors.New("--parallel can not be used with profiles")
+		case len(collectorList) > 0 || leakMetrics:
+			return errors.New("--parallel can not be used with collectors or --leak-metrics")
+		case autoBenchTime != "" || (preview && pflag.CommandLine.Changed("preview")):
+			return errors.New("--parallel can not be used with --auto-benchtime or --preview")
+		case numaNode >= 0:
+			return errors.New("--parallel can not be used with --numa-node")
+		}
+		// The preview, which is on by default, interleaves with the output
+		// of the concurrent tests.
+		preview = false
+	}
+	if shardBenchmarks && (cpuProfile || memProfile || mutexProfile) {
+		return errors.New("--shard-benchmarks can not be used with profiles")
+	}
+	if fuzzSeeds {
+		switch {
+		case cpuProfile || memProfile || mutexProfile:
+			return errors.New("--fuzz-seeds can not be used with profiles")
+		case len(collectorList) > 0 || leakMetrics:
+			return errors.New("--fuzz-seeds can not be used with collectors or --leak-metrics")
+		case shardBenchmarks || autoBenchTime != "" || skipBench != "":
+			return errors.New("--fuzz-seeds can not be used with --shard-benchmarks, --auto-benchtime, or --skip-bench")
+		}
+	}
+	if skipBench != "" {
+		if _, err := regexp.Compile(skipBench); err != nil {
+			return errors.Wrap(err, "--skip-bench")
+		}
+		if autoBenchTime != "" && strings.Contains(skipBench, "/") {
+			return errors.New("--skip-bench can not match sub-benchmarks when used with --auto-benchtime")
+		}
+	}
+	var sampleFrac float64
+	if sample != "" {
+		if sampleFrac, err = parseSample(sample); err != nil {
+			return err
+		}
+	}
+	if (shuffle != shuffleOff || sample != "") && !pflag.CommandLine.Changed("seed") {
+		seed = time.Now().UnixNano()
+	}
+	cfg := runConfig{
+		resultOptions: resultOptions{
+			pkgs:            pkgFilter,
+			runPattern:      runPattern,
+			skipBench:       skipBench,
+			shardBenchmarks: shardBenchmarks,
+			fuzzSeeds:       fuzzSeeds,
+			examples:        examples,
+			parallel:        parallel,
+			exclusive:       exclusive,
+			benchTime:       benchTime,
+			cpuProfile:      cpuProfile,
+			memProfile:      memProfile,
+			mutexProfile:    mutexProfile,
+			itersPerTest:    itersPerTest,
+			strategy:        strategy,
+			autoBenchTime:   autoBenchTime,
+			short:           short,
+			sizeClass:       sizeClass,
+			skipIdentical:   skipIdentical,
+			equalizeN:       equalizeN,
+			sample:          sample,
+			collectorList:   collectorList,
+		},
+		schedule:   schedule,
+		shuffle:    shuffle,
+		seed:       seed,
+		priority:   priority,
+		control:    controlSuite,
+		compare:    cmp,
+		collectors: collectors,
+		preview:    preview,
+		plugins:    plugins,
+		units:      units,
+		frozenOld:  release != nil,
+	}
+	cacheKey := resultCacheKey(&oldSuite, &newSuite, &cfg)
+	useCache := !forceRerun && !cpuProfile && !memProfile && !mutexProfile && controlSuite == nil && release == nil
+
+	var identical []string
+	var cached bool // whether the results were served from the cache
+	switch {
+	case previousRun == "" && useCache && hasCachedResults(cacheKey):
+		if err := loadCachedResults(cacheKey, &oldSuite, &newSuite); err != nil {
+			return err
+		}
+		cached = true
+	case previousRun == "":
+		suites := []*benchSuite{&oldSuite, &newSuite}
+		if release != nil {
+			suites = suites[1:]
+		}
+		if controlSuite != nil {
+			suites = append(suites, controlSuite)
+		}
+		if err := buildBenches(ctx, pkgFilter, postChck, allowToolchainSkew, suites...); err != nil {
+			return err
+		}
+		for _, bs := range suites {
+			if err := bs.pushBinaries(ctx); err != nil {
+				return err
+			}
+		}
+		if err := runHooks(ctx, plugins, hookEvent{Event: hookPostBuild}, &oldSuite, &newSuite); err != nil {
 			return err
 		}
 
 		// Run the benchmarks.
 		tests := oldSuite.intersectTests(&newSuite)
-		err = runCmpBenches(
-			ctx, &oldSuite, &newSuite, tests.sorted(), runPattern,
-			benchTime, cpuProfile, memProfile, mutexProfile, itersPerTest, preview,
-		)
+		if release != nil {
+			if err := release.install(&oldSuite, time.Now().UTC()); err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, release.describe(ctx))
+			tests = newSuite.intersectTests(&newSuite)
+		}
+		if controlSuite != nil {
+			for t := range tests {
+				if _, ok := controlSuite.testFiles[t]; !ok {
+					delete(tests, t)
+				}
+			}
+		}
+		if skipIdentical {
+			if identical, err = identicalTests(&oldSuite, &newSuite, tests); err != nil {
+				return err
+			}
+			for _, t := range identical {
+				delete(tests, t)
+			}
+		}
+		if shuffle != shuffleOff {
+			fmt.Fprintf(os.Stderr, "shuffling %s with seed %d\n", shuffle, seed)
+		}
+		if sample != "" {
+			fmt.Fprintf(os.Stderr, "sampling %s of benchmarks with seed %d\n", sample, seed)
+			cfg.testPatterns, err = sampleBenchmarks(ctx, &oldSuite, tests.sorted(), runPattern, sampleFrac, seed)
+			if err != nil {
+				return err
+			}
+		}
+		runBenches := runCmpBenches
+		if parallel > 1 {
+			runBenches = runParallel
+		}
+		if cfg.progress, err = startProgress(runID, itersPerTest, failures, newSuite.getReportFile(".txt")); err != nil {
+			return err
+		}
+		err := runBenches(ctx, &oldSuite, &newSuite, tests.sorted(), &cfg)
+		if progressErr := cfg.progress.finish(err); err == nil {
+			err = progressErr
+		}
 		if err != nil {
 			return err
 		}
-	} else {
+
+		if equalizeN {
+			tables, err := computeTables(&oldSuite, &newSuite, true, cmp)
+			if err != nil {
+				return err
+			}
+			if err := equalizeSamples(ctx, &oldSuite, &newSuite, tables, benchTime); err != nil {
+				return err
+			}
+		}
+		if release == nil {
+			if err := storeCachedResults(cacheKey, &oldSuite, &newSuite); err != nil {
+				return err
+			}
+		}
+	default:
 		// Find output files for the given run.
 		t, err := time.Parse(timeFormat, previousRun)
 		if err != nil {
 			return err
 		}
 
-		// Install existing artifacts into benchSuites.
-		oldSuite.artDir = testArtifactsDir(oldSuite.ref)
-		oldSuite.outFile, err = os.Open(oldSuite.getOutputFile(t))
+		// Install existing artifacts into benchSuites, decompressing them if
+		// the run compressed them.
+		for _, bs := range []*benchSuite{&oldSuite, &newSuite, controlSuite} {
+			if bs == nil {
+				continue
+			}
+			bs.artDir = testArtifactsDir(bs.id())
+			if err := decompressRun(ctx, bs, bs.getOutputFile(t)); err != nil {
+				return err
+			}
+			bs.outFile, err = os.Open(bs.getOutputFile(t))
+			if err != nil {
+				return err
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "Found previous run; old=%s, new=%s\n", oldSuite.outFile.Name(), newSuite.outFile.Name())
+	}
+	// Process the benchmark output.
+	if output.has(html) || publish != nil || noise {
+		history, err := loadHistory(ctx, historyDir)
+		if err != nil {
+			return err
+		}
+		history = entriesWithConfig(history, historyConfig(&newSuite, &cfg))
+		if output.sparks, err = loadSparklines(history, sparklineRuns); err != nil {
+			return err
+		}
+		if noise {
+			if cmp.noise, err = loadNoiseScores(history); err != nil {
+				return err
+			}
+		}
+	}
+	res, err := processBenchOutput(ctx, os.Stdout, &oldSuite, &newSuite, controlSuite, order == "name", pkgFilter, cmp, output)
+	if err != nil {
+		return err
+	}
+	if err := writeReport(&oldSuite, &newSuite, res, true); err != nil {
+		return err
+	}
+	ev := hookEvent{Event: hookPostRun, Tables: makeJSONTables(res)}
+	if err := runHooks(ctx, plugins, ev, &oldSuite, &newSuite); err != nil {
+		return err
+	}
+	if teams != nil {
+		summaries, err := summarizeTeams(teams, &newSuite, res)
+		if err != nil {
+			return err
+		}
+		writeTeamSummaries(os.Stdout, summaries)
+		if err := notifyTeams(ctx, teams, &oldSuite, &newSuite, summaries); err != nil {
+			return err
+		}
+	}
+	if isSelfComparison(&newSuite) {
+		writeSelfComparison(os.Stdout, res)
+	}
+	logIdenticalTests(os.Stdout, identical)
+	writeTriage(os.Stdout, failures.list())
+	if sample != "" {
+		fmt.Printf("\n%s\n", sampleNote(sample, seed))
+	}
+	if warmup != nil {
+		fmt.Printf("\n%s\n", warmupNote(&oldSuite, &newSuite))
+	}
+	logProfileLocations(&oldSuite, &newSuite, cpuProfile, memProfile, mutexProfile)
+	if len(newSuite.binDirs) > 1 {
+		if err := logLayoutVariance(os.Stdout, &oldSuite, &newSuite, res); err != nil {
+			return err
+		}
+	}
+	if memProfile {
+		if err := attributeAllocs(os.Stdout, &oldSuite, &newSuite, res); err != nil {
+			return err
+		}
+	}
+	// Cached results were recorded when they were run, and recording them
+	// again would skew the noise scores.
+	if record && cached {
+		fmt.Fprintln(os.Stderr, "not recording cached results in the history store again")
+	} else if record {
+		if err := recordHistory(ctx, historyDir, &newSuite, &cfg, time.Now()); err != nil {
+			return err
+		}
+	}
+	if publish != nil {
+		url, err := publish.publish(ctx, runID, &oldSuite, &newSuite, res, output.sparks)
+		if err != nil {
+			return errors.Wrap(err, "publishing report")
+		}
+		fmt.Printf("\npublished report: %s\n", url)
+	}
+	if crossMachine(&oldSuite, &newSuite) {
+		fmt.Printf("\nnormalized new results by calibration ratio %.3f (new/old)\n", newSuite.calRatio)
+	}
+
+	if githubCheck {
+		if err := reportCheckRun(ctx, gh, &oldSuite, &newSuite, res, threshold, cmp); err != nil {
+			return err
+		}
+	}
+	if fileIssuesAbove >= 0 {
+		pkgs, err := benchPkgs(newSuite.outFile)
 		if err != nil {
 			return err
 		}
-		newSuite.artDir = testArtifactsDir(newSuite.ref)
-		newSuite.outFile, err = os.Open(newSuite.getOutputFile(t))
+		regs := findRegressions(res, fileIssuesAbove, pkgs)
+		confirmed, paths, err := verifyRegressions(ctx, &oldSuite, &newSuite, regs, fileIssuesAbove, &cfg)
 		if err != nil {
 			return err
 		}
-
-		fmt.Fprintf(os.Stderr, "Found previous run; old=%s, new=%s\n", oldSuite.outFile.Name(), newSuite.outFile.Name())
-	}
-	// Process the benchmark output.
-	res, err := processBenchOutput(ctx, os.Stdout, &oldSuite, &newSuite, order == "name", out, pkgFilter, srv)
-	if err != nil {
-		return err
+		if len(regs) > 0 {
+			fmt.Printf("\nconfirmed %d of %d regression(s) above %.2f%%\n", len(confirmed), len(regs), fileIssuesAbove*100)
+		}
+		if err := fileIssues(ctx, gh, &oldSuite, &newSuite, confirmed, paths, issueLabels); err != nil {
+			return err
+		}
+	}
+
+	// The budget reads the new suite's output, so evaluate it before the
+	// artifacts are compressed.
+	var budgetGroups []budgetGroup
+	if db != nil {
+		if budgetGroups, err = db.evaluate(&newSuite, res, cmp.directions); err != nil {
+			return err
+		}
+		db.write(os.Stdout, budgetGroups)
+	}
+	if compress {
+		if err := compressArtifacts(ctx, &oldSuite, &newSuite, controlSuite); err != nil {
+			return err
+		}
+	}
+
+	if summary {
+		if err := writeArtifactSummary(os.Stderr, runID, &oldSuite, &newSuite, controlSuite); err != nil {
+			return err
+		}
+	}
+
+	// Determine whether any package exceeded its budget, or any tests the
+	// allowable regression threshold.
+	if db != nil {
+		if err := db.check(budgetGroups); err != nil {
+			return err
+		}
 	}
-	logProfileLocations(&oldSuite, &newSuite, cpuProfile, memProfile, mutexProfile)
-
-	// Determine whether any tests exceeded the allowable regression threshold.
-	return checkPassing(threshold, res)
+	return checkPassing(threshold, cmp, res)
 }
 
 func runHelp(ctx context.Context) error {
@@ -275,41 +1585,46 @@ func runHelp(ctx context.Context) error {
 	return nil
 }
 
-func parseGitRefs(oldRef, newRef string) (string, string, error) {
+func parseGitRefs(ctx context.Context, oldRef, newRef string) (string, string, error) {
 	var err error
 	if newRef == "" {
-		newRef, err = getCurRef()
+		newRef, err = getCurRef(ctx)
+		if err != nil {
+			return "", "", err
+		}
+	} else if newRef == worktreeRef {
+		newRef, err = snapshotWorktree(ctx)
 		if err != nil {
 			return "", "", err
 		}
 	} else {
-		newRef, err = getRefAsSHA(newRef)
+		newRef, err = getRefAsSHA(ctx, newRef)
 		if err != nil {
 			return "", "", err
 		}
 	}
-	newRef = shortenRef(newRef)
-	if ok, err := checkValidRef(newRef); err != nil {
+	newRef = shortenRef(ctx, newRef)
+	if ok, err := checkValidRef(ctx, newRef); err != nil {
 		return "", "", err
 	} else if !ok {
 		return "", "", errors.Errorf("invalid git ref %q", newRef)
 	}
 
 	if oldRef == "" {
-		oldRef, err = getPrevRef(newRef)
+		oldRef, err = getPrevRef(ctx, newRef)
 		if err != nil {
 			return "", "", err
 		}
 	} else if oldRef == "lastmerge" {
-		oldRef, err = capture("git", "log", "-n", "1", "--merges", "--format=%H", newRef)
+		oldRef, err = capture(ctx, "git", "log", "-n", "1", "--merges", "--format=%H", newRef)
 	} else {
-		oldRef, err = getRefAsSHA(oldRef)
+		oldRef, err = getRefAsSHA(ctx, oldRef)
 		if err != nil {
 			return "", "", err
 		}
 	}
-	oldRef = shortenRef(oldRef)
-	if ok, err := checkValidRef(oldRef); err != nil {
+	oldRef = shortenRef(ctx, oldRef)
+	if ok, err := checkValidRef(ctx, oldRef); err != nil {
 		return "", "", err
 	} else if !ok {
 		return "", "", errors.Errorf("invalid git ref %q", oldRef)
@@ -318,70 +1633,275 @@ func parseGitRefs(oldRef, newRef string) (string, string, error) {
 	return oldRef, newRef, nil
 }
 
-func buildBenches(ctx context.Context, pkgFilter []string, postChck string, bss ...*benchSuite) error {
-	// Get the current branch so we can revert to it after, if possible.
-	if ref, ok, err := getCurSymbolicRef(); err != nil {
-		return err
-	} else if ok {
-		defer checkoutRef(ref, "")
-	}
-	now := time.Now() // used to uniquely name artifact files
+func buildBenches(
+	ctx context.Context, pkgFilter []string, postChck string, allowSkew bool, bss ...*benchSuite,
+) error {
+	now := time.Now().UTC() // used to uniquely name artifact files
 	for _, bs := range bss {
-		if err := bs.build(pkgFilter, postChck, now); err != nil {
+		if err := bs.build(ctx, pkgFilter, postChck, now); err != nil {
 			return err
 		}
 	}
-	return nil
+	if err := checkToolchains(ctx, bss, allowSkew); err != nil {
+		return err
+	}
+	return recordLinkedLibs(ctx, bss)
 }
 
-func runCmpBenches(
-	ctx context.Context,
-	bs1, bs2 *benchSuite,
-	tests []string,
-	runPattern, benchTime string,
-	cpuProfile, memProfile, mutexProfile bool,
-	itersPerTest int,
-	preview bool,
-) error {
-	var spinner ui.Spinner
+// runConfig holds the options that control how benchmarks are run.
+type runConfig struct {
+	resultOptions
+	schedule string
+	// frozenOld is whether the old suite's results are recorded numbers,
+	// e.g. of a release, so that only the new suite is run.
+	frozenOld    bool
+	shuffle      string
+	seed         int64
+	testPatterns map[string]string // per-test overrides of runPattern
+	priority     []string          // packages to run first
+	control      *benchSuite       // control suite, if any
+	compare      *compareConfig    // for previews and partial reports
+	collectors   []Collector
+	preview      bool
+	plugins      []plugin
+	units        unitOpts // scaling of values in text output
+	progress     *progressFile
+}
+
+// testPattern returns the -test.bench pattern to run the test with.
+func (cfg *runConfig) testPattern(test string) string {
+	if p, ok := cfg.testPatterns[test]; ok {
+		return p
+	}
+	return cfg.runPattern
+}
+
+func runCmpBenches(ctx context.Context, bs1, bs2 *benchSuite, tests []string, cfg *runConfig) error {
+	runs, nPrio, err := prioritizeRuns(tests, cfg)
+	if err != nil {
+		return err
+	}
+	setup := make(map[string]*setupStats)
+	defer logSetupDominated(setup, cfg.strategy == strategyInterleaveCount)
+	ramps := make(map[string]*rampState)
+	defer logRamps(ramps, cfg.autoBenchTime)
+	var ramped *rampedBenchmarks
+	if cfg.autoBenchTime != "" {
+		ramped = newRampedBenchmarks(cfg.autoBenchTime)
+	}
+	spinner := new(ui.Spinner)
 	spinner.Start(os.Stderr, "running benchmarks:\n")
-	defer spinner.Stop()
-	for i, t := range tests {
-		pkg := testBinToPkg(t)
-		for j := 0; j < itersPerTest; j++ {
-			pkgFrac := ui.Fraction(i+1, len(tests))
-			iterFrac := ui.Fraction(j+1, itersPerTest)
-			var buf bytes.Buffer
-			if preview && j > 0 {
-				_, err := processBenchOutput(ctx, &buf, bs1, bs2, true, text, tests, nil)
-				if err != nil {
-					return err
-				}
-				_, _ = fmt.Fprintln(&buf)
-			}
-			_, _ = fmt.Fprintf(&buf, "pkg=%s iter=%s %s",
-				pkgFrac, iterFrac,
-				pkg)
-			spinner.Update(buf.String())
-
-			// Interleave test suite runs instead of using -count=itersPerTest. The
-			// idea is that this reduces the chance that we pick up external noise
-			// with a time correlation.
-			for _, b := range []*benchSuite{bs1, bs2} {
-				if j == 0 {
-					if err := b.unlinkProfiles(); err != nil {
-						return err
-					}
-				}
-				if err := runSingleBench(b, t, runPattern, benchTime, cpuProfile, memProfile, mutexProfile); err != nil {
-					return err
-				}
+	defer func() { spinner.Stop() }()
+	suites := []*benchSuite{bs1, bs2, cfg.control}
+	for _, bs := range suites {
+		if bs != nil {
+			bs.ramped = ramped
+		}
+	}
+	it := &cmpIterations{
+		cfg:    cfg,
+		suites: suites,
+		setup:  setup,
+		ramps:  ramps,
+		shards: make(map[string][]string),
+	}
+	rn := runner.Runner{Runs: make([]runner.Run, len(runs))}
+	for i, r := range runs {
+		idxs := r.suites
+		if cfg.control != nil {
+			idxs = withControl(idxs)
+		}
+		if cfg.frozenOld {
+			idxs = withoutOld(idxs)
+		}
+		rn.Runs[i] = runner.Run{Test: r.test, TestIdx: r.testIdx, Iter: r.iter, Count: r.count, Suites: idxs}
+	}
+	var iterStart time.Time
+	rn.OnIterationStart = func(r runner.Run) error {
+		iterStart = time.Now()
+		cfg.progress.iterationStarted(r.Test, r.Iter+1)
+		pkg := testBinToPkg(r.Test)
+		pkgFrac := ui.Fraction(r.TestIdx+1, len(tests))
+		iterFrac := ui.Fraction(r.Iter+r.Count, cfg.itersPerTest)
+		var buf bytes.Buffer
+		if cfg.preview && r.Iter > 0 {
+			_, err := processBenchOutput(ctx, &buf, bs1, bs2, cfg.control, true, tests, cfg.compare, textOutput(cfg.units))
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintln(&buf)
+		}
+		_, _ = fmt.Fprintf(&buf, "pkg=%s iter=%s %s",
+			pkgFrac, iterFrac,
+			pkg)
+		spinner.Update(buf.String())
 
-				if err := b.mergeProfiles(cpuProfile, memProfile, mutexProfile); err != nil {
+		// By default, interleave test suite runs instead of using
+		// -count=itersPerTest. The idea is that this reduces the chance that we
+		// pick up external noise with a time correlation. See --strategy.
+		if cfg.autoBenchTime != "" && r.Iter == rampAfterIters {
+			if _, ok := ramps[r.Test]; !ok {
+				if ramps[r.Test], err = decideRamp(bs1, bs2, r.Test, cfg.compare); err != nil {
 					return err
 				}
+				ramped.add(ramps[r.Test])
+			}
+		}
+		return nil
+	}
+	rn.Exec = it.exec
+	var done int
+	rn.OnIterationDone = func(r runner.Run) error {
+		cfg.progress.iterationDone(r.Test, r.Count, time.Since(iterStart))
+		ev := hookEvent{Event: hookPostIteration, Test: r.Test, Iteration: r.Iter + 1}
+		if err := runHooks(ctx, cfg.plugins, ev, bs1, bs2); err != nil {
+			return err
+		}
+		if err := writePartialReport(bs1, bs2, cfg.compare); err != nil {
+			return err
+		}
+
+		// Print the comparison of the prioritized tests as soon as they
+		// complete, if other tests remain to be run.
+		if done++; done == nPrio && nPrio < len(runs) {
+			spinner.Stop()
+			fmt.Println("results of prioritized packages (other packages still running):")
+			if _, err := processBenchOutput(ctx, os.Stdout, bs1, bs2, cfg.control, false, tests, cfg.compare, textOutput(cfg.units)); err != nil {
+				return err
+			}
+			fmt.Println()
+			spinner = new(ui.Spinner)
+			spinner.Start(os.Stderr, "running benchmarks:\n")
+		}
+		return nil
+	}
+	return rn.Run(ctx)
+}
+
+// cmpIterations runs the iterations of runCmpBenches against the suites.
+type cmpIterations struct {
+	cfg    *runConfig
+	suites []*benchSuite // the old, new, and control suites
+	setup  map[string]*setupStats
+	ramps  map[string]*rampState
+	// shards holds the benchmark patterns of each suite's tests, if sharding.
+	shards map[string][]string
+}
+
+// exec runs an iteration against the suite at the index, as the Exec of a
+// runner.Runner.
+func (it *cmpIterations) exec(ctx context.Context, idx int, r runner.Run) error {
+	cfg, bs1, bs2 := it.cfg, it.suites[0], it.suites[1]
+	b := it.suites[idx]
+	if r.TestIdx == 0 && idx < 2 && crossMachine(bs1, bs2) {
+		if err := runCalibration(ctx, b); err != nil {
+			return err
+		}
+	}
+	b.selectLayout(r.Iter)
+	if r.Iter == 0 {
+		if err := b.unlinkProfiles(); err != nil {
+			return err
+		}
+	}
+	if err := b.writeConfig(r.Iter+1, cfg.benchTime); err != nil {
+		return err
+	}
+	off, err := b.outFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	// Probe the binary's flags before starting the clock, so that the probe
+	// doesn't count as setup time.
+	if !cfg.fuzzSeeds {
+		b.helpOutput(ctx, b.getTestBinary(r.Test))
+	}
+	start := time.Now()
+	ramp := it.ramps[r.Test]
+	var skipPattern string
+	if ramp != nil && len(ramp.ramped) > 0 {
+		skipPattern = topLevelRegexp(ramp.ramped)
+	}
+	patterns := []string{cfg.testPattern(r.Test)}
+	if cfg.shardBenchmarks {
+		key := b.id() + "/" + r.Test
+		if _, ok := it.shards[key]; !ok {
+			if it.shards[key], err = benchShards(ctx, b, r.Test, patterns[0]); err != nil {
+				return err
 			}
 		}
+		patterns = it.shards[key]
+	}
+	for _, pattern := range patterns {
+		err = runSingleBench(ctx, b, r.Test, benchOpts{
+			runPattern:    pattern,
+			skipPattern:   joinSkipPatterns(skipPattern, cfg.skipBench),
+			iter:          r.Iter + 1,
+			tolerateCrash: cfg.shardBenchmarks,
+			fuzzSeeds:     cfg.fuzzSeeds,
+			benchTime:     cfg.benchTime,
+			count:         r.Count,
+			short:         cfg.short,
+			sizeClass:     cfg.sizeClass,
+			collectors:    cfg.collectors,
+			cpuProfile:    cfg.cpuProfile,
+			memProfile:    cfg.memProfile,
+			mutexProfile:  cfg.mutexProfile,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.examples {
+		err := runExamples(ctx, b, r.Test, benchOpts{
+			runPattern: cfg.runPattern,
+			iter:       r.Iter + 1,
+			benchTime:  cfg.benchTime,
+			count:      r.Count,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	wall := time.Since(start)
+	reported, err := reportedBenchTime(b.outFile, off)
+	if err != nil {
+		return err
+	}
+	st, ok := it.setup[r.Test]
+	if !ok {
+		st = &setupStats{}
+		it.setup[r.Test] = st
+	}
+	st.wall += wall
+	st.bench += reported
+
+	// Run the fast, noisy benchmarks separately with a longer benchtime,
+	// selecting only them, at the levels below the top-level benchmarks
+	// as the run pattern does.
+	if skipPattern != "" {
+		if err := b.writeConfig(r.Iter+1, cfg.autoBenchTime); err != nil {
+			return err
+		}
+		runPattern := topLevelRegexp(ramp.ramped)
+		if p := cfg.testPattern(r.Test); strings.Contains(p, "/") {
+			runPattern += p[strings.Index(p, "/"):]
+		}
+		opts := benchOpts{
+			runPattern:  runPattern,
+			skipPattern: cfg.skipBench,
+			iter:        r.Iter + 1,
+			benchTime:   cfg.autoBenchTime,
+			short:       cfg.short,
+			sizeClass:   cfg.sizeClass,
+		}
+		if err := runSingleBench(ctx, b, r.Test, opts); err != nil {
+			return err
+		}
+	}
+
+	if err := b.mergeProfiles(cfg.cpuProfile, cfg.memProfile, cfg.mutexProfile); err != nil {
+		return err
 	}
 	return nil
 }
@@ -460,106 +1980,330 @@ func (bs *benchSuite) mergeProfiles(cpuProfile, memProfile, mutexProfile bool) e
 	return nil
 }
 
-func runSingleBench(
-	bs *benchSuite, test, runPattern, benchTime string, cpuProfile, memProfile, mutexProfile bool,
-) error {
-	bin := bs.getTestBinary(test)
+// benchOpts holds the options for a single invocation of a test binary.
+type benchOpts struct {
+	runPattern  string // -test.bench
+	skipPattern string // -test.skip
+	iter        int    // iteration of the run, for failure triage, or 0
+	// tolerateCrash records crashes of the binary, rather than failing the
+	// run, like benchmark failures.
+	tolerateCrash bool
+	// cpuTime, if set, is populated with the user and system CPU time of the
+	// invocation.
+	cpuTime *time.Duration
+	// fuzzSeeds runs the seed corpora of fuzz targets instead of benchmarks.
+	// See runFuzzSeeds.
+	fuzzSeeds    bool
+	benchTime    string // -test.benchtime
+	count        int    // -test.count
+	short        bool   // -test.short
+	sizeClass    string // exported as BENCHDIFF_SIZE
+	collectors   []Collector
+	cpuProfile   bool
+	memProfile   bool
+	mutexProfile bool
+}
+
+// helpOutputs caches the --help output of test binaries, keyed by host and
+// path, so that the flags of a binary are probed once rather than on every
+// invocation, where the probe would count towards its time. It is shared by
+// the copies of a suite, which may run concurrently under --parallel.
+type helpOutputs struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
 
-	// Determine whether the binary has a --logtostderr flag. Use CombinedOutput
-	// and ignore the error because --help creates a failed error status. If there
-	// is a real error we'll hit it below.
-	cmd := exec.Command(bin, "--help")
+// helpOutput returns the --help output of the test binary. It uses
+// CombinedOutput and ignores the error because --help creates a failed error
+// status. If there is a real error, running the binary will hit it.
+func (bs *benchSuite) helpOutput(ctx context.Context, bin string) []byte {
+	key := bs.host + ":" + bin
+	if bs.help != nil {
+		bs.help.mu.Lock()
+		defer bs.help.mu.Unlock()
+		if out, ok := bs.help.m[key]; ok {
+			return out
+		}
+	}
+	helpArgs := bs.remoteCommand([]string{bin, "--help"})
+	cmd := exec.CommandContext(ctx, helpArgs[0], helpArgs[1:]...)
 	out, _ := cmd.CombinedOutput()
+	if bs.help != nil && ctx.Err() == nil {
+		bs.help.m[key] = out
+	}
+	return out
+}
+
+func runSingleBench(ctx context.Context, bs *benchSuite, test string, opts benchOpts) error {
+	if opts.fuzzSeeds {
+		return runFuzzSeeds(ctx, bs, test, opts)
+	}
+	bin := bs.getTestBinary(test)
+
+	// Determine whether the binary has a --logtostderr flag.
+	out := bs.helpOutput(ctx, bin)
 	hasLogToStderr := bytes.Contains(out, []byte("logtostderr"))
 
+	if err := bs.writeLinkedLibs(test); err != nil {
+		return err
+	}
+
 	// Run the benchmark binary.
+	runPattern, skipPattern := opts.runPattern, opts.skipPattern
+	if skipPattern != "" && !bytes.Contains(out, []byte("test.skip")) {
+		var err error
+		if runPattern, err = excludeBenchmarks(ctx, bs, test, runPattern, skipPattern); err != nil {
+			return err
+		}
+		skipPattern = ""
+	}
+	off, err := bs.outFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
 	args := []string{bin, "-test.run", "-", "-test.bench", runPattern, "-test.benchmem"}
-	if benchTime != "" {
-		args = append(args, "-test.benchtime", benchTime)
+	if skipPattern != "" {
+		args = append(args, "-test.skip", skipPattern)
 	}
-	if cpuProfile {
+	if opts.benchTime != "" {
+		args = append(args, "-test.benchtime", opts.benchTime)
+	}
+	if opts.count > 1 {
+		args = append(args, "-test.count", strconv.Itoa(opts.count))
+	}
+	if opts.short {
+		args = append(args, "-test.short")
+	}
+	if opts.cpuProfile {
 		args = append(args, "-test.cpuprofile", bs.getProfileFile("cpu_last"))
 	}
-	if memProfile {
+	if opts.memProfile {
 		// TODO(nvanbenschoten): consider passing -test.memprofilerate=1.
 		args = append(args, "-test.memprofile", bs.getProfileFile("mem_last"))
 	}
-	if mutexProfile {
+	if opts.mutexProfile {
 		args = append(args, "-test.mutexprofile", bs.getProfileFile("mutex_last"))
 	}
 	if hasLogToStderr {
 		args = append(args, "--logtostderr", "NONE")
 	}
-	if err := spawnWith(os.Stdin, bs.outFile, bs.outFile, args...); err != nil {
+	env := append([]string(nil), bs.env...)
+	if opts.sizeClass != "" {
+		env = append(env, sizeClassEnv+"="+opts.sizeClass)
+	}
+	if bs.leakMetrics {
+		env = append(env, leakMetricsEnv+"=1")
+	}
+	for _, c := range opts.collectors {
+		if ec, ok := c.(envCollector); ok {
+			env = append(env, ec.Env()...)
+		}
+	}
+	scratch, releaseScratch, err := bs.scratch.acquire(test)
+	if err != nil {
+		return err
+	}
+	if scratch != "" {
+		env = append(env, "TMPDIR="+scratch)
+	}
+	args = bs.remoteCommand(args, env...)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var output io.Writer = bs.outFile
+	for _, c := range opts.collectors {
+		if oc, ok := c.(outputCollector); ok {
+			output = oc.WrapOutput(output)
+		}
+	}
+	var filter *benchLineFilter
+	if bs.validateLines {
+		known, err := listBenchmarks(ctx, bs, test, ".")
+		if err != nil {
+			return err
+		}
+		filter = newBenchLineFilter(output, known)
+		output = filter
+	}
+	// Stdout and Stderr are the same writer, so their output stays ordered.
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, output, output
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "error running %v", args)
+	}
+	for i, c := range opts.collectors {
+		if err := c.Start(cmd.Process.Pid); err != nil {
+			// Stop the collectors that did start, so they can clean up.
+			for _, started := range opts.collectors[:i] {
+				_, _ = started.Stop()
+			}
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			return errors.Wrap(err, "starting collector")
+		}
+	}
+	err = cmd.Wait()
+	if releaseErr := releaseScratch(); err == nil {
+		err = releaseErr
+	}
+	if filter != nil {
+		if closeErr := filter.Close(); err == nil {
+			err = closeErr
+		}
+		if filter.discarded > 0 {
+			fmt.Fprintf(os.Stderr, "  discarded %d benchmark result lines of %s that don't match its benchmarks\n",
+				filter.discarded, test)
+		}
+	}
+	if opts.cpuTime != nil {
+		*opts.cpuTime = cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+	}
+	metrics := make(map[string]float64)
+	var collectErr error
+	for _, c := range opts.collectors {
+		m, err := c.Stop()
+		if err != nil {
+			collectErr = err
+			continue
+		}
+		for unit, v := range m {
+			metrics[unit] = v
+		}
+	}
+	if err != nil && bs.memLimit != "" {
+		oom, oomErr := ranOutOfMemory(err, bs.outFile, off)
+		if oomErr != nil {
+			return oomErr
+		}
+		if oom {
+			// Fail fast, as the next binary is likely to run out of memory
+			// too, and a leak can take down the host before the limit is
+			// enforced.
+			msg := fmt.Sprintf("ran out of memory (--mem-limit=%s)", bs.memLimit)
+			bs.triage.record(stageOOM, bs, test, opts.iter, msg)
+			return errors.Errorf("%s %s running %s", test, msg, runPattern)
+		}
+	}
+	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			if exitErr.ExitCode() == 1 {
 				// Assume exit code 1 corresponds to a benchmark failure.
 				fmt.Fprintln(os.Stderr, "  saw one or more benchmark failures")
+				bs.triage.record(stageRun, bs, test, opts.iter, "one or more benchmarks failed")
 			} else {
-				return errors.Wrapf(err, "error running %v: %s", args, exitErr.Stderr)
+				bs.triage.record(stageRun, bs, test, opts.iter, err.Error())
+				if !opts.tolerateCrash {
+					return errors.Wrapf(err, "error running %v: %s", args, exitErr.Stderr)
+				}
+				fmt.Fprintf(os.Stderr, "  %s crashed running %s: %v\n", test, runPattern, err)
 			}
 		} else {
+			bs.triage.record(stageRun, bs, test, opts.iter, err.Error())
 			return errors.Wrapf(err, "error running %v", args)
 		}
 	}
-	return nil
+	if n, first, err := malformedResults(bs.outFile, off); err != nil {
+		return err
+	} else if n > 0 {
+		bs.triage.record(stageParse, bs, test, opts.iter,
+			fmt.Sprintf("%d malformed result line(s), first: %q", n, first))
+	}
+	if collectErr != nil {
+		return errors.Wrap(collectErr, "collecting metrics")
+	}
+	return writeInvocationMetrics(bs, test, metrics)
 }
 
+// processBenchOutput computes the comparison of the suites and writes it to
+// the configured sinks. w is the writer of sinks without a path.
 func processBenchOutput(
 	ctx context.Context,
 	w io.Writer,
 	oldSuite, newSuite *benchSuite,
+	controlSuite *benchSuite, // optional
 	byName bool, // instead of by delta reversed
-	out outputFmt,
 	pkgFilter []string,
-	srv *google.Service,
+	cc *compareConfig,
+	output *outputConfig,
 ) ([]*benchstat.Table, error) {
-	// We're going to be reading the output files, so seek to the beginning.
-	oldSuite.outFile.Seek(0, io.SeekStart)
-	newSuite.outFile.Seek(0, io.SeekStart)
+	if err := warnProcsMismatch(oldSuite, newSuite); err != nil {
+		return nil, err
+	}
+	tables, err := computeTables(oldSuite, newSuite, byName, cc)
+	if err != nil {
+		return nil, err
+	}
+	tables = output.subFilter.apply(tables)
+	markAsymmetricRows(tables)
+	markExampleRows(tables)
+	markConfidenceIntervals(tables, cc)
+	if cc.effectSizes {
+		markEffectSizes(tables)
+	}
+	markNoiseScores(tables, cc.noise)
+	markAnnotatedRows(tables, output.annotations)
+	if controlSuite != nil {
+		if err := markControlNoise(tables, controlSuite, oldSuite); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeSinks(ctx, w, oldSuite, newSuite, controlSuite, byName, pkgFilter, tables, output); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// compareConfig holds the options that control how the results of the suites
+// are compared, and which regressions fail the gate.
+type compareConfig struct {
+	// paired is whether deltas are tested with pairedTest.
+	paired bool
+	// ci is the method of computing confidence intervals of deltas. See
+	// markConfidenceIntervals.
+	ci string
+	// fdr is the false discovery rate that significant deltas are controlled
+	// at, or 0 to not control it. See controlFDR.
+	fdr float64
+	// effectSizes is whether rows are annotated with their effect sizes, and
+	// sortByEffect whether they are sorted by them. Regressions whose effect
+	// size is below minEffect don't fail the gate. See cliffsDelta.
+	effectSizes  bool
+	sortByEffect bool
+	minEffect    float64
+	// directions overrides whether larger or smaller values are better per
+	// unit. See --direction.
+	directions directions
+	// noise holds the noise scores of the benchmarks, if loaded with --noise.
+	noise noiseScores
+}
 
-	// Compute the benchmark comparison results.
+// computeTables computes the benchmark comparison results from the output
+// files of the old and new suites.
+func computeTables(oldSuite, newSuite *benchSuite, byName bool, cc *compareConfig) ([]*benchstat.Table, error) {
 	var c benchstat.Collection
 	c.Alpha = 0.05
-	if byName {
+	c.DeltaTest = benchstat.UTest
+	if cc.paired {
+		c.DeltaTest = pairedTest
+	}
+	switch {
+	case byName:
 		c.Order = benchstat.ByName
-	} else {
+	case cc.sortByEffect:
+		c.Order = byEffect
+	default:
 		c.Order = benchstat.Reverse(benchstat.ByDelta) // best, first
 	}
-	if err := c.AddFile("old", oldSuite.outFile); err != nil {
+	if err := addSuites(&c, []string{"old", "new"}, oldSuite, newSuite); err != nil {
 		return nil, err
 	}
-	if err := c.AddFile("new", newSuite.outFile); err != nil {
-		return nil, err
+	if crossMachine(oldSuite, newSuite) {
+		newSuite.calRatio = normalizeByCalibration(&c)
 	}
 	tables := c.Tables()
-
-	// Output the results.
-	switch out {
-	case text:
-		benchstat.FormatText(w, tables)
-	case csv:
-		// If norange is true, suppress the range information for each data item.
-		// If norange is false, insert a "±" in the appropriate columns of the header row.
-		norange := false
-		benchstat.FormatCSV(w, tables, norange)
-	case html:
-		var buf bytes.Buffer
-		benchstat.FormatHTML(&buf, tables)
-		io.Copy(w, &buf)
-	case sheets:
-		// When outputting a Google sheet, also output as text first.
-		benchstat.FormatText(w, tables)
-
-		sheetName := fmt.Sprintf("benchdiff: %s (%s -> %s)",
-			strings.Join(pkgFilter, " "), oldSuite.ref, newSuite.ref)
-		url, err := srv.CreateSheet(ctx, sheetName, tables)
-		if err != nil {
-			return nil, err
-		}
-		fmt.Printf("\ngenerated sheet: %s\n", url)
-	default:
-		panic("unexpected")
+	// The percentile rows are recomputed first, as benchstat computes them,
+	// so that orient applies the direction to them like to any other row.
+	comparePercentiles(tables, c.DeltaTest, c.Alpha, c.Order)
+	cc.directions.orient(tables, c.Order)
+	if cc.fdr > 0 {
+		controlFDR(tables, c.DeltaTest, cc.fdr)
 	}
 	return tables, nil
 }
@@ -582,18 +2326,12 @@ func logProfileLocations(
 	}
 }
 
-func checkPassing(thresh float64, tables []*benchstat.Table) error {
-	if thresh < 0 {
-		return nil
-	}
-	threshPct := thresh * 100
+func checkPassing(thresh thresholds, cc *compareConfig, tables []*benchstat.Table) error {
 	for _, table := range tables {
 		for _, row := range table.Rows {
-			worse := row.Change == -1
-			exceededThresh := math.Abs(row.PctDelta) > threshPct
-			if worse && exceededThresh {
+			if cc.failsGate(table, row, thresh.of(table)) {
 				return errors.Errorf("%s regression in %s of %s exceeded threshold of %.2f%%",
-					table.Metric, row.Benchmark, row.Delta, threshPct)
+					table.Metric, row.Benchmark, row.Delta, cc.regressionThreshold(table, row, thresh.of(table)))
 			}
 		}
 	}
@@ -602,31 +2340,112 @@ func checkPassing(thresh float64, tables []*benchstat.Table) error {
 
 type benchSuite struct {
 	ref       string
+	commit    string // full SHA of ref
 	subject   string // commit subject
 	artDir    string
 	outFile   *os.File
 	binDir    string
-	useBazel  bool
-	testFiles fileSet
+	host      string     // remote host to run on, or empty if local
+	k8s       *k8sConfig // set if host is a Kubernetes namespace
+	buildHost string     // host to build on, or empty if local
+	binRoot   string     // directory to store binaries in, if not the repository
+	triage    *triage    // failures of the run, shared by its suites
+	// showBuildOutput is whether the output of the build tool is streamed to
+	// stderr. See --show-build-output.
+	showBuildOutput bool
+	// skipBrokenBuilds is whether packages that fail to build are skipped
+	// rather than failing the build. See --skip-broken-builds.
+	skipBrokenBuilds bool
+	calRatio         float64 // calibration ratio relative to the other suite
+	useBazel         bool
+	testFiles        fileSet
+	// buildFlags are passed to the build tool when building the test
+	// binaries, and env (in KEY=VALUE form) is set when running them. Along
+	// with the ref, they make up the suite's identity, so that a commit can be
+	// compared against itself with a different build or run configuration.
+	buildFlags []string
+	env        []string
+	// label distinguishes suites that are otherwise identical, like the
+	// control suite and the old suite.
+	label string
+	// launch is the command prefix that the test binaries are run through,
+	// if any. See numaPrefix, privilegePrefix, and noASLRPrefix.
+	launch []string
+	// layouts is the number of binary layouts to build and cycle through
+	// across iterations, or 0 to only build the default layout. binDirs holds
+	// the binary directory of each layout, and layout is the index of the
+	// layout currently in binDir.
+	layouts int
+	binDirs []string
+	layout  int
+	// harness is whether the test binaries are built with the harness, and
+	// leakMetrics whether they are run with its leak metrics enabled. See
+	// harnessTemplate.
+	harness     bool
+	leakMetrics bool
+	// libs holds the shared libraries that each test binary links against,
+	// keyed by soname. See linkedLibs.
+	libs map[string]map[string]string
+	// image is the digest-pinned container image of the environment, if one
+	// was recorded with snapshot-env.
+	image string
+	// secrets are passed to the post-checkout command and plugins.
+	secrets *hookSecrets
+	// generate regenerates the generated code after checkout, if stale.
+	generate *generateStep
+	// procs normalizes the GOMAXPROCS suffixes of benchmark names before
+	// results are compared, if set.
+	procs *procsNormalization
+	// redact strips identifying details from shareable outputs, if set.
+	redact *redactor
+	// scratch holds the scratch directories of the test binaries, if set.
+	scratch *scratchSpace
+	// memLimit is the memory limit of the test binaries as passed to
+	// --mem-limit, if any. See memLimitPrefix.
+	memLimit string
+	// validateLines discards benchmark result lines of benchmarks that the
+	// test binaries don't have. See benchLineFilter.
+	validateLines bool
+	// warmup drops the warm-up samples of the suite's results, if set, and
+	// warmupDropped counts the samples it dropped.
+	warmup        *warmupPolicy
+	warmupDropped int
+	// ramped drops the samples that benchmarks ramped up with
+	// --auto-benchtime took before they were, if set. It is shared by the
+	// suites of a run.
+	ramped *rampedBenchmarks
+	// help caches the --help output of the suite's test binaries.
+	help *helpOutputs
+	// cpuSetSize is the number of CPUs that a --parallel worker suite is
+	// pinned to. See workerSuite.
+	cpuSetSize int
+	// projection filters and groups the results of parameterized benchmarks
+	// before they are compared, if set. See --filter and --group-by.
+	projection *projection
+	// payloads are the payload sizes that MB/s is derived from for benchmarks
+	// that don't call b.SetBytes. See --payload-size.
+	payloads []payloadSize
 }
 type fileSet map[string]struct{}
 
-func makeBenchSuite(ref string, subject string, useBazel bool) benchSuite {
+func makeBenchSuite(ref string, subject string, host string, useBazel bool) benchSuite {
 	return benchSuite{
 		ref:       ref,
 		subject:   subject,
+		host:      host,
 		testFiles: make(fileSet),
 		useBazel:  useBazel,
+		help:      &helpOutputs{m: make(map[string][]byte)},
 	}
 }
 
-func (bs *benchSuite) build(pkgFilter []string, postChck string, t time.Time) (err error) {
+func (bs *benchSuite) build(ctx context.Context, pkgFilter []string, postChck string, t time.Time) (err error) {
 	if len(bs.testFiles) != 0 {
 		panic("benchSuite already built")
 	}
 
 	// Create the artifacts directory: ./benchdiff/<ref>/artifacts
-	bs.artDir = testArtifactsDir(bs.ref)
+	bs.artDir = testArtifactsDir(bs.id())
 	if err = os.MkdirAll(bs.artDir, 0744); err != nil {
 		return err
 	}
@@ -638,58 +2457,204 @@ func (bs *benchSuite) build(pkgFilter []string, postChck string, t time.Time) (e
 		return err
 	}
 
-	// Create the binary directory: ./benchdiff/<ref>/bin/<hash(pkgFilter)>
-	bs.binDir = testBinDir(bs.ref, pkgFilter)
-	if _, err = os.Stat(bs.binDir); err == nil {
-		files, err := ioutil.ReadDir(bs.binDir)
+	// Build the binaries of each layout. The first layout is the linker's
+	// default, the others are randomized. See --layouts.
+	n := bs.layouts
+	if n == 0 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		flags := bs.buildFlags
+		if i > 0 {
+			flags = append(append([]string(nil), flags...), layoutFlag(i))
+		}
+		key := append(append([]string(nil), pkgFilter...), flags...)
+		if bs.harness {
+			key = append(key, harnessFile)
+		}
+		if bs.buildHost != "" {
+			key = append(key, "build-on="+bs.buildHost)
+		}
+		dir := testBinDir(bs.binRoot, bs.ref, key)
+		files, err := bs.buildBinaries(ctx, dir, pkgFilter, postChck, flags)
 		if err != nil {
 			return err
 		}
-		for _, f := range files {
-			if f.IsDir() {
-				return errors.Errorf("unexpected directory %q", f.Name())
+		if i == 0 {
+			bs.testFiles = files
+		} else {
+			// Only tests that built in every layout can be run.
+			for f := range bs.testFiles {
+				if _, ok := files[f]; !ok {
+					delete(bs.testFiles, f)
+				}
 			}
-			bs.testFiles[f.Name()] = struct{}{}
 		}
-		return nil
+		bs.binDirs = append(bs.binDirs, dir)
+	}
+	bs.binDir = bs.binDirs[0]
+	return nil
+}
+
+// buildBinaries builds the test binaries of the packages into the binary
+// directory, ./benchdiff/<ref>/bin/<hash(pkgFilter, flags)>, passing the build
+// flags to the build tool. If the directory already exists and its manifest
+// validates, the binaries in it are reused.
+func (bs *benchSuite) buildBinaries(
+	ctx context.Context,
+	binDir string, pkgFilter []string, postChck string, flags []string,
+) (_ fileSet, err error) {
+	testFiles := make(fileSet)
+	manifest := bs.makeManifest(pkgFilter, flags)
+	if _, err = os.Stat(binDir); err == nil {
+		if err := validateManifest(binDir, manifest, bs.skipBrokenBuilds); err != nil {
+			fmt.Fprintf(os.Stderr, "rebuilding binaries in %s: %v\n", binDir, err)
+			if err := removeBinDir(binDir); err != nil {
+				return nil, err
+			}
+		} else {
+			files, err := ioutil.ReadDir(binDir)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				testFiles[f.Name()] = struct{}{}
+			}
+			return testFiles, nil
+		}
 	} else if !os.IsNotExist(err) {
-		return errors.Wrap(err, "looking for test directory")
+		return nil, errors.Wrap(err, "looking for test directory")
 	}
-	if err := os.MkdirAll(bs.binDir, 0700); err != nil {
-		return err
+	if err := os.MkdirAll(binDir, 0700); err != nil {
+		return nil, err
 	}
-	// If the binaries are not generated successfully, delete the bin directory
-	// so we don't consider the build successful next time benchdiff runs.
+	// Record the provenance of the binaries once they are generated
+	// successfully. If they are not, delete the bin directory so we don't
+	// consider the build successful next time benchdiff runs.
 	defer func() {
+		if err == nil {
+			err = writeManifest(ctx, binDir, manifest)
+		}
 		if err != nil {
-			_ = os.RemoveAll(bs.binDir)
+			_ = removeBinDir(binDir)
 		}
 	}()
 
-	if err := checkoutRef(bs.ref, postChck); err != nil {
-		return err
+	if bs.buildHost != "" {
+		files, broken, err := bs.buildRemoteBinaries(ctx, binDir, pkgFilter, postChck, flags)
+		manifest.Broken = broken
+		return files, err
+	}
+	// The ref is built in the build worktree, so the paths of the binaries and
+	// logs must not be relative to the working directory.
+	absBinDir, err := filepath.Abs(binDir)
+	if err != nil {
+		return nil, err
+	}
+	artDir, err := filepath.Abs(bs.artDir)
+	if err != nil {
+		return nil, err
+	}
+	leave, err := enterWorktree(ctx, bs.ref, postChck, bs.secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	if err := bs.generate.runLocal(ctx, bs.ref, pkgFilter, bs.secrets); err != nil {
+		return nil, err
+	}
+	if !bs.useBazel {
+		if err := downloadModules(ctx, bs.ref); err != nil {
+			return nil, err
+		}
 	}
 
 	// Determine which packages to build.
-	pkgs, err := expandPackages(pkgFilter)
+	pkgs, err := expandPackages(ctx, pkgFilter)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	// With --show-build-output, the build output is streamed instead of showing
+	// the spinner, which would overwrite it.
 	var spinner ui.Spinner
-	spinner.Start(os.Stderr, fmt.Sprintf("building benchmark binaries for %s: %.50s [bazel=%t] ", bs.ref,
-		bs.subject, bs.useBazel))
-	defer spinner.Stop()
+	var buildLog io.Writer
+	progress := func(string) {}
+	status := fmt.Sprintf("building benchmark binaries for %s: %.50s [bazel=%t] ", bs.ref, bs.subject, bs.useBazel)
+	if bs.showBuildOutput {
+		fmt.Fprintln(os.Stderr, strings.TrimSpace(status))
+		buildLog = os.Stderr
+	} else {
+		spinner.Start(os.Stderr, status)
+		defer spinner.Stop()
+		progress = spinner.Update
+	}
+	var harnessDir string
+	if bs.harness {
+		if harnessDir, err = ioutil.TempDir("", "benchdiff-harness"); err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(harnessDir)
+	}
 	for i, pkg := range pkgs {
-		spinner.Update(ui.Fraction(i, len(pkgs)))
-		if testBin, ok, err := buildTestBin(pkg, bs.binDir, bs.useBazel); err != nil {
-			return err
+		progress(ui.Fraction(i, len(pkgs)))
+		pkgFlags := flags
+		if bs.harness {
+			overlay, ok, err := writeHarnessOverlay(ctx, pkg, harnessDir)
+			if err != nil {
+				return nil, err
+			} else if ok {
+				pkgFlags = append(append([]string(nil), flags...), overlay)
+			} else {
+				fmt.Fprintf(os.Stderr, "\n%s defines TestMain; building without harness\n", pkg)
+			}
+		}
+		if testBin, ok, err := buildTestBin(ctx, pkg, absBinDir, bs.useBazel, pkgFlags, buildLog); err != nil {
+			bs.triage.record(stageBuild, bs, pkgToTestBin(pkg), 0, err.Error())
+			logPath, logErr := saveBuildLog(artDir, pkg, err)
+			if logErr != nil {
+				return nil, logErr
+			}
+			if !bs.skipBrokenBuilds {
+				return nil, errors.Wrapf(err, "building %s for %s (output saved to %s)", pkg, bs.ref, logPath)
+			}
+			fmt.Fprintf(os.Stderr, "\nskipping %s, which failed to build (output saved to %s)\n", pkg, logPath)
+			manifest.Broken = append(manifest.Broken, pkg)
 		} else if ok {
-			bs.testFiles[testBin] = struct{}{}
+			testFiles[testBin] = struct{}{}
 		}
-		spinner.Update(ui.Fraction(i+1, len(pkgs)))
+		progress(ui.Fraction(i+1, len(pkgs)))
 	}
-	return nil
+	return testFiles, nil
+}
+
+// id returns a name that uniquely identifies the suite's ref and
+// configuration, used to name its artifacts directory.
+func (bs *benchSuite) id() string {
+	id := bs.ref
+	if len(bs.buildFlags) != 0 || len(bs.env) != 0 {
+		id += "+" + hash(append(append([]string(nil), bs.buildFlags...), bs.env...))
+	}
+	if bs.label != "" {
+		id += "+" + bs.label
+	}
+	return id
+}
+
+// describe returns a description of the suite's build and run configuration,
+// or the empty string if it has none.
+func (bs *benchSuite) describe() string {
+	var parts []string
+	if len(bs.buildFlags) > 0 {
+		parts = append(parts, "build: "+strings.Join(bs.buildFlags, " "))
+	}
+	if len(bs.env) > 0 {
+		parts = append(parts, "env: "+strings.Join(bs.env, " "))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(parts, "; ") + "]"
 }
 
 func (bs *benchSuite) close() {
@@ -728,9 +2693,18 @@ func (fs fileSet) sorted() []string {
 }
 
 func printHeader(w io.Writer, oldSuite, newSuite benchSuite) {
-	fmt.Fprintf(w, "old:  %s %.50s\n", oldSuite.ref, oldSuite.subject)
-	fmt.Fprintf(w, "new:  %s %.50s\n", newSuite.ref, newSuite.subject)
-	fmt.Fprintf(w, "args: %s\n\n", strings.Join(func() []string {
+	var buf bytes.Buffer
+	defer func() { io.WriteString(w, newSuite.redact.string(buf.String())) }()
+	fmt.Fprintf(&buf, "old:  %s %.50s%s\n", oldSuite.ref, oldSuite.subject, oldSuite.describe())
+	fmt.Fprintf(&buf, "new:  %s %.50s%s\n", newSuite.ref, newSuite.subject, newSuite.describe())
+	if isSelfComparison(&newSuite) {
+		fmt.Fprintf(&buf, "mode: A/A self-comparison of %s, measuring noise\n", newSuite.ref)
+	}
+	if crossMachine(&oldSuite, &newSuite) {
+		fmt.Fprintf(&buf, "mode: cross-machine (old on %s, new on %s), normalized by calibration\n",
+			oldSuite.hostName(), newSuite.hostName())
+	}
+	fmt.Fprintf(&buf, "args: %s\n\n", strings.Join(func() []string {
 		quoted := make([]string, 1+len(os.Args[1:]))
 		quoted[0] = "benchdiff"
 		for i, arg := range os.Args[1:] {
@@ -739,3 +2713,8 @@ func printHeader(w io.Writer, oldSuite, newSuite benchSuite) {
 		return quoted
 	}(), " "))
 }
+
+// crossMachine returns whether the two suites are run on different machines.
+func crossMachine(bs1, bs2 *benchSuite) bool {
+	return bs1.host != bs2.host
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// binManifest records the provenance of the test binaries in a binary
+// directory. It is written next to the directory once its binaries are built
+// and validated before they are reused, so that binaries that were built from
+// a different commit or with different flags, or that were modified or
+// truncated since, are rebuilt instead.
+type binManifest struct {
+	Commit     string            `json:"commit"`
+	PkgFilter  []string          `json:"pkg_filter"`
+	BuildFlags []string          `json:"build_flags"`
+	Bazel      bool              `json:"bazel"`
+	Harness    bool              `json:"harness"`
+	BuildHost  string            `json:"build_host,omitempty"`
+	GoVersion  string            `json:"go_version,omitempty"`
+	BuildTime  time.Time         `json:"build_time"`
+	Binaries   map[string]string `json:"binaries"` // name to SHA256
+	// Broken lists the packages that failed to build and were skipped. See
+	// --skip-broken-builds.
+	Broken []string `json:"broken,omitempty"`
+}
+
+// manifestPath returns the path of the manifest of the binary directory.
+func manifestPath(binDir string) string {
+	return binDir + ".manifest.json"
+}
+
+// makeManifest returns the manifest that binaries built for the suite from
+// the packages with the flags must match, without the fields that are only
+// known once they are built.
+func (bs *benchSuite) makeManifest(pkgFilter, flags []string) binManifest {
+	return binManifest{
+		Commit:     bs.commit,
+		PkgFilter:  append([]string{}, pkgFilter...),
+		BuildFlags: append([]string{}, flags...),
+		Bazel:      bs.useBazel,
+		Harness:    bs.harness,
+		BuildHost:  bs.buildHost,
+	}
+}
+
+// digestBinaries returns the SHA256 of each file in the binary directory.
+func digestBinaries(binDir string) (map[string]string, error) {
+	files, err := ioutil.ReadDir(binDir)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string, len(files))
+	for _, f := range files {
+		if f.IsDir() {
+			return nil, errors.Errorf("unexpected directory %q", f.Name())
+		}
+		digest, err := fileDigest(filepath.Join(binDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		res[f.Name()] = hex.EncodeToString(digest)
+	}
+	return res, nil
+}
+
+// writeManifest writes the manifest of the freshly built binary directory.
+func writeManifest(ctx context.Context, binDir string, m binManifest) error {
+	var err error
+	if m.Binaries, err = digestBinaries(binDir); err != nil {
+		return err
+	}
+	m.BuildTime = time.Now().UTC()
+	names := make([]string, 0, len(m.Binaries))
+	for name := range m.Binaries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		if info, err := toolchainInfo(ctx, filepath.Join(binDir, names[0])); err == nil {
+			m.GoVersion = info["go"]
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(manifestPath(binDir), data)
+}
+
+// validateManifest verifies that the binaries in the binary directory were
+// built as described by want and have not changed since. Unless allowBroken is
+// set, binaries built while skipping broken packages are not valid either, so
+// that the packages get another chance to build.
+func validateManifest(binDir string, want binManifest, allowBroken bool) error {
+	data, err := ioutil.ReadFile(manifestPath(binDir))
+	if os.IsNotExist(err) {
+		return errors.New("no manifest")
+	} else if err != nil {
+		return err
+	}
+	var got binManifest
+	if err := json.Unmarshal(data, &got); err != nil {
+		return errors.Wrap(err, "decoding manifest")
+	}
+	for _, c := range []struct {
+		what      string
+		got, want interface{}
+	}{
+		{"commit", got.Commit, want.Commit},
+		{"packages", got.PkgFilter, want.PkgFilter},
+		{"build flags", got.BuildFlags, want.BuildFlags},
+		{"bazel", got.Bazel, want.Bazel},
+		{"harness", got.Harness, want.Harness},
+		{"build host", got.BuildHost, want.BuildHost},
+	} {
+		if !reflect.DeepEqual(c.got, c.want) {
+			return errors.Errorf("built with %s %v, want %v", c.what, c.got, c.want)
+		}
+	}
+	if len(got.Broken) > 0 && !allowBroken {
+		return errors.Errorf("built without broken packages %s", strings.Join(got.Broken, ", "))
+	}
+	digests, err := digestBinaries(binDir)
+	if err != nil {
+		return err
+	}
+	for name, digest := range digests {
+		if got.Binaries[name] != digest {
+			return errors.Errorf("%s does not match its checksum", name)
+		}
+	}
+	for name := range got.Binaries {
+		if _, ok := digests[name]; !ok {
+			return errors.Errorf("%s is missing", name)
+		}
+	}
+	return nil
+}
+
+// removeBinDir removes the binary directory and its manifest.
+func removeBinDir(binDir string) error {
+	if err := os.RemoveAll(binDir); err != nil {
+		return err
+	}
+	if err := os.Remove(manifestPath(binDir)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
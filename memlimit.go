@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Mechanisms that --mem-limit can cap the memory of test binaries with.
+const (
+	// memLimitRlimit sets RLIMIT_AS, so that allocations beyond the limit
+	// fail and the Go runtime aborts with "out of memory".
+	memLimitRlimit = "rlimit"
+	// memLimitCgroup runs each binary in a transient systemd scope with
+	// MemoryMax set, so that the kernel OOM-kills it beyond the limit. Unlike
+	// RLIMIT_AS, this limits resident rather than virtual memory.
+	memLimitCgroup = "cgroup"
+)
+
+// memSizeUnits are the suffixes accepted by parseMemSize, longest first.
+var memSizeUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// parseMemSize parses a memory size such as 8GiB, 512M, or 1073741824.
+// Single-letter suffixes are binary, as with ulimit and systemd.
+func parseMemSize(s string) (int64, error) {
+	num, scale := s, int64(1)
+	for _, u := range memSizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			num, scale = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.scale
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v <= 0 {
+		return 0, errors.Errorf("invalid memory size %q", s)
+	}
+	return int64(v * float64(scale)), nil
+}
+
+// memLimitPrefix returns the command prefix that caps the memory of the test
+// binaries at the limit, in bytes, with the mechanism.
+func memLimitPrefix(limit int64, mode string) ([]string, error) {
+	n := strconv.FormatInt(limit, 10)
+	switch mode {
+	case memLimitRlimit:
+		return []string{"prlimit", "--as=" + n, "--"}, nil
+	case memLimitCgroup:
+		return []string{
+			"systemd-run", "--user", "--scope", "--quiet",
+			"-p", "MemoryMax=" + n, "-p", "MemorySwapMax=0", "--",
+		}, nil
+	default:
+		return nil, errors.Errorf("invalid --mem-limit-mode %q: must be %q or %q",
+			mode, memLimitRlimit, memLimitCgroup)
+	}
+}
+
+// oomMarkers are printed by the Go runtime when it fails to allocate memory,
+// as it does when RLIMIT_AS is reached. The runtime reserves address space at
+// startup, which fails if the limit is too low (below about 1GiB).
+var oomMarkers = [][]byte{
+	[]byte("runtime: out of memory"),
+	[]byte("fatal error: out of memory"),
+	[]byte("fatal error: failed to reserve"),
+	[]byte("cannot allocate memory"),
+}
+
+// ranOutOfMemory returns whether the test binary that exited with the error
+// and wrote its output to the file since the offset exceeded its memory limit:
+// either it was killed by SIGKILL, as the OOM killer does, or the runtime
+// reported that it ran out of memory. Over ssh, a SIGKILL surfaces as exit
+// status 137.
+func ranOutOfMemory(err error, f *os.File, from int64) (bool, error) {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return false, nil
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() && ws.Signal() == syscall.SIGKILL {
+		return true, nil
+	}
+	if exitErr.ExitCode() == 128+int(syscall.SIGKILL) {
+		return true, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	out, err := ioutil.ReadAll(io.NewSectionReader(f, from, fi.Size()-from))
+	if err != nil {
+		return false, err
+	}
+	for _, m := range oomMarkers {
+		if bytes.Contains(out, m) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
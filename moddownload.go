@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/nvanbenschoten/benchdiff/ui"
+	"github.com/pkg/errors"
+)
+
+// downloadModules downloads the modules that the checked out ref depends on
+// and that aren't in the module cache yet, reporting the progress, before its
+// test binaries are built. Old refs often depend on many modules that haven't
+// been downloaded since, which would otherwise stall the first build without
+// explanation. Repositories that vendor their dependencies or have no go.mod
+// are skipped.
+func downloadModules(ctx context.Context, ref string) error {
+	if _, err := os.Stat("go.mod"); err != nil {
+		return nil
+	}
+	if _, err := os.Stat("vendor"); err == nil {
+		return nil
+	}
+	// GOMODCACHE goes last, as it is empty before Go 1.15.
+	env, err := capture(ctx, "go", "env", "GOPATH", "GOPROXY", "GOMODCACHE")
+	if err != nil {
+		return errors.Wrap(err, "reading go env")
+	}
+	vars := strings.Split(env, "\n")
+	for len(vars) < 3 {
+		vars = append(vars, "")
+	}
+	gopath, proxy, modCache := vars[0], vars[1], vars[2]
+	if modCache == "" {
+		modCache = filepath.Join(strings.Split(gopath, string(filepath.ListSeparator))[0], "pkg", "mod")
+	}
+
+	// Modules replaced by directories have no version and aren't downloaded.
+	const format = `{{if not .Main}}{{with .Replace}}{{if .Version}}{{.Path}}@{{.Version}}{{end}}` +
+		`{{else}}{{.Path}}@{{.Version}}{{end}}{{end}}`
+	list, err := capture(ctx, "go", "list", "-m", "-f", format, "all")
+	if err != nil {
+		return errors.Wrap(err, "listing modules")
+	}
+	mods := strings.Fields(list)
+	missing := missingModules(modCache, mods)
+	// Only the modules that provide packages of the build are downloaded, but
+	// those aren't known without downloading them, so a build list that is
+	// all cached is the only way to know that there is nothing to download.
+	if len(missing) == 0 {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "%d of the %d modules in the build list of %s are missing from the module cache in %s; "+
+		"downloading the ones needed from %s\n", len(missing), len(mods), ref, modCache, proxy)
+
+	// go mod download only reports the modules once they are all downloaded,
+	// so the progress is tracked by polling the module cache.
+	var spinner ui.Spinner
+	spinner.Start(os.Stderr, fmt.Sprintf("downloading modules for %s: ", ref))
+	start := time.Now()
+	var stderr bytes.Buffer
+	done := make(chan error, 1)
+	go func() { done <- spawnWith(ctx, nil, ioutil.Discard, &stderr, "go", "mod", "download") }()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case err = <-done:
+			running = false
+		case <-ticker.C:
+			n := len(missing) - len(missingModules(modCache, missing))
+			spinner.Update(fmt.Sprintf("%d so far, %s", n, time.Since(start).Round(time.Second)))
+		}
+	}
+	spinner.Stop()
+	if err != nil {
+		return errors.Wrapf(err, "downloading modules: %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+	n := len(missing) - len(missingModules(modCache, missing))
+	fmt.Fprintf(os.Stderr, "downloaded %d modules for %s in %s\n", n, ref, time.Since(start).Round(time.Second))
+	return nil
+}
+
+// missingModules returns the modules, in path@version form, that are missing
+// from the module cache.
+func missingModules(modCache string, mods []string) []string {
+	var missing []string
+	for _, mod := range mods {
+		if !moduleCached(modCache, mod) {
+			missing = append(missing, mod)
+		}
+	}
+	return missing
+}
+
+// moduleCached returns whether the module, in path@version form, has been
+// downloaded to the module cache.
+func moduleCached(modCache, mod string) bool {
+	i := strings.LastIndex(mod, "@")
+	if i < 0 {
+		return true
+	}
+	zip := filepath.Join(modCache, "cache", "download", escapeModulePath(mod[:i]), "@v", mod[i+1:]+".zip")
+	_, err := os.Stat(zip)
+	return err == nil
+}
+
+// escapeModulePath escapes the module path as the module cache does, replacing
+// upper-case letters with an exclamation mark followed by their lower-case
+// equivalent, to be safe on case-insensitive file systems.
+func escapeModulePath(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if unicode.IsUpper(r) {
+			b.WriteByte('!')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// noiseWidening is the multiple of a benchmark's noise score that its
+// regression threshold is widened to, if the threshold is narrower.
+const noiseWidening = 2
+
+// noiseScores holds the reproducibility of each benchmark metric, keyed by
+// metric and then benchmark: the root mean square deviation, in percent, of
+// the means of repeat runs of the same commit from their average. A score of
+// 2 means that rerunning the same code typically moves the benchmark by 2%.
+type noiseScores map[string]map[string]float64
+
+// loadNoiseScores derives the noise scores of the benchmarks from the runs in
+// the history store that repeat a commit under the same configuration, such as
+// A/A runs or reruns of nightly builds. Runs of a commit under different
+// configurations differ systematically, which would inflate the scores, and
+// entries without a recorded configuration can't be told apart, so neither
+// count as repeats. Benchmarks without repeat runs have no score.
+func loadNoiseScores(entries []historyEntry) (noiseScores, error) {
+	type identity struct{ ref, config string }
+	byIdentity := make(map[identity][]historyEntry)
+	for _, e := range entries {
+		if e.config == "" {
+			continue
+		}
+		id := identity{e.ref, e.config}
+		byIdentity[id] = append(byIdentity[id], e)
+	}
+	sumSq := make(map[string]map[string]float64)
+	dof := make(map[string]map[string]int)
+	for _, repeats := range byIdentity {
+		if len(repeats) < 2 {
+			continue
+		}
+		means, err := loadSparklines(repeats, len(repeats))
+		if err != nil {
+			return nil, err
+		}
+		for metric, benchmarks := range means {
+			if sumSq[metric] == nil {
+				sumSq[metric] = make(map[string]float64)
+				dof[metric] = make(map[string]int)
+			}
+			for name, ms := range benchmarks {
+				avg := mean(ms)
+				if len(ms) < 2 || avg == 0 {
+					continue
+				}
+				for _, m := range ms {
+					sumSq[metric][name] += (m/avg - 1) * (m/avg - 1)
+				}
+				dof[metric][name] += len(ms) - 1
+			}
+		}
+	}
+	res := make(noiseScores)
+	for metric, benchmarks := range sumSq {
+		res[metric] = make(map[string]float64)
+		for name, s := range benchmarks {
+			if n := dof[metric][name]; n > 0 {
+				res[metric][name] = math.Sqrt(s/float64(n)) * 100
+			}
+		}
+	}
+	return res, nil
+}
+
+// score returns the noise score of the benchmark metric, if it has one.
+func (ns noiseScores) score(metric, benchmark string) (float64, bool) {
+	s, ok := ns[metric][benchmark]
+	return s, ok
+}
+
+// markNoiseScores annotates the note of each row with the noise score of its
+// benchmark.
+func markNoiseScores(tables []*benchstat.Table, ns noiseScores) {
+	for _, table := range tables {
+		for _, row := range table.Rows {
+			if s, ok := ns.score(table.Metric, row.Benchmark); ok {
+				row.Note = strings.TrimSpace(fmt.Sprintf("%s [noise ±%.1f%%]", row.Note, s))
+			}
+		}
+	}
+}
+
+// regressionThreshold returns the threshold, in percent, above which a
+// regression of the row fails the gate: the threshold, widened for
+// historically noisy benchmarks to noiseWidening times their noise score.
+func (cc *compareConfig) regressionThreshold(table *benchstat.Table, row *benchstat.Row, thresh float64) float64 {
+	pct := thresh * 100
+	if s, ok := cc.noise.score(table.Metric, row.Benchmark); ok && noiseWidening*s > pct {
+		pct = noiseWidening * s
+	}
+	return pct
+}
+
+// failsGate returns whether the row is a regression that fails the gate at the
+// threshold, given the configured minimum effect size and noise scores.
+func (cc *compareConfig) failsGate(table *benchstat.Table, row *benchstat.Row, thresh float64) bool {
+	return thresh >= 0 && row.Change == -1 &&
+		math.Abs(row.PctDelta) > cc.regressionThreshold(table, row, thresh) &&
+		meetsMinEffect(row, cc.minEffect)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoadNoiseScores(t *testing.T) {
+	dir := t.TempDir()
+	var entries []historyEntry
+	add := func(ref, config string, ns float64) {
+		e := historyEntry{
+			time:   time.Unix(int64(len(entries)), 0),
+			ref:    ref,
+			config: config,
+			path:   filepath.Join(dir, historyEntryName(time.Unix(int64(len(entries)), 0), ref, config)),
+		}
+		out := []byte("BenchmarkFoo 1 " + strconv.FormatFloat(ns, 'g', -1, 64) + " ns/op\n")
+		if err := ioutil.WriteFile(e.path, out, 0644); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	// Two repeats of a commit under the same configuration, 2% apart.
+	add("abc", "1", 99)
+	add("abc", "1", 101)
+	// Runs of the same commit under other configurations, or without one,
+	// aren't repeats.
+	add("abc", "2", 200)
+	add("abc", "", 300)
+	add("abc", "", 310)
+	// A single run of another commit.
+	add("def", "1", 150)
+
+	ns, err := loadNoiseScores(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ok := ns.score("time/op", "Foo")
+	if !ok {
+		t.Fatalf("no score in %v", ns)
+	}
+	if want := math.Sqrt(2*0.01*0.01) * 100; math.Abs(s-want) > 1e-9 {
+		t.Errorf("got score %g, want %g", s, want)
+	}
+}
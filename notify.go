@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// notifyCompletion fires a native desktop notification and/or rings the
+// terminal bell to signal that a run finished, successfully or not. Failures
+// to notify are logged but otherwise ignored. It notifies of canceled runs too,
+// so it doesn't take the run's context.
+func notifyCompletion(desktop, bell bool, start time.Time, err error) {
+	title := "benchdiff finished"
+	msg := fmt.Sprintf("run completed in %s", time.Since(start).Round(time.Second))
+	if err != nil {
+		title = "benchdiff failed"
+		msg = err.Error()
+	}
+	if bell {
+		fmt.Fprint(os.Stderr, "\a")
+	}
+	if !desktop {
+		return
+	}
+	var args []string
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", strconv.Quote(msg), strconv.Quote(title))
+		args = []string{"osascript", "-e", script}
+	default:
+		args = []string{"notify-send", title, msg}
+	}
+	if _, lookErr := exec.LookPath(args[0]); lookErr != nil {
+		fmt.Fprintf(os.Stderr, "unable to send desktop notification: %s\n", lookErr)
+		return
+	}
+	if _, notifyErr := capture(context.Background(), args...); notifyErr != nil {
+		fmt.Fprintf(os.Stderr, "unable to send desktop notification: %s\n", notifyErr)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "strconv"
+
+// numaPrefix returns the command prefix that binds a test binary's CPU and
+// memory to the provided NUMA node using numactl, or nil if node is negative.
+// On multi-socket machines, this avoids variance from cross-node memory
+// traffic and from the scheduler migrating the benchmark between nodes.
+func numaPrefix(node int) []string {
+	if node < 0 {
+		return nil
+	}
+	n := strconv.Itoa(node)
+	return []string{"numactl", "--cpunodebind=" + n, "--membind=" + n}
+}
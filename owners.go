@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// unowned is the team of benchmarks whose package matches no owners rule.
+const unowned = "(unowned)"
+
+// ownerRule assigns the packages matching a pattern to a team.
+type ownerRule struct {
+	pattern string
+	re      *regexp.Regexp
+	team    string
+	// webhook is the slack incoming webhook of the team, if any.
+	webhook string
+}
+
+// owners maps packages to the teams that own them, as parsed from an owners
+// file. Like CODEOWNERS, the last matching rule wins.
+type owners []ownerRule
+
+// loadOwners parses the owners file. Each line of the file holds a package
+// pattern, the owning team, and optionally the team's slack incoming webhook:
+//
+//	# comments and blank lines are ignored
+//	github.com/org/repo/pkg/kv/...   @kv
+//	github.com/org/repo/pkg/sql/...  @sql  $SQL_SLACK_WEBHOOK
+//
+// Patterns are import paths in which "..." matches any string, as in go list.
+// Webhooks of the form $VAR are read from the environment, so that owners
+// files can be checked in.
+func loadOwners(path string) (owners, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var res owners
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, errors.Errorf("%s:%d: expected a pattern, a team, and optionally a webhook", path, n)
+		}
+		r := ownerRule{pattern: fields[0], re: pkgPatternRegexp(fields[0]), team: fields[1]}
+		if len(fields) == 3 {
+			r.webhook = fields[2]
+			if strings.HasPrefix(r.webhook, "$") {
+				if r.webhook = os.Getenv(r.webhook[1:]); r.webhook == "" {
+					return nil, errors.Errorf("%s:%d: %s is not set", path, n, fields[2])
+				}
+			}
+		}
+		res = append(res, r)
+	}
+	return res, s.Err()
+}
+
+// pkgPatternRegexp returns the regexp matching the package pattern. As in go
+// list, "..." matches any string, and a trailing "/..." also matches the
+// package itself.
+func pkgPatternRegexp(pattern string) *regexp.Regexp {
+	re := regexp.QuoteMeta(pattern)
+	if strings.HasSuffix(re, `/\.\.\.`) {
+		re = strings.TrimSuffix(re, `/\.\.\.`) + `(/\.\.\.)?`
+	}
+	re = strings.Replace(re, `\.\.\.`, `.*`, -1)
+	return regexp.MustCompile("^" + re + "$")
+}
+
+// teamOf returns the team owning the package.
+func (o owners) teamOf(pkg string) string {
+	for i := len(o) - 1; i >= 0; i-- {
+		if o[i].re.MatchString(pkg) {
+			return o[i].team
+		}
+	}
+	return unowned
+}
+
+// webhookOf returns the slack incoming webhook of the team, if any.
+func (o owners) webhookOf(team string) string {
+	for _, r := range o {
+		if r.team == team && r.webhook != "" {
+			return r.webhook
+		}
+	}
+	return ""
+}
+
+// teamSummary is the comparison of the benchmarks owned by a team.
+type teamSummary struct {
+	team         string
+	benchmarks   int
+	regressions  int
+	improvements int
+	// tables holds the team's regressed rows.
+	tables []*benchstat.Table
+}
+
+// summarizeTeams splits the comparison by the teams owning the benchmarks'
+// packages. Teams are sorted by regressions, most first, so that a tree-wide
+// run leads with the teams that need to act, and unowned benchmarks last.
+func summarizeTeams(o owners, newSuite *benchSuite, tables []*benchstat.Table) ([]*teamSummary, error) {
+	pkgs, err := benchPkgs(newSuite.outFile)
+	if err != nil {
+		return nil, err
+	}
+	byTeam := make(map[string]*teamSummary)
+	benchmarks := make(map[string]map[string]bool)
+	for _, t := range tables {
+		regressed := make(map[string]*benchstat.Table)
+		for _, row := range t.Rows {
+			team := o.teamOf(pkgs[row.Benchmark])
+			ts, ok := byTeam[team]
+			if !ok {
+				ts = &teamSummary{team: team}
+				byTeam[team] = ts
+				benchmarks[team] = make(map[string]bool)
+			}
+			benchmarks[team][row.Benchmark] = true
+			switch row.Change {
+			case -1:
+				ts.regressions++
+				rt, ok := regressed[team]
+				if !ok {
+					excerpt := *t
+					excerpt.Rows = nil
+					rt = &excerpt
+					regressed[team] = rt
+					ts.tables = append(ts.tables, rt)
+				}
+				rt.Rows = append(rt.Rows, row)
+			case 1:
+				ts.improvements++
+			}
+		}
+	}
+	res := make([]*teamSummary, 0, len(byTeam))
+	for team, ts := range byTeam {
+		ts.benchmarks = len(benchmarks[team])
+		res = append(res, ts)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].regressions != res[j].regressions {
+			return res[i].regressions > res[j].regressions
+		}
+		if (res[i].team == unowned) != (res[j].team == unowned) {
+			return res[j].team == unowned
+		}
+		return res[i].team < res[j].team
+	})
+	return res, nil
+}
+
+// writeTeamSummaries writes a summary section per team, listing the team's
+// regressions.
+func writeTeamSummaries(w io.Writer, summaries []*teamSummary) {
+	fmt.Fprintf(w, "\nby team:\n")
+	for _, ts := range summaries {
+		fmt.Fprintf(w, "\n%s: %s\n", ts.team, ts.counts())
+		if len(ts.tables) > 0 {
+			benchstat.FormatText(w, ts.tables)
+		}
+	}
+}
+
+func (ts *teamSummary) counts() string {
+	return fmt.Sprintf("%d benchmark(s), %d regression(s), %d improvement(s)",
+		ts.benchmarks, ts.regressions, ts.improvements)
+}
+
+// notifyTeams posts the regressions of each team that has them to the team's
+// slack incoming webhook, if it has one.
+func notifyTeams(ctx context.Context, o owners, oldSuite, newSuite *benchSuite, summaries []*teamSummary) error {
+	for _, ts := range summaries {
+		url := o.webhookOf(ts.team)
+		if url == "" || ts.regressions == 0 {
+			continue
+		}
+		var buf bytes.Buffer
+		benchstat.FormatText(&buf, ts.tables)
+		msg := fmt.Sprintf("*benchdiff* %s → %s (%s)\n%s: %s\n```\n%s```",
+			oldSuite.ref, newSuite.ref, newSuite.redact.string(newSuite.subject),
+			ts.team, ts.counts(), truncateSlack(buf.String()))
+		if err := postSlackText(ctx, url, msg); err != nil {
+			return errors.Wrapf(err, "notifying %s", ts.team)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// maxExactPairs is the number of pairs up to which the exact distribution of
+// the signed-rank statistic is computed, rather than its normal
+// approximation.
+const maxExactPairs = 50
+
+// pairedTest is a benchstat.DeltaTest that exploits the interleaving of the
+// suites' iterations: the i-th samples of the old and new suites ran in the
+// same round, under the same machine conditions, so load that drifts across
+// rounds affects both alike. The test is a Wilcoxon signed-rank test of the
+// per-round log ratios of the samples, which cancels out the drift instead of
+// pooling it into the variance of both sides, as the U-test does.
+//
+// Benchmarks whose samples can't be paired, because a side is missing some
+// rounds, fall back to the U-test.
+func pairedTest(old, new *benchstat.Metrics) (float64, error) {
+	if len(old.Values) != len(new.Values) {
+		return benchstat.UTest(old, new)
+	}
+	var diffs []float64
+	for i := range old.Values {
+		if old.Values[i] <= 0 || new.Values[i] <= 0 {
+			return benchstat.UTest(old, new)
+		}
+		if d := math.Log(new.Values[i] / old.Values[i]); d != 0 {
+			diffs = append(diffs, d)
+		}
+	}
+	if len(diffs) == 0 {
+		return -1, benchstat.ErrSamplesEqual
+	}
+	return signedRankTest(diffs), nil
+}
+
+// signedRankTest returns the two-sided p-value of the Wilcoxon signed-rank
+// test of the non-zero differences.
+func signedRankTest(diffs []float64) float64 {
+	n := len(diffs)
+	abs := make([]float64, n)
+	for i, d := range diffs {
+		abs[i] = math.Abs(d)
+	}
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return abs[order[i]] < abs[order[j]] })
+
+	// Rank the absolute differences, averaging the ranks of ties.
+	ranks := make([]float64, n)
+	ties := false
+	var tieCorrection float64
+	for i := 0; i < n; {
+		j := i
+		for j+1 < n && abs[order[j+1]] == abs[order[i]] {
+			j++
+		}
+		rank := float64(i+j+2) / 2
+		for k := i; k <= j; k++ {
+			ranks[order[k]] = rank
+		}
+		if t := float64(j - i + 1); t > 1 {
+			ties = true
+			tieCorrection += t*t*t - t
+		}
+		i = j + 1
+	}
+	var wPlus float64
+	for i, d := range diffs {
+		if d > 0 {
+			wPlus += ranks[i]
+		}
+	}
+
+	if n <= maxExactPairs && !ties {
+		return exactSignedRankP(n, int(wPlus))
+	}
+	mean := float64(n*(n+1)) / 4
+	variance := float64(n*(n+1)*(2*n+1))/24 - tieCorrection/48
+	if variance == 0 {
+		return 1
+	}
+	z := (math.Abs(wPlus-mean) - 0.5) / math.Sqrt(variance) // continuity corrected
+	if z < 0 {
+		z = 0
+	}
+	return math.Erfc(z / math.Sqrt2)
+}
+
+// exactSignedRankP returns the two-sided p-value of the signed-rank statistic
+// w of n untied pairs, under the null hypothesis that each rank is equally
+// likely to be positive or negative.
+func exactSignedRankP(n, w int) float64 {
+	max := n * (n + 1) / 2
+	// counts[s] is the number of subsets of the ranks 1..n summing to s.
+	counts := make([]float64, max+1)
+	counts[0] = 1
+	for r := 1; r <= n; r++ {
+		for s := max; s >= r; s-- {
+			counts[s] += counts[s-r]
+		}
+	}
+	if w > max-w {
+		w = max - w
+	}
+	var tail float64
+	for s := 0; s <= w; s++ {
+		tail += counts[s]
+	}
+	p := 2 * tail / math.Pow(2, float64(n))
+	if p > 1 {
+		p = 1
+	}
+	return p
+}
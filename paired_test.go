@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"golang.org/x/perf/benchstat"
+)
+
+func metrics(vs ...float64) *benchstat.Metrics {
+	return &benchstat.Metrics{Values: vs, RValues: vs}
+}
+
+func TestSignedRankTest(t *testing.T) {
+	// ranks returns the differences 1..n, with the listed ranks negated.
+	ranks := func(n int, negative ...int) []float64 {
+		diffs := make([]float64, n)
+		for i := range diffs {
+			diffs[i] = float64(i + 1)
+		}
+		for _, r := range negative {
+			diffs[r-1] = -diffs[r-1]
+		}
+		return diffs
+	}
+	// normalP is the continuity-corrected normal approximation of the
+	// p-value of n untied pairs, all of them positive.
+	normalP := func(n int) float64 {
+		mean := float64(n*(n+1)) / 4
+		sd := math.Sqrt(float64(n*(n+1)*(2*n+1)) / 24)
+		return math.Erfc((float64(n*(n+1))/2 - mean - 0.5) / sd / math.Sqrt2)
+	}
+	for _, tc := range []struct {
+		name  string
+		diffs []float64
+		want  float64
+	}{
+		// Exact p-values, e.g. of R's wilcox.test(x, exact=TRUE).
+		{"all positive n=5", ranks(5), 0.0625},
+		{"all negative n=6", ranks(6, 1, 2, 3, 4, 5, 6), 0.03125},
+		{"W=8 n=10", ranks(10, 2, 5, 6, 7, 8, 9, 10), 50.0 / 1024},
+		{"balanced n=4", ranks(4, 1, 4), 1},
+		// Ties use the normal approximation with the tie correction, as
+		// wilcox.test(c(1, 1, 2, -3), exact=FALSE) does.
+		{"ties", []float64{1, 1, 2, -3}, 0.853923},
+		{"all tied", []float64{1, -1}, 1},
+		// The exact distribution is used up to maxExactPairs, and the normal
+		// approximation beyond.
+		{"exact at maxExactPairs", ranks(maxExactPairs), 2 / math.Pow(2, maxExactPairs)},
+		{"normal above maxExactPairs", ranks(maxExactPairs + 1), normalP(maxExactPairs + 1)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := signedRankTest(tc.diffs)
+			if math.Abs(got-tc.want) > 1e-6*tc.want {
+				t.Errorf("signedRankTest(%v) = %g, want %g", tc.diffs, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExactSignedRankP(t *testing.T) {
+	// The p-value is symmetric in W and sums over the lower tail.
+	for w := 0; w <= 15; w++ {
+		if a, b := exactSignedRankP(5, w), exactSignedRankP(5, 15-w); a != b {
+			t.Errorf("exactSignedRankP(5, %d) = %g, but exactSignedRankP(5, %d) = %g", w, a, 15-w, b)
+		}
+	}
+	// The lower tail of n=8: P(W <= 3) = 5/256.
+	if got, want := exactSignedRankP(8, 3), 10.0/256; got != want {
+		t.Errorf("exactSignedRankP(8, 3) = %g, want %g", got, want)
+	}
+}
+
+func TestPairedTest(t *testing.T) {
+	t.Run("all zero diffs", func(t *testing.T) {
+		_, err := pairedTest(metrics(1, 2, 3), metrics(1, 2, 3))
+		if err != benchstat.ErrSamplesEqual {
+			t.Errorf("got err %v, want %v", err, benchstat.ErrSamplesEqual)
+		}
+	})
+	t.Run("pairs", func(t *testing.T) {
+		// The new samples are 5-14% slower in every round. The drift across
+		// rounds swamps the delta for the U-test.
+		old := metrics(100, 200, 300, 400, 500, 600)
+		new := metrics(105, 224, 318, 456, 540, 678)
+		got, err := pairedTest(old, new)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := 0.03125; math.Abs(got-want) > 1e-9 {
+			t.Errorf("got p=%g, want %g", got, want)
+		}
+		if u, _ := benchstat.UTest(old, new); u <= got {
+			t.Errorf("U-test p=%g is not above paired p=%g", u, got)
+		}
+	})
+	for _, tc := range []struct {
+		name     string
+		old, new *benchstat.Metrics
+	}{
+		{"unequal lengths", metrics(1, 2, 3, 4), metrics(2, 3, 4, 5, 6)},
+		{"non-positive values", metrics(0, 2, 3, 4), metrics(2, 3, 4, 5)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := pairedTest(tc.old, tc.new)
+			want, wantErr := benchstat.UTest(tc.old, tc.new)
+			if got != want || err != wantErr {
+				t.Errorf("got (%g, %v), want the U-test's (%g, %v)", got, err, want, wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sysCPUDir is where Linux exposes the topology of the machine's CPUs.
+const sysCPUDir = "/sys/devices/system/cpu"
+
+// partitionCPUs splits the CPUs that the process may run on into n disjoint
+// sets of equally many physical cores, in the list format of taskset -c.
+// Hyperthread siblings are kept in the same set, so that no two workers share
+// a core.
+func partitionCPUs(n int) ([]string, error) {
+	cpus, err := allowedCPUs()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading the CPU affinity")
+	}
+	return partitionCores(cpuCores(sysCPUDir, cpus), n)
+}
+
+// cpuCores groups the CPUs into physical cores by their hyperthread siblings
+// as listed in the topology under dir, keeping the order of the CPUs. A CPU
+// whose siblings can't be read is treated as a core of its own.
+func cpuCores(dir string, cpus []int) [][]int {
+	allowed := make(map[int]bool, len(cpus))
+	for _, c := range cpus {
+		allowed[c] = true
+	}
+	seen := make(map[int]bool, len(cpus))
+	var cores [][]int
+	for _, c := range cpus {
+		if seen[c] {
+			continue
+		}
+		core := []int{c}
+		b, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("cpu%d", c), "topology", "thread_siblings_list"))
+		if err == nil {
+			if siblings, err := parseCPUList(strings.TrimSpace(string(b))); err == nil {
+				core = core[:0]
+				for _, s := range siblings {
+					if allowed[s] && !seen[s] {
+						core = append(core, s)
+					}
+				}
+			}
+		}
+		for _, s := range core {
+			seen[s] = true
+		}
+		cores = append(cores, core)
+	}
+	return cores
+}
+
+// partitionCores splits the cores into n sets of equally many cores, leaving
+// the remainder unused.
+func partitionCores(cores [][]int, n int) ([]string, error) {
+	if n > len(cores) {
+		return nil, errors.Errorf("--parallel=%d exceeds the number of available cores (%d)", n, len(cores))
+	}
+	per := len(cores) / n
+	res := make([]string, n)
+	for i := range res {
+		var cpus []int
+		for _, core := range cores[i*per : (i+1)*per] {
+			cpus = append(cpus, core...)
+		}
+		res[i] = formatCPUList(cpus)
+	}
+	return res, nil
+}
+
+// parseCPUList parses a CPU list like "0-3,8,10-11", as found in sysfs.
+func parseCPUList(s string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		lo, hi := part, part
+		if i := strings.IndexByte(part, '-'); i >= 0 {
+			lo, hi = part[:i], part[i+1:]
+		}
+		l, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, errors.Errorf("invalid CPU list %q", s)
+		}
+		h, err := strconv.Atoi(hi)
+		if err != nil || h < l {
+			return nil, errors.Errorf("invalid CPU list %q", s)
+		}
+		for c := l; c <= h; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus, nil
+}
+
+// formatCPUList formats the CPUs as a list for taskset -c, collapsing runs of
+// consecutive CPUs into ranges.
+func formatCPUList(cpus []int) string {
+	sorted := append([]int(nil), cpus...)
+	sort.Ints(sorted)
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// workerSuite returns a copy of the suite for a parallel worker. The copy runs
+// the test binaries pinned to the CPU set and writes their output to a private
+// temporary file, which is flushed to the suite's output file after each run.
+func (bs *benchSuite) workerSuite(cpus string) (*benchSuite, error) {
+	set, err := parseCPUList(cpus)
+	if err != nil {
+		return nil, err
+	}
+	w := *bs
+	f, err := ioutil.TempFile("", "benchdiff-worker")
+	if err != nil {
+		return nil, err
+	}
+	w.outFile = f
+	w.launch = append([]string{"taskset", "-c", cpus}, bs.launch...)
+	w.cpuSetSize = len(set)
+	return &w, nil
+}
+
+// flushTo appends the output of the worker suite to the output file of the
+// suite that it is a copy of, and truncates it.
+func (bs *benchSuite) flushTo(dst *benchSuite) error {
+	if _, err := bs.outFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := dst.outFile.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst.outFile, bs.outFile); err != nil {
+		return err
+	}
+	if err := bs.outFile.Truncate(0); err != nil {
+		return err
+	}
+	_, err := bs.outFile.Seek(0, io.SeekStart)
+	return err
+}
+
+// closeWorker removes the worker suite's temporary output file.
+func (bs *benchSuite) closeWorker() {
+	_ = bs.outFile.Close()
+	_ = os.Remove(bs.outFile.Name())
+}
+
+// exclusiveShare is the share of its worker's CPU set that an invocation of a
+// test binary must keep busy on average for its test to be considered
+// saturating, e.g. because its benchmarks use b.RunParallel. A test that is
+// pinned to a larger CPU set has more room for the garbage collector's
+// background workers before it competes with itself.
+const exclusiveShare = 0.9
+
+// exclusiveTests tracks the tests that must be run exclusively under
+// --parallel, i.e. without other tests running concurrently and without being
+// pinned to a subset of the CPUs.
+type exclusiveTests struct {
+	// mu is held for reading by each run of a non-exclusive test and for
+	// writing by each run of an exclusive test.
+	mu sync.RWMutex
+
+	detectedMu sync.Mutex
+	configured []string        // see --exclusive
+	detected   map[string]bool // tests detected to saturate their CPU set
+}
+
+func (e *exclusiveTests) isExclusive(test string) bool {
+	e.detectedMu.Lock()
+	defer e.detectedMu.Unlock()
+	return e.detected[test] || matchesPackages(test, e.configured)
+}
+
+// observe marks the test as exclusive if an invocation of it, pinned to a set
+// of cpus CPUs, kept at least exclusiveShare of them busy on average.
+func (e *exclusiveTests) observe(test string, cpu, wall time.Duration, cpus int) {
+	if wall <= 0 || cpus <= 0 || float64(cpu) < exclusiveShare*float64(cpus)*float64(wall) {
+		return
+	}
+	e.detectedMu.Lock()
+	defer e.detectedMu.Unlock()
+	if e.detected[test] {
+		return
+	}
+	e.detected[test] = true
+	fmt.Fprintf(os.Stderr, "%s kept %.1f of its %d CPUs busy; running it exclusively from now on\n",
+		testBinToPkg(test), float64(cpu)/float64(wall), cpus)
+}
+
+// runParallel is the counterpart of runCmpBenches for --parallel. It runs the
+// comparisons of up to cfg.parallel tests concurrently, each on a disjoint set
+// of CPUs. The runs of each test keep the order of the schedule and are not
+// run concurrently with each other. Tests that saturate the machine, either
+// as configured with --exclusive or as detected from the CPU time of their
+// invocations, are run exclusively.
+func runParallel(ctx context.Context, bs1, bs2 *benchSuite, tests []string, cfg *runConfig) error {
+	runs, _, err := prioritizeRuns(tests, cfg)
+	if err != nil {
+		return err
+	}
+	var order []string
+	byTest := make(map[string][]benchRun)
+	for _, r := range runs {
+		if _, ok := byTest[r.test]; !ok {
+			order = append(order, r.test)
+		}
+		byTest[r.test] = append(byTest[r.test], r)
+	}
+	cpuSets, err := partitionCPUs(cfg.parallel)
+	if err != nil {
+		return err
+	}
+	suites := []*benchSuite{bs1, bs2, cfg.control}
+	if crossMachine(bs1, bs2) {
+		for _, b := range suites[:2] {
+			if err := runCalibration(ctx, b); err != nil {
+				return err
+			}
+		}
+	}
+
+	excl := &exclusiveTests{configured: cfg.exclusive, detected: make(map[string]bool)}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex // protects the suites' output files, done, and firstErr
+	var done int
+	var firstErr error
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for _, cpus := range cpuSets {
+		var workers []*benchSuite
+		for _, b := range suites {
+			if b == nil {
+				workers = append(workers, nil)
+				continue
+			}
+			w, err := b.workerSuite(cpus)
+			if err != nil {
+				// Stop the workers that were already started.
+				cancel()
+				close(work)
+				wg.Wait()
+				return err
+			}
+			defer w.closeWorker()
+			workers = append(workers, w)
+		}
+		wg.Add(1)
+		go func(cpus string, workers []*benchSuite) {
+			defer wg.Done()
+			for test := range work {
+				err := runParallelTest(ctx, suites, workers, byTest[test], cfg, &mu, excl)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = errors.Wrapf(err, "running %s", test)
+					cancel()
+				}
+				done++
+				fmt.Fprintf(os.Stderr, "finished %s on CPUs %s (%d/%d)\n", testBinToPkg(test), cpus, done, len(order))
+				mu.Unlock()
+			}
+		}(cpus, workers)
+	}
+	for _, test := range order {
+		select {
+		case work <- test:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// runParallelTest runs the runs of a single test using the worker suites,
+// flushing their output to the suites after each run.
+func runParallelTest(
+	ctx context.Context,
+	suites, workers []*benchSuite,
+	runs []benchRun,
+	cfg *runConfig,
+	mu *sync.Mutex,
+	excl *exclusiveTests,
+) error {
+	for _, r := range runs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := runParallelIter(ctx, suites, workers, r, cfg, mu, excl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runParallelIter runs a single run of a test using the worker suites.
+func runParallelIter(
+	ctx context.Context,
+	suites, workers []*benchSuite, r benchRun, cfg *runConfig, mu *sync.Mutex, excl *exclusiveTests,
+) error {
+	exclusive := excl.isExclusive(r.test)
+	if exclusive {
+		excl.mu.Lock()
+		defer excl.mu.Unlock()
+	} else {
+		excl.mu.RLock()
+		defer excl.mu.RUnlock()
+	}
+	cfg.progress.iterationStarted(r.test, r.iter+1)
+	iterStart := time.Now()
+	idxs := r.suites
+	if cfg.control != nil {
+		idxs = withControl(idxs)
+	}
+	if cfg.frozenOld {
+		idxs = withoutOld(idxs)
+	}
+	for _, idx := range idxs {
+		w := workers[idx]
+		if exclusive {
+			// Use all CPUs.
+			pinned := w.launch
+			w.launch = suites[idx].launch
+			defer func() { w.launch = pinned }()
+		}
+		w.selectLayout(r.iter)
+		if err := w.writeConfig(r.iter+1, cfg.benchTime); err != nil {
+			return err
+		}
+		patterns := []string{cfg.testPattern(r.test)}
+		if cfg.shardBenchmarks {
+			var err error
+			if patterns, err = benchShards(ctx, w, r.test, patterns[0]); err != nil {
+				return err
+			}
+		}
+		for _, pattern := range patterns {
+			var cpu time.Duration
+			start := time.Now()
+			err := runSingleBench(ctx, w, r.test, benchOpts{
+				runPattern:    pattern,
+				skipPattern:   cfg.skipBench,
+				iter:          r.iter + 1,
+				tolerateCrash: cfg.shardBenchmarks,
+				fuzzSeeds:     cfg.fuzzSeeds,
+				benchTime:     cfg.benchTime,
+				count:         r.count,
+				short:         cfg.short,
+				sizeClass:     cfg.sizeClass,
+				cpuTime:       &cpu,
+			})
+			if err != nil {
+				return err
+			}
+			if !exclusive && !w.isRemote() {
+				excl.observe(r.test, cpu, time.Since(start), w.cpuSetSize)
+			}
+		}
+		if cfg.examples {
+			err := runExamples(ctx, w, r.test, benchOpts{
+				runPattern: cfg.runPattern,
+				iter:       r.iter + 1,
+				benchTime:  cfg.benchTime,
+				count:      r.count,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	cfg.progress.iterationDone(r.test, r.count, time.Since(iterStart))
+	mu.Lock()
+	err := func() error {
+		for _, idx := range idxs {
+			if err := workers[idx].flushTo(suites[idx]); err != nil {
+				return err
+			}
+		}
+		ev := hookEvent{Event: hookPostIteration, Test: r.test, Iteration: r.iter + 1}
+		if err := runHooks(ctx, cfg.plugins, ev, suites[0], suites[1]); err != nil {
+			return err
+		}
+		return writePartialReport(suites[0], suites[1], cfg.compare)
+	}()
+	mu.Unlock()
+	return err
+}
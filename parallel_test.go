@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCPUList(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []int
+		err  bool
+	}{
+		{in: "0", want: []int{0}},
+		{in: "0-3", want: []int{0, 1, 2, 3}},
+		{in: "0,64", want: []int{0, 64}},
+		{in: "0-1,8,10-11", want: []int{0, 1, 8, 10, 11}},
+		{in: "", err: true},
+		{in: "3-1", err: true},
+		{in: "a", err: true},
+	} {
+		got, err := parseCPUList(tc.in)
+		if (err != nil) != tc.err {
+			t.Errorf("parseCPUList(%q): err = %v, want error %t", tc.in, err, tc.err)
+			continue
+		}
+		if !tc.err && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseCPUList(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestFormatCPUList(t *testing.T) {
+	for _, tc := range []struct {
+		in   []int
+		want string
+	}{
+		{in: []int{0}, want: "0"},
+		{in: []int{0, 1, 2, 3}, want: "0-3"},
+		{in: []int{64, 0, 65, 1}, want: "0-1,64-65"},
+		{in: []int{0, 2, 4}, want: "0,2,4"},
+	} {
+		if got := formatCPUList(tc.in); got != tc.want {
+			t.Errorf("formatCPUList(%v) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestPartitionCPUs(t *testing.T) {
+	// A machine with 4 cores of 2 hyperthreads each, numbered like Linux does
+	// on x86 (CPU i and i+4 share a core), with CPU 3 not in the affinity mask.
+	dir, err := ioutil.TempDir("", "cpus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for c := 0; c < 8; c++ {
+		topo := filepath.Join(dir, fmt.Sprintf("cpu%d", c), "topology")
+		if err := os.MkdirAll(topo, 0755); err != nil {
+			t.Fatal(err)
+		}
+		siblings := fmt.Sprintf("%d,%d", c%4, c%4+4)
+		if err := ioutil.WriteFile(filepath.Join(topo, "thread_siblings_list"), []byte(siblings+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cores := cpuCores(dir, []int{0, 1, 2, 4, 5, 6, 7})
+	want := [][]int{{0, 4}, {1, 5}, {2, 6}, {7}}
+	if !reflect.DeepEqual(cores, want) {
+		t.Fatalf("cpuCores = %v, want %v", cores, want)
+	}
+
+	sets, err := partitionCores(cores, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"0-1,4-5", "2,6-7"}; !reflect.DeepEqual(sets, want) {
+		t.Errorf("partitionCores(2) = %q, want %q", sets, want)
+	}
+	sets, err = partitionCores(cores, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"0,4", "1,5", "2,6"}; !reflect.DeepEqual(sets, want) {
+		t.Errorf("partitionCores(3) = %q, want %q", sets, want)
+	}
+	if _, err := partitionCores(cores, 5); err == nil {
+		t.Error("partitionCores(5) of 4 cores succeeded")
+	}
+
+	// Without topology, every CPU is a core of its own.
+	if got, want := cpuCores(filepath.Join(dir, "missing"), []int{0, 1}), [][]int{{0}, {1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cpuCores without topology = %v, want %v", got, want)
+	}
+}
+
+func TestExclusiveTestsObserve(t *testing.T) {
+	for _, tc := range []struct {
+		cpu, wall time.Duration
+		cpus      int
+		want      bool
+	}{
+		{cpu: 3 * time.Second, wall: time.Second, cpus: 4, want: false},
+		{cpu: 3600 * time.Millisecond, wall: time.Second, cpus: 4, want: true},
+		{cpu: 2 * time.Second, wall: time.Second, cpus: 16, want: false},
+		{cpu: 950 * time.Millisecond, wall: time.Second, cpus: 1, want: true},
+		{cpu: time.Second, wall: 0, cpus: 1, want: false},
+	} {
+		e := &exclusiveTests{detected: make(map[string]bool)}
+		e.observe("pkg.test", tc.cpu, tc.wall, tc.cpus)
+		if got := e.isExclusive("pkg.test"); got != tc.want {
+			t.Errorf("observe(cpu=%s, wall=%s, cpus=%d): exclusive = %t, want %t",
+				tc.cpu, tc.wall, tc.cpus, got, tc.want)
+		}
+	}
+}
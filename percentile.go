@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// percentileUnit matches the units of latency percentiles that benchmarks
+// report with b.ReportMetric, like p50-ns or p99.9-ns.
+var percentileUnit = regexp.MustCompile(`^p(\d+(?:\.\d+)?)-(\w+)$`)
+
+// isPercentileTable returns whether the table holds a latency percentile.
+func isPercentileTable(t *benchstat.Table) bool {
+	return percentileUnit.MatchString(t.Metric)
+}
+
+// comparePercentiles recomputes the rows of the latency percentile tables
+// around medians instead of means. Each sample of a percentile is already an
+// order statistic of a run, whose tail is what it measures, so the samples
+// aren't trimmed of outliers and the center of a row and its delta are the
+// median of its samples, which a single slow run can't skew. Significance is
+// tested with the rank-based test of the comparison, as before.
+func comparePercentiles(tables []*benchstat.Table, test benchstat.DeltaTest, alpha float64, order benchstat.Order) {
+	for _, t := range tables {
+		if !isPercentileTable(t) || !t.OldNewDelta {
+			continue
+		}
+		for _, row := range t.Rows {
+			if len(row.Metrics) != 2 {
+				continue
+			}
+			for _, m := range row.Metrics {
+				m.RValues = m.Values
+				m.Mean = median(m.Values)
+				m.Min, m.Max = math.Inf(1), math.Inf(-1)
+				for _, v := range m.Values {
+					m.Min, m.Max = math.Min(m.Min, v), math.Max(m.Max, v)
+				}
+			}
+			compareRow(row, test, alpha)
+			row.Note = strings.TrimSpace(row.Note + " [median]")
+		}
+		if order != nil {
+			benchstat.Sort(t, order)
+		}
+	}
+}
+
+// compareRow sets the delta of the row as benchstat does, for a metric of
+// which smaller is better. See directions.orient for the other metrics.
+func compareRow(row *benchstat.Row, test benchstat.DeltaTest, alpha float64) {
+	old, new := row.Metrics[0], row.Metrics[1]
+	row.PctDelta, row.Delta, row.Change, row.Note = 0, "~", 0, ""
+	pval, err := test(old, new)
+	switch {
+	case err == benchstat.ErrZeroVariance:
+		row.Note = "(zero variance)"
+	case err == benchstat.ErrSampleSize:
+		row.Note = "(too few samples)"
+	case err == benchstat.ErrSamplesEqual:
+		row.Note = "(all equal)"
+	case err != nil:
+		row.Note = fmt.Sprintf("(%s)", err)
+	case pval < alpha:
+		if new.Mean == old.Mean {
+			row.Delta = "0.00%"
+		} else if old.Mean != 0 {
+			row.PctDelta = (new.Mean/old.Mean - 1) * 100
+			row.Delta = fmt.Sprintf("%+.2f%%", row.PctDelta)
+			if row.PctDelta < 0 {
+				row.Change = +1
+			} else {
+				row.Change = -1
+			}
+		}
+	}
+	if row.Note == "" && pval != -1 {
+		row.Note = fmt.Sprintf("(p=%0.3f n=%d+%d)", pval, len(old.RValues), len(new.RValues))
+	}
+}
+
+// splitPercentileTables splits the tables into the latency percentile tables
+// and the others.
+func splitPercentileTables(tables []*benchstat.Table) (others, percentiles []*benchstat.Table) {
+	for _, t := range tables {
+		if isPercentileTable(t) {
+			percentiles = append(percentiles, t)
+		} else {
+			others = append(others, t)
+		}
+	}
+	return others, percentiles
+}
+
+// formatLatencies writes the latency percentile tables as a single table,
+// with a row per benchmark and the old, new, and delta columns of each
+// percentile side by side.
+func formatLatencies(w io.Writer, tables []*benchstat.Table) {
+	sort.SliceStable(tables, func(i, j int) bool {
+		return percentileOf(tables[i].Metric) < percentileOf(tables[j].Metric)
+	})
+	rows := make(map[string]map[string]*benchstat.Row)
+	var names []string
+	for _, t := range tables {
+		for _, row := range t.Rows {
+			if len(row.Metrics) != 2 {
+				continue
+			}
+			if rows[row.Benchmark] == nil {
+				rows[row.Benchmark] = make(map[string]*benchstat.Row)
+				names = append(names, row.Benchmark)
+			}
+			rows[row.Benchmark][t.Metric] = row
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\nlatencies (medians of the per-run percentiles):\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "name")
+	for _, t := range tables {
+		p := strings.SplitN(t.Metric, "-", 2)[0]
+		fmt.Fprintf(tw, "\told %s\tnew %s\tdelta", p, p)
+	}
+	fmt.Fprintln(tw)
+	for _, name := range names {
+		fmt.Fprint(tw, name)
+		for _, t := range tables {
+			row, ok := rows[name][t.Metric]
+			if !ok {
+				fmt.Fprint(tw, "\t\t\t")
+				continue
+			}
+			fmt.Fprintf(tw, "\t%s\t%s\t%s", formatLatency(row.Metrics[0]), formatLatency(row.Metrics[1]), row.Delta)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+}
+
+// percentileOf returns the percentile of the unit, e.g. 99.9 for p99.9-ns.
+func percentileOf(unit string) float64 {
+	m := percentileUnit.FindStringSubmatch(unit)
+	if m == nil {
+		return 0
+	}
+	p, _ := strconv.ParseFloat(m[1], 64)
+	return p
+}
+
+// formatLatency formats the median of the percentile, scaled as a duration if
+// its unit is nanoseconds.
+func formatLatency(m *benchstat.Metrics) string {
+	unit := m.Unit
+	if strings.HasSuffix(unit, "-ns") {
+		unit = "ns/op"
+	}
+	return benchstat.NewScaler(m.Mean, unit)(m.Mean)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/perf/benchstat"
+)
+
+func TestComparePercentilesDirection(t *testing.T) {
+	table := func() *benchstat.Table {
+		old, new := metrics(100, 101, 102, 103, 104, 105), metrics(200, 201, 202, 203, 204, 205)
+		old.Unit, new.Unit = "p99-ns", "p99-ns"
+		return &benchstat.Table{
+			Metric:      "p99-ns",
+			OldNewDelta: true,
+			Rows: []*benchstat.Row{{
+				Benchmark: "Lat",
+				Metrics:   []*benchstat.Metrics{old, new},
+			}},
+		}
+	}
+	for _, tc := range []struct {
+		dirs directions
+		want int
+	}{
+		{nil, -1},
+		{directions{"p99-ns": true}, +1},
+	} {
+		tables := []*benchstat.Table{table()}
+		comparePercentiles(tables, benchstat.UTest, 0.05, nil)
+		tc.dirs.orient(tables, nil)
+		row := tables[0].Rows[0]
+		if row.Change != tc.want {
+			t.Errorf("directions %v: change = %d, want %d", tc.dirs, row.Change, tc.want)
+		}
+		if row.Metrics[0].Mean != 102.5 || row.Metrics[1].Mean != 202.5 {
+			t.Errorf("directions %v: centers = %v, %v, want the medians", tc.dirs, row.Metrics[0].Mean, row.Metrics[1].Mean)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// runtimeKnobs are the environment variables that tune the Go runtime of the
+// test binaries, which --pin-runtime pins.
+var runtimeKnobs = []string{"GOGC", "GOMAXPROCS", "GOMEMLIMIT", "GODEBUG"}
+
+func isRuntimeKnob(name string) bool {
+	for _, k := range runtimeKnobs {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePinnedRuntime parses the --pin-runtime values, each a comma-separated
+// list of <knob>=<value> assignments, into KEY=VALUE form. As GODEBUG values
+// are themselves comma-separated, an item that doesn't assign a knob continues
+// the value of the previous one, e.g. GODEBUG=madvdontneed=1,gctrace=1.
+func parsePinnedRuntime(specs []string) ([]string, error) {
+	var res []string
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		for _, item := range strings.Split(spec, ",") {
+			i := strings.Index(item, "=")
+			if i < 0 || !isRuntimeKnob(item[:i]) {
+				if len(res) == 0 || !strings.HasPrefix(res[len(res)-1], "GODEBUG=") {
+					return nil, errors.Errorf("invalid --pin-runtime assignment %q: must be <knob>=<value>, "+
+						"where the knob is one of %s", item, strings.Join(runtimeKnobs, ", "))
+				}
+				res[len(res)-1] += "," + item
+				continue
+			}
+			if seen[item[:i]] {
+				return nil, errors.Errorf("--pin-runtime pins %s more than once", item[:i])
+			}
+			seen[item[:i]] = true
+			res = append(res, item)
+		}
+	}
+	return res, nil
+}
+
+// checkPinnedRuntime returns an error if the environment of a suite sets a
+// knob that is pinned, which would defeat the pinning.
+func checkPinnedRuntime(pinned, env []string) error {
+	for _, kv := range env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		for _, p := range pinned {
+			if strings.HasPrefix(p, name+"=") {
+				return errors.Errorf("%s is pinned by --pin-runtime and can't be set for one suite", name)
+			}
+		}
+	}
+	return nil
+}
+
+// unpinnedRuntimePrefix returns the command prefix that unsets the runtime
+// knobs that aren't pinned, so that they run with the runtime's defaults
+// rather than whatever benchdiff's environment, or the remote host's, happens
+// to set.
+func unpinnedRuntimePrefix(pinned []string) []string {
+	res := []string{"env"}
+	for _, k := range runtimeKnobs {
+		var ok bool
+		for _, p := range pinned {
+			ok = ok || strings.HasPrefix(p, k+"=")
+		}
+		if !ok {
+			res = append(res, "-u", k)
+		}
+	}
+	if len(res) == 1 {
+		return nil
+	}
+	return res
+}
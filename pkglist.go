@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// readPkgList reads a list of package filters from the file at the provided
+// path, or from stdin if the path is "-". Packages are separated by
+// whitespace, and lines starting with # are ignored. See --pkgs-from.
+func readPkgList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading package list")
+		}
+		defer f.Close()
+		r = f
+	}
+	var pkgs []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		pkgs = append(pkgs, strings.Fields(line)...)
+	}
+	return pkgs, errors.Wrap(s.Err(), "reading package list")
+}
+
+// dedupPkgs sorts the package filters and removes duplicates.
+func dedupPkgs(pkgs []string) []string {
+	sort.Strings(pkgs)
+	res := pkgs[:0]
+	for i, p := range pkgs {
+		if i == 0 || p != pkgs[i-1] {
+			res = append(res, p)
+		}
+	}
+	return res
+}
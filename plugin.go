@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// pluginPrefix is the prefix of the name of plugin executables on the PATH.
+const pluginPrefix = "benchdiff-"
+
+// Lifecycle points at which plugins are invoked.
+const (
+	hookPostBuild     = "post-build"
+	hookPostIteration = "post-iteration"
+	hookPostRun       = "post-run"
+)
+
+// plugin is an external executable named benchdiff-<name> that is invoked at
+// each lifecycle point of a run. The plugin is passed the name of the
+// lifecycle point as its only argument and a JSON-encoded hookEvent on stdin.
+// It may reply with a JSON-encoded hookResponse on stdout.
+type plugin struct {
+	name string
+	path string
+}
+
+// suiteInfo describes a benchmark suite to plugins and templates.
+type suiteInfo struct {
+	Ref     string   `json:"ref"`
+	Subject string   `json:"subject"`
+	Host    string   `json:"host,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	Build   []string `json:"build_flags,omitempty"`
+	OutFile string   `json:"out_file,omitempty"`
+	BinDir  string   `json:"bin_dir,omitempty"`
+	Image   string   `json:"image,omitempty"`
+}
+
+// hookEvent is the payload passed to plugins on stdin.
+type hookEvent struct {
+	Event     string      `json:"event"`
+	Old       suiteInfo   `json:"old"`
+	New       suiteInfo   `json:"new"`
+	Test      string      `json:"test,omitempty"`
+	Iteration int         `json:"iteration,omitempty"`
+	Tables    []jsonTable `json:"tables,omitempty"`
+}
+
+// hookResponse is the optional payload that plugins reply with on stdout.
+// OldResults and NewResults are lines in the Go benchmark format which are
+// appended to the output of the corresponding suite, allowing plugins to
+// contribute extra metrics to the comparison. They are rejected for post-run,
+// which is invoked once the comparison is complete. Output is printed to
+// stdout.
+type hookResponse struct {
+	OldResults []string `json:"old_results"`
+	NewResults []string `json:"new_results"`
+	Output     string   `json:"output"`
+}
+
+// findPlugins locates the executables for the plugins with the provided names
+// on the PATH.
+func findPlugins(names []string) ([]plugin, error) {
+	var res []plugin
+	for _, name := range names {
+		path, err := exec.LookPath(pluginPrefix + name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "finding plugin %q", name)
+		}
+		res = append(res, plugin{name: name, path: path})
+	}
+	return res, nil
+}
+
+// listPlugins returns the names of all plugins on the PATH.
+func listPlugins() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		matches, _ := filepath.Glob(filepath.Join(dir, pluginPrefix+"*"))
+		for _, m := range matches {
+			name := strings.TrimPrefix(filepath.Base(m), pluginPrefix)
+			if fi, err := os.Stat(m); err != nil || fi.IsDir() || fi.Mode()&0111 == 0 || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func makeSuiteInfo(bs *benchSuite) suiteInfo {
+	s := suiteInfo{
+		Ref:     bs.ref,
+		Subject: bs.subject,
+		Host:    bs.host,
+		Env:     bs.env,
+		Build:   bs.buildFlags,
+		BinDir:  bs.binDir,
+		Image:   bs.image,
+	}
+	if bs.outFile != nil {
+		s.OutFile = bs.outFile.Name()
+	}
+	return s
+}
+
+// runHooks invokes each plugin for the provided lifecycle event and applies
+// their responses. Plugins are run with the suites' secrets in their
+// environment, which are scrubbed from their output.
+func runHooks(ctx context.Context, plugins []plugin, ev hookEvent, oldSuite, newSuite *benchSuite) error {
+	if len(plugins) == 0 {
+		return nil
+	}
+	ev.Old, ev.New = makeSuiteInfo(oldSuite), makeSuiteInfo(newSuite)
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	for _, p := range plugins {
+		var stdout bytes.Buffer
+		err := oldSuite.secrets.run(ctx, bytes.NewReader(payload), &stdout, os.Stderr, p.path, ev.Event)
+		if err != nil {
+			return errors.Wrapf(err, "running plugin %q for %s", p.name, ev.Event)
+		}
+		if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+			continue
+		}
+		var resp hookResponse
+		if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+			return errors.Wrapf(err, "decoding response of plugin %q for %s", p.name, ev.Event)
+		}
+		if ev.Event == hookPostRun && (len(resp.OldResults) > 0 || len(resp.NewResults) > 0) {
+			return errors.Errorf("plugin %q returned results for %s, after the comparison; "+
+				"return them for %s instead", p.name, ev.Event, hookPostIteration)
+		}
+		if err := appendResults(oldSuite, resp.OldResults); err != nil {
+			return err
+		}
+		if err := appendResults(newSuite, resp.NewResults); err != nil {
+			return err
+		}
+		if resp.Output != "" {
+			fmt.Println(strings.TrimRight(resp.Output, "\n"))
+		}
+	}
+	return nil
+}
+
+// appendResults appends the provided benchmark result lines to the output file
+// of the suite.
+func appendResults(bs *benchSuite, lines []string) error {
+	if len(lines) == 0 || bs.outFile == nil {
+		return nil
+	}
+	if _, err := bs.outFile.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(bs.outFile, strings.Join(lines, "\n"))
+	return err
+}
+
+// runListPlugins implements `benchdiff plugins`, which lists the plugins found
+// on the PATH.
+func runListPlugins(ctx context.Context, args []string) error {
+	for _, name := range listPlugins() {
+		fmt.Println(name)
+	}
+	return nil
+}
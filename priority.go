@@ -0,0 +1,49 @@
+package main
+
+import "strings"
+
+// matchesPackages returns whether the test binary belongs to one of the
+// packages in the list, like --priority. Entries are package paths, optionally
+// relative (./pkg/kv) and optionally ending in /... to match all packages
+// beneath a directory.
+func matchesPackages(test string, pkgs []string) bool {
+	for _, p := range pkgs {
+		p = strings.TrimPrefix(p, "./")
+		recursive := strings.HasSuffix(p, "/...")
+		bin := pkgToTestBin(strings.TrimSuffix(p, "/..."))
+		if test == bin || strings.HasSuffix(test, "_"+bin) {
+			return true
+		}
+		if recursive && (strings.HasPrefix(test, bin+"_") || strings.Contains(test, "_"+bin+"_")) {
+			return true
+		}
+	}
+	return false
+}
+
+// prioritizeRuns schedules all iterations of the tests in the priority list
+// before those of all other tests, so that the comparison of the prioritized
+// tests is available early. It returns the runs along with the number of
+// leading runs that belong to prioritized tests.
+func prioritizeRuns(tests []string, cfg *runConfig) ([]benchRun, int, error) {
+	var prio, rest []string
+	for _, t := range tests {
+		if matchesPackages(t, cfg.priority) {
+			prio = append(prio, t)
+		} else {
+			rest = append(rest, t)
+		}
+	}
+	prioRuns, err := scheduleRuns(prio, cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	restRuns, err := scheduleRuns(rest, cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range restRuns {
+		restRuns[i].testIdx += len(prio)
+	}
+	return append(prioRuns, restRuns...), len(prioRuns), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// privilegePrefix returns the command prefix that runs a test binary as root
+// (sudo) or as the current user with the provided ambient capabilities
+// (caps), or nil if neither is requested. Capabilities are granted by having
+// sudo run setpriv, which drops back to the current user while retaining the
+// capabilities.
+func privilegePrefix(sudo bool, caps []string) []string {
+	if len(caps) > 0 {
+		var set []string
+		for _, c := range caps {
+			set = append(set, "+"+strings.TrimPrefix(strings.ToLower(c), "cap_"))
+		}
+		capList := strings.Join(set, ",")
+		return []string{
+			"sudo", "-E", "setpriv",
+			"--reuid=" + strconv.Itoa(os.Getuid()),
+			"--regid=" + strconv.Itoa(os.Getgid()),
+			"--init-groups",
+			"--inh-caps=" + capList,
+			"--ambient-caps=" + capList,
+			"--",
+		}
+	}
+	if sudo {
+		return []string{"sudo", "-E"}
+	}
+	return nil
+}
+
+// confirmPrivileges asks the user to confirm on stdin that the test binaries
+// may be run with elevated privileges, unless the confirmation was given up
+// front.
+func confirmPrivileges(sudo bool, caps []string, confirmed bool) error {
+	if confirmed {
+		return nil
+	}
+	what := "as root"
+	if len(caps) > 0 {
+		what = "with capabilities " + strings.Join(caps, ",")
+	}
+	fmt.Fprintf(os.Stderr, "benchmarks will be run %s via sudo. Continue? [y/N] ", what)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return errors.Wrap(err, "reading confirmation (pass --yes to confirm non-interactively)")
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	default:
+		return errors.New("running with elevated privileges not confirmed")
+	}
+}
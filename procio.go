@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// procIOFile is the I/O accounting file of the benchdiff process. The kernel
+// adds the I/O counters of each child process to its parent's counters when
+// the child is reaped, so the difference between readings taken before and
+// after a test binary is run (and waited on) measures the I/O of the test
+// binary.
+const procIOFile = "/proc/self/io"
+
+// procIOMetrics maps the counters in /proc/<pid>/io that are compared to the
+// units that they are reported under.
+var procIOMetrics = []struct {
+	counter, unit string
+}{
+	{"read_bytes", "read-B"},
+	{"write_bytes", "write-B"},
+	{"syscr", "read-syscalls"},
+	{"syscw", "write-syscalls"},
+}
+
+// readProcIO reads the I/O counters of the benchdiff process.
+func readProcIO() (map[string]uint64, error) {
+	f, err := os.Open(procIOFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading I/O counters")
+	}
+	defer f.Close()
+	res := make(map[string]uint64)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		res[parts[0]] = v
+	}
+	return res, s.Err()
+}
+
+// procIODelta returns the I/O performed between the two readings. Bytes are
+// those that hit (or would have hit) the storage layer, so they capture write
+// amplification but exclude reads served from the page cache. Syscall counts
+// include the few writes that benchdiff itself makes to the terminal while
+// the test binary runs.
+func procIODelta(start, end map[string]uint64) map[string]float64 {
+	res := make(map[string]float64, len(procIOMetrics))
+	for _, m := range procIOMetrics {
+		res[m.unit] = float64(end[m.counter] - start[m.counter])
+	}
+	return res
+}
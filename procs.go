@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// procsNormalization describes how the GOMAXPROCS suffixes of benchmark names
+// (the -8 in BenchmarkFoo-8) are rewritten before results are compared, so
+// that results from machines with different core counts line up. See
+// --normalize-procs.
+type procsNormalization struct {
+	// strip removes the suffixes from the results of both suites.
+	strip bool
+	// mapping maps suffixes (without the dash) of the old suite's results to
+	// those of the new suite's.
+	mapping map[string]string
+}
+
+// parseProcsNormalization parses the value of --normalize-procs, which is
+// either 'strip' or a comma-separated list of old=new suffix mappings. It
+// returns nil for an empty value.
+func parseProcsNormalization(s string) (*procsNormalization, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if s == "strip" {
+		return &procsNormalization{strip: true}, nil
+	}
+	n := &procsNormalization{mapping: make(map[string]string)}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !isProcs(parts[0]) || !isProcs(parts[1]) {
+			return nil, errors.Errorf("invalid --normalize-procs %q: must be 'strip' or old=new mappings like 8=16", s)
+		}
+		n.mapping[parts[0]] = parts[1]
+	}
+	return n, nil
+}
+
+// isBenchResult returns whether the line of output is a benchmark result.
+func isBenchResult(line string) bool {
+	return strings.HasPrefix(line, "Benchmark") && isResultLine(strings.Fields(line))
+}
+
+func isProcs(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n > 0
+}
+
+// splitProcs splits the GOMAXPROCS suffix off a benchmark name as it appears
+// in the output of a test binary.
+func splitProcs(name string) (base, procs string) {
+	if i := strings.LastIndexByte(name, '-'); i >= 0 && isProcs(name[i+1:]) {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// normalize rewrites the benchmark names in the output of a suite. old is
+// whether the output is from the old (or control) suite.
+func (n *procsNormalization) normalize(out []byte, old bool) []byte {
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(out, []byte("\n")) {
+		if !isBenchResult(string(line)) {
+			buf.Write(line)
+			continue
+		}
+		i := bytes.IndexAny(line, " \t")
+		buf.WriteString(n.rename(string(line[:i]), old))
+		buf.Write(line[i:])
+	}
+	return buf.Bytes()
+}
+
+// rename returns the normalized benchmark name. old is whether the name is
+// from the output of the old (or control) suite.
+func (n *procsNormalization) rename(name string, old bool) string {
+	base, procs := splitProcs(name)
+	switch {
+	case procs == "":
+		return name
+	case n.strip:
+		return base
+	case old && n.mapping[procs] != "":
+		return base + "-" + n.mapping[procs]
+	default:
+		return name
+	}
+}
+
+// results returns a reader of the suite's output, with the benchmark names
+// normalized if configured. old is whether the suite is the old (or control)
+// suite. The output file is left at its end.
+func (bs *benchSuite) results(old bool) (io.Reader, error) {
+	if _, err := bs.outFile.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	out, err := ioutil.ReadAll(bs.outFile)
+	if err != nil {
+		return nil, err
+	}
+	if bs.ramped != nil {
+		out = bs.ramped.drop(out)
+	}
+	if bs.procs != nil {
+		out = bs.procs.normalize(out, old)
+	}
+	if len(bs.payloads) > 0 {
+		out = deriveThroughput(out, bs.payloads)
+	}
+	if bs.warmup != nil {
+		out, bs.warmupDropped = bs.warmup.drop(out)
+	}
+	if bs.projection != nil {
+		out = bs.projection.apply(out)
+	}
+	return bytes.NewReader(out), nil
+}
+
+// recordedProcs returns the GOMAXPROCS values that the results were recorded
+// with. Go suffixes every benchmark name of a process with its GOMAXPROCS,
+// unless that is 1, so a suffix that not all results of a process share, like
+// the -64 in BenchmarkFoo/size-64, is part of a benchmark's name instead.
+func recordedProcs(r io.Reader) (map[string]bool, error) {
+	res := make(map[string]bool)
+	var procs string // the suffix shared by the results of the process so far
+	var results int
+	flush := func() {
+		if results > 0 && procs != "" {
+			res[procs] = true
+		}
+		procs, results = "", 0
+	}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "pkg: "):
+			flush()
+		case isBenchResult(line):
+			_, p := splitProcs(strings.Fields(line)[0])
+			if results == 0 {
+				procs = p
+			} else if p != procs {
+				procs = ""
+			}
+			results++
+		}
+	}
+	flush()
+	return res, s.Err()
+}
+
+// procsSuffixes returns the set of GOMAXPROCS suffixes in the suite's output.
+func procsSuffixes(bs *benchSuite) (map[string]bool, error) {
+	if _, err := bs.outFile.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	defer bs.outFile.Seek(0, io.SeekEnd)
+	res := make(map[string]bool)
+	s := bufio.NewScanner(bs.outFile)
+	for s.Scan() {
+		if line := s.Text(); isBenchResult(line) {
+			if _, procs := splitProcs(strings.Fields(line)[0]); procs != "" {
+				res[procs] = true
+			}
+		}
+	}
+	return res, s.Err()
+}
+
+// warnProcsMismatch warns if the benchmark names of the suites have different
+// GOMAXPROCS suffixes, in which case their results don't line up, unless they
+// are normalized.
+func warnProcsMismatch(oldSuite, newSuite *benchSuite) error {
+	if oldSuite.procs != nil {
+		return nil
+	}
+	oldProcs, err := procsSuffixes(oldSuite)
+	if err != nil {
+		return err
+	}
+	newProcs, err := procsSuffixes(newSuite)
+	if err != nil {
+		return err
+	}
+	sorted := func(set map[string]bool) string {
+		var res []string
+		for p := range set {
+			res = append(res, "-"+p)
+		}
+		sort.Strings(res)
+		return strings.Join(res, ",")
+	}
+	if o, n := sorted(oldProcs), sorted(newProcs); o != n && o != "" && n != "" {
+		fmt.Fprintf(os.Stderr, "warning: the old results have GOMAXPROCS suffixes %s but the new results have %s, "+
+			"so their benchmarks don't line up; pass --normalize-procs to compare them\n", o, n)
+	}
+	return nil
+}
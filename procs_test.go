@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRecordedProcs(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		out  string
+		want map[string]bool
+	}{
+		{
+			name: "suffixed",
+			out: `pkg: example.com/a
+BenchmarkFoo/size-64-8	100	10 ns/op
+BenchmarkBar-8	100	10 ns/op
+`,
+			want: map[string]bool{"8": true},
+		},
+		{
+			name: "GOMAXPROCS=1",
+			out: `pkg: example.com/a
+BenchmarkFoo/size-64	100	10 ns/op
+BenchmarkFoo/size-128	100	10 ns/op
+`,
+			want: map[string]bool{},
+		},
+		{
+			name: "per process",
+			out: `pkg: example.com/a
+BenchmarkFoo-4	100	10 ns/op
+pkg: example.com/a
+BenchmarkFoo-16	100	10 ns/op
+pkg: example.com/b
+BenchmarkBar/size-64	100	10 ns/op
+BenchmarkBaz	100	10 ns/op
+`,
+			want: map[string]bool{"4": true, "16": true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := recordedProcs(strings.NewReader(tc.out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("recordedProcs = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
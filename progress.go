@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+const statusUsage = `usage: benchdiff status [<run-id>]
+
+benchdiff status prints the progress of a run from its progress file in
+benchdiff/progress: the iterations completed and time spent per test, the
+tests being run, the number of failures, and the comparison of the results
+collected so far, as of the last completed iteration. Without a run id, the
+latest run is shown. A running benchdiff also prints its status to stderr,
+without interrupting the run, when it receives SIGUSR1:
+
+  $ kill -USR1 <pid>
+
+The pid of a run is part of its status.`
+
+// progressDir is the directory holding the progress files of runs.
+var progressDir = filepath.Join("benchdiff", "progress")
+
+// progressFlushInterval is how often the progress file of a run is written.
+const progressFlushInterval = 5 * time.Second
+
+// Statuses of a run in its progress file. A file that is left with the
+// running status belongs to a run that crashed or was killed, along with its
+// machine.
+const (
+	progressRunning = "running"
+	progressDone    = "done"
+	progressFailed  = "failed"
+)
+
+// progressState is the content of a progress file.
+type progressState struct {
+	RunID   string    `json:"run_id"`
+	PID     int       `json:"pid"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+	// Iterations is the number of iterations of each test.
+	Iterations int `json:"iterations"`
+	// Running maps the tests being run to their current iteration.
+	Running map[string]int `json:"running,omitempty"`
+	// Completed maps the tests to the number of iterations that completed.
+	Completed map[string]int `json:"completed"`
+	// Durations maps the tests to the time spent running them so far.
+	Durations map[string]string `json:"durations"`
+	Failures  []failure         `json:"failures,omitempty"`
+	// Report is the text report of the comparison of the results collected
+	// so far, which is rewritten after every iteration.
+	Report string `json:"report,omitempty"`
+}
+
+// progressFile periodically writes the progress of a run to
+// benchdiff/progress/<run-id>.json, so that after a crash or a reboot of the
+// machine it shows where the run stopped and what had completed. A nil
+// *progressFile records nothing. The progress is also printed on SIGUSR1.
+type progressFile struct {
+	path     string
+	failures *triage
+	stop     chan struct{}
+	stopped  chan struct{}
+
+	mu        sync.Mutex
+	state     progressState
+	durations map[string]time.Duration
+}
+
+// startProgress starts writing the progress of the run to its progress file.
+// report is the text report of the partial comparison of the run.
+func startProgress(runID string, iters int, failures *triage, report string) (*progressFile, error) {
+	if err := os.MkdirAll(progressDir, 0755); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	p := &progressFile{
+		path:     filepath.Join(progressDir, runID+".json"),
+		failures: failures,
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		state: progressState{
+			RunID:      runID,
+			PID:        os.Getpid(),
+			Status:     progressRunning,
+			Started:    now,
+			Iterations: iters,
+			Running:    make(map[string]int),
+			Completed:  make(map[string]int),
+			Durations:  make(map[string]string),
+			Report:     report,
+		},
+		durations: make(map[string]time.Duration),
+	}
+	if err := p.flush(); err != nil {
+		return nil, err
+	}
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		defer close(p.stopped)
+		defer signal.Stop(usr1)
+		t := time.NewTicker(progressFlushInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := p.flush(); err != nil {
+					fmt.Fprintf(os.Stderr, "\nwriting progress file: %v\n", err)
+				}
+			case <-usr1:
+				p.mu.Lock()
+				p.state.Updated = time.Now().UTC()
+				p.state.Failures = p.failures.list()
+				var buf strings.Builder
+				writeStatus(&buf, &p.state)
+				p.mu.Unlock()
+				fmt.Fprintf(os.Stderr, "\n%s\n", buf.String())
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p, nil
+}
+
+// iterationStarted records that the iteration of the test, counting from 1,
+// started.
+func (p *progressFile) iterationStarted(test string, iter int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state.Running[test] = iter
+}
+
+// iterationDone records that count iterations of the test completed, taking
+// the duration.
+func (p *progressFile) iterationDone(test string, count int, d time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.state.Running, test)
+	p.state.Completed[test] += count
+	p.durations[test] += d
+	p.state.Durations[test] = p.durations[test].Round(time.Millisecond).String()
+}
+
+// finish records the outcome of the run and stops writing its progress file.
+func (p *progressFile) finish(err error) error {
+	if p == nil {
+		return nil
+	}
+	close(p.stop)
+	<-p.stopped
+	p.mu.Lock()
+	if err != nil {
+		p.state.Status, p.state.Error = progressFailed, err.Error()
+	} else {
+		p.state.Status = progressDone
+	}
+	p.mu.Unlock()
+	return p.flush()
+}
+
+// flush writes the progress file. It is written to a temporary file that is
+// renamed over it, so that a crash never leaves a truncated file.
+func (p *progressFile) flush() error {
+	p.mu.Lock()
+	p.state.Updated = time.Now().UTC()
+	p.state.Failures = p.failures.list()
+	data, err := json.MarshalIndent(p.state, "", "  ")
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+// writeStatus writes the progress of the run, followed by the comparison of
+// the results collected so far.
+func writeStatus(w io.Writer, st *progressState) {
+	fmt.Fprintf(w, "run %s (pid %d): %s", st.RunID, st.PID, st.Status)
+	if st.Status == progressRunning {
+		fmt.Fprintf(w, " for %s, updated %s ago",
+			st.Updated.Sub(st.Started).Round(time.Second), time.Since(st.Updated).Round(time.Second))
+	} else {
+		fmt.Fprintf(w, " at %s", st.Updated.Local().Format(localTimeFormat))
+	}
+	fmt.Fprintln(w)
+	if st.Error != "" {
+		fmt.Fprintf(w, "error: %s\n", st.Error)
+	}
+	var tests []string
+	for test := range st.Completed {
+		tests = append(tests, test)
+	}
+	for test := range st.Running {
+		if _, ok := st.Completed[test]; !ok {
+			tests = append(tests, test)
+		}
+	}
+	sort.Strings(tests)
+	for _, test := range tests {
+		fmt.Fprintf(w, "  %s: %d/%d iterations", test, st.Completed[test], st.Iterations)
+		if d, ok := st.Durations[test]; ok {
+			fmt.Fprintf(w, " in %s", d)
+		}
+		if iter, ok := st.Running[test]; ok {
+			fmt.Fprintf(w, ", running iteration %d", iter)
+		}
+		fmt.Fprintln(w)
+	}
+	if len(st.Failures) > 0 {
+		fmt.Fprintf(w, "failures: %d\n", len(st.Failures))
+	}
+	if st.Report == "" {
+		return
+	}
+	report, err := ioutil.ReadFile(st.Report)
+	if os.IsNotExist(err) {
+		fmt.Fprintln(w, "no iteration has completed on both sides yet")
+		return
+	} else if err != nil {
+		fmt.Fprintf(w, "reading partial comparison: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "comparison so far (%s):\n%s", st.Report, report)
+}
+
+// latestRunWithProgress returns the id of the latest run with a progress file.
+func latestRunWithProgress() (string, error) {
+	files, err := ioutil.ReadDir(progressDir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	var latest string
+	for _, f := range files {
+		if id := strings.TrimSuffix(f.Name(), ".json"); id != f.Name() && id > latest {
+			latest = id
+		}
+	}
+	if latest == "" {
+		return "", errors.Errorf("no progress files in %s", progressDir)
+	}
+	return latest, nil
+}
+
+func runStatus(ctx context.Context, args []string) error {
+	var help bool
+	flags := pflag.NewFlagSet("status", pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, statusUsage) }
+	flags.BoolVarP(&help, "help", "h", false, "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if help || flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, statusUsage)
+		return nil
+	}
+
+	runID := flags.Arg(0)
+	if runID == "" {
+		var err error
+		if runID, err = latestRunWithProgress(); err != nil {
+			return err
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(progressDir, runID+".json"))
+	if err != nil {
+		return err
+	}
+	var st progressState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+	writeStatus(os.Stdout, &st)
+	return nil
+}
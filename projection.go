@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// projection slices the results of parameterized benchmark families by the
+// parameters of their sub-benchmarks (see subBenchmark.params), in the style
+// of benchproc: a filter selects the results to compare, and the group-by
+// keys aggregate the results that share their values into a single benchmark.
+// Keys are 'name', the top-level benchmark, and '/<param>', e.g. '/size'. See
+// --filter and --group-by.
+type projection struct {
+	filter  []filterTerm
+	groupBy []string
+}
+
+// filterTerm is a term of a --filter expression, <key>:<value>, matching the
+// results whose key has the value. The value may be a parenthesized list of
+// alternatives separated by OR, or a /regexp/.
+type filterTerm struct {
+	key    string
+	values []string
+	re     *regexp.Regexp
+	negate bool // the term was prefixed with '-'
+}
+
+// parseProjection parses the --filter expression and --group-by keys, or
+// returns nil if both are empty.
+func parseProjection(filter string, groupBy []string) (*projection, error) {
+	if filter == "" && len(groupBy) == 0 {
+		return nil, nil
+	}
+	p := &projection{}
+	for _, key := range groupBy {
+		if err := checkProjectionKey(key); err != nil {
+			return nil, errors.Wrap(err, "--group-by")
+		}
+		p.groupBy = append(p.groupBy, strings.TrimPrefix(key, "."))
+	}
+	for _, tok := range splitFilter(filter) {
+		if tok == "AND" {
+			continue
+		}
+		var t filterTerm
+		if strings.HasPrefix(tok, "-") {
+			t.negate, tok = true, tok[1:]
+		}
+		i := strings.Index(tok, ":")
+		if i < 0 {
+			return nil, errors.Errorf("invalid --filter term %q: must be <key>:<value>", tok)
+		}
+		t.key, tok = strings.TrimPrefix(tok[:i], "."), tok[i+1:]
+		if err := checkProjectionKey(t.key); err != nil {
+			return nil, errors.Wrap(err, "--filter")
+		}
+		switch {
+		case len(tok) > 1 && strings.HasPrefix(tok, "/") && strings.HasSuffix(tok, "/"):
+			re, err := regexp.Compile(tok[1 : len(tok)-1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid --filter term %q", tok)
+			}
+			t.re = re
+		case strings.HasPrefix(tok, "(") && strings.HasSuffix(tok, ")"):
+			for _, v := range strings.Split(tok[1:len(tok)-1], " OR ") {
+				t.values = append(t.values, strings.TrimSpace(v))
+			}
+		default:
+			t.values = []string{tok}
+		}
+		p.filter = append(p.filter, t)
+	}
+	return p, nil
+}
+
+func checkProjectionKey(key string) error {
+	key = strings.TrimPrefix(key, ".")
+	if key != "name" && (!strings.HasPrefix(key, "/") || len(key) == 1) {
+		return errors.Errorf("invalid key %q: must be 'name' or '/<param>'", key)
+	}
+	return nil
+}
+
+// splitFilter splits the --filter expression into its terms, which are
+// separated by spaces outside of parentheses.
+func splitFilter(s string) []string {
+	var res []string
+	var depth, start int
+	for i := 0; i <= len(s); i++ {
+		switch {
+		case i == len(s) || (s[i] == ' ' && depth == 0):
+			if tok := strings.TrimSpace(s[start:i]); tok != "" {
+				res = append(res, tok)
+			}
+			start = i + 1
+		case s[i] == '(':
+			depth++
+		case s[i] == ')':
+			depth--
+		}
+	}
+	return res
+}
+
+// projectionValue returns the value of the key for the benchmark.
+func projectionValue(sb subBenchmark, key string) (string, bool) {
+	if key == "name" {
+		return sb.parent, true
+	}
+	v, ok := sb.params()[key[1:]]
+	return v, ok
+}
+
+func (t filterTerm) matches(sb subBenchmark) bool {
+	v, ok := projectionValue(sb, t.key)
+	match := ok && t.re != nil && t.re.MatchString(v)
+	for _, want := range t.values {
+		match = match || (ok && v == want)
+	}
+	return match != t.negate
+}
+
+// group returns the name of the aggregate benchmark that the benchmark is
+// part of, such as Foo/size=1024 when grouping by name and /size, or
+// All/size=1024 when grouping by /size across benchmarks.
+func (p *projection) group(sb subBenchmark) string {
+	parts := []string{"All"}
+	for _, key := range p.groupBy {
+		v, ok := projectionValue(sb, key)
+		switch {
+		case !ok:
+		case key == "name":
+			parts[0] = v
+		default:
+			parts = append(parts, key[1:]+"="+v)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// rename returns the name that the results of the benchmark are compared
+// under, which is that of its group if grouping, or false if the filter drops
+// them.
+func (p *projection) rename(name string) (string, bool) {
+	sb := parseSubBenchmark(name)
+	for _, t := range p.filter {
+		if !t.matches(sb) {
+			return "", false
+		}
+	}
+	if len(p.groupBy) == 0 {
+		return name, true
+	}
+	return p.group(sb), true
+}
+
+// apply filters the benchmark results in the output of a suite and, if
+// grouping, replaces the results of each group's members with aggregate
+// results. The n-th aggregate result of a group is the geometric mean of the
+// n-th result of each member, per unit, so that each iteration of the run
+// still contributes one sample and the comparison keeps its statistics.
+func (p *projection) apply(out []byte) []byte {
+	var buf bytes.Buffer
+	type sample map[string][]float64 // values by unit
+	var groups []string
+	samples := make(map[string][]sample)
+	var units []string
+	seenUnit := make(map[string]bool)
+	occurrences := make(map[string]int)
+	for _, line := range bytes.SplitAfter(out, []byte("\n")) {
+		if !isBenchResult(string(line)) {
+			buf.Write(line)
+			continue
+		}
+		fields := strings.Fields(string(line))
+		g, keep := p.rename(strings.TrimPrefix(fields[0], "Benchmark"))
+		if !keep {
+			continue
+		}
+		if len(p.groupBy) == 0 {
+			buf.Write(line)
+			continue
+		}
+		if _, ok := samples[g]; !ok {
+			groups = append(groups, g)
+		}
+		n := occurrences[fields[0]]
+		occurrences[fields[0]]++
+		for len(samples[g]) <= n {
+			samples[g] = append(samples[g], make(sample))
+		}
+		for i := 2; i+1 < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				continue
+			}
+			unit := fields[i+1]
+			if !seenUnit[unit] {
+				seenUnit[unit] = true
+				units = append(units, unit)
+			}
+			samples[g][n][unit] = append(samples[g][n][unit], v)
+		}
+	}
+	for _, g := range groups {
+		for _, s := range samples[g] {
+			buf.WriteString("Benchmark" + g + " 1")
+			for _, unit := range units {
+				if vs, ok := s[unit]; ok {
+					buf.WriteString(" " + strconv.FormatFloat(geomean(vs), 'g', 10, 64) + " " + unit)
+				}
+			}
+			buf.WriteString("\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+// geomean returns the geometric mean of the values, or their arithmetic mean
+// if any is zero, as is common for allocation counts, for which the geometric
+// mean is undefined.
+func geomean(vs []float64) float64 {
+	var logSum, sum float64
+	zero := false
+	for _, v := range vs {
+		if v <= 0 {
+			zero = true
+		} else {
+			logSum += math.Log(v)
+		}
+		sum += v
+	}
+	if zero {
+		return sum / float64(len(vs))
+	}
+	return math.Exp(logSum / float64(len(vs)))
+}
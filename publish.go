@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// publishManifest is the file under the publish target that lists the
+// published runs, from which its index page is rendered.
+const publishManifest = "runs.json"
+
+// publishTarget is where --publish uploads the HTML reports of runs: a GCS
+// bucket prefix of the form gs://<bucket>/<path>, or an scp target of the form
+// <host>:<path>. Each run is uploaded to <target>/<run-id>/index.html, next to
+// an index page listing all runs published there, so that teams that already
+// serve static sites from GCS or a web server can share links to results.
+type publishTarget struct {
+	dest string
+	// url is the URL that dest is served at, if known.
+	url string
+}
+
+// newPublishTarget parses the --publish target. baseURL overrides the URL that
+// the target is served at, which defaults to the public URL of GCS objects.
+func newPublishTarget(dest, baseURL string) (*publishTarget, error) {
+	dest = strings.TrimSuffix(dest, "/")
+	switch {
+	case strings.HasPrefix(dest, "gs://"):
+		if strings.TrimPrefix(dest, "gs://") == "" {
+			return nil, errors.New("--publish requires a bucket")
+		}
+		if baseURL == "" {
+			baseURL = "https://storage.googleapis.com/" + strings.TrimPrefix(dest, "gs://")
+		}
+	case strings.Contains(dest, ":"):
+		if host, dir := splitHostPath(dest); host == "" || dir == "" {
+			return nil, errors.Errorf("invalid --publish target %q; expected <host>:<path>", dest)
+		}
+	default:
+		return nil, errors.Errorf("invalid --publish target %q; expected gs://<bucket>/<path> or <host>:<path>", dest)
+	}
+	return &publishTarget{dest: dest, url: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+// splitHostPath splits an scp target into its host and path.
+func splitHostPath(dest string) (host, dir string) {
+	i := strings.Index(dest, ":")
+	return dest[:i], dest[i+1:]
+}
+
+func (p *publishTarget) isGCS() bool {
+	return strings.HasPrefix(p.dest, "gs://")
+}
+
+// location returns the URL of the file under the target, or its location if
+// the URL that the target is served at isn't known.
+func (p *publishTarget) location(name string) string {
+	if p.url == "" {
+		return p.dest + "/" + name
+	}
+	return p.url + "/" + name
+}
+
+// publishedRun is an entry of the manifest of published runs.
+type publishedRun struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Old     string    `json:"old"`
+	New     string    `json:"new"`
+	Subject string    `json:"subject"`
+}
+
+// publish renders the comparison of the run as an HTML report, uploads it to
+// the target along with an updated index page, and returns the URL of the
+// report.
+func (p *publishTarget) publish(
+	ctx context.Context,
+	runID string,
+	oldSuite, newSuite *benchSuite,
+	tables []*benchstat.Table,
+	sparks sparklineData,
+) (string, error) {
+	tmp, err := ioutil.TempDir("", "benchdiff-publish")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	run := publishedRun{
+		ID:      runID,
+		Time:    time.Now().UTC(),
+		Old:     newSuite.redact.string(oldSuite.ref),
+		New:     newSuite.redact.string(newSuite.ref),
+		Subject: newSuite.redact.string(newSuite.subject),
+	}
+	runDir := filepath.Join(tmp, runID)
+	if err := os.Mkdir(runDir, 0755); err != nil {
+		return "", err
+	}
+	page, err := renderPublishedReport(run, newSuite, tables, sparks)
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(runDir, "index.html"), page, 0644); err != nil {
+		return "", err
+	}
+	if err := p.upload(ctx, runDir, ""); err != nil {
+		return "", errors.Wrap(err, "uploading report")
+	}
+
+	runs, err := p.loadManifest(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "reading published runs")
+	}
+	for i := range runs {
+		if runs[i].ID == runID {
+			runs = append(runs[:i], runs[i+1:]...)
+			break
+		}
+	}
+	runs = append(runs, run)
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID > runs[j].ID })
+	data, err := json.MarshalIndent(runs, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, publishManifest), data, 0644); err != nil {
+		return "", err
+	}
+	var index bytes.Buffer
+	if err := publishIndexTemplate.Execute(&index, runs); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "index.html"), index.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	for _, name := range []string{publishManifest, "index.html"} {
+		if err := p.upload(ctx, filepath.Join(tmp, name), name); err != nil {
+			return "", errors.Wrap(err, "uploading index")
+		}
+	}
+	return p.location(runID + "/index.html"), nil
+}
+
+// upload copies the local file or directory to the target, under the name if
+// provided or else under its base name. Files are uploaded without caching, as
+// the index page and manifest are overwritten by every run.
+func (p *publishTarget) upload(ctx context.Context, local, name string) error {
+	if name == "" {
+		name = filepath.Base(local)
+	}
+	if p.isGCS() {
+		cp := "cp"
+		if info, err := os.Stat(local); err != nil {
+			return err
+		} else if info.IsDir() {
+			cp = "rsync"
+		}
+		_, err := capture(ctx, "gsutil", "-m", "-q", "-h", "Cache-Control:no-cache",
+			cp, "-r", local, p.dest+"/"+name)
+		return err
+	}
+	host, dir := splitHostPath(p.dest)
+	if _, err := capture(ctx, "ssh", host, "mkdir", "-p", shellQuote(dir)); err != nil {
+		return err
+	}
+	// The remote path is interpreted by the remote shell, as with mkdir.
+	_, err := capture(ctx, "scp", "-q", "-r", local, host+":"+shellQuote(path.Join(dir, name)))
+	return err
+}
+
+// loadManifest returns the runs published to the target so far.
+func (p *publishTarget) loadManifest(ctx context.Context) ([]publishedRun, error) {
+	var data string
+	var err error
+	if p.isGCS() {
+		url := p.dest + "/" + publishManifest
+		// gsutil stat fails if the object doesn't exist.
+		if _, statErr := capture(ctx, "gsutil", "-q", "stat", url); statErr != nil {
+			return nil, nil
+		}
+		data, err = capture(ctx, "gsutil", "cat", url)
+	} else {
+		host, dir := splitHostPath(p.dest)
+		file := shellQuote(path.Join(dir, publishManifest))
+		data, err = capture(ctx, "ssh", host, "test ! -f "+file+" || cat "+file)
+	}
+	if err != nil || data == "" {
+		return nil, err
+	}
+	var runs []publishedRun
+	if err := json.Unmarshal([]byte(data), &runs); err != nil {
+		return nil, errors.Wrap(err, publishManifest)
+	}
+	return runs, nil
+}
+
+// renderPublishedReport renders the comparison as a standalone HTML page,
+// rendering the tables like the html output format.
+func renderPublishedReport(
+	run publishedRun, newSuite *benchSuite, tables []*benchstat.Table, sparks sparklineData,
+) ([]byte, error) {
+	var buf bytes.Buffer
+	benchstat.FormatHTML(&buf, tables)
+	var failures bytes.Buffer
+	writeTriage(&failures, newSuite.redact.failures(newSuite.triage.list()))
+	var page bytes.Buffer
+	err := publishReportTemplate.Execute(&page, struct {
+		publishedRun
+		Tables   template.HTML
+		Failures string
+	}{run, template.HTML(addSparklines(buf.Bytes(), tables, sparks)), failures.String()})
+	return page.Bytes(), err
+}
+
+var publishReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>benchdiff: {{.Old}} → {{.New}}</title>
+</head>
+<body>
+<p><a href="../index.html">all runs</a></p>
+<h1>{{.Old}} → {{.New}}</h1>
+<p>{{.Subject}}<br>run {{.ID}}, published {{.Time.UTC.Format "2006-01-02 15:04 MST"}}</p>
+{{.Tables}}
+{{with .Failures}}<pre>{{.}}</pre>{{end}}
+</body>
+</html>
+`))
+
+var publishIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>benchdiff runs</title>
+</head>
+<body>
+<h1>benchdiff runs</h1>
+<table>
+<tr><th>run</th><th>old</th><th>new</th><th>subject</th></tr>
+{{range .}}<tr><td><a href="{{.ID}}/index.html">{{.ID}}</a></td><td>{{.Old}}</td><td>{{.New}}</td><td>{{.Subject}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// rampAfterIters is the number of iterations of a test after which the
+	// decision to ramp up the benchtime of its benchmarks is made.
+	rampAfterIters = 2
+	// rampMaxNsPerOp is the time/op below which a benchmark is considered
+	// fast enough to have its benchtime ramped up.
+	rampMaxNsPerOp = 1000
+	// rampMinCV is the coefficient of variation above which a benchmark is
+	// considered noisy enough to have its benchtime ramped up.
+	rampMinCV = 0.05
+)
+
+// rampState records which top-level benchmarks of a test binary have had their
+// benchtime ramped up.
+type rampState struct {
+	pkg    string   // the package of the test binary
+	ramped []string // top-level benchmarks run with the ramped up benchtime
+}
+
+// rampedBenchmarks holds the top-level benchmarks whose benchtime was ramped
+// up, keyed by package, so that the samples that they took before, at another
+// benchtime, are discarded rather than pooled with those taken after. It is
+// shared by the suites of a run.
+type rampedBenchmarks struct {
+	benchTime string // the ramped up benchtime
+	pkgs      map[string]map[string]bool
+}
+
+func newRampedBenchmarks(benchTime string) *rampedBenchmarks {
+	return &rampedBenchmarks{benchTime: benchTime, pkgs: make(map[string]map[string]bool)}
+}
+
+// add records the ramped benchmarks of a test binary.
+func (rb *rampedBenchmarks) add(st *rampState) {
+	if len(st.ramped) == 0 {
+		return
+	}
+	if rb.pkgs[st.pkg] == nil {
+		rb.pkgs[st.pkg] = make(map[string]bool)
+	}
+	for _, top := range st.ramped {
+		rb.pkgs[st.pkg][top] = true
+	}
+}
+
+// drop discards the results of the ramped benchmarks in the output of a suite
+// that were recorded at another benchtime than the ramped up one.
+func (rb *rampedBenchmarks) drop(out []byte) []byte {
+	var buf bytes.Buffer
+	var pkg, benchTime string
+	for _, line := range bytes.SplitAfter(out, []byte("\n")) {
+		s := string(line)
+		switch {
+		case strings.HasPrefix(s, "pkg: "):
+			pkg = strings.TrimSpace(strings.TrimPrefix(s, "pkg: "))
+		case strings.HasPrefix(s, "benchtime: "):
+			benchTime = strings.TrimSpace(strings.TrimPrefix(s, "benchtime: "))
+		case isBenchResult(s) && benchTime != rb.benchTime:
+			name := strings.TrimPrefix(strings.Fields(s)[0], "Benchmark")
+			if rb.pkgs[pkg][topLevelBench(name)] {
+				continue
+			}
+		}
+		buf.Write(line)
+	}
+	return buf.Bytes()
+}
+
+// decideRamp inspects the samples collected so far for the provided test
+// binary and determines which of its top-level benchmarks are both fast and
+// noisy, and would therefore benefit from a longer benchtime.
+func decideRamp(oldSuite, newSuite *benchSuite, test string, cc *compareConfig) (*rampState, error) {
+	tables, err := computeTables(oldSuite, newSuite, true, cc)
+	if err != nil {
+		return nil, err
+	}
+	pkgs, err := benchPkgs(newSuite.outFile)
+	if err != nil {
+		return nil, err
+	}
+	var st rampState
+	ramp := make(map[string]bool)
+	for _, table := range tables {
+		if table.Metric != "time/op" {
+			continue
+		}
+		for _, row := range table.Rows {
+			if pkgToTestBin(pkgs[row.Benchmark]) != test || len(row.Metrics) != 2 {
+				continue
+			}
+			st.pkg = pkgs[row.Benchmark]
+			top := topLevelBench(row.Benchmark)
+			var maxMean, maxCV float64
+			for _, m := range row.Metrics {
+				mean, cv := meanAndCV(m.Values)
+				maxMean, maxCV = math.Max(maxMean, mean), math.Max(maxCV, cv)
+			}
+			ramp[top] = ramp[top] || (maxMean < rampMaxNsPerOp && maxCV > rampMinCV)
+		}
+	}
+	for top, ok := range ramp {
+		if ok {
+			st.ramped = append(st.ramped, top)
+		}
+	}
+	sort.Strings(st.ramped)
+	return &st, nil
+}
+
+// topLevelBench returns the name of the top-level benchmark function of the
+// provided benchmark, as reported by benchstat.
+func topLevelBench(name string) string {
+	name = procsSuffix.ReplaceAllString(name, "")
+	return strings.SplitN(name, "/", 2)[0]
+}
+
+// topLevelRegexp returns a -test.bench or -test.skip pattern that matches
+// exactly the provided top-level benchmarks.
+func topLevelRegexp(names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = regexp.QuoteMeta(n)
+	}
+	return "^Benchmark(" + strings.Join(quoted, "|") + ")$"
+}
+
+// meanAndCV returns the mean and the coefficient of variation of the samples.
+func meanAndCV(xs []float64) (float64, float64) {
+	if len(xs) == 0 {
+		return 0, 0
+	}
+	m := mean(xs)
+	if m == 0 {
+		return 0, 0
+	}
+	var ss float64
+	for _, x := range xs {
+		ss += (x - m) * (x - m)
+	}
+	return m, math.Sqrt(ss/float64(len(xs))) / m
+}
+
+// logRamps reports the benchmarks that had their benchtime ramped up.
+func logRamps(ramps map[string]*rampState, benchTime string) {
+	var tests []string
+	for t, st := range ramps {
+		if len(st.ramped) > 0 {
+			tests = append(tests, t)
+		}
+	}
+	if len(tests) == 0 {
+		return
+	}
+	sort.Strings(tests)
+	fmt.Fprintf(os.Stderr, "\nincreased benchtime to %s after %d iterations for fast, noisy benchmarks:\n",
+		benchTime, rampAfterIters)
+	for _, t := range tests {
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", testBinToPkg(t), strings.Join(ramps[t].ramped, ", "))
+	}
+}
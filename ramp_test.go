@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestRampedBenchmarksDrop(t *testing.T) {
+	rb := newRampedBenchmarks("5s")
+	rb.add(&rampState{pkg: "example.com/a", ramped: []string{"Fast"}})
+
+	out := `commit: abc
+benchtime: 1s
+pkg: example.com/a
+BenchmarkFast-8   	1000000	        10.0 ns/op
+BenchmarkFast/sub-8	1000000	        11.0 ns/op
+BenchmarkSlow-8   	     100	   1000000 ns/op
+pkg: example.com/b
+BenchmarkFast-8   	1000000	        12.0 ns/op
+benchtime: 5s
+pkg: example.com/a
+BenchmarkFast-8   	5000000	         9.0 ns/op
+`
+	want := `commit: abc
+benchtime: 1s
+pkg: example.com/a
+BenchmarkSlow-8   	     100	   1000000 ns/op
+pkg: example.com/b
+BenchmarkFast-8   	1000000	        12.0 ns/op
+benchtime: 5s
+pkg: example.com/a
+BenchmarkFast-8   	5000000	         9.0 ns/op
+`
+	if got := string(rb.drop([]byte(out))); got != want {
+		t.Errorf("drop:\n%s\nwant:\n%s", got, want)
+	}
+
+	// A test binary with nothing ramped is left alone.
+	rb.add(&rampState{pkg: "example.com/b"})
+	if len(rb.pkgs) != 1 {
+		t.Errorf("add of no ramped benchmarks recorded package: %v", rb.pkgs)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// redactor strips hostnames, usernames, and absolute paths from the metadata
+// of shareable outputs (the header, sheets, HTML, JSON, and templates), so that
+// results can be posted publicly without leaking details of internal
+// infrastructure. See --redact. A nil *redactor leaves everything unchanged.
+type redactor struct {
+	// prefixes are path prefixes replaced by placeholders, longest first.
+	prefixes []redaction
+	// words are hostnames and usernames, replaced where they appear as whole
+	// words.
+	words []*regexp.Regexp
+	names []string // the placeholders of words
+}
+
+type redaction struct {
+	old, new string
+}
+
+// absPath matches absolute paths that follow the start of the string,
+// whitespace, or a separator in flags, environment variables, and lists.
+var absPath = regexp.MustCompile(`(^|[\s=:,"'(\[])(/[^\s:,"')\]]*)`)
+
+// newRedactor returns a redactor for the local host, user, and repository and
+// for the provided remote hosts (which may be of the form user@host).
+func newRedactor(ctx context.Context, hosts ...string) *redactor {
+	r := &redactor{}
+	if top, err := capture(ctx, "git", "rev-parse", "--show-toplevel"); err == nil {
+		r.prefixes = append(r.prefixes, redaction{top, "<repo>"})
+	}
+	if wd, err := os.Getwd(); err == nil {
+		r.prefixes = append(r.prefixes, redaction{wd, "<repo>"})
+	}
+	if home, err := os.UserHomeDir(); err == nil && home != "/" {
+		r.prefixes = append(r.prefixes, redaction{home, "~"})
+	}
+	var users []string
+	if u, err := user.Current(); err == nil {
+		users = append(users, u.Username)
+	}
+	if h, err := os.Hostname(); err == nil {
+		hosts = append(hosts, h)
+	}
+	for _, h := range hosts {
+		h = strings.TrimPrefix(h, k8sHostPrefix)
+		if i := strings.Index(h, "@"); i >= 0 {
+			users = append(users, h[:i])
+			h = h[i+1:]
+		}
+		r.addWord(h, "<host>")
+		// Also redact the short name of fully-qualified hostnames.
+		if i := strings.Index(h, "."); i > 0 {
+			r.addWord(h[:i], "<host>")
+		}
+	}
+	for _, u := range users {
+		r.addWord(u, "<user>")
+	}
+	sort.Slice(r.prefixes, func(i, j int) bool { return len(r.prefixes[i].old) > len(r.prefixes[j].old) })
+	return r
+}
+
+func (r *redactor) addWord(word, name string) {
+	if word == "" || word == "localhost" {
+		return
+	}
+	r.words = append(r.words, regexp.MustCompile(`\b`+regexp.QuoteMeta(word)+`\b`))
+	r.names = append(r.names, name)
+}
+
+// string redacts the string. Paths under the repository and the home directory
+// are made relative to them, and the directories of other absolute paths are
+// dropped.
+func (r *redactor) string(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, p := range r.prefixes {
+		s = strings.ReplaceAll(s, p.old, p.new)
+	}
+	s = absPath.ReplaceAllStringFunc(s, func(m string) string {
+		i := strings.Index(m, "/")
+		path := m[i:]
+		if path == "/" {
+			return m
+		}
+		return m[:i] + "<path>/" + path[strings.LastIndex(path, "/")+1:]
+	})
+	for i, w := range r.words {
+		s = w.ReplaceAllLiteralString(s, r.names[i])
+	}
+	return s
+}
+
+func (r *redactor) strings(ss []string) []string {
+	if r == nil || ss == nil {
+		return ss
+	}
+	res := make([]string, len(ss))
+	for i, s := range ss {
+		res[i] = r.string(s)
+	}
+	return res
+}
+
+// suiteInfo redacts the description of a suite.
+func (r *redactor) suiteInfo(s suiteInfo) suiteInfo {
+	if r == nil {
+		return s
+	}
+	s.Host = r.string(s.Host)
+	s.Env = r.strings(s.Env)
+	s.Build = r.strings(s.Build)
+	s.OutFile = r.string(s.OutFile)
+	s.BinDir = r.string(s.BinDir)
+	s.Image = r.string(s.Image)
+	return s
+}
+
+// failures redacts the messages of failures.
+func (r *redactor) failures(fs []failure) []failure {
+	if r == nil {
+		return fs
+	}
+	res := make([]failure, len(fs))
+	for i, f := range fs {
+		f.Message = r.string(f.Message)
+		res[i] = f
+	}
+	return res
+}
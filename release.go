@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+const publishReleaseUsage = `usage: benchdiff publish-release [--release-store <dir>] <tag> <out-file>
+
+benchdiff publish-release publishes the benchmark output of a release, such as
+the out file of a benchdiff run of the release's commit, to the release store,
+so that branches can be compared against the release's recorded numbers with
+--old=release:<tag> instead of building and running the release.
+
+Each release is stored as a bundle, the directory <store>/<tag> holding the
+benchmark output (out.txt) and its metadata (bundle.json). The store is a
+directory or a gs:// bucket.
+
+Options:
+      --release-store <dir>  the release store (default $BENCHDIFF_RELEASE_STORE)`
+
+// releasePrefix marks an --old ref that names a release, whose recorded
+// benchmark output is fetched from the release store instead of being built
+// and run.
+const releasePrefix = "release:"
+
+// releaseStoreEnv is the environment variable holding the default location of
+// the release store.
+const releaseStoreEnv = "BENCHDIFF_RELEASE_STORE"
+
+// releaseLabel labels a suite whose output is the recorded output of a release.
+const releaseLabel = "release"
+
+// Files of a release bundle.
+const (
+	releaseMetaFile = "bundle.json"
+	releaseOutFile  = "out.txt"
+)
+
+// releaseBundle is the recorded benchmark output of a release.
+type releaseBundle struct {
+	Tag       string    `json:"tag"`
+	Commit    string    `json:"commit"`
+	GoVersion string    `json:"go_version"`
+	CPU       string    `json:"cpu,omitempty"` // as reported by the benchmarks
+	Created   time.Time `json:"created"`
+	// dir is the local directory holding the bundle.
+	dir string
+}
+
+// releaseDir returns the location of the release's bundle in the store.
+func releaseDir(store, tag string) (string, error) {
+	if store == "" {
+		return "", errors.Errorf("no release store configured; pass --release-store or set %s", releaseStoreEnv)
+	}
+	if tag == "" || strings.Contains(tag, "..") || strings.HasPrefix(tag, "/") {
+		return "", errors.Errorf("invalid release tag %q", tag)
+	}
+	return strings.TrimSuffix(store, "/") + "/" + tag, nil
+}
+
+// fetchReleaseBundle returns the bundle of the release from the store. Bundles
+// in buckets are downloaded to a local cache once, as published bundles don't
+// change.
+func fetchReleaseBundle(ctx context.Context, store, tag string) (*releaseBundle, error) {
+	dir, err := releaseDir(store, tag)
+	if err != nil {
+		return nil, err
+	}
+	if isRemoteHistory(store) {
+		cache := filepath.Join("benchdiff", "releases", hash([]string{store}), tag)
+		if _, err := os.Stat(filepath.Join(cache, releaseMetaFile)); os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "fetching release %s from %s\n", tag, store)
+			if err := os.MkdirAll(cache, 0755); err != nil {
+				return nil, err
+			}
+			if _, err := capture(ctx, "gsutil", "-m", "-q", "rsync", "-r", dir, cache); err != nil {
+				os.RemoveAll(cache)
+				return nil, errors.Wrapf(err, "fetching release %s", tag)
+			}
+		}
+		dir = cache
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, releaseMetaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("no release %s in %s", tag, store)
+		}
+		return nil, err
+	}
+	var rb releaseBundle
+	if err := json.Unmarshal(data, &rb); err != nil {
+		return nil, errors.Wrapf(err, "decoding bundle of release %s", tag)
+	}
+	rb.dir = dir
+	return &rb, nil
+}
+
+// install makes the release's benchmark output the output of the suite, as if
+// the suite had been run at the time. The output is kept apart from that of
+// runs of the release's commit.
+func (rb *releaseBundle) install(bs *benchSuite, t time.Time) error {
+	bs.label = releaseLabel
+	bs.artDir = testArtifactsDir(bs.id())
+	if err := os.MkdirAll(bs.artDir, 0755); err != nil {
+		return err
+	}
+	src, err := os.Open(filepath.Join(rb.dir, releaseOutFile))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if bs.outFile, err = os.OpenFile(bs.getOutputFile(t), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+		return err
+	}
+	_, err = io.Copy(bs.outFile, src)
+	return err
+}
+
+// withoutOld returns the indexes of the suites to run without the old suite,
+// whose results are recorded numbers. See runConfig.frozenOld.
+func withoutOld(suites []int) []int {
+	res := make([]int, 0, len(suites))
+	for _, idx := range suites {
+		if idx != 0 {
+			res = append(res, idx)
+		}
+	}
+	return res
+}
+
+// describe returns a note on the provenance of the release's numbers, which
+// were recorded on other hardware and possibly with another toolchain.
+func (rb *releaseBundle) describe(ctx context.Context) string {
+	note := fmt.Sprintf("old results are the recorded numbers of release %s (%s, %s",
+		rb.Tag, shortenRef(ctx, rb.Commit), rb.GoVersion)
+	if rb.CPU != "" {
+		note += ", " + rb.CPU
+	}
+	note += "); differences in hardware or toolchain show up as changes"
+	return note
+}
+
+func runPublishRelease(ctx context.Context, args []string) error {
+	var store string
+	var help bool
+
+	flags := pflag.NewFlagSet("publish-release", pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, publishReleaseUsage) }
+	flags.BoolVarP(&help, "help", "h", false, "")
+	flags.StringVarP(&store, "release-store", "", os.Getenv(releaseStoreEnv), "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if help {
+		fmt.Fprintln(os.Stderr, publishReleaseUsage)
+		return nil
+	}
+	if flags.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, publishReleaseUsage)
+		return errors.New("expected a tag and an out file")
+	}
+	tag, outFile := flags.Arg(0), flags.Arg(1)
+	dst, err := releaseDir(store, tag)
+	if err != nil {
+		return err
+	}
+	rb := releaseBundle{Tag: tag, Created: time.Now().UTC()}
+	if rb.Commit, err = getRefAsSHA(ctx, tag+"^{commit}"); err != nil {
+		return err
+	}
+	if rb.GoVersion, err = capture(ctx, "go", "env", "GOVERSION"); err != nil {
+		return err
+	}
+	if rb.CPU, err = outputCPU(outFile); err != nil {
+		return err
+	}
+
+	local := dst
+	if isRemoteHistory(store) {
+		if local, err = ioutil.TempDir("", "benchdiff-release"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(local)
+	} else if err := os.MkdirAll(local, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(rb, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(local, releaseMetaFile), append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	out, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(local, releaseOutFile), out, 0644); err != nil {
+		return err
+	}
+	if isRemoteHistory(store) {
+		if _, err := capture(ctx, "gsutil", "-m", "-q", "rsync", "-r", local, dst); err != nil {
+			return errors.Wrapf(err, "uploading release %s", tag)
+		}
+	}
+	fmt.Printf("published release %s (%s) to %s\n", tag, shortenRef(ctx, rb.Commit), dst)
+	return nil
+}
+
+// outputCPU returns the CPU reported in the "cpu:" line of benchmark output.
+func outputCPU(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := s.Text(); strings.HasPrefix(line, "cpu: ") {
+			return strings.TrimPrefix(line, "cpu: "), nil
+		}
+	}
+	return "", s.Err()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// remoteDir returns the directory on a remote host where the test binaries of
+// the suite with the specified id are copied to.
+func remoteDir(id string) string {
+	return path.Join("/tmp", "benchdiff", id)
+}
+
+// remoteDir returns the directory on the suite's remote host, or on the volume
+// of its Kubernetes Jobs, where its test binaries are copied to.
+func (bs *benchSuite) remoteDir() string {
+	if bs.k8s != nil {
+		return path.Join(k8sMountDir, bs.id())
+	}
+	return remoteDir(bs.id())
+}
+
+// isRemote returns whether the suite's benchmarks are run on a remote host.
+func (bs *benchSuite) isRemote() bool {
+	return bs.host != ""
+}
+
+// hostName returns the name of the host that the suite's benchmarks are run
+// on.
+func (bs *benchSuite) hostName() string {
+	if bs.isRemote() {
+		return bs.host
+	}
+	return "localhost"
+}
+
+// pushBinaries copies the suite's test binaries, along with the benchdiff
+// binary itself (used for calibration), to the suite's remote host.
+func (bs *benchSuite) pushBinaries(ctx context.Context) error {
+	if !bs.isRemote() {
+		return nil
+	}
+	dir := bs.remoteDir()
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	files := []string{self}
+	for _, t := range bs.testFiles.sorted() {
+		files = append(files, bs.getTestBinary(t))
+	}
+	if bs.k8s != nil {
+		return bs.k8s.pushBinaries(ctx, dir, files)
+	}
+	if _, err := capture(ctx, "ssh", bs.host, "mkdir", "-p", shellQuote(dir)); err != nil {
+		return errors.Wrapf(err, "creating remote directory on %s", bs.host)
+	}
+	args := append(append([]string{"scp", "-q"}, files...), bs.host+":"+dir)
+	if _, err := capture(ctx, args...); err != nil {
+		return errors.Wrapf(err, "copying test binaries to %s", bs.host)
+	}
+	return nil
+}
+
+// remoteCommand wraps the provided command, which references a local binary,
+// so that the binary is instead run on the suite's remote host. If any
+// environment variables are provided (in KEY=VALUE form), the binary is run
+// with them set. If the suite has a launch prefix (e.g. for NUMA binding or
+// elevated privileges), the binary is run through it. If the suite is not
+// remote, no environment variables are provided, and it has no launch prefix,
+// the command is returned unchanged. Suites on Kubernetes run the command as a
+// Job. As ssh passes the command to the remote host's shell, its arguments are
+// quoted, so that patterns like ^Benchmark(A|B)$ and values with spaces reach
+// the binary intact.
+func (bs *benchSuite) remoteCommand(args []string, env ...string) []string {
+	var res []string
+	if bs.isRemote() {
+		args = append([]string{path.Join(bs.remoteDir(), filepath.Base(args[0]))}, args[1:]...)
+	}
+	if len(env) > 0 {
+		res = append(res, "env")
+		res = append(res, env...)
+	}
+	res = append(res, bs.launch...)
+	res = append(res, args...)
+	if bs.k8s != nil {
+		return bs.k8s.command(res)
+	}
+	if bs.isRemote() {
+		quoted := make([]string, len(res))
+		for i, a := range res {
+			quoted[i] = shellQuote(a)
+		}
+		res = append([]string{"ssh", bs.host}, quoted...)
+	}
+	return res
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nvanbenschoten/benchdiff/ui"
+	"github.com/pkg/errors"
+)
+
+// remoteBuildDir returns the directory, relative to the home directory on a
+// build host, of the clone of the repository that test binaries are built in.
+func remoteBuildDir(ctx context.Context) (string, error) {
+	top, err := capture(ctx, "git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", err
+	}
+	return path.Join("benchdiff-build", filepath.Base(top)), nil
+}
+
+// shellQuote quotes the argument for a POSIX shell.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			strings.ContainsRune("-_./=:,+@%", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// remoteShell runs the command in the directory on the host.
+func remoteShell(ctx context.Context, host, dir string, args ...string) (string, error) {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return capture(ctx, "ssh", host, "cd "+shellQuote(dir)+" && "+strings.Join(quoted, " "))
+}
+
+// syncRemoteSource pushes the commit to the clone of the repository on the
+// build host, creating it if necessary, checks it out, and runs the
+// post-checkout command there with the secrets in its environment.
+func syncRemoteSource(ctx context.Context, host, dir, commit, postCheckout string, secrets *hookSecrets) error {
+	if _, err := capture(ctx, "ssh", host, "git", "init", "-q", shellQuote(dir)); err != nil {
+		return errors.Wrapf(err, "creating repository on %s", host)
+	}
+	if _, err := capture(ctx, "git", "push", "-q", "--force", host+":"+dir, commit+":refs/heads/benchdiff"); err != nil {
+		return errors.Wrapf(err, "pushing %s to %s", commit, host)
+	}
+	if _, err := remoteShell(ctx, host, dir, "git", "checkout", "-q", "--force", "--detach", commit); err != nil {
+		return errors.Wrapf(err, "checking out %s on %s", commit, host)
+	}
+	if postCheckout != "" {
+		if err := secrets.remoteRun(ctx, host, dir, strings.Split(postCheckout, " ")...); err != nil {
+			return errors.Wrapf(err, "post-checkout on %s", host)
+		}
+	}
+	return nil
+}
+
+// buildRemoteTestBin builds a test binary for the specified package on the
+// build host and copies it to the destination directory if successful. It
+// mirrors buildTestBin.
+func buildRemoteTestBin(ctx context.Context, host, dir, pkg, dst string, buildFlags []string) (string, bool, error) {
+	dstFile := pkgToTestBin(pkg)
+	remoteFile := path.Join("bin", dstFile)
+	args := append([]string{"go", "test", "-c", "-o", remoteFile}, buildFlags...)
+	if _, err := remoteShell(ctx, host, dir, append(args, pkg)...); err != nil {
+		return "", false, errors.Wrapf(err, "building test binary on %s", host)
+	}
+	// Packages without tests produce no test binary.
+	if _, err := remoteShell(ctx, host, dir, "test", "-f", remoteFile); err != nil {
+		return "", false, nil
+	}
+	if _, err := capture(ctx, "scp", "-q", host+":"+path.Join(dir, remoteFile), filepath.Join(dst, dstFile)); err != nil {
+		return "", false, errors.Wrapf(err, "copying test binary from %s", host)
+	}
+	if _, err := remoteShell(ctx, host, dir, "rm", "-f", remoteFile); err != nil {
+		return "", false, err
+	}
+	return dstFile, true, nil
+}
+
+// buildRemoteBinaries builds the test binaries of the packages on the suite's
+// build host into the binary directory. It returns the packages that failed to
+// build and were skipped.
+func (bs *benchSuite) buildRemoteBinaries(
+	ctx context.Context,
+	binDir string, pkgFilter []string, postChck string, flags []string,
+) (_ fileSet, broken []string, _ error) {
+	dir, err := remoteBuildDir(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := syncRemoteSource(ctx, bs.buildHost, dir, bs.commit, postChck, bs.secrets); err != nil {
+		return nil, nil, err
+	}
+	if err := bs.generate.runRemote(ctx, bs.buildHost, dir, bs.ref, pkgFilter, bs.secrets); err != nil {
+		return nil, nil, err
+	}
+	out, err := remoteShell(ctx, bs.buildHost, dir, append([]string{"go", "list"}, pkgFilter...)...)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "expanding packages")
+	}
+	pkgs := strings.Split(out, "\n")
+
+	var spinner ui.Spinner
+	spinner.Start(os.Stderr, fmt.Sprintf("building benchmark binaries for %s on %s: %.50s ", bs.ref,
+		bs.buildHost, bs.subject))
+	defer spinner.Stop()
+	testFiles := make(fileSet)
+	for i, pkg := range pkgs {
+		spinner.Update(ui.Fraction(i, len(pkgs)))
+		if testBin, ok, err := buildRemoteTestBin(ctx, bs.buildHost, dir, pkg, binDir, flags); err != nil {
+			bs.triage.record(stageBuild, bs, pkgToTestBin(pkg), 0, err.Error())
+			logPath, logErr := saveBuildLog(bs.artDir, pkg, err)
+			if logErr != nil {
+				return nil, nil, logErr
+			}
+			if !bs.skipBrokenBuilds {
+				return nil, nil, errors.Wrapf(err, "building %s for %s (output saved to %s)", pkg, bs.ref, logPath)
+			}
+			fmt.Fprintf(os.Stderr, "\nskipping %s, which failed to build (output saved to %s)\n", pkg, logPath)
+			broken = append(broken, pkg)
+		} else if ok {
+			testFiles[testBin] = struct{}{}
+		}
+		spinner.Update(ui.Fraction(i+1, len(pkgs)))
+	}
+	return testFiles, broken, nil
+}
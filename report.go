@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// jsonReport is the JSON representation of a (possibly partial) comparison
+// report written to the artifacts directory.
+type jsonReport struct {
+	Old      suiteInfo   `json:"old"`
+	New      suiteInfo   `json:"new"`
+	Updated  time.Time   `json:"updated"`
+	Complete bool        `json:"complete"`
+	Tables   []jsonTable `json:"tables"`
+	Failures []failure   `json:"failures,omitempty"`
+}
+
+// getReportFile returns the path of the report with the provided extension in
+// the suite's artifacts directory.
+func (bs *benchSuite) getReportFile(ext string) string {
+	return filepath.Join(bs.artDir, "report"+ext)
+}
+
+// writePartialReport computes the comparison of the results collected so far
+// and writes it to the new suite's artifacts directory.
+func writePartialReport(oldSuite, newSuite *benchSuite, cc *compareConfig) error {
+	tables, err := computeTables(oldSuite, newSuite, true, cc)
+	if err != nil {
+		return err
+	}
+	markAsymmetricRows(tables)
+	markExampleRows(tables)
+	markConfidenceIntervals(tables, cc)
+	if cc.effectSizes {
+		markEffectSizes(tables)
+	}
+	return writeReport(oldSuite, newSuite, tables, false)
+}
+
+// writeReport writes the comparison, in text and JSON, to the new suite's
+// artifacts directory. The files are replaced atomically, so that readers
+// always observe a complete report, even if benchdiff dies mid-write.
+func writeReport(oldSuite, newSuite *benchSuite, tables []*benchstat.Table, complete bool) error {
+	failures := newSuite.redact.failures(newSuite.triage.list())
+	var text bytes.Buffer
+	benchstat.FormatText(&text, tables)
+	writeTriage(&text, failures)
+	if err := writeFileAtomic(newSuite.getReportFile(".txt"), text.Bytes()); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(makeJSONReport(oldSuite, newSuite, tables, complete), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(newSuite.getReportFile(".json"), data)
+}
+
+// makeJSONReport returns the JSON representation of the comparison.
+func makeJSONReport(oldSuite, newSuite *benchSuite, tables []*benchstat.Table, complete bool) jsonReport {
+	return jsonReport{
+		Old:      newSuite.redact.suiteInfo(makeSuiteInfo(oldSuite)),
+		New:      newSuite.redact.suiteInfo(makeSuiteInfo(newSuite)),
+		Updated:  time.Now().UTC(),
+		Complete: complete,
+		Tables:   makeJSONTables(tables),
+		Failures: newSuite.redact.failures(newSuite.triage.list()),
+	}
+}
+
+// writeFileAtomic writes the data to a temporary file and renames it to the
+// provided path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
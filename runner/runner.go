@@ -0,0 +1,138 @@
+// Package runner runs benchmarks the way benchdiff does, for tools that embed
+// its methodology instead of shelling out to the benchdiff CLI. Rather than
+// running all iterations of a suite before the other's, a Runner interleaves
+// the iterations of the suites being compared, so that noise with a time
+// correlation affects the suites alike.
+package runner
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Suite is one side of a comparison: a directory of prebuilt test binaries,
+// e.g. built with go test -c, and the writer that their output goes to.
+type Suite struct {
+	Name   string
+	BinDir string
+	// Env holds additional environment variables, in KEY=VALUE form, that
+	// the test binaries are run with.
+	Env []string
+	Out io.Writer
+}
+
+// Run is a scheduled iteration of a test binary, which is run against the
+// suites at the indexes in order.
+type Run struct {
+	Test    string // name of the test binary
+	TestIdx int    // index of the test in the list of tests
+	Iter    int    // zero-indexed iteration of the test
+	Count   int    // number of iterations run in a single process
+	Suites  []int
+}
+
+// Interleave returns the runs of iters iterations of each test, one test after
+// another, each iteration running the first suite and then the second.
+func Interleave(tests []string, iters int) []Run {
+	runs := make([]Run, 0, len(tests)*iters)
+	for i, t := range tests {
+		for j := 0; j < iters; j++ {
+			runs = append(runs, Run{Test: t, TestIdx: i, Iter: j, Count: 1, Suites: []int{0, 1}})
+		}
+	}
+	return runs
+}
+
+// Runner runs the scheduled iterations of test binaries against suites.
+type Runner struct {
+	Suites []*Suite
+	Runs   []Run
+	// Bench and BenchTime are passed to the test binaries as -test.bench and
+	// -test.benchtime by ExecBinary.
+	Bench     string
+	BenchTime string
+	// Exec runs an iteration against the suite at the index. It defaults to
+	// ExecBinary.
+	Exec func(ctx context.Context, suite int, r Run) error
+
+	// OnIterationStart, if set, is called before an iteration is run against
+	// its suites, and OnIterationDone after. OnTestDone is called after the
+	// last iteration of a test. An error returned by a callback stops the
+	// Runner.
+	OnIterationStart func(r Run) error
+	OnIterationDone  func(r Run) error
+	OnTestDone       func(test string) error
+}
+
+// Run runs the iterations in order, until they are all done, one fails, or
+// the context is canceled.
+func (rn *Runner) Run(ctx context.Context) error {
+	execFn := rn.Exec
+	if execFn == nil {
+		execFn = rn.ExecBinary
+	}
+	remaining := make(map[string]int)
+	for _, r := range rn.Runs {
+		remaining[r.Test]++
+	}
+	for _, r := range rn.Runs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if rn.OnIterationStart != nil {
+			if err := rn.OnIterationStart(r); err != nil {
+				return err
+			}
+		}
+		for _, idx := range r.Suites {
+			if err := execFn(ctx, idx, r); err != nil {
+				return err
+			}
+		}
+		if rn.OnIterationDone != nil {
+			if err := rn.OnIterationDone(r); err != nil {
+				return err
+			}
+		}
+		if remaining[r.Test]--; remaining[r.Test] == 0 && rn.OnTestDone != nil {
+			if err := rn.OnTestDone(r.Test); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ExecBinary runs the iteration's test binary of the suite at the index,
+// writing its output to the suite's writer. The binary is killed if the
+// context is canceled. It is deliberately minimal: benchdiff sets its own
+// Exec, which also runs the binaries on remote hosts and through launch
+// prefixes, and writes the configuration lines of each iteration.
+func (rn *Runner) ExecBinary(ctx context.Context, suite int, r Run) error {
+	s := rn.Suites[suite]
+	bench := rn.Bench
+	if bench == "" {
+		bench = "."
+	}
+	args := []string{"-test.run=^$", "-test.bench=" + bench, "-test.benchmem"}
+	if rn.BenchTime != "" {
+		args = append(args, "-test.benchtime="+rn.BenchTime)
+	}
+	if r.Count > 1 {
+		args = append(args, "-test.count="+strconv.Itoa(r.Count))
+	}
+	cmd := exec.CommandContext(ctx, filepath.Join(s.BinDir, r.Test), args...)
+	cmd.Dir = s.BinDir
+	cmd.Env = append(os.Environ(), s.Env...)
+	cmd.Stdout, cmd.Stderr = s.Out, s.Out
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "running %s of %s", r.Test, s.Name)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestInterleave(t *testing.T) {
+	runs := Interleave([]string{"a.test", "b.test"}, 2)
+	want := []Run{
+		{Test: "a.test", TestIdx: 0, Iter: 0, Count: 1, Suites: []int{0, 1}},
+		{Test: "a.test", TestIdx: 0, Iter: 1, Count: 1, Suites: []int{0, 1}},
+		{Test: "b.test", TestIdx: 1, Iter: 0, Count: 1, Suites: []int{0, 1}},
+		{Test: "b.test", TestIdx: 1, Iter: 1, Count: 1, Suites: []int{0, 1}},
+	}
+	if !reflect.DeepEqual(runs, want) {
+		t.Errorf("Interleave = %+v, want %+v", runs, want)
+	}
+}
+
+func TestRunnerRun(t *testing.T) {
+	var events []string
+	rn := Runner{
+		Runs: []Run{
+			{Test: "a.test", Iter: 0, Suites: []int{0, 1}},
+			{Test: "a.test", Iter: 1, Suites: []int{1, 0}},
+			{Test: "b.test", Iter: 0, Suites: []int{0}},
+		},
+		Exec: func(ctx context.Context, suite int, r Run) error {
+			events = append(events, fmt.Sprintf("exec %s/%d suite %d", r.Test, r.Iter, suite))
+			return nil
+		},
+		OnIterationStart: func(r Run) error {
+			events = append(events, fmt.Sprintf("start %s/%d", r.Test, r.Iter))
+			return nil
+		},
+		OnIterationDone: func(r Run) error {
+			events = append(events, fmt.Sprintf("done %s/%d", r.Test, r.Iter))
+			return nil
+		},
+		OnTestDone: func(test string) error {
+			events = append(events, "test done "+test)
+			return nil
+		},
+	}
+	if err := rn.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"start a.test/0", "exec a.test/0 suite 0", "exec a.test/0 suite 1", "done a.test/0",
+		"start a.test/1", "exec a.test/1 suite 1", "exec a.test/1 suite 0", "done a.test/1",
+		"test done a.test",
+		"start b.test/0", "exec b.test/0 suite 0", "done b.test/0",
+		"test done b.test",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events:\n%s\nwant:\n%s", strings.Join(events, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRunnerRunStops(t *testing.T) {
+	errExec := errors.New("exec failed")
+	errStart := errors.New("start failed")
+	for _, tc := range []struct {
+		name  string
+		rn    Runner
+		want  error
+		execs int
+	}{
+		{
+			name: "exec error",
+			rn: Runner{Exec: func(ctx context.Context, suite int, r Run) error {
+				return errExec
+			}},
+			want:  errExec,
+			execs: 1,
+		},
+		{
+			name: "callback error",
+			rn: Runner{OnIterationStart: func(r Run) error {
+				if r.Iter == 1 {
+					return errStart
+				}
+				return nil
+			}},
+			want:  errStart,
+			execs: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var execs int
+			rn := tc.rn
+			rn.Runs = Interleave([]string{"a.test"}, 3)
+			exec := rn.Exec
+			rn.Exec = func(ctx context.Context, suite int, r Run) error {
+				execs++
+				if exec != nil {
+					return exec(ctx, suite, r)
+				}
+				return nil
+			}
+			if err := rn.Run(context.Background()); err != tc.want {
+				t.Errorf("Run = %v, want %v", err, tc.want)
+			}
+			if execs != tc.execs {
+				t.Errorf("ran %d execs, want %d", execs, tc.execs)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rn := Runner{
+		Runs: Interleave([]string{"a.test"}, 1),
+		Exec: func(ctx context.Context, suite int, r Run) error {
+			t.Error("exec after cancellation")
+			return nil
+		},
+	}
+	if err := rn.Run(ctx); err != context.Canceled {
+		t.Errorf("Run of a canceled context = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestExecBinary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the test binary")
+	}
+	dir, err := ioutil.TempDir("", "runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The fake test binary prints its arguments, its working directory, and
+	// an environment variable of the suite, and fails if asked to.
+	script := "#!/bin/sh\necho \"$@\"\npwd\necho \"FOO=$FOO\"\n[ -z \"$FAIL\" ]\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "pkg.test"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		rn    Runner
+		count int
+		want  string
+	}{
+		{
+			name: "defaults",
+			want: "-test.run=^$ -test.bench=. -test.benchmem\n" + wd + "\nFOO=bar\n",
+		},
+		{
+			name:  "options",
+			rn:    Runner{Bench: "^BenchmarkX$", BenchTime: "100x"},
+			count: 3,
+			want: "-test.run=^$ -test.bench=^BenchmarkX$ -test.benchmem -test.benchtime=100x -test.count=3\n" +
+				wd + "\nFOO=bar\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			rn := tc.rn
+			rn.Suites = []*Suite{{Name: "old", BinDir: dir, Env: []string{"FOO=bar"}, Out: &out}}
+			if err := rn.ExecBinary(context.Background(), 0, Run{Test: "pkg.test", Count: tc.count}); err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != tc.want {
+				t.Errorf("output:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+
+	var out bytes.Buffer
+	rn := Runner{Suites: []*Suite{{Name: "new", BinDir: dir, Env: []string{"FAIL=1"}, Out: &out}}}
+	err = rn.ExecBinary(context.Background(), 0, Run{Test: "pkg.test"})
+	if err == nil || !strings.Contains(err.Error(), "running pkg.test of new") {
+		t.Errorf("ExecBinary of a failing binary = %v, want an error naming the test and suite", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// runtimeMetric is a runtime/metrics metric that is recorded by the harness
+// when --runtime-metrics is passed. Histograms are recorded as the provided
+// quantiles (in percent).
+type runtimeMetric struct {
+	Name      string
+	Unit      string
+	Quantiles []int
+}
+
+// runtimeMetrics are the runtime/metrics recorded by the harness. Metrics
+// that are not supported by the Go version the test binary is built with are
+// omitted. In addition, the fraction of CPU time spent on GC is recorded as
+// gc-cpu-frac.
+var runtimeMetrics = []runtimeMetric{
+	{Name: "/sched/latencies:seconds", Unit: "sched-latency-sec", Quantiles: []int{50, 99}},
+	{Name: "/gc/pauses:seconds", Unit: "gc-pause-sec", Quantiles: []int{50, 99}},
+	{Name: "/gc/cycles/total:gc-cycles", Unit: "gc-cycles"},
+	{Name: "/gc/heap/allocs:bytes", Unit: "heap-alloc-B"},
+	{Name: "/gc/heap/goal:bytes", Unit: "heap-goal-B"},
+	{Name: "/memory/classes/total:bytes", Unit: "mapped-B"},
+	{Name: "/sched/goroutines:goroutines", Unit: "final-goroutines"},
+	{Name: "/sync/mutex/wait/total:seconds", Unit: "mutex-wait-sec"},
+}
+
+// runtimeCollector records the runtime/metrics of an invocation of a test
+// binary built with the harness, which the binary writes to a file on exit.
+type runtimeCollector struct {
+	path string
+}
+
+func newRuntimeCollector() (Collector, error) {
+	f, err := ioutil.TempFile("", "benchdiff-runtime-metrics")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return &runtimeCollector{path: f.Name()}, nil
+}
+
+// Env implements envCollector.
+func (c *runtimeCollector) Env() []string {
+	return []string{runtimeMetricsEnv + "=" + c.path}
+}
+
+func (c *runtimeCollector) Start(pid int) error {
+	// Don't attribute a stale snapshot to this invocation if the binary fails
+	// to write one, e.g. because its package defines its own TestMain.
+	return ioutil.WriteFile(c.path, nil, 0644)
+}
+
+func (c *runtimeCollector) Stop() (map[string]float64, error) {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res := make(map[string]float64)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing runtime metric %q", fields[0])
+		}
+		res[fields[0]] = v
+	}
+	return res, s.Err()
+}
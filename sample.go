@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// parseSample parses the fraction of benchmarks to run from a percentage such
+// as "20%". The percent sign is optional.
+func parseSample(s string) (float64, error) {
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || pct <= 0 || pct > 100 {
+		return 0, errors.Errorf("invalid sample %q: must be a percentage in (0%%, 100%%]", s)
+	}
+	return pct / 100, nil
+}
+
+// listBenchmarks returns the top-level benchmarks in the test binary that
+// match the provided pattern, which may only refer to top-level benchmarks.
+func listBenchmarks(ctx context.Context, bs *benchSuite, test, pattern string) ([]string, error) {
+	args := bs.remoteCommand([]string{bs.getTestBinary(test), "-test.list", pattern})
+	out, err := capture(ctx, args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing benchmarks in %s", test)
+	}
+	var res []string
+	for _, name := range strings.Split(out, "\n") {
+		if strings.HasPrefix(name, "Benchmark") {
+			res = append(res, name)
+		}
+	}
+	return res, nil
+}
+
+// sampleBenchmarks selects a random fraction of the benchmarks matching the
+// run pattern in each test and returns a -test.bench pattern per test that
+// matches only the selected benchmarks. At least one benchmark is selected in
+// every test that has any.
+func sampleBenchmarks(
+	ctx context.Context,
+	bs *benchSuite, tests []string, runPattern string, frac float64, seed int64,
+) (map[string]string, error) {
+	// Only the top-level part of the pattern can be used to list benchmarks.
+	top, sub := runPattern, ""
+	if i := strings.Index(runPattern, "/"); i >= 0 {
+		top, sub = runPattern[:i], runPattern[i:]
+	}
+	rng := rand.New(rand.NewSource(seed))
+	res := make(map[string]string, len(tests))
+	var total, selected int
+	for _, t := range tests {
+		names, err := listBenchmarks(ctx, bs, t, top)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			continue
+		}
+		n := int(math.Ceil(frac * float64(len(names))))
+		total += len(names)
+		selected += n
+		rng.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+		names = names[:n]
+		for i, name := range names {
+			names[i] = regexp.QuoteMeta(name)
+		}
+		res[t] = "^(" + strings.Join(names, "|") + ")$" + sub
+	}
+	fmt.Fprintf(os.Stderr, "sampled %d of %d benchmarks\n", selected, total)
+	return res, nil
+}
+
+// sampleNote describes a sampled run in the report.
+func sampleNote(sample string, seed int64) string {
+	return fmt.Sprintf("sampled %s of benchmarks in each package (seed %d); results do not cover all benchmarks",
+		sample, seed)
+}
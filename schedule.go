@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math/rand"
+
+	"github.com/pkg/errors"
+)
+
+// Scheduling modes that determine the order in which benchmark iterations are
+// run.
+const (
+	// scheduleByTest runs all iterations of one test binary before moving on
+	// to the next.
+	scheduleByTest = "by-test"
+	// scheduleRoundRobin runs one iteration of every test binary before
+	// moving on to the next iteration, so that the samples of every benchmark
+	// are spread over the entire duration of the run. This further decorrelates
+	// results from slow environmental drift.
+	scheduleRoundRobin = "round-robin"
+)
+
+// Shuffling modes that determine whether the order of benchmark iterations is
+// randomized.
+const (
+	// shuffleOff runs tests in sorted order.
+	shuffleOff = "off"
+	// shuffleTests runs tests in a random order, which is the same in every
+	// round of iterations.
+	shuffleTests = "tests"
+	// shuffleAll randomizes the order of every iteration of every test, as
+	// well as whether the old or the new suite runs first in each iteration.
+	shuffleAll = "all"
+)
+
+// Strategies that determine how iterations are distributed across process
+// invocations and how the old and new suites are interleaved.
+const (
+	// strategyInterleaveProcess runs each iteration in its own process, and
+	// alternates between the old and new suite after every iteration.
+	strategyInterleaveProcess = "interleave-process"
+	// strategyInterleaveCount runs all iterations of a test in a single
+	// process using -test.count, and alternates between the old and new suite
+	// after every test. This amortizes expensive fixture setup.
+	strategyInterleaveCount = "interleave-count"
+	// strategyBlock runs each iteration in its own process, but runs all
+	// iterations of a test (or with round-robin scheduling, of a round) on the
+	// old suite before running them on the new suite.
+	strategyBlock = "block"
+)
+
+// benchRun is a single scheduled iteration of a test binary, which is run
+// against the suites at the specified indexes (0 for old, 1 for new) in order.
+type benchRun struct {
+	test    string
+	testIdx int   // index of test in the list of tests
+	iter    int   // zero-indexed iteration of the test
+	count   int   // number of iterations to run in a single process
+	suites  []int // indexes of the suites to run against, in order
+}
+
+var (
+	oldThenNew = []int{0, 1}
+	newThenOld = []int{1, 0}
+	oldOnly    = []int{0}
+	newOnly    = []int{1}
+)
+
+// scheduleRuns returns the order in which the iterations of each test are to
+// be run according to the provided run configuration.
+func scheduleRuns(tests []string, cfg *runConfig) ([]benchRun, error) {
+	itersPerTest := cfg.itersPerTest
+	count := 1
+	switch cfg.strategy {
+	case strategyInterleaveProcess:
+	case strategyInterleaveCount:
+		// Each test is run once with all of its iterations.
+		count, itersPerTest = itersPerTest, 1
+	case strategyBlock:
+		if cfg.shuffle == shuffleAll {
+			return nil, errors.New("--strategy=block and --shuffle=all incompatible")
+		}
+	default:
+		return nil, errors.Errorf("unknown strategy %q", cfg.strategy)
+	}
+
+	rng := rand.New(rand.NewSource(cfg.seed))
+	switch shuffle := cfg.shuffle; shuffle {
+	case shuffleOff, shuffleAll:
+	case shuffleTests:
+		tests = append([]string(nil), tests...)
+		rng.Shuffle(len(tests), func(i, j int) { tests[i], tests[j] = tests[j], tests[i] })
+	default:
+		return nil, errors.Errorf("unknown shuffle mode %q", shuffle)
+	}
+
+	runs := make([]benchRun, 0, len(tests)*itersPerTest)
+	// blockKey identifies the block that a run belongs to when blocking.
+	var blockKey func(r benchRun) int
+	switch cfg.schedule {
+	case scheduleByTest:
+		for i, t := range tests {
+			for j := 0; j < itersPerTest; j++ {
+				runs = append(runs, benchRun{test: t, testIdx: i, iter: j, count: count, suites: oldThenNew})
+			}
+		}
+		blockKey = func(r benchRun) int { return r.testIdx }
+	case scheduleRoundRobin:
+		for j := 0; j < itersPerTest; j++ {
+			for i, t := range tests {
+				runs = append(runs, benchRun{test: t, testIdx: i, iter: j, count: count, suites: oldThenNew})
+			}
+		}
+		blockKey = func(r benchRun) int { return r.iter }
+	default:
+		return nil, errors.Errorf("unknown schedule %q", cfg.schedule)
+	}
+
+	if cfg.shuffle == shuffleAll {
+		rng.Shuffle(len(runs), func(i, j int) { runs[i], runs[j] = runs[j], runs[i] })
+		// Renumber the iterations of each test in the order that they now run.
+		iters := make(map[string]int, len(tests))
+		for i := range runs {
+			runs[i].iter = iters[runs[i].test]
+			if rng.Intn(2) == 0 {
+				runs[i].suites = newThenOld
+			}
+			iters[runs[i].test]++
+		}
+	}
+
+	if cfg.strategy == strategyBlock {
+		runs = blockRuns(runs, blockKey)
+	}
+	return runs, nil
+}
+
+// blockRuns splits each run into a run against only the old suite and a run
+// against only the new suite, and reorders them such that within each block of
+// consecutive runs with the same key, all runs against the old suite precede
+// all runs against the new suite.
+func blockRuns(runs []benchRun, key func(benchRun) int) []benchRun {
+	res := make([]benchRun, 0, 2*len(runs))
+	for start := 0; start < len(runs); {
+		end := start + 1
+		for end < len(runs) && key(runs[end]) == key(runs[start]) {
+			end++
+		}
+		for _, suites := range [][]int{oldOnly, newOnly} {
+			for _, r := range runs[start:end] {
+				r.suites = suites
+				res = append(res, r)
+			}
+		}
+		start = end
+	}
+	return res
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// defaultScratchMinFree is the free space that --scratch-dir requires before
+// each test binary is run, unless --scratch-min-free is passed.
+const defaultScratchMinFree = "1GiB"
+
+// scratchSpace gives each invocation of a test binary a fresh scratch
+// directory as its TMPDIR, where b.TempDir and os.TempDir point, and removes
+// it once the binary exits. Storage benchmarks that fill /tmp otherwise fail
+// nondeterministically halfway through long runs, once the files of earlier
+// iterations that weren't cleaned up exhaust it. See --scratch-dir.
+type scratchSpace struct {
+	dir     string
+	minFree int64 // in bytes, checked before each invocation
+	minSpec string
+}
+
+// newScratchSpace returns the scratch space in the directory, creating it if
+// needed, and checks that it has the minimum free space.
+func newScratchSpace(dir, minFree string) (*scratchSpace, error) {
+	if minFree == "" {
+		minFree = defaultScratchMinFree
+	}
+	n, err := parseMemSize(minFree)
+	if err != nil {
+		return nil, errors.Wrap(err, "--scratch-min-free")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "creating scratch directory")
+	}
+	s := &scratchSpace{dir: dir, minFree: n, minSpec: minFree}
+	return s, s.preflight()
+}
+
+// preflight returns an error if the scratch directory has less than the
+// minimum free space.
+func (s *scratchSpace) preflight() error {
+	free, err := freeSpace(s.dir)
+	if err != nil {
+		return errors.Wrapf(err, "checking free space of %s", s.dir)
+	}
+	if free < s.minFree {
+		return errors.Errorf("scratch directory %s has %s free, less than --scratch-min-free=%s",
+			s.dir, formatBytes(free), s.minSpec)
+	}
+	return nil
+}
+
+// acquire checks the free space of the scratch directory and creates a fresh
+// directory in it for an invocation of the test binary. The returned function
+// removes it.
+func (s *scratchSpace) acquire(test string) (string, func() error, error) {
+	if s == nil {
+		return "", func() error { return nil }, nil
+	}
+	if err := s.preflight(); err != nil {
+		return "", nil, err
+	}
+	dir, err := ioutil.TempDir(s.dir, "benchdiff-"+test+"-")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "creating scratch directory")
+	}
+	release := func() error {
+		return errors.Wrapf(os.RemoveAll(dir), "cleaning up scratch directory %s", dir)
+	}
+	return dir, release, nil
+}
+
+// freeSpace returns the space available to unprivileged users on the file
+// system of the directory, in bytes.
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// formatBytes formats the number of bytes with a binary unit.
+func formatBytes(n int64) string {
+	v := float64(n)
+	return pickScale(unitScales("bytes", true), v).scaler()(v)
+}
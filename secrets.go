@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// hookSecrets are secrets that are made available to the post-checkout command
+// and to plugins as environment variables, for instance to generate
+// license-gated assets. They are loaded from environment files (see
+// --secrets-file) or from the output of a command (see --secrets-cmd), are
+// never passed to the test binaries or recorded, and their values are scrubbed
+// from the output of the commands that receive them and from errors. A nil
+// *hookSecrets holds no secrets.
+type hookSecrets struct {
+	env    []string // in KEY=VALUE form
+	values []string // longest first, so that overlapping values are fully scrubbed
+}
+
+// secretMask replaces the values of secrets in output.
+const secretMask = "******"
+
+// loadHookSecrets loads the secrets from the environment files and from the
+// output of the command, if provided. Later definitions of a key override
+// earlier ones. It returns nil if there are no secrets.
+func loadHookSecrets(ctx context.Context, files []string, cmd string) (*hookSecrets, error) {
+	var env []string
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading secrets")
+		}
+		kvs, err := parseEnvFile(string(data))
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing secrets file %s", file)
+		}
+		env = append(env, kvs...)
+	}
+	if cmd != "" {
+		var out bytes.Buffer
+		c := exec.CommandContext(ctx, "sh", "-c", cmd)
+		c.Stdout, c.Stderr = &out, os.Stderr
+		if err := c.Run(); err != nil {
+			return nil, errors.Wrap(err, "running secrets command")
+		}
+		kvs, err := parseEnvFile(out.String())
+		if err != nil {
+			// Don't include the output in the error, as it may hold secrets.
+			return nil, errors.New("parsing the output of the secrets command: expected KEY=VALUE lines")
+		}
+		env = append(env, kvs...)
+	}
+	if len(env) == 0 {
+		return nil, nil
+	}
+	s := &hookSecrets{env: env}
+	for _, kv := range env {
+		if v := kv[strings.Index(kv, "=")+1:]; v != "" {
+			s.values = append(s.values, v)
+		}
+	}
+	sort.Slice(s.values, func(i, j int) bool { return len(s.values[i]) > len(s.values[j]) })
+	return s, nil
+}
+
+// parseEnvFile parses KEY=VALUE lines, as in a .env file. Blank lines and
+// lines starting with # are ignored, an optional "export " prefix is allowed,
+// and values may be single or double quoted.
+func parseEnvFile(data string) ([]string, error) {
+	var res []string
+	s := bufio.NewScanner(strings.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, errors.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		key, val := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+			unquoted, err := strconv.Unquote(val)
+			if err != nil {
+				return nil, errors.Errorf("line %d: invalid quoted value", n)
+			}
+			val = unquoted
+		} else if len(val) >= 2 && val[0] == '\'' && val[len(val)-1] == '\'' {
+			val = val[1 : len(val)-1]
+		}
+		res = append(res, key+"="+val)
+	}
+	return res, s.Err()
+}
+
+// scrub replaces the values of the secrets in the string.
+func (s *hookSecrets) scrub(str string) string {
+	if s == nil {
+		return str
+	}
+	for _, v := range s.values {
+		str = strings.ReplaceAll(str, v, secretMask)
+	}
+	return str
+}
+
+// scrubErr replaces the values of the secrets in the error's message.
+func (s *hookSecrets) scrubErr(err error) error {
+	if s == nil || err == nil {
+		return err
+	}
+	if msg := err.Error(); s.scrub(msg) != msg {
+		return errors.New(s.scrub(msg))
+	}
+	return err
+}
+
+// environ returns the environment to run commands that receive the secrets
+// with, or nil (i.e. the current environment) if there are none.
+func (s *hookSecrets) environ() []string {
+	if s == nil {
+		return nil
+	}
+	return append(os.Environ(), s.env...)
+}
+
+// writer returns a writer that scrubs the secrets from the output written to
+// it before passing it on to w. Output is passed on a line at a time, so that
+// secrets split across writes are scrubbed, and the writer must be closed to
+// pass on any incomplete final line.
+func (s *hookSecrets) writer(w io.Writer) io.WriteCloser {
+	return &scrubWriter{s: s, w: w}
+}
+
+type scrubWriter struct {
+	s   *hookSecrets
+	w   io.Writer
+	mu  sync.Mutex // stdout and stderr may share the writer
+	buf []byte
+}
+
+func (sw *scrubWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.buf = append(sw.buf, p...)
+	if i := bytes.LastIndexByte(sw.buf, '\n'); i >= 0 {
+		if _, err := io.WriteString(sw.w, sw.s.scrub(string(sw.buf[:i+1]))); err != nil {
+			return 0, err
+		}
+		sw.buf = append(sw.buf[:0], sw.buf[i+1:]...)
+	}
+	return len(p), nil
+}
+
+func (sw *scrubWriter) Close() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if len(sw.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(sw.w, sw.s.scrub(string(sw.buf)))
+	sw.buf = nil
+	return err
+}
+
+// run runs the command with the secrets in its environment, scrubbing them
+// from its output and from the returned error.
+func (s *hookSecrets) run(ctx context.Context, in io.Reader, out, errOut io.Writer, args ...string) error {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	stdout, stderr := s.writer(out), s.writer(errOut)
+	if out == errOut {
+		stderr = stdout
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr, cmd.Env = in, stdout, stderr, s.environ()
+	err := cmd.Run()
+	stdout.Close()
+	stderr.Close()
+	return s.scrubErr(err)
+}
+
+// remoteRun runs the command in the directory on the host with the secrets in
+// its environment. The secrets are sent over ssh's stdin, rather than on the
+// command line, so that they don't show up in the process list of either
+// host.
+func (s *hookSecrets) remoteRun(ctx context.Context, host, dir string, args ...string) error {
+	if s == nil {
+		_, err := remoteShell(ctx, host, dir, args...)
+		return err
+	}
+	var assignments strings.Builder
+	for _, kv := range s.env {
+		i := strings.Index(kv, "=")
+		assignments.WriteString(kv[:i+1] + shellQuote(kv[i+1:]) + "\n")
+	}
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	script := `set -a && eval "$(cat)" && set +a && cd ` + shellQuote(dir) + " && " + strings.Join(quoted, " ")
+	var out bytes.Buffer
+	err := s.run(ctx, strings.NewReader(assignments.String()), &out, &out, "ssh", host, script)
+	if err != nil && out.Len() > 0 {
+		err = errors.Errorf("%s: %s", err, bytes.TrimSpace(out.Bytes()))
+	}
+	return err
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"golang.org/x/perf/benchfmt"
+	"golang.org/x/perf/benchseries"
+)
+
+const seriesUsage = `usage: benchdiff series [--history-dir <dir>] [--window <n>]
+
+benchdiff series feeds the runs in the history store, ordered by time, into
+benchseries to compute the ratio of each benchmark between every run and the
+run preceding it, along with bootstrapped confidence intervals. Runs are
+recorded in the history store by passing --record to benchdiff.
+
+Options:
+      --history-dir <dir>  directory or gs:// bucket holding the history (default benchdiff/history)
+  -w, --window      <n>    only consider the last n runs (default all)
+      --confidence  <n>    confidence level of the intervals (default 0.95)
+      --bootstrap   <n>    number of bootstrap samples (default 1000)`
+
+// Configuration keys attached to each result before it is handed to
+// benchseries to describe the position of its run in the series.
+const (
+	seriesKeyPoint   = "benchdiff-series"
+	seriesKeyRole    = "benchdiff-role"
+	seriesKeyNumHash = "benchdiff-numerator"
+	seriesKeyDenHash = "benchdiff-denominator"
+)
+
+func runSeries(ctx context.Context, args []string) error {
+	var historyDir string
+	var window, bootstrap int
+	var confidence float64
+	var help bool
+
+	flags := pflag.NewFlagSet("series", pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, seriesUsage) }
+	flags.BoolVarP(&help, "help", "h", false, "")
+	flags.StringVarP(&historyDir, "history-dir", "", defaultHistoryDir, "")
+	flags.IntVarP(&window, "window", "w", 0, "")
+	flags.Float64VarP(&confidence, "confidence", "", 0.95, "")
+	flags.IntVarP(&bootstrap, "bootstrap", "", 1000, "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if help {
+		fmt.Fprintln(os.Stderr, seriesUsage)
+		return nil
+	}
+
+	entries, err := loadHistory(ctx, historyDir)
+	if err != nil {
+		return err
+	}
+	entries = latestConfigEntries(entries)
+	if window > 0 && len(entries) > window {
+		entries = entries[len(entries)-window:]
+	}
+	if len(entries) < 2 {
+		return errors.Errorf("need at least 2 runs in history store %q, found %d", historyDir, len(entries))
+	}
+
+	b, err := benchseries.NewBuilder(&benchseries.BuilderOptions{
+		Filter:          ".unit:/.*/",
+		Series:          seriesKeyPoint,
+		Table:           "pkg",
+		Experiment:      seriesKeyPoint,
+		Compare:         seriesKeyRole,
+		Numerator:       "numerator",
+		Denominator:     "denominator",
+		NumeratorHash:   seriesKeyNumHash,
+		DenominatorHash: seriesKeyDenHash,
+		Warn: func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format, args...)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Each point in the series compares a run (the numerator) against the run
+	// before it (the denominator), so every run other than the first and last
+	// contributes its results to two points.
+	for i := 1; i < len(entries); i++ {
+		den, num := entries[i-1], entries[i]
+		point := num.time.Format(historyTimeFormat)
+		for _, side := range []struct {
+			role  string
+			entry historyEntry
+		}{{"denominator", den}, {"numerator", num}} {
+			err := readResults(side.entry.path, func(res *benchfmt.Result) {
+				res.SetConfig(seriesKeyPoint, point)
+				res.SetConfig(seriesKeyRole, side.role)
+				res.SetConfig(seriesKeyNumHash, num.ref)
+				res.SetConfig(seriesKeyDenHash, den.ref)
+				b.Add(res)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	css, err := b.AllComparisonSeries(nil, benchseries.DUPE_REPLACE)
+	if err != nil {
+		return err
+	}
+	refs := make(map[string]string, len(entries))
+	for _, e := range entries {
+		refs[e.time.Format(historyTimeFormat)] = e.ref
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, cs := range css {
+		cs.AddSummaries(confidence, bootstrap)
+		fmt.Fprintf(tw, "\n%s\n", cs.Unit)
+		header := []string{"name"}
+		for _, s := range cs.Series {
+			header = append(header, refs[s])
+		}
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+		for i, bench := range cs.Benchmarks {
+			row := []string{bench}
+			for _, sum := range cs.Summaries[i] {
+				if sum == nil || !sum.Present {
+					row = append(row, "-")
+					continue
+				}
+				row = append(row, fmt.Sprintf("%.3f [%.3f, %.3f]", sum.Center, sum.Low, sum.High))
+			}
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+	}
+	return tw.Flush()
+}
+
+// readResults parses the benchmark results in the Go benchmark format from the
+// file at the provided path and passes a copy of each to fn.
+func readResults(path string, fn func(*benchfmt.Result)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := benchfmt.NewReader(f, path)
+	for r.Scan() {
+		if res, ok := r.Result().(*benchfmt.Result); ok {
+			fn(res.Clone())
+		}
+	}
+	return r.Err()
+}
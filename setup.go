@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setupDominatedFraction is the fraction of a test binary's wall time spent
+// outside of benchmark loops above which the binary is considered to be
+// dominated by fixture setup.
+const setupDominatedFraction = 0.5
+
+// setupStats accumulates, for a single test binary, the wall time of each of
+// its processes and the time that the benchmarks reported spending in their
+// benchmark loops.
+type setupStats struct {
+	wall  time.Duration
+	bench time.Duration
+}
+
+// setupFraction returns the fraction of the wall time that was spent outside
+// of benchmark loops.
+func (s setupStats) setupFraction() float64 {
+	if s.wall <= 0 || s.bench >= s.wall {
+		return 0
+	}
+	return 1 - float64(s.bench)/float64(s.wall)
+}
+
+// reportedBenchTime returns the total time that the benchmark results written
+// to the file after the provided offset report having spent in their benchmark
+// loops. The file's offset is not modified.
+func reportedBenchTime(f *os.File, from int64) (time.Duration, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var total time.Duration
+	s := bufio.NewScanner(io.NewSectionReader(f, from, fi.Size()-from))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		n, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		for i := 2; i+1 < len(fields); i += 2 {
+			if fields[i+1] != "ns/op" {
+				continue
+			}
+			if nsPerOp, err := strconv.ParseFloat(fields[i], 64); err == nil {
+				total += time.Duration(n * nsPerOp)
+			}
+		}
+	}
+	return total, s.Err()
+}
+
+// logSetupDominated warns about the test binaries whose wall time is dominated
+// by fixture setup instead of by the benchmarks themselves.
+func logSetupDominated(stats map[string]*setupStats, reuseProcess bool) {
+	var tests []string
+	for t, s := range stats {
+		if s.setupFraction() > setupDominatedFraction {
+			tests = append(tests, t)
+		}
+	}
+	if len(tests) == 0 {
+		return
+	}
+	sort.Strings(tests)
+	fmt.Fprintln(os.Stderr, "\nthe following packages spent most of their time outside of benchmarks:")
+	for _, t := range tests {
+		s := stats[t]
+		fmt.Fprintf(os.Stderr, "  %s: %.0f%% of %s wall time\n",
+			testBinToPkg(t), 100*s.setupFraction(), s.wall.Round(time.Millisecond))
+	}
+	if !reuseProcess {
+		fmt.Fprintln(os.Stderr, "consider passing --reuse-process to amortize setup across iterations")
+	}
+}
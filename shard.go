@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+)
+
+// benchShards returns a -test.bench pattern for each top-level benchmark in
+// the test that matches the run pattern, so that each benchmark function can
+// be run in its own process. See --shard-benchmarks.
+func benchShards(ctx context.Context, bs *benchSuite, test, runPattern string) ([]string, error) {
+	top, sub := runPattern, ""
+	if i := strings.Index(runPattern, "/"); i >= 0 {
+		top, sub = runPattern[:i], runPattern[i:]
+	}
+	names, err := listBenchmarks(ctx, bs, test, top)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, len(names))
+	for i, name := range names {
+		res[i] = "^" + regexp.QuoteMeta(name) + "$" + sub
+	}
+	return res, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/nvanbenschoten/benchdiff/google"
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// sink is a destination that the benchmark comparison is written to. A run
+// may write to several sinks, e.g. text to stdout, JSON to a file, and a
+// Google sheet.
+type sink struct {
+	format outputFmt
+	// path is the file that the comparison is written to, or empty for
+	// stdout. Unused by sheets and slack sinks.
+	path string
+	// url is the webhook of a slack sink.
+	url string
+}
+
+// sinkFormats maps the names accepted by --format to output formats.
+var sinkFormats = map[string]outputFmt{
+	"text":     text,
+	"csv":      csv,
+	"html":     html,
+	"sheets":   sheets,
+	"template": tmpl,
+	"json":     jsonFmt,
+}
+
+// parseSinks parses the sinks of the run from the --format values, each of the
+// form <format>[:<path>], and the shorthand flags. If no sink writes to
+// stdout, the comparison is also written to stdout as text, as it is the
+// primary output of a run.
+func parseSinks(formats []string, outCSV, outHTML, outSheets bool, slackWebhook string) ([]sink, error) {
+	var res []sink
+	for _, f := range formats {
+		name, path := f, ""
+		if i := strings.Index(f, ":"); i >= 0 {
+			name, path = f[:i], f[i+1:]
+		}
+		format, ok := sinkFormats[name]
+		if !ok {
+			return nil, errors.Errorf("unknown format %q", name)
+		}
+		if format == sheets && path != "" {
+			return nil, errors.New("--format=sheets does not take a path")
+		}
+		res = append(res, sink{format: format, path: path})
+	}
+	for _, s := range []struct {
+		set    bool
+		format outputFmt
+	}{{outCSV, csv}, {outHTML, html}, {outSheets, sheets}} {
+		if s.set {
+			res = append(res, sink{format: s.format})
+		}
+	}
+	if slackWebhook != "" {
+		res = append(res, sink{format: slack, url: slackWebhook})
+	}
+
+	var stdout int
+	for _, s := range res {
+		if s.writesStdout() {
+			stdout++
+		}
+	}
+	if stdout > 1 {
+		return nil, errors.New("only one output format can be written to stdout; " +
+			"write the others to files with --format=<format>:<path>")
+	}
+	if stdout == 0 {
+		res = append([]sink{{format: text}}, res...)
+	}
+	return res, nil
+}
+
+// writesStdout returns whether the sink writes the comparison to stdout.
+func (s sink) writesStdout() bool {
+	return s.path == "" && s.format != sheets && s.format != slack
+}
+
+// outputConfig configures the sinks that the comparison is written to, along
+// with the resources that they need.
+type outputConfig struct {
+	sinks   []sink
+	units   unitOpts   // for text sinks
+	dialect csvDialect // for csv sinks
+	srv     *google.Service
+	tmpl    *template.Template
+	sparks  sparklineData // optional, for html sinks
+	// hierarchy groups sub-benchmarks under their top-level benchmarks, with
+	// rollups, in html, sheets, and json sinks. See --hierarchy.
+	hierarchy bool
+	// subFilter drops the benchmarks whose sub-benchmark parameters don't
+	// match. See --sub-filter.
+	subFilter subFilter
+	// annotations are rendered in the notes of the rows they match.
+	annotations []annotation
+}
+
+// textOutput returns the output configuration that writes text to stdout.
+func textOutput(units unitOpts) *outputConfig {
+	return &outputConfig{sinks: []sink{{format: text}}, units: units}
+}
+
+// has returns whether any sink has the format.
+func (oc *outputConfig) has(format outputFmt) bool {
+	for _, s := range oc.sinks {
+		if s.format == format {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSinks writes the comparison to each sink in turn. w is the writer of
+// sinks without a path.
+func writeSinks(
+	ctx context.Context,
+	w io.Writer,
+	oldSuite, newSuite *benchSuite,
+	controlSuite *benchSuite, // optional
+	byName bool,
+	pkgFilter []string,
+	tables []*benchstat.Table,
+	oc *outputConfig,
+) error {
+	for _, s := range oc.sinks {
+		out := w
+		var f *os.File
+		if s.path != "" {
+			var err error
+			if f, err = os.Create(s.path); err != nil {
+				return err
+			}
+			out = f
+		}
+		err := writeSink(ctx, out, s, oldSuite, newSuite, controlSuite, byName, pkgFilter, tables, oc)
+		if f != nil {
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			return errors.Wrapf(err, "writing %s output", s.name())
+		}
+		if s.path != "" {
+			fmt.Fprintf(os.Stderr, "wrote %s output to %s\n", s.name(), s.path)
+		}
+	}
+	return nil
+}
+
+func (s sink) name() string {
+	if s.format == slack {
+		return "slack"
+	}
+	for name, f := range sinkFormats {
+		if f == s.format {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+func writeSink(
+	ctx context.Context,
+	w io.Writer,
+	s sink,
+	oldSuite, newSuite *benchSuite,
+	controlSuite *benchSuite,
+	byName bool,
+	pkgFilter []string,
+	tables []*benchstat.Table,
+	oc *outputConfig,
+) error {
+	switch s.format {
+	case text:
+		restore := applyUnits(tables, oc.units)
+		defer restore()
+		others, latencies := splitPercentileTables(tables)
+		benchstat.FormatText(w, others)
+		formatLatencies(w, latencies)
+		if controlSuite != nil {
+			return formatControlTables(w, controlSuite, oldSuite, newSuite, byName)
+		}
+		return nil
+	case csv:
+		return formatCSV(w, tables, oc.dialect)
+	case html:
+		if oc.hierarchy {
+			return formatHierarchyHTML(w, tables)
+		}
+		var buf bytes.Buffer
+		benchstat.FormatHTML(&buf, tables)
+		_, err := w.Write(addSparklines(buf.Bytes(), tables, oc.sparks))
+		return err
+	case sheets:
+		sheetName := fmt.Sprintf("benchdiff: %s (%s -> %s)",
+			strings.Join(pkgFilter, " "), oldSuite.ref, newSuite.ref)
+		sheetTables := tables
+		if oc.hierarchy {
+			sheetTables = append(append([]*benchstat.Table(nil), tables...), rollupTables(tables)...)
+		}
+		url, err := oc.srv.CreateSheet(ctx, newSuite.redact.string(sheetName), sheetTables)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\ngenerated sheet: %s\n", url)
+		return nil
+	case tmpl:
+		return executeTemplate(w, oc.tmpl, oldSuite, newSuite, pkgFilter, tables)
+	case jsonFmt:
+		report := makeJSONReport(oldSuite, newSuite, tables, true)
+		if oc.hierarchy {
+			addJSONHierarchy(report.Tables, tables)
+		}
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	case slack:
+		return postSlack(ctx, s.url, oldSuite, newSuite, tables)
+	default:
+		panic("unexpected")
+	}
+}
+
+// slackMaxTable is the maximum length of the comparison posted to slack, which
+// truncates long messages.
+const slackMaxTable = 3500
+
+// postSlack posts the comparison, as text, to the slack incoming webhook.
+func postSlack(ctx context.Context, url string, oldSuite, newSuite *benchSuite, tables []*benchstat.Table) error {
+	var buf bytes.Buffer
+	benchstat.FormatText(&buf, tables)
+	msg := fmt.Sprintf("*benchdiff* %s → %s (%s)\n```\n%s```",
+		oldSuite.ref, newSuite.ref, newSuite.redact.string(newSuite.subject), truncateSlack(buf.String()))
+	return postSlackText(ctx, url, msg)
+}
+
+// truncateSlack truncates the table to slackMaxTable, at a line boundary.
+func truncateSlack(table string) string {
+	if len(table) > slackMaxTable {
+		table = table[:strings.LastIndex(table[:slackMaxTable], "\n")+1] + "...\n"
+	}
+	return table
+}
+
+// postSlackText posts the message to the slack incoming webhook.
+func postSlackText(ctx context.Context, url, msg string) error {
+	payload, err := json.Marshal(map[string]string{"text": msg})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("slack webhook returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import "github.com/pkg/errors"
+
+// sizeClassEnv is the environment variable through which the selected size
+// class is exported to benchmarks. By convention, benchmarks with heavyweight
+// cases consult it to decide which cases to run, for instance:
+//
+//	if os.Getenv("BENCHDIFF_SIZE") == "small" {
+//		b.Skip("skipping heavyweight benchmark")
+//	}
+//
+// If the variable is unset, benchmarks should run all cases.
+const sizeClassEnv = "BENCHDIFF_SIZE"
+
+// Size classes, from a quick smoke comparison to the full heavyweight run.
+const (
+	sizeSmall  = "small"
+	sizeMedium = "medium"
+	sizeLarge  = "large"
+)
+
+// validateSizeClass returns an error if the provided size class is not known.
+func validateSizeClass(class string) error {
+	switch class {
+	case "", sizeSmall, sizeMedium, sizeLarge:
+		return nil
+	default:
+		return errors.Errorf("unknown size class %q", class)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// joinSkipPatterns returns a -test.skip pattern that skips the benchmarks
+// matched by either of the provided patterns. Patterns are matched against
+// each level of a benchmark's name separately, so only patterns without
+// sub-benchmark levels can be joined.
+func joinSkipPatterns(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	return "(?:" + a + ")|(?:" + b + ")"
+}
+
+// excludeBenchmarks emulates -test.skip for test binaries that predate it
+// (Go 1.20) by listing the top-level benchmarks that match the run pattern
+// and returning a -test.bench pattern that matches only those that are not
+// matched by the skip pattern.
+func excludeBenchmarks(ctx context.Context, bs *benchSuite, test, runPattern, skipPattern string) (string, error) {
+	if strings.Contains(skipPattern, "/") {
+		return "", errors.Errorf("%s does not support -test.skip, so only top-level benchmarks can be skipped", test)
+	}
+	skip, err := regexp.Compile(skipPattern)
+	if err != nil {
+		return "", err
+	}
+	top, sub := runPattern, ""
+	if i := strings.Index(runPattern, "/"); i >= 0 {
+		top, sub = runPattern[:i], runPattern[i:]
+	}
+	names, err := listBenchmarks(ctx, bs, test, top)
+	if err != nil {
+		return "", err
+	}
+	var keep []string
+	for _, name := range names {
+		if !skip.MatchString(name) {
+			keep = append(keep, regexp.QuoteMeta(name))
+		}
+	}
+	if len(keep) == 0 {
+		// Match no benchmark.
+		return "^$", nil
+	}
+	return "^(" + strings.Join(keep, "|") + ")$" + sub, nil
+}
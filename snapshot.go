@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+const snapshotEnvUsage = `usage: benchdiff snapshot-env [options]
+
+benchdiff snapshot-env records a container image holding the exact toolchain
+and OS libraries that benchmarks are built and run with, so that published
+comparisons can later be re-executed in the same environment. The image is
+recorded by its digest in benchdiff/env.json, and the digest is embedded in the
+metadata of all subsequent results (as the 'image' configuration line and in
+the JSON report).
+
+Either an existing image is recorded with --image, or an image is built with
+--tag from a Dockerfile (by default, one based on the golang image of the local
+Go version). Built images must be pushed to a registry with --push for their
+digest to be resolvable elsewhere.
+
+Options:
+      --image      <ref>   record the existing image, pulling it if needed
+      --tag        <ref>   build an image and tag it with the provided reference
+      --dockerfile <path>  the Dockerfile to build with --tag (default generated)
+      --push               push the built image to its registry
+      --builder    <cmd>   the container tool to use (default docker)
+      --clear              remove the recorded image`
+
+// snapshotFile is the file that the recorded environment image is stored in.
+var snapshotFile = filepath.Join("benchdiff", "env.json")
+
+// envSnapshot describes a container image recorded by snapshot-env.
+type envSnapshot struct {
+	// Image is the image reference, pinned by digest.
+	Image     string    `json:"image"`
+	GoVersion string    `json:"go_version"`
+	OS        string    `json:"os,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// snapshotDockerfile is the Dockerfile used to build an environment image if
+// none is provided. The Go version is filled in with the local version.
+const snapshotDockerfile = `FROM golang:%s
+RUN apt-get update && apt-get install -y --no-install-recommends git numactl util-linux && rm -rf /var/lib/apt/lists/*
+`
+
+func runSnapshotEnv(ctx context.Context, args []string) error {
+	var image, tag, dockerfile, builder string
+	var push, clear, help bool
+
+	flags := pflag.NewFlagSet("snapshot-env", pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, snapshotEnvUsage) }
+	flags.BoolVarP(&help, "help", "h", false, "")
+	flags.StringVarP(&image, "image", "", "", "")
+	flags.StringVarP(&tag, "tag", "", "", "")
+	flags.StringVarP(&dockerfile, "dockerfile", "", "", "")
+	flags.BoolVarP(&push, "push", "", false, "")
+	flags.StringVarP(&builder, "builder", "", "docker", "")
+	flags.BoolVarP(&clear, "clear", "", false, "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if help {
+		fmt.Fprintln(os.Stderr, snapshotEnvUsage)
+		return nil
+	}
+	if clear {
+		if err := os.Remove(snapshotFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if (image == "") == (tag == "") {
+		fmt.Fprintln(os.Stderr, snapshotEnvUsage)
+		return errors.New("expected exactly one of --image or --tag")
+	}
+	if image != "" && (dockerfile != "" || push) {
+		return errors.New("--dockerfile and --push can only be used with --tag")
+	}
+
+	goVersion, err := capture(ctx, "go", "env", "GOVERSION")
+	if err != nil {
+		return errors.Wrap(err, "determining the Go version")
+	}
+	if tag != "" {
+		if err := buildSnapshotImage(ctx, builder, tag, dockerfile, goVersion); err != nil {
+			return err
+		}
+		if push {
+			if err := spawn(ctx, builder, "push", tag); err != nil {
+				return errors.Wrapf(err, "pushing %s", tag)
+			}
+		}
+		image = tag
+	} else if _, err := capture(ctx, builder, "image", "inspect", image); err != nil {
+		if err := spawn(ctx, builder, "pull", image); err != nil {
+			return errors.Wrapf(err, "pulling %s", image)
+		}
+	}
+
+	snap := envSnapshot{Created: time.Now().UTC()}
+	if snap.Image, err = imageDigest(ctx, builder, image); err != nil {
+		return err
+	}
+	// Record the versions inside the image, which may differ from the local
+	// ones for a recorded image.
+	if snap.GoVersion, err = capture(ctx, builder, "run", "--rm", snap.Image, "go", "env", "GOVERSION"); err != nil {
+		return errors.Wrapf(err, "determining the Go version of %s", snap.Image)
+	}
+	if out, err := capture(ctx, builder, "run", "--rm", snap.Image, "cat", "/etc/os-release"); err == nil {
+		snap.OS = osReleaseName(out)
+	}
+	if snap.GoVersion != goVersion {
+		fmt.Fprintf(os.Stderr, "warning: %s has %s, but the local toolchain is %s\n",
+			snap.Image, snap.GoVersion, goVersion)
+	}
+
+	if err := ignoreBenchdiffDir(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(snapshotFile, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("recorded %s (%s, %s) in %s\n", snap.Image, snap.GoVersion, snap.OS, snapshotFile)
+	return nil
+}
+
+// buildSnapshotImage builds the environment image from the Dockerfile, or from
+// snapshotDockerfile if none is provided.
+func buildSnapshotImage(ctx context.Context, builder, tag, dockerfile, goVersion string) error {
+	dir, err := ioutil.TempDir("", "benchdiff-snapshot")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if dockerfile == "" {
+		dockerfile = filepath.Join(dir, "Dockerfile")
+		contents := fmt.Sprintf(snapshotDockerfile, strings.TrimPrefix(goVersion, "go"))
+		if err := ioutil.WriteFile(dockerfile, []byte(contents), 0644); err != nil {
+			return err
+		}
+	}
+	if err := spawn(ctx, builder, "build", "--pull", "-t", tag, "-f", dockerfile, dir); err != nil {
+		return errors.Wrapf(err, "building %s", tag)
+	}
+	return nil
+}
+
+// imageDigest returns the reference of the image pinned by its registry
+// digest. Images that were never pushed to or pulled from a registry have no
+// registry digest, in which case their local ID is used, which can only be
+// resolved on this host.
+func imageDigest(ctx context.Context, builder, image string) (string, error) {
+	out, err := capture(ctx, builder, "image", "inspect", "--format", "{{json .RepoDigests}}", image)
+	if err != nil {
+		return "", errors.Wrapf(err, "inspecting %s", image)
+	}
+	var digests []string
+	if err := json.Unmarshal([]byte(out), &digests); err != nil {
+		return "", errors.Wrapf(err, "decoding digests of %s", image)
+	}
+	if len(digests) > 0 {
+		return digests[0], nil
+	}
+	id, err := capture(ctx, builder, "image", "inspect", "--format", "{{.Id}}", image)
+	if err != nil {
+		return "", errors.Wrapf(err, "inspecting %s", image)
+	}
+	fmt.Fprintf(os.Stderr, "warning: %s has no registry digest; push it with --push so it can be re-executed elsewhere\n", image)
+	return id, nil
+}
+
+// osReleaseName returns the PRETTY_NAME from the contents of /etc/os-release.
+func osReleaseName(osRelease string) string {
+	for _, line := range strings.Split(osRelease, "\n") {
+		if strings.HasPrefix(line, "PRETTY_NAME=") {
+			return strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), `"`)
+		}
+	}
+	return ""
+}
+
+// loadEnvSnapshot returns the environment image recorded by snapshot-env, or
+// nil if none is recorded.
+func loadEnvSnapshot() (*envSnapshot, error) {
+	data, err := ioutil.ReadFile(snapshotFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var snap envSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, errors.Wrapf(err, "decoding %s", snapshotFile)
+	}
+	return &snap, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"strings"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// sparklineRuns is the number of most recent runs in the history store that
+// are plotted in each sparkline.
+const sparklineRuns = 20
+
+// Dimensions of each sparkline, in pixels.
+const (
+	sparklineWidth  = 80
+	sparklineHeight = 16
+)
+
+// sparklineData holds the mean of every benchmark metric in each of the most
+// recent runs in the history store, keyed by metric and then benchmark.
+type sparklineData map[string]map[string][]float64
+
+// loadSparklines reads the means of every benchmark metric from the last n
+// runs in the history store.
+func loadSparklines(entries []historyEntry, n int) (sparklineData, error) {
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	res := make(sparklineData)
+	for _, e := range entries {
+		f, err := os.Open(e.path)
+		if err != nil {
+			return nil, err
+		}
+		var c benchstat.Collection
+		err = c.AddFile(e.ref, f)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range c.Tables() {
+			m, ok := res[t.Metric]
+			if !ok {
+				m = make(map[string][]float64)
+				res[t.Metric] = m
+			}
+			for _, row := range t.Rows {
+				if len(row.Metrics) == 1 && len(row.Metrics[0].RValues) > 0 {
+					m[row.Benchmark] = append(m[row.Benchmark], row.Metrics[0].Mean)
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// sparklineSVG renders the values as an inline SVG sparkline. The last value
+// is marked with a dot.
+func sparklineSVG(values []float64) string {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	var pts []string
+	var x, y float64
+	for i, v := range values {
+		x = 1
+		if len(values) > 1 {
+			x += float64(i) * (sparklineWidth - 2) / float64(len(values)-1)
+		}
+		y = sparklineHeight / 2
+		if hi > lo {
+			y = 1 + (hi-v)*(sparklineHeight-2)/(hi-lo)
+		}
+		pts = append(pts, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	return fmt.Sprintf("<svg class='sparkline' width='%d' height='%d'>"+
+		"<polyline fill='none' stroke='currentColor' points='%s'/>"+
+		"<circle cx='%.1f' cy='%.1f' r='1.5'/></svg>",
+		sparklineWidth, sparklineHeight, strings.Join(pts, " "), x, y)
+}
+
+// addSparklines inserts a sparkline of each benchmark's history, followed by
+// its mean in the new run, next to its name in the HTML rendering of the
+// tables produced by benchstat.FormatHTML.
+func addSparklines(out []byte, tables []*benchstat.Table, data sparklineData) []byte {
+	// Each table is rendered in its own tbody.
+	parts := bytes.Split(out, []byte("<tbody>"))
+	if len(parts) != len(tables)+1 {
+		return out
+	}
+	for i, t := range tables {
+		for _, row := range t.Rows {
+			values := data[t.Metric][row.Benchmark]
+			if len(values) == 0 || len(row.Metrics) != 2 {
+				continue
+			}
+			values = append(append([]float64(nil), values...), row.Metrics[1].Mean)
+			cell := []byte("<td>" + escapeHTML(row.Benchmark) + "<td>")
+			repl := []byte("<td>" + escapeHTML(row.Benchmark) + " " + sparklineSVG(values) + "<td>")
+			parts[i+1] = bytes.Replace(parts[i+1], cell, repl, 1)
+		}
+	}
+	return bytes.Join(parts, []byte("<tbody>"))
+}
+
+var escapeTemplate = template.Must(template.New("").Parse("{{.}}"))
+
+// escapeHTML escapes the string in the same way as the html/template package
+// used by benchstat.FormatHTML.
+func escapeHTML(s string) string {
+	var buf bytes.Buffer
+	if err := escapeTemplate.Execute(&buf, s); err != nil {
+		panic(err)
+	}
+	return buf.String()
+}
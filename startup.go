@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// outputCollector is implemented by collectors that observe the output of the
+// test binary. WrapOutput is called just before the binary is started and
+// returns the writer that its output is written to instead of w.
+type outputCollector interface {
+	WrapOutput(w io.Writer) io.Writer
+}
+
+// startupMarkers are the prefixes of the lines that the testing package
+// prints once it starts running benchmarks.
+var startupMarkers = [][]byte{[]byte("goos:"), []byte("pkg:"), []byte("Benchmark")}
+
+// startupCollector measures the time from the start of an invocation to the
+// first line of benchmark output, which covers process startup, package
+// initialization, and TestMain setup. Regressions in it would otherwise be
+// spread invisibly across the results.
+type startupCollector struct {
+	start   time.Time
+	startup time.Duration
+	line    []byte // prefix of the current line, up to the longest marker
+}
+
+func (c *startupCollector) WrapOutput(w io.Writer) io.Writer {
+	c.start, c.startup, c.line = time.Now(), 0, c.line[:0]
+	return &startupWriter{c: c, w: w}
+}
+
+func (c *startupCollector) Start(pid int) error {
+	if c.start.IsZero() {
+		return errors.New("startup collector did not observe the output of the test binary")
+	}
+	return nil
+}
+
+func (c *startupCollector) Stop() (map[string]float64, error) {
+	defer func() { c.start = time.Time{} }()
+	if c.startup == 0 {
+		// No benchmarks ran.
+		return nil, nil
+	}
+	return map[string]float64{"startup-ns": float64(c.startup)}, nil
+}
+
+// observe scans output for the first line with a startup marker.
+func (c *startupCollector) observe(p []byte) {
+	const maxLen = len("Benchmark")
+	for len(p) > 0 && c.startup == 0 {
+		i := bytes.IndexByte(p, '\n')
+		chunk := p
+		if i >= 0 {
+			chunk = p[:i]
+		}
+		if n := maxLen - len(c.line); n > 0 {
+			if n > len(chunk) {
+				n = len(chunk)
+			}
+			c.line = append(c.line, chunk[:n]...)
+		}
+		for _, m := range startupMarkers {
+			if bytes.HasPrefix(c.line, m) {
+				c.startup = time.Since(c.start)
+				return
+			}
+		}
+		if i < 0 {
+			return
+		}
+		c.line, p = c.line[:0], p[i+1:]
+	}
+}
+
+type startupWriter struct {
+	c *startupCollector
+	w io.Writer
+}
+
+func (w *startupWriter) Write(p []byte) (int, error) {
+	w.c.observe(p)
+	return w.w.Write(p)
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+const suggestUsage = `usage: benchdiff suggest [options]
+
+benchdiff suggest lists the exported functions and methods changed between two
+refs that no benchmark in their package refers to, to help decide what to
+benchmark before comparing. To rank the suggestions by how hot the functions
+are, the tests of the changed packages are run once with a CPU profile (if the
+working tree is at the new ref), or existing CPU profiles are used.
+
+Options:
+      --old        <commit>  the old commit (default: the parent of --new)
+      --new        <commit>  the new commit (default: HEAD)
+      --profile    <path>    CPU profile(s) to rank by, instead of a quick run
+      --no-profile           don't rank by CPU profiles
+      --run        <regexp>  the tests to run for the quick run (default all)
+      --timeout    <d>       timeout of the quick run of each package (default 2m)
+      --skeletons            also print a skeleton benchmark for each function`
+
+// changedFunc is an exported function or method that was changed between the
+// refs.
+type changedFunc struct {
+	dir  string // of the package, relative to the repository root
+	file string
+	line int
+	recv string // e.g. "(*T)" or "T", empty for functions
+	name string
+	// share is the fraction of CPU time spent in the function (including its
+	// callees) in the profiles, or -1 if it wasn't profiled.
+	share float64
+}
+
+// symbol returns the name of the function as it appears in CPU profiles,
+// without the package path.
+func (f *changedFunc) symbol() string {
+	if f.recv == "" {
+		return f.name
+	}
+	return f.recv + "." + f.name
+}
+
+func runSuggest(ctx context.Context, args []string) error {
+	var oldRef, newRef, runPattern, timeout string
+	var profiles []string
+	var noProfile, skeletons, help bool
+
+	flags := pflag.NewFlagSet("suggest", pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, suggestUsage) }
+	flags.BoolVarP(&help, "help", "h", false, "")
+	flags.StringVarP(&oldRef, "old", "", "", "")
+	flags.StringVarP(&newRef, "new", "", "", "")
+	flags.StringSliceVarP(&profiles, "profile", "", nil, "")
+	flags.BoolVarP(&noProfile, "no-profile", "", false, "")
+	flags.StringVarP(&runPattern, "run", "", ".", "")
+	flags.StringVarP(&timeout, "timeout", "", "2m", "")
+	flags.BoolVarP(&skeletons, "skeletons", "", false, "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if help {
+		fmt.Fprintln(os.Stderr, suggestUsage)
+		return nil
+	}
+	if noProfile && len(profiles) > 0 {
+		return errors.New("--profile can not be used with --no-profile")
+	}
+	oldRef, newRef, err := parseGitRefs(ctx, oldRef, newRef)
+	if err != nil {
+		return err
+	}
+	top, err := capture(ctx, "git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(top); err != nil {
+		return err
+	}
+
+	funcs, err := changedExportedFuncs(ctx, oldRef, newRef)
+	if err != nil {
+		return err
+	}
+	var uncovered []*changedFunc
+	covered := make(map[string]map[string]bool) // by package directory
+	for _, f := range funcs {
+		refs, ok := covered[f.dir]
+		if !ok {
+			if refs, err = benchmarkRefs(ctx, newRef, f.dir); err != nil {
+				return err
+			}
+			covered[f.dir] = refs
+		}
+		if !refs[f.name] {
+			uncovered = append(uncovered, f)
+		}
+	}
+	if len(uncovered) == 0 {
+		fmt.Printf("all %d changed exported functions between %s and %s are referenced by benchmarks\n",
+			len(funcs), oldRef, newRef)
+		return nil
+	}
+
+	if !noProfile {
+		if len(profiles) == 0 {
+			if profiles, err = quickProfiles(ctx, newRef, uncovered, runPattern, timeout); err != nil {
+				return err
+			}
+			defer func() {
+				for _, p := range profiles {
+					os.RemoveAll(filepath.Dir(p))
+				}
+			}()
+		}
+		if err := rankByProfiles(ctx, uncovered, profiles); err != nil {
+			return err
+		}
+	}
+	sort.SliceStable(uncovered, func(i, j int) bool {
+		a, b := uncovered[i], uncovered[j]
+		if a.share != b.share {
+			return a.share > b.share
+		}
+		if a.dir != b.dir {
+			return a.dir < b.dir
+		}
+		return a.symbol() < b.symbol()
+	})
+
+	fmt.Printf("changed exported functions without benchmarks (%s -> %s):\n", oldRef, newRef)
+	for _, f := range uncovered {
+		share := "     -"
+		if f.share >= 0 {
+			share = fmt.Sprintf("%5.1f%%", 100*f.share)
+		}
+		fmt.Printf("  %s  %s.%s\t%s:%d\n", share, path.Base(f.dir), f.symbol(), f.file, f.line)
+	}
+	if !noProfile {
+		fmt.Println("\n(share of CPU time in the profiles, including callees)")
+	}
+	if skeletons {
+		for _, f := range uncovered {
+			fmt.Println()
+			fmt.Print(benchmarkSkeleton(f))
+		}
+	}
+	return nil
+}
+
+// hunkHeader matches the header of a hunk in a unified diff, capturing the
+// start and length of the hunk in the new file.
+var hunkHeader = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+// changedExportedFuncs returns the exported functions and methods, outside of
+// tests, whose declarations at the new ref overlap the lines changed between
+// the refs.
+func changedExportedFuncs(ctx context.Context, oldRef, newRef string) ([]*changedFunc, error) {
+	out, err := capture(ctx, "git", "diff", "-U0", "--no-color", "--no-ext-diff", oldRef, newRef, "--", "*.go")
+	if err != nil {
+		return nil, errors.Wrap(err, "diffing refs")
+	}
+	// The changed line ranges of each file, at the new ref.
+	changed := make(map[string][][2]int)
+	var files []string
+	var file string
+	s := bufio.NewScanner(strings.NewReader(out))
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "+++ ") {
+			file = ""
+			if name := strings.TrimPrefix(line, "+++ "); strings.HasPrefix(name, "b/") &&
+				!strings.HasSuffix(name, "_test.go") {
+				file = strings.TrimPrefix(name, "b/")
+				files = append(files, file)
+			}
+			continue
+		}
+		m := hunkHeader.FindStringSubmatch(line)
+		if m == nil || file == "" {
+			continue
+		}
+		start, _ := strconv.Atoi(m[1])
+		n := 1
+		if m[2] != "" {
+			n, _ = strconv.Atoi(m[2])
+		}
+		// Pure deletions are recorded as touching the line they follow.
+		end := start + n - 1
+		if n == 0 {
+			end = start
+		}
+		changed[file] = append(changed[file], [2]int{start, end})
+	}
+
+	var res []*changedFunc
+	for _, file := range files {
+		src, err := capture(ctx, "git", "show", newRef+":"+file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s at %s", file, newRef)
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, file, src, 0)
+		if err != nil {
+			// Skip files that don't parse, e.g. templates with a .go suffix.
+			fmt.Fprintf(os.Stderr, "warning: skipping %s: %s\n", file, err)
+			continue
+		}
+		if f.Name.Name == "main" {
+			continue
+		}
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || !fn.Name.IsExported() {
+				continue
+			}
+			cf := &changedFunc{dir: path.Dir(file), file: file, name: fn.Name.Name, share: -1}
+			if fn.Recv != nil && len(fn.Recv.List) == 1 {
+				var ok bool
+				if cf.recv, ok = receiverName(fn.Recv.List[0].Type); !ok {
+					continue
+				}
+			}
+			start, end := fset.Position(fn.Pos()).Line, fset.Position(fn.End()).Line
+			for _, r := range changed[file] {
+				if r[0] <= end && r[1] >= start {
+					cf.line = start
+					res = append(res, cf)
+					break
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// receiverName returns the receiver of a method as it appears in the symbol
+// name of the method, e.g. "(*T)", and whether the receiver type is exported.
+func receiverName(expr ast.Expr) (string, bool) {
+	star := false
+	if s, ok := expr.(*ast.StarExpr); ok {
+		star, expr = true, s.X
+	}
+	// Type parameters are elided from the symbol names of generic methods.
+	if t, ok := expr.(*ast.IndexExpr); ok {
+		expr = t.X
+	}
+	id, ok := expr.(*ast.Ident)
+	if !ok || !id.IsExported() {
+		return "", false
+	}
+	if star {
+		return "(*" + id.Name + ")", true
+	}
+	return id.Name, true
+}
+
+// benchmarkRefs returns the identifiers referred to by the benchmarks of the
+// package in the directory at the ref, including those in the external test
+// package, as a set.
+func benchmarkRefs(ctx context.Context, ref, dir string) (map[string]bool, error) {
+	out, err := capture(ctx, "git", "ls-tree", "--name-only", ref, dir+"/")
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %s at %s", dir, ref)
+	}
+	refs := make(map[string]bool)
+	for _, file := range strings.Fields(out) {
+		if !strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		src, err := capture(ctx, "git", "show", ref+":"+file)
+		if err != nil {
+			return nil, err
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), file, src, 0)
+		if err != nil {
+			continue
+		}
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Body == nil || !strings.HasPrefix(fn.Name.Name, "Benchmark") {
+				continue
+			}
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Ident); ok {
+					refs[id.Name] = true
+				}
+				return true
+			})
+		}
+	}
+	return refs, nil
+}
+
+// quickProfiles runs the tests of the packages of the functions once, each
+// with a CPU profile, and returns the paths of the profiles. If the working
+// tree isn't at the new ref, there is nothing to profile, so no profiles are
+// returned.
+func quickProfiles(ctx context.Context, newRef string, funcs []*changedFunc, runPattern, timeout string) ([]string, error) {
+	head, err := getCurRef(ctx)
+	if err != nil {
+		return nil, err
+	}
+	newSHA, err := getRefAsSHA(ctx, newRef)
+	if err != nil {
+		return nil, err
+	}
+	if head != newSHA {
+		fmt.Fprintf(os.Stderr, "warning: the working tree is not at %s; not ranking by CPU profiles "+
+			"(check it out or pass --profile)\n", newRef)
+		return nil, nil
+	}
+	seen := make(map[string]bool)
+	var res []string
+	for _, f := range funcs {
+		if seen[f.dir] {
+			continue
+		}
+		seen[f.dir] = true
+		dir, err := ioutil.TempDir("", "benchdiff-suggest")
+		if err != nil {
+			return nil, err
+		}
+		prof := filepath.Join(dir, "cpu.prof")
+		fmt.Fprintf(os.Stderr, "profiling the tests of ./%s\n", f.dir)
+		err = spawnWith(ctx, nil, ioutil.Discard, os.Stderr, "go", "test", "-count", "1", "-run", runPattern,
+			"-timeout", timeout, "-cpuprofile", prof, "-o", filepath.Join(dir, "pkg.test"), "./"+f.dir)
+		if err != nil {
+			// A failing test doesn't prevent ranking by the rest of the
+			// profiles.
+			fmt.Fprintf(os.Stderr, "warning: testing ./%s: %s\n", f.dir, err)
+		}
+		if _, err := os.Stat(prof); err != nil {
+			os.RemoveAll(dir)
+			continue
+		}
+		res = append(res, prof)
+	}
+	return res, nil
+}
+
+// rankByProfiles sets the share of CPU time of each function, including its
+// callees, across the CPU profiles.
+func rankByProfiles(ctx context.Context, funcs []*changedFunc, profiles []string) error {
+	cum := make(map[string]float64) // by symbol, without the package path
+	var total float64
+	for _, file := range profiles {
+		p, err := readProfile(file)
+		if err != nil {
+			return errors.Wrapf(err, "reading %s", file)
+		}
+		idx := len(p.SampleType) - 1
+		for i, st := range p.SampleType {
+			if st.Type == "cpu" {
+				idx = i
+			}
+		}
+		if idx < 0 {
+			continue
+		}
+		for _, s := range p.Sample {
+			v := float64(s.Value[idx])
+			total += v
+			for sym := range sampleSymbols(s) {
+				cum[sym] += v
+			}
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	for _, f := range funcs {
+		if v, ok := cum[path.Base(importPathOf(ctx, f.dir))+"."+f.symbol()]; ok {
+			f.share = v / total
+		} else {
+			f.share = 0
+		}
+	}
+	return nil
+}
+
+// typeParams matches the type parameters in the symbol names of generic
+// functions.
+var typeParams = regexp.MustCompile(`\[[^\]]*\]`)
+
+// sampleSymbols returns the set of functions in the stack of the sample, each
+// as the last element of its package path and its symbol, e.g. "pkg.(*T).M",
+// as they are named in changedFunc.
+func sampleSymbols(s *profile.Sample) map[string]bool {
+	res := make(map[string]bool)
+	for _, loc := range s.Location {
+		for _, l := range loc.Line {
+			name := typeParams.ReplaceAllString(l.Function.Name, "")
+			if i := strings.LastIndex(name, "/"); i >= 0 {
+				name = name[i+1:]
+			}
+			res[name] = true
+		}
+	}
+	return res
+}
+
+// importPathOf returns the import path of the package in the directory, or the
+// directory if it can't be determined.
+func importPathOf(ctx context.Context, dir string) string {
+	if p, err := capture(ctx, "go", "list", "-f", "{{.ImportPath}}", "./"+dir); err == nil {
+		return p
+	}
+	return dir
+}
+
+// benchmarkSkeleton returns a skeleton benchmark of the function.
+func benchmarkSkeleton(f *changedFunc) string {
+	name := f.name
+	call := f.name + "(...)"
+	if f.recv != "" {
+		recv := strings.Trim(f.recv, "(*)")
+		name = recv + "_" + f.name
+		call = strings.ToLower(recv[:1]) + recv[1:] + "." + f.name + "(...)"
+	}
+	return fmt.Sprintf(`// %s
+func Benchmark%s(b *testing.B) {
+	// TODO: set up the inputs of %s.
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// TODO: %s
+	}
+}
+`, f.file, name, f.symbol(), call)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// templateData is the data model that user-supplied report templates are
+// executed against.
+type templateData struct {
+	Old      suiteInfo
+	New      suiteInfo
+	Packages []string
+	Tables   []jsonTable
+}
+
+// templateFuncs are the helper functions available to report templates.
+var templateFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"pct": func(f float64) string {
+		return fmt.Sprintf("%+.2f%%", f)
+	},
+}
+
+// loadTemplate parses the report template at the provided path.
+func loadTemplate(path string) (*template.Template, error) {
+	t, err := template.New(filepath.Base(path)).Funcs(templateFuncs).ParseFiles(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing template")
+	}
+	return t, nil
+}
+
+// executeTemplate renders the benchmark comparison using the report template.
+func executeTemplate(
+	w io.Writer,
+	tmpl *template.Template,
+	oldSuite, newSuite *benchSuite,
+	pkgFilter []string,
+	tables []*benchstat.Table,
+) error {
+	data := templateData{
+		Old:      newSuite.redact.suiteInfo(makeSuiteInfo(oldSuite)),
+		New:      newSuite.redact.suiteInfo(makeSuiteInfo(newSuite)),
+		Packages: newSuite.redact.strings(pkgFilter),
+		Tables:   makeJSONTables(tables),
+	}
+	return errors.Wrap(tmpl.Execute(w, data), "executing template")
+}
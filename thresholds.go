@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// thresholds maps metrics, or their units, to the regression threshold of the
+// gate, as a fraction. The empty key holds the threshold of the metrics
+// without one of their own. A negative threshold gates nothing, and a nil
+// thresholds gates nothing at all. See --threshold.
+type thresholds map[string]float64
+
+// parseThresholds parses the --threshold values, each a threshold for all
+// metrics or of the form <metric>:<threshold>, e.g. time/op:5%. A threshold
+// is a fraction, e.g. 0.05, or a percentage, e.g. 5%. A negative threshold,
+// like the -1 that used to be the default, disables the gate, for all metrics
+// or for the metric.
+func parseThresholds(specs []string) (thresholds, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	res := make(thresholds)
+	for _, spec := range specs {
+		var metric string
+		val := spec
+		if i := strings.LastIndex(spec, ":"); i >= 0 {
+			metric, val = spec[:i], spec[i+1:]
+			if metric == "" {
+				return nil, errors.Errorf("invalid --threshold %q: must be <threshold> or <metric>:<threshold>", spec)
+			}
+		}
+		scale := 1.0
+		if strings.HasSuffix(val, "%") {
+			val, scale = strings.TrimSuffix(val, "%"), 0.01
+		}
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid --threshold %q: must be a fraction or percentage", spec)
+		}
+		if f *= scale; f < 0 {
+			f = -1
+		}
+		if _, ok := res[metric]; ok {
+			if metric == "" {
+				return nil, errors.New("--threshold sets the threshold of all metrics more than once")
+			}
+			return nil, errors.Errorf("--threshold sets the threshold of %s more than once", metric)
+		}
+		res[metric] = f
+	}
+	return res, nil
+}
+
+// of returns the threshold of the metric of the table, or -1 if it has none.
+func (th thresholds) of(t *benchstat.Table) float64 {
+	if f, ok := th[t.Metric]; ok {
+		return f
+	}
+	if len(t.Rows) > 0 && len(t.Rows[0].Metrics) > 0 {
+		if f, ok := th[t.Rows[0].Metrics[0].Unit]; ok {
+			return f
+		}
+	}
+	if f, ok := th[""]; ok {
+		return f
+	}
+	return -1
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseThresholds(t *testing.T) {
+	for _, tc := range []struct {
+		specs []string
+		want  thresholds
+		err   bool
+	}{
+		{specs: nil, want: nil},
+		{specs: []string{"0.2"}, want: thresholds{"": 0.2}},
+		{specs: []string{"5%", "allocs/op:0%"}, want: thresholds{"": 0.05, "allocs/op": 0}},
+		{specs: []string{"-1"}, want: thresholds{"": -1}},
+		{specs: []string{"5%", "time/op:-5%"}, want: thresholds{"": 0.05, "time/op": -1}},
+		{specs: []string{"x"}, err: true},
+		{specs: []string{":5%"}, err: true},
+		{specs: []string{"1", "2"}, err: true},
+	} {
+		got, err := parseThresholds(tc.specs)
+		if (err != nil) != tc.err {
+			t.Errorf("parseThresholds(%q): err = %v, want error %t", tc.specs, err, tc.err)
+			continue
+		}
+		if !tc.err && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseThresholds(%q) = %v, want %v", tc.specs, got, tc.want)
+		}
+	}
+}
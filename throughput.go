@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// payloadSize is the number of bytes that each operation of the matching
+// benchmarks processes, for benchmarks that don't call b.SetBytes. See
+// --payload-size.
+type payloadSize struct {
+	re    *regexp.Regexp
+	bytes int64
+}
+
+// parsePayloadSizes parses the --payload-size values, each of the form
+// <regexp>=<size>.
+func parsePayloadSizes(specs []string) ([]payloadSize, error) {
+	var res []payloadSize
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, "=")
+		if i <= 0 {
+			return nil, errors.Errorf("invalid --payload-size %q: must be <regexp>=<size>", spec)
+		}
+		re, err := regexp.Compile(spec[:i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid --payload-size %q", spec)
+		}
+		n, err := parseMemSize(spec[i+1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid --payload-size %q", spec)
+		}
+		res = append(res, payloadSize{re: re, bytes: n})
+	}
+	return res, nil
+}
+
+// deriveThroughput appends the MB/s derived from the payload size and ns/op
+// to the benchmark results in the output that match a payload size and don't
+// report MB/s already, as if the benchmark had called b.SetBytes. The first
+// matching payload size applies.
+func deriveThroughput(out []byte, sizes []payloadSize) []byte {
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(out, []byte("\n")) {
+		if !isBenchResult(string(line)) {
+			buf.Write(line)
+			continue
+		}
+		fields := strings.Fields(string(line))
+		name := strings.TrimPrefix(fields[0], "Benchmark")
+		var ns float64
+		var hasSpeed bool
+		for i := 2; i+1 < len(fields); i += 2 {
+			switch fields[i+1] {
+			case "ns/op":
+				ns, _ = strconv.ParseFloat(fields[i], 64)
+			case "MB/s":
+				hasSpeed = true
+			}
+		}
+		var size int64
+		for _, s := range sizes {
+			if s.re.MatchString(name) {
+				size = s.bytes
+				break
+			}
+		}
+		if size == 0 || ns <= 0 || hasSpeed {
+			buf.Write(line)
+			continue
+		}
+		// As computed by the testing package: bytes/op * 1e-6 / (ns/op * 1e-9).
+		mbps := float64(size) * 1e3 / ns
+		buf.WriteString(strings.TrimRight(string(line), "\n"))
+		buf.WriteString("\t" + strconv.FormatFloat(mbps, 'f', 2, 64) + " MB/s\n")
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// toolchainSettings are the build settings recorded in test binaries that
+// describe the toolchain, as opposed to the code or the build flags, which
+// may legitimately differ between suites. GO* settings such as GOAMD64 are
+// also included.
+var toolchainSettings = map[string]bool{
+	"-compiler":    true,
+	"CGO_ENABLED":  true,
+	"CGO_CFLAGS":   true,
+	"CGO_CPPFLAGS": true,
+	"CGO_CXXFLAGS": true,
+	"CGO_LDFLAGS":  true,
+}
+
+// toolchainInfo returns the Go version and toolchain build settings recorded
+// in the binary.
+func toolchainInfo(ctx context.Context, bin string) (map[string]string, error) {
+	out, err := capture(ctx, "go", "version", "-m", bin)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading build info of %s", bin)
+	}
+	lines := strings.Split(out, "\n")
+	// <path>: <go version>
+	info := map[string]string{"go": strings.TrimSpace(lines[0][strings.LastIndex(lines[0], ":")+1:])}
+	for _, line := range lines[1:] {
+		fields := strings.SplitN(strings.TrimSpace(line), "\t", 2)
+		if len(fields) != 2 || fields[0] != "build" {
+			continue
+		}
+		kv := strings.SplitN(fields[1], "=", 2)
+		if len(kv) == 2 && (toolchainSettings[kv[0]] || strings.HasPrefix(kv[0], "GO")) {
+			info[kv[0]] = kv[1]
+		}
+	}
+	return info, nil
+}
+
+// checkToolchains verifies that the test binaries of all suites were built
+// with the same Go toolchain and cgo settings, which may differ if, for
+// instance, the commits' go.mod files select different toolchains. Otherwise,
+// deltas may reflect the toolchain skew rather than the code change. The
+// suites are always built on the same host, so they share a C compiler. If
+// allowSkew is set, a mismatch is only warned about.
+func checkToolchains(ctx context.Context, bss []*benchSuite, allowSkew bool) error {
+	var base map[string]string
+	for i, bs := range bss {
+		tests := bs.testFiles.sorted()
+		if len(tests) == 0 {
+			continue
+		}
+		info, err := toolchainInfo(ctx, bs.getTestBinary(tests[0]))
+		if err != nil {
+			return err
+		}
+		if base == nil {
+			base = info
+			continue
+		}
+		if diff := diffToolchains(base, info); diff != "" {
+			msg := fmt.Sprintf("%s and %s were built with different toolchains: %s",
+				bss[0].id(), bss[i].id(), diff)
+			if !allowSkew {
+				return errors.New(msg + "; pass --allow-toolchain-skew to compare them anyway")
+			}
+			fmt.Fprintf(os.Stderr, "WARNING: %s; deltas may reflect the toolchain, not the code\n", msg)
+		}
+	}
+	return nil
+}
+
+// diffToolchains describes the differences between two toolchains, or
+// returns the empty string if they are the same.
+func diffToolchains(a, b map[string]string) string {
+	keys := make(map[string]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	var diffs []string
+	for k := range keys {
+		if a[k] != b[k] {
+			diffs = append(diffs, fmt.Sprintf("%s %q vs %q", k, a[k], b[k]))
+		}
+	}
+	sort.Strings(diffs)
+	return strings.Join(diffs, ", ")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"golang.org/x/perf/benchstat"
+)
+
+const trendUsage = `usage: benchdiff trend [--window <n>] [--history-dir <dir>]
+
+benchdiff trend compares the most recent run in the history store against each
+of the preceding runs in the window and reports benchmarks that have drifted in
+a consistent direction, even if no single comparison is significant. Runs are
+recorded in the history store by passing --record to benchdiff.
+
+Options:
+  -w, --window      <n>    number of preceding runs to compare against (default 14)
+      --history-dir <dir>  directory or gs:// bucket holding the history (default benchdiff/history)
+      --min-delta   <n>    minimum median delta to report, as a fraction (default 0.01)
+      --consistency <n>    fraction of comparisons that must agree on the direction (default 0.8)`
+
+// trendKey identifies a single metric of a single benchmark.
+type trendKey struct {
+	metric, benchmark string
+}
+
+// trendStat accumulates the deltas of a single benchmark metric across the
+// comparisons against each run in the window.
+type trendStat struct {
+	smallerBetter bool
+	deltas        []float64 // fractional change of mean, per comparison
+	significant   int       // number of comparisons that were significant
+}
+
+func runTrend(ctx context.Context, args []string) error {
+	var window int
+	var historyDir string
+	var minDelta, consistency float64
+	var help bool
+
+	flags := pflag.NewFlagSet("trend", pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, trendUsage) }
+	flags.BoolVarP(&help, "help", "h", false, "")
+	flags.IntVarP(&window, "window", "w", 14, "")
+	flags.StringVarP(&historyDir, "history-dir", "", defaultHistoryDir, "")
+	flags.Float64VarP(&minDelta, "min-delta", "", 0.01, "")
+	flags.Float64VarP(&consistency, "consistency", "", 0.8, "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if help {
+		fmt.Fprintln(os.Stderr, trendUsage)
+		return nil
+	}
+
+	entries, err := loadHistory(ctx, historyDir)
+	if err != nil {
+		return err
+	}
+	entries = latestConfigEntries(entries)
+	if len(entries) < 2 {
+		return errors.Errorf("need at least 2 runs in history store %q, found %d", historyDir, len(entries))
+	}
+	cur := entries[len(entries)-1]
+	prev := entries[:len(entries)-1]
+	if len(prev) > window {
+		prev = prev[len(prev)-window:]
+	}
+	fmt.Printf("comparing %s (%s) against %d preceding run(s)\n\n",
+		cur.ref, cur.time.Format(historyTimeFormat), len(prev))
+
+	stats := make(map[trendKey]*trendStat)
+	for _, e := range prev {
+		tables, err := compareFiles(e.path, cur.path)
+		if err != nil {
+			return err
+		}
+		for _, table := range tables {
+			for _, row := range table.Rows {
+				if len(row.Metrics) != 2 || row.Metrics[0].Mean == 0 {
+					continue
+				}
+				k := trendKey{metric: table.Metric, benchmark: row.Benchmark}
+				s, ok := stats[k]
+				if !ok {
+					s = &trendStat{smallerBetter: isSmallerBetter(table)}
+					stats[k] = s
+				}
+				s.deltas = append(s.deltas, row.Metrics[1].Mean/row.Metrics[0].Mean-1)
+				if row.Delta != "~" {
+					s.significant++
+				}
+			}
+		}
+	}
+
+	type drift struct {
+		trendKey
+		median    float64
+		agreeing  int
+		stat      *trendStat
+		regressed bool
+	}
+	var drifts []drift
+	for k, s := range stats {
+		med := median(s.deltas)
+		if math.Abs(med) < minDelta {
+			continue
+		}
+		var agreeing int
+		for _, d := range s.deltas {
+			if (d < 0) == (med < 0) && d != 0 {
+				agreeing++
+			}
+		}
+		if float64(agreeing) < consistency*float64(len(s.deltas)) {
+			continue
+		}
+		drifts = append(drifts, drift{
+			trendKey:  k,
+			median:    med,
+			agreeing:  agreeing,
+			stat:      s,
+			regressed: (med > 0) == s.smallerBetter,
+		})
+	}
+	if len(drifts) == 0 {
+		fmt.Println("no sustained drift detected")
+		return nil
+	}
+	sort.Slice(drifts, func(i, j int) bool {
+		if drifts[i].metric != drifts[j].metric {
+			return drifts[i].metric < drifts[j].metric
+		}
+		return math.Abs(drifts[i].median) > math.Abs(drifts[j].median)
+	})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "metric\tname\tmedian delta\tagreeing\tsignificant\tdirection")
+	for _, d := range drifts {
+		dir := "improved"
+		if d.regressed {
+			dir = "regressed"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%+.2f%%\t%d/%d\t%d/%d\t%s\n",
+			d.metric, d.benchmark, d.median*100,
+			d.agreeing, len(d.stat.deltas), d.stat.significant, len(d.stat.deltas), dir)
+	}
+	return tw.Flush()
+}
+
+// compareFiles computes the benchmark comparison between the benchmark output
+// in two files.
+func compareFiles(oldPath, newPath string) ([]*benchstat.Table, error) {
+	var c benchstat.Collection
+	c.Alpha = 0.05
+	c.Order = benchstat.ByName
+	for _, f := range []struct{ config, path string }{{"old", oldPath}, {"new", newPath}} {
+		r, err := os.Open(f.path)
+		if err != nil {
+			return nil, err
+		}
+		err = c.AddFile(f.config, r)
+		_ = r.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.Tables(), nil
+}
+
+// isSmallerBetter returns whether smaller values are better for the metric in
+// the provided table, by the default directions.
+func isSmallerBetter(table *benchstat.Table) bool {
+	return !directions(nil).higherIsBetter(table)
+}
+
+func median(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	s := append([]float64(nil), xs...)
+	sort.Float64s(s)
+	if len(s)%2 == 1 {
+		return s[len(s)/2]
+	}
+	return (s[len(s)/2-1] + s[len(s)/2]) / 2
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// Stages of a test binary's lifecycle at which it can fail.
+const (
+	stageBuild = "build"
+	stageRun   = "run"
+	stageOOM   = "oom" // the binary exceeded --mem-limit
+	stageParse = "parse"
+)
+
+var triageStages = []string{stageBuild, stageRun, stageOOM, stageParse}
+
+// failure is a failure of a test binary at some stage, recorded for the triage
+// report.
+type failure struct {
+	Stage     string `json:"stage"`
+	Suite     string `json:"suite"`
+	Test      string `json:"test"`
+	Iteration int    `json:"iteration,omitempty"`
+	Message   string `json:"message"`
+}
+
+// triage collects the failures of a run, so that they can be reported together
+// instead of being interleaved with the progress output of large runs. It is
+// shared by the suites of a run. A nil triage discards failures.
+type triage struct {
+	mu       sync.Mutex
+	failures []failure
+}
+
+// record records a failure of the test binary of the suite. The iteration is
+// 0 if unknown or not applicable.
+func (t *triage) record(stage string, bs *benchSuite, test string, iter int, msg string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures = append(t.failures, failure{
+		Stage: stage, Suite: bs.id(), Test: test, Iteration: iter, Message: msg,
+	})
+}
+
+// list returns the recorded failures.
+func (t *triage) list() []failure {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]failure(nil), t.failures...)
+}
+
+// writeTriage writes a triage section listing, for each test binary with any
+// failure, the status of each stage, followed by the failure messages.
+func writeTriage(w io.Writer, failures []failure) {
+	if len(failures) == 0 {
+		return
+	}
+	byTest := make(map[string]map[string][]failure)
+	for _, f := range failures {
+		if byTest[f.Test] == nil {
+			byTest[f.Test] = make(map[string][]failure)
+		}
+		byTest[f.Test][f.Stage] = append(byTest[f.Test][f.Stage], f)
+	}
+	tests := make([]string, 0, len(byTest))
+	for t := range byTest {
+		tests = append(tests, t)
+	}
+	sort.Strings(tests)
+
+	fmt.Fprintf(w, "\nfailure triage:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "  test\t%s\n", strings.Join(triageStages, "\t"))
+	for _, t := range tests {
+		cells := []string{t}
+		for _, stage := range triageStages {
+			fs := byTest[t][stage]
+			switch {
+			case len(fs) > 0:
+				cells = append(cells, describeFailures(fs))
+			case stage != stageBuild && len(byTest[t][stageBuild]) > 0:
+				cells = append(cells, "-")
+			default:
+				cells = append(cells, "ok")
+			}
+		}
+		fmt.Fprintf(tw, "  %s\n", strings.Join(cells, "\t"))
+	}
+	_ = tw.Flush()
+	fmt.Fprintln(w)
+	for _, f := range failures {
+		where := f.Suite
+		if f.Iteration > 0 {
+			where += " iteration " + strconv.Itoa(f.Iteration)
+		}
+		fmt.Fprintf(w, "  [%s] %s (%s): %s\n", f.Stage, f.Test, where, f.Message)
+	}
+}
+
+// describeFailures summarizes the failures of a test at one stage, listing
+// the failed iterations of each suite.
+func describeFailures(fs []failure) string {
+	var suites []string
+	iters := make(map[string][]string)
+	for _, f := range fs {
+		if _, ok := iters[f.Suite]; !ok {
+			suites = append(suites, f.Suite)
+			iters[f.Suite] = nil
+		}
+		if f.Iteration > 0 {
+			iters[f.Suite] = append(iters[f.Suite], "#"+strconv.Itoa(f.Iteration))
+		}
+	}
+	parts := make([]string, len(suites))
+	for i, s := range suites {
+		parts[i] = s
+		if len(iters[s]) > 0 {
+			parts[i] += " " + strings.Join(iters[s], ",")
+		}
+	}
+	return "failed: " + strings.Join(parts, "; ")
+}
+
+// malformedResults scans the output written to the file since the offset for
+// lines that look like benchmark results but can not be parsed as such, e.g.
+// because log output was interleaved with them. It returns their number and
+// the first of them.
+func malformedResults(f *os.File, from int64) (int, string, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+	var n int
+	var first string
+	s := bufio.NewScanner(io.NewSectionReader(f, from, fi.Size()-from))
+	for s.Scan() {
+		line := s.Text()
+		fields := strings.Fields(line)
+		// Lines with just a benchmark's name precede its output in verbose
+		// mode, and failed or skipped benchmarks are followed by a "--- FAIL"
+		// or "--- SKIP" marker instead of results.
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "Benchmark") || fields[1] == "---" {
+			continue
+		}
+		if !isResultLine(fields) {
+			if n == 0 {
+				first = line
+			}
+			n++
+		}
+	}
+	return n, first, s.Err()
+}
+
+// isResultLine returns whether the fields of a line form a benchmark result:
+// a name, an iteration count, and value-unit pairs.
+func isResultLine(fields []string) bool {
+	if len(fields) < 4 || len(fields)%2 != 0 {
+		return false
+	}
+	if _, err := strconv.Atoi(fields[1]); err != nil {
+		return false
+	}
+	for i := 2; i < len(fields); i += 2 {
+		if _, err := strconv.ParseFloat(fields[i], 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
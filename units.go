@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// unitOpts controls how values are scaled in text output. See --units,
+// --bytes, and --thousands.
+type unitOpts struct {
+	// mode is 'auto' to scale each row to its own unit (e.g. µs or ms), as
+	// benchstat does, 'base' to never scale values (ns, B), or 'table' to
+	// scale all rows of a table to the unit of its smallest value.
+	mode string
+	// iec scales byte values by powers of 1024 (KiB, MiB) rather than 1000.
+	iec bool
+	// thousands inserts thousands separators.
+	thousands bool
+}
+
+func makeUnitOpts(mode, bytes string, thousands bool) (unitOpts, error) {
+	switch mode {
+	case "auto", "base", "table":
+	default:
+		return unitOpts{}, errors.Errorf("invalid --units %q: must be 'auto', 'base', or 'table'", mode)
+	}
+	switch bytes {
+	case "si", "iec":
+	default:
+		return unitOpts{}, errors.Errorf("invalid --bytes %q: must be 'si' or 'iec'", bytes)
+	}
+	return unitOpts{mode: mode, iec: bytes == "iec", thousands: thousands}, nil
+}
+
+// isDefault returns whether the options format values as benchstat does.
+func (o unitOpts) isDefault() bool {
+	return (o.mode == "" || o.mode == "auto") && !o.iec && !o.thousands
+}
+
+// applyUnits replaces the scaler of each row of the tables according to the
+// options. It returns a function that restores the original scalers, for
+// other output formats.
+func applyUnits(tables []*benchstat.Table, o unitOpts) (restore func()) {
+	if o.isDefault() {
+		return func() {}
+	}
+	var orig []benchstat.Scaler
+	for _, t := range tables {
+		for _, row := range t.Rows {
+			orig = append(orig, row.Scaler)
+		}
+	}
+	restore = func() {
+		i := 0
+		for _, t := range tables {
+			for _, row := range t.Rows {
+				row.Scaler = orig[i]
+				i++
+			}
+		}
+	}
+	for _, t := range tables {
+		// In table mode, scale to the unit of the smallest value, so that no
+		// value is rounded to zero.
+		min := math.Inf(1)
+		for _, row := range t.Rows {
+			for _, m := range row.Metrics {
+				if m.Mean > 0 && m.Mean < min {
+					min = m.Mean
+				}
+			}
+		}
+		for _, row := range t.Rows {
+			if len(row.Metrics) == 0 {
+				continue
+			}
+			unit, mean := row.Metrics[0].Unit, row.Metrics[0].Mean
+			scales := unitScales(unit, o.iec)
+			switch {
+			case o.mode == "base":
+				row.Scaler = scales[0].scaler()
+			case o.mode == "table" && !math.IsInf(min, 1):
+				row.Scaler = pickScale(scales, min).scaler()
+			case o.iec && isBytesUnit(unit):
+				row.Scaler = pickScale(scales, mean).scaler()
+			default:
+				row.Scaler = benchstat.NewScaler(mean, unit)
+			}
+			if o.thousands {
+				row.Scaler = withThousands(row.Scaler)
+			}
+		}
+	}
+	return restore
+}
+
+// unitScale is a unit that values are scaled to for output.
+type unitScale struct {
+	factor float64
+	suffix string
+}
+
+// unitScales returns the units, in ascending order, that values of the
+// benchmark unit are scaled to.
+func unitScales(unit string, iec bool) []unitScale {
+	switch {
+	case unit == "ns/op" || strings.HasSuffix(unit, "-ns/op") || unit == "ns/GC":
+		return []unitScale{{1, "ns"}, {1e3, "µs"}, {1e6, "ms"}, {1e9, "s"}}
+	case isBytesUnit(unit) && iec:
+		return []unitScale{{1, "B"}, {1 << 10, "KiB"}, {1 << 20, "MiB"}, {1 << 30, "GiB"}, {1 << 40, "TiB"}}
+	case isBytesUnit(unit):
+		return []unitScale{{1, "B"}, {1e3, "kB"}, {1e6, "MB"}, {1e9, "GB"}, {1e12, "TB"}}
+	case unit == "MB/s" || strings.HasSuffix(unit, "-MB/s"):
+		return []unitScale{{1, "MB/s"}, {1e3, "GB/s"}, {1e6, "TB/s"}}
+	default:
+		return []unitScale{{1, ""}, {1e3, "k"}, {1e6, "M"}, {1e9, "G"}, {1e12, "T"}}
+	}
+}
+
+// pickScale returns the largest of the units that val is at least 1 of.
+func pickScale(scales []unitScale, val float64) unitScale {
+	res := scales[0]
+	for _, s := range scales[1:] {
+		if val/s.factor >= 0.995 {
+			res = s
+		}
+	}
+	return res
+}
+
+func (s unitScale) scaler() benchstat.Scaler {
+	return func(val float64) string {
+		return fmt.Sprintf(precision(val/s.factor)+s.suffix, val/s.factor)
+	}
+}
+
+// precision returns the format verb with which to print val with three
+// significant digits, or as an integer if it's larger.
+func precision(val float64) string {
+	switch {
+	case val >= 99.5:
+		return "%.0f"
+	case val >= 9.95:
+		return "%.1f"
+	default:
+		return "%.2f"
+	}
+}
+
+func isBytesUnit(unit string) bool {
+	for _, u := range []string{"B/op", "bytes/op", "bytes"} {
+		if unit == u || strings.HasSuffix(unit, "-"+u) {
+			return true
+		}
+	}
+	return false
+}
+
+// withThousands wraps the scaler to insert thousands separators into the
+// integer part of the values it formats.
+func withThousands(s benchstat.Scaler) benchstat.Scaler {
+	return func(val float64) string {
+		str := s(val)
+		end := strings.IndexFunc(str, func(r rune) bool { return (r < '0' || r > '9') && r != '-' })
+		if end < 0 {
+			end = len(str)
+		}
+		intPart := str[:end]
+		start := 0
+		if strings.HasPrefix(intPart, "-") {
+			start = 1
+		}
+		var b strings.Builder
+		b.WriteString(intPart[:start])
+		digits := intPart[start:]
+		for i, r := range digits {
+			if i > 0 && (len(digits)-i)%3 == 0 {
+				b.WriteByte(',')
+			}
+			b.WriteRune(r)
+		}
+		return b.String() + str[end:]
+	}
+}
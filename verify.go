@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// verifyIters is the number of additional iterations that regressions are
+// rerun for when re-verifying them.
+const verifyIters = 5
+
+// regression is a single regressed metric of a benchmark.
+type regression struct {
+	table *benchstat.Table
+	row   *benchstat.Row
+	pkg   string
+}
+
+// findRegressions returns the regressions in the tables whose delta exceeds
+// the threshold, expressed as a fraction.
+func findRegressions(tables []*benchstat.Table, thresh float64, pkgs map[string]string) []regression {
+	var res []regression
+	for _, t := range tables {
+		for _, row := range t.Rows {
+			if row.Change == -1 && math.Abs(row.PctDelta) > thresh*100 {
+				res = append(res, regression{table: t, row: row, pkg: pkgs[row.Benchmark]})
+			}
+		}
+	}
+	return res
+}
+
+// verifyRegressions reruns the benchmarks of the provided regressions on both
+// suites for verifyIters additional, interleaved iterations, writing the
+// output to fresh files in each suite's artifacts directory. It returns the
+// regressions that reproduce above the threshold, along with the paths of the
+// verification output files.
+func verifyRegressions(
+	ctx context.Context,
+	oldSuite, newSuite *benchSuite, regs []regression, thresh float64, cfg *runConfig,
+) ([]regression, []string, error) {
+	if len(regs) == 0 {
+		return nil, nil, nil
+	}
+	if oldSuite.binDir == "" || newSuite.binDir == "" {
+		return nil, nil, errors.New("re-verifying regressions requires the test binaries; " +
+			"rerun without --previous-run (and with --force-rerun if results were cached)")
+	}
+	fmt.Fprintf(os.Stderr, "re-verifying %d regression(s)\n", len(regs))
+	results, err := newSuite.results(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	procs, err := recordedProcs(results)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Run the verification against copies of the suites writing to new files.
+	var vOld, vNew benchSuite
+	var paths []string
+	for _, c := range []struct {
+		src, dst *benchSuite
+	}{{oldSuite, &vOld}, {newSuite, &vNew}} {
+		*c.dst = *c.src
+		f, err := ioutil.TempFile(c.src.artDir, "verify.")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		c.dst.outFile = f
+		// The verification runs at a single benchtime.
+		c.dst.ramped = nil
+		paths = append(paths, f.Name())
+		if crossMachine(oldSuite, newSuite) {
+			if err := runCalibration(ctx, c.dst); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, r := range regs {
+		if seen[r.row.Benchmark] || r.pkg == "" {
+			continue
+		}
+		seen[r.row.Benchmark] = true
+		opts := benchOpts{
+			runPattern: benchRegexp(r.row.Benchmark, procs),
+			benchTime:  cfg.benchTime,
+			short:      cfg.short,
+			sizeClass:  cfg.sizeClass,
+		}
+		for i := 0; i < verifyIters; i++ {
+			for _, bs := range []*benchSuite{&vOld, &vNew} {
+				if err := bs.writeConfig(i+1, cfg.benchTime); err != nil {
+					return nil, nil, err
+				}
+				if err := runSingleBench(ctx, bs, pkgToTestBin(r.pkg), opts); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	tables, err := computeTables(&vOld, &vNew, true, cfg.compare)
+	if err != nil {
+		return nil, nil, err
+	}
+	reproduced := make(map[[2]string]bool)
+	for _, t := range tables {
+		for _, row := range t.Rows {
+			if row.Change == -1 && math.Abs(row.PctDelta) > thresh*100 {
+				reproduced[[2]string{t.Metric, row.Benchmark}] = true
+			}
+		}
+	}
+	var confirmed []regression
+	for _, r := range regs {
+		if reproduced[[2]string{r.table.Metric, r.row.Benchmark}] {
+			confirmed = append(confirmed, r)
+		}
+	}
+	return confirmed, paths, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultWarmupDeviation is the deviation, in percent, from the process's
+// other samples beyond which the 'auto' policy drops a first sample.
+const defaultWarmupDeviation = 50
+
+// warmupRule is the policy of dropping the first samples of the benchmarks
+// matching a pattern: always, or if they deviate by more than a percentage.
+type warmupRule struct {
+	re        *regexp.Regexp // nil matches all benchmarks
+	always    bool
+	deviation float64 // in percent
+}
+
+// warmupPolicy decides which first samples of each benchmark in each process
+// are discarded as warm-up samples, taken with cold caches. A process only
+// produces several samples of a benchmark with -test.count, i.e. with
+// --strategy=interleave-count, so only such processes are affected.
+type warmupPolicy struct {
+	spec  string
+	rules []warmupRule
+}
+
+// parseWarmupPolicy parses the --drop-warmup policy: comma-separated rules of
+// the form [<pattern>=]<policy>, where the policy is 'never', 'always',
+// 'auto', or a deviation such as '30%'. A rule without a pattern applies to
+// all benchmarks, and the last matching rule wins. It returns nil if no
+// samples are ever dropped.
+func parseWarmupPolicy(spec string) (*warmupPolicy, error) {
+	if spec == "" || spec == "never" {
+		return nil, nil
+	}
+	wp := &warmupPolicy{spec: spec}
+	for _, s := range strings.Split(spec, ",") {
+		var r warmupRule
+		policy := s
+		if i := strings.LastIndex(s, "="); i >= 0 {
+			re, err := regexp.Compile(s[:i])
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid --drop-warmup pattern")
+			}
+			r.re, policy = re, s[i+1:]
+		}
+		switch {
+		case policy == "never":
+			r.deviation = math.Inf(1)
+		case policy == "always":
+			r.always = true
+		case policy == "auto":
+			r.deviation = defaultWarmupDeviation
+		case strings.HasSuffix(policy, "%"):
+			pct, err := strconv.ParseFloat(strings.TrimSuffix(policy, "%"), 64)
+			if err != nil || pct < 0 {
+				return nil, errors.Errorf("invalid --drop-warmup deviation %q", policy)
+			}
+			r.deviation = pct
+		default:
+			return nil, errors.Errorf("unknown --drop-warmup policy %q; expected 'never', 'always', 'auto', or a deviation like 30%%", policy)
+		}
+		wp.rules = append(wp.rules, r)
+	}
+	return wp, nil
+}
+
+// rule returns the rule applying to the benchmark, if any.
+func (wp *warmupPolicy) rule(name string) (warmupRule, bool) {
+	name = procsSuffix.ReplaceAllString(strings.TrimPrefix(name, "Benchmark"), "")
+	for i := len(wp.rules) - 1; i >= 0; i-- {
+		if r := wp.rules[i]; r.re == nil || r.re.MatchString(name) {
+			return r, true
+		}
+	}
+	return warmupRule{}, false
+}
+
+// drop returns the benchmark output without the warm-up samples, along with
+// the number of samples dropped. Each process's output starts with its goos
+// line. The original output is kept in the out files.
+func (wp *warmupPolicy) drop(out []byte) ([]byte, int) {
+	lines := bytes.SplitAfter(out, []byte("\n"))
+	dropped := make(map[int]bool)
+	// samples holds the indexes of the result lines of each benchmark in the
+	// current process.
+	samples := make(map[string][]int)
+	flush := func() {
+		for name, idxs := range samples {
+			if len(idxs) > 1 && wp.isWarmup(name, lines, idxs) {
+				dropped[idxs[0]] = true
+			}
+		}
+		samples = make(map[string][]int)
+	}
+	for i, line := range lines {
+		s := string(line)
+		if strings.HasPrefix(s, "goos: ") {
+			flush()
+		} else if isBenchResult(s) {
+			name := strings.Fields(s)[0]
+			samples[name] = append(samples[name], i)
+		}
+	}
+	flush()
+	if len(dropped) == 0 {
+		return out, 0
+	}
+	var buf bytes.Buffer
+	for i, line := range lines {
+		if !dropped[i] {
+			buf.Write(line)
+		}
+	}
+	return buf.Bytes(), len(dropped)
+}
+
+// isWarmup returns whether the first of the samples of the benchmark, at the
+// indexes of the lines, is a warm-up sample.
+func (wp *warmupPolicy) isWarmup(name string, lines [][]byte, idxs []int) bool {
+	r, ok := wp.rule(name)
+	if !ok {
+		return false
+	}
+	if r.always {
+		return true
+	}
+	first, ok := sampleValue(lines[idxs[0]])
+	if !ok {
+		return false
+	}
+	var rest []float64
+	for _, i := range idxs[1:] {
+		if v, ok := sampleValue(lines[i]); ok {
+			rest = append(rest, v)
+		}
+	}
+	med := median(rest)
+	return med > 0 && math.Abs(first/med-1)*100 > r.deviation
+}
+
+// sampleValue returns the first value, usually ns/op, of a result line.
+func sampleValue(line []byte) (float64, bool) {
+	fields := strings.Fields(string(line))
+	if len(fields) < 3 {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(fields[2], 64)
+	return v, err == nil
+}
+
+// warmupNote describes the warm-up samples dropped from the suites in the
+// report.
+func warmupNote(oldSuite, newSuite *benchSuite) string {
+	return fmt.Sprintf("dropped %d+%d warm-up sample(s) (old+new) per --drop-warmup=%s",
+		oldSuite.warmupDropped, newSuite.warmupDropped, newSuite.warmup.spec)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// buildWorktreeDir returns the path of the git worktree that refs are built
+// in, so that building a ref never touches the user's checkout and
+// uncommitted changes don't block runs. The worktree lives in the
+// repository's git directory, out of sight of the go tool and editors, and is
+// reused across builds and runs, as the build cache is keyed by the paths of
+// the sources.
+func buildWorktreeDir(ctx context.Context) (string, error) {
+	dir, err := capture(ctx, "git", "rev-parse", "--git-common-dir")
+	if err != nil {
+		return "", errors.Wrap(err, "locating git directory")
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "benchdiff-worktree"), nil
+}
+
+// lockWorktree takes the lock of the build worktree, waiting for other
+// benchdiff processes that build in it, and returns the function that releases
+// it.
+func lockWorktree(ctx context.Context, dir string) (unlock func(), err error) {
+	f, err := os.OpenFile(dir+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for waiting := false; ; waiting = true {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			_ = f.Close()
+			return nil, errors.Wrapf(err, "locking worktree %s", dir)
+		}
+		if !waiting {
+			fmt.Fprintf(os.Stderr, "waiting for another benchdiff process to finish building in %s\n", dir)
+		}
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	// Closing the file releases the lock.
+	return func() { _ = f.Close() }, nil
+}
+
+// enterWorktree checks out the ref in the build worktree, creating it if
+// needed, and changes the working directory to the worktree's counterpart of
+// the current one. If a post-checkout command is provided, it is run in the
+// worktree after checking out the ref, with the secrets in its environment.
+// The worktree is locked until the returned function, which changes the
+// working directory back, is called, so that concurrent runs in the same
+// repository don't check out refs from under each other's builds.
+func enterWorktree(
+	ctx context.Context, ref string, postCheckout string, secrets *hookSecrets,
+) (leave func(), err error) {
+	dir, err := buildWorktreeDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := lockWorktree(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			unlock()
+		}
+	}()
+	prefix, err := capture(ctx, "git", "rev-parse", "--show-prefix")
+	if err != nil {
+		return nil, errors.Wrap(err, "locating working directory in repository")
+	}
+	if pathExists(filepath.Join(dir, ".git")) {
+		_, err = capture(ctx, "git", "-C", dir, "checkout", "-q", "--force", "--detach", ref)
+	} else {
+		// Forget the worktree if it was deleted, which would otherwise block
+		// adding it again.
+		if _, err := capture(ctx, "git", "worktree", "prune"); err != nil {
+			return nil, errors.Wrap(err, "pruning worktrees")
+		}
+		_, err = capture(ctx, "git", "worktree", "add", "-q", "--force", "--detach", dir, ref)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "checking out %s in worktree %s", ref, dir)
+	}
+	prev, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chdir(filepath.Join(dir, prefix)); err != nil {
+		return nil, err
+	}
+	leave = func() {
+		_ = os.Chdir(prev)
+		unlock()
+	}
+	if err := runPostCheckout(ctx, postCheckout, secrets); err != nil {
+		_ = os.Chdir(prev)
+		return nil, err
+	}
+	return leave, nil
+}
+
+// worktreeRef is the --new value that selects the uncommitted changes in the
+// working tree.
+const worktreeRef = "worktree"
+
+// snapshotWorktree records the working tree, including its uncommitted
+// changes and untracked files that aren't ignored, in a commit on top of HEAD
+// and returns its SHA, or HEAD's if the working tree is clean. The commit
+// isn't on any branch and the user's index is left untouched. As its dates
+// and author are fixed, the same changes always result in the same commit,
+// so that binaries and results are reused like those of any commit.
+func snapshotWorktree(ctx context.Context) (string, error) {
+	top, err := capture(ctx, "git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", errors.Wrap(err, "locating working tree")
+	}
+	head, err := getCurRef(ctx)
+	if err != nil {
+		return "", err
+	}
+	// Stage the changes in a copy of the index, which saves hashing the
+	// files that didn't change.
+	index, err := ioutil.TempFile("", "benchdiff-index")
+	if err != nil {
+		return "", err
+	}
+	_ = index.Close()
+	defer os.Remove(index.Name())
+	indexPath, err := capture(ctx, "git", "rev-parse", "--git-path", "index")
+	if err != nil {
+		return "", err
+	}
+	if data, err := ioutil.ReadFile(indexPath); err == nil {
+		if err := ioutil.WriteFile(index.Name(), data, 0644); err != nil {
+			return "", err
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	env := []string{"GIT_INDEX_FILE=" + index.Name()}
+	if _, err := captureWithEnv(ctx, env, "git", "-C", top, "add", "-A"); err != nil {
+		return "", errors.Wrap(err, "staging working tree")
+	}
+	tree, err := captureWithEnv(ctx, env, "git", "write-tree")
+	if err != nil {
+		return "", errors.Wrap(err, "writing working tree")
+	}
+	if headTree, err := capture(ctx, "git", "rev-parse", "HEAD^{tree}"); err != nil {
+		return "", err
+	} else if tree == headTree {
+		fmt.Fprintf(os.Stderr, "working tree is clean; using HEAD (%s)\n", shortenRef(ctx, head))
+		return head, nil
+	}
+	date, err := capture(ctx, "git", "log", "-1", "--format=%cI", head)
+	if err != nil {
+		return "", err
+	}
+	env = append(env,
+		"GIT_AUTHOR_NAME=benchdiff", "GIT_AUTHOR_EMAIL=benchdiff", "GIT_AUTHOR_DATE="+date,
+		"GIT_COMMITTER_NAME=benchdiff", "GIT_COMMITTER_EMAIL=benchdiff", "GIT_COMMITTER_DATE="+date)
+	msg := "uncommitted changes on " + shortenRef(ctx, head)
+	commit, err := captureWithEnv(ctx, env, "git", "commit-tree", tree, "-p", head, "-m", msg)
+	if err != nil {
+		return "", errors.Wrap(err, "committing working tree")
+	}
+	return commit, nil
+}